@@ -3,9 +3,15 @@ package agent
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/modfin/bellman/metrics"
 	"github.com/modfin/bellman/models"
 	"github.com/modfin/bellman/models/gen"
 	"github.com/modfin/bellman/prompt"
@@ -13,18 +19,100 @@ import (
 	"github.com/modfin/bellman/tools"
 )
 
+// ErrToolNotFound is matched, using errors.Is, by a ToolNotFoundError
+var ErrToolNotFound = errors.New("tool not found in local setup")
+
+// ToolNotFoundError is returned when the model calls a tool that is not configured on the generator
+type ToolNotFoundError struct {
+	Name string
+}
+
+func (e *ToolNotFoundError) Error() string {
+	return fmt.Sprintf("tool %s not found in local setup", e.Name)
+}
+
+func (e *ToolNotFoundError) Is(target error) bool {
+	return target == ErrToolNotFound
+}
+
+// lookupTool resolves a tool by name from the generator, for calls without a Ref, e.g. when the provider did not
+// attach one
+func lookupTool(g *gen.Generator, name string) (*tools.Tool, error) {
+	toolList := g.Tools()
+	for i := range toolList {
+		if toolList[i].Name == name {
+			return &toolList[i], nil
+		}
+	}
+	return nil, &ToolNotFoundError{Name: name}
+}
+
 // Run will prompt until the llm responds with no tool calls, or until maxDepth is reached. Unless Output is already
-// set, it will be set by using schema.From on the expected result struct. Does not work with gemini as of 2025-02-17.
+// set, it will be set by using schema.From on the expected result struct. For models not supporting tools and
+// structured output together, e.g. gemini, see gen.Model.SupportsToolsWithOutput, it runs as RunWithToolsOnly.
 func Run[T any](maxDepth int, parallelism int, g *gen.Generator, prompts ...prompt.Prompt) (*Result[T], error) {
+	return RunWith[T](g, Options{MaxDepth: maxDepth, Parallelism: parallelism}, prompts...)
+}
+
+// RunWith runs the agent as configured by the options, i.e. as Run, or as RunWithToolsOnly if ToolsOnly is set or the
+// model does not support tools and structured output together. The options are used as is, see NewOptions for the
+// defaults
+func RunWith[T any](g *gen.Generator, opts Options, prompts ...prompt.Prompt) (*Result[T], error) {
+	var result T
+	_, resultIsString := any(result).(string)
+
+	start := time.Now()
+	var res *Result[T]
+	var err error
+	if opts.ToolsOnly || !resultIsString && !g.Request.Model.SupportsToolsWithOutput() {
+		res, err = runWithToolsOnly[T](g, opts, prompts...)
+	} else {
+		res, err = run[T](g, opts, prompts...)
+	}
+
+	m := metrics.OrNop(opts.Metrics)
+	m.ObserveLatency(metrics.OpAgent, g.Request.Model.FQN(), time.Since(start))
+	if err != nil {
+		m.IncError(metrics.OpAgent, g.Request.Model.FQN(), err)
+	}
+	if err == nil && opts.Pricing != nil {
+		res.Metadata.EstimateCost(opts.Pricing)
+	}
+	return res, err
+}
+
+func run[T any](g *gen.Generator, opts Options, prompts ...prompt.Prompt) (*Result[T], error) {
 	var result T
 	_, resultIsString := any(result).(string)
 	if g.Request.OutputSchema == nil && !resultIsString {
 		g = g.Output(schema.From(result))
 	}
+	toolCtx := g.ToolContext() // once per run, the seeded random source and the code session span all depths
+	toolCtx = tools.ContextWithResultTransform(toolCtx, opts.ToolResultTransform)
+	session := tools.CodeSessionFromContext(toolCtx)
 
 	promptMetadata := models.Metadata{Model: g.Request.Model.Name}
-	for i := 0; i < maxDepth; i++ {
-		resp, err := g.Prompt(prompts...)
+	toolStats := map[string]ToolStats{}
+	calls := callLog{session: session}
+	var thinking [][]string
+	var compactions []Compaction
+	var truncated []TruncatedResponse
+	for i := 0; i < opts.MaxDepth; i++ {
+		var compaction *Compaction
+		var err error
+		g, err = opts.activeTools(g, i, prompts)
+		if err != nil {
+			return nil, fmt.Errorf("%w, at depth %d", err, i)
+		}
+		prompts, compaction, err = opts.compact(g, prompts, i)
+		if err != nil {
+			return nil, fmt.Errorf("%w, at depth %d", err, i)
+		}
+		if compaction != nil {
+			compactions = append(compactions, *compaction)
+		}
+
+		resp, err := promptRetryEmpty(g, opts.RetryEmpty, prompts...)
 		if err != nil {
 			return nil, fmt.Errorf("failed to prompt: %w, at depth %d", err, i)
 		}
@@ -32,6 +120,9 @@ func Run[T any](maxDepth int, parallelism int, g *gen.Generator, prompts ...prom
 		promptMetadata.ThinkingTokens += resp.Metadata.ThinkingTokens
 		promptMetadata.OutputTokens += resp.Metadata.OutputTokens
 		promptMetadata.TotalTokens += resp.Metadata.TotalTokens
+		promptMetadata.ThrottleWaitMs += resp.Metadata.ThrottleWaitMs
+		promptMetadata.FinishReason = resp.Metadata.FinishReason
+		thinking = append(thinking, resp.Thinking)
 
 		if !resp.IsTools() {
 			// Check if T is string type and handle directly
@@ -43,40 +134,65 @@ func Run[T any](maxDepth int, parallelism int, g *gen.Generator, prompts ...prom
 				// Convert string to T (which we know is string) using unsafe casting
 				result = any(text).(T)
 			} else {
-				err = resp.Unmarshal(&result)
+				if opts.LenientJSON {
+					err = resp.UnmarshalLenient(&result)
+				} else {
+					err = resp.Unmarshal(&result)
+				}
 				if err != nil {
 					return nil, fmt.Errorf("could not unmarshal text response: %w, at depth %d", err, i)
 				}
 			}
 			return &Result[T]{
-				Prompts:  prompts,
-				Result:   result,
-				Metadata: promptMetadata,
-				Depth:    i,
+				Prompts:     prompts,
+				Result:      result,
+				Metadata:    promptMetadata,
+				Depth:       i,
+				PTCCalls:    session.Executions(),
+				PTCDedup:    session.Deduplications(),
+				ToolStats:   toolStats,
+				Calls:       calls.calls,
+				Thinking:    thinking,
+				Compactions: compactions,
+				Truncated:   truncated,
+				TraceID:     g.Request.TraceID,
 			}, nil
 		}
 
+		if err := opts.checkTokenBudget(promptMetadata); err != nil {
+			return nil, fmt.Errorf("%w, at depth %d", err, i)
+		}
+
 		callbacks, err := resp.AsTools()
 		if err != nil {
 			return nil, fmt.Errorf("failed to get tools: %w, at depth %d", err, i)
 		}
 
 		// Pre-validate all callbacks before execution
-		for _, callback := range callbacks {
+		for j, callback := range callbacks {
 			if callback.Ref == nil {
-				return nil, fmt.Errorf("tool %s not found in local setup", callback.Name)
+				ref, err := lookupTool(g, callback.Name)
+				if err != nil {
+					return nil, fmt.Errorf("%w, at depth %d", err, i)
+				}
+				callbacks[j].Ref = ref
+				callback.Ref = ref
 			}
 			if callback.Ref.Function == nil {
 				return nil, fmt.Errorf("tool %s has no callback function attached", callback.Name)
 			}
 		}
 
-		var callbackResults []callbackResult
-		if parallelism <= 1 {
-			callbackResults = executeCallbacksSequential(g.Request.Context, callbacks)
-		} else {
-			callbackResults = executeCallbacksParallel(g.Request.Context, callbacks, parallelism)
-		}
+		callbackResults := opts.executeCallbacks(toolCtx, callbacks)
+		addToolStats(toolStats, callbackResults)
+		opts.observeToolCalls(callbackResults)
+
+		// tool responses must follow the order of the tool calls, regardless of execution and completion order
+		sort.SliceStable(callbackResults, func(a, b int) bool {
+			return callbackResults[a].Index < callbackResults[b].Index
+		})
+		truncated = append(truncated, limitResponses(g, opts, i, callbacks, callbackResults)...)
+		calls.add(opts, toolStats, i, callbacks, callbackResults)
 
 		// Process results and check for errors
 		for _, cbResult := range callbackResults {
@@ -91,14 +207,52 @@ func Run[T any](maxDepth int, parallelism int, g *gen.Generator, prompts ...prom
 		}
 
 	}
-	return nil, fmt.Errorf("max depth %d reached", maxDepth)
+	return nil, fmt.Errorf("max depth %d reached", opts.MaxDepth)
+}
+
+// promptRetryEmpty re-prompts once, if retry is set, if the model responded with an empty candidate, see WithRetryEmpty
+func promptRetryEmpty(g *gen.Generator, retry bool, prompts ...prompt.Prompt) (*gen.Response, error) {
+	resp, err := g.Prompt(prompts...)
+	if retry && errors.Is(err, gen.ErrEmptyCandidate) {
+		resp, err = g.Prompt(prompts...)
+	}
+	return resp, err
 }
 
 const customResultCalculatedTool = "__return_result_tool__"
 
 // RunWithToolsOnly will prompt until the llm responds with a certain tool call. Prefer to use the Run function above,
-// but gemini does not support the above function (requiring tools and structured output), so use this one instead for those models.
+// which uses this strategy for models not supporting tools and structured output together, e.g. gemini.
 func RunWithToolsOnly[T any](maxDepth int, parallelism int, g *gen.Generator, prompts ...prompt.Prompt) (*Result[T], error) {
+	return RunWith[T](g, Options{MaxDepth: maxDepth, Parallelism: parallelism, ToolsOnly: true}, prompts...)
+}
+
+// parseTextResult parses a text response as the result, which must be JSON of the result without unknown fields, or
+// any text if the result is a string. A surrounding markdown code fence is ignored, and if lenient the JSON is
+// extracted from any surrounding text, see gen.ExtractJSON
+func parseTextResult[T any](text string, lenient bool) (T, bool) {
+	var result T
+	if s, ok := any(&result).(*string); ok {
+		*s = text
+		return result, true
+	}
+
+	text = strings.TrimSpace(text)
+	if lenient || strings.HasPrefix(text, "```") && strings.HasSuffix(text, "```") {
+		text = gen.ExtractJSON(text)
+	}
+	dec := json.NewDecoder(strings.NewReader(text))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&result); err != nil {
+		return result, false
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return result, false
+	}
+	return result, true
+}
+
+func runWithToolsOnly[T any](g *gen.Generator, opts Options, prompts ...prompt.Prompt) (*Result[T], error) {
 	if g.Request.OutputSchema != nil {
 		g = g.Output(nil)
 	}
@@ -113,16 +267,61 @@ func RunWithToolsOnly[T any](maxDepth int, parallelism int, g *gen.Generator, pr
 	g = g.SetTools(newTools...)
 
 	var result T
-	g = g.AddTools(tools.Tool{
+	returnTool := tools.Tool{
 		Name:           customResultCalculatedTool,
 		Description:    "Return the final results to the user",
 		ArgumentSchema: schema.From(result),
-	})
-	g = g.SetToolConfig(tools.RequiredTool)
+	}
+	g = g.AddTools(returnTool)
+	if opts.Hybrid {
+		g = g.SetToolConfig(tools.AutoTool)
+	} else {
+		g = g.SetToolConfig(tools.RequiredTool)
+	}
+	toolCtx := g.ToolContext() // once per run, the seeded random source and the code session span all depths
+	toolCtx = tools.ContextWithResultTransform(toolCtx, opts.ToolResultTransform)
+	session := tools.CodeSessionFromContext(toolCtx)
 
 	promptMetadata := models.Metadata{Model: g.Request.Model.Name}
-	for i := 0; i < maxDepth; i++ {
-		resp, err := g.Prompt(prompts...)
+	toolStats := map[string]ToolStats{}
+	calls := callLog{session: session}
+	var thinking [][]string
+	var compactions []Compaction
+	var truncated []TruncatedResponse
+	var fallback string
+	done := func(result T, depth int) *Result[T] {
+		return &Result[T]{
+			Fallback:    fallback,
+			Prompts:     prompts,
+			Result:      result,
+			Metadata:    promptMetadata,
+			Depth:       depth,
+			PTCCalls:    session.Executions(),
+			PTCDedup:    session.Deduplications(),
+			ToolStats:   toolStats,
+			Calls:       calls.calls,
+			Thinking:    thinking,
+			Compactions: compactions,
+			Truncated:   truncated,
+			TraceID:     g.Request.TraceID,
+		}
+	}
+	for i := 0; i < opts.MaxDepth; i++ {
+		var compaction *Compaction
+		var err error
+		g, err = opts.activeTools(g, i, prompts, returnTool)
+		if err != nil {
+			return nil, fmt.Errorf("%w, at depth %d", err, i)
+		}
+		prompts, compaction, err = opts.compact(g, prompts, i)
+		if err != nil {
+			return nil, fmt.Errorf("%w, at depth %d", err, i)
+		}
+		if compaction != nil {
+			compactions = append(compactions, *compaction)
+		}
+
+		resp, err := promptRetryEmpty(g, opts.RetryEmpty, prompts...)
 		if err != nil {
 			return nil, fmt.Errorf("failed to prompt: %w, at depth %d", err, i)
 		}
@@ -130,6 +329,33 @@ func RunWithToolsOnly[T any](maxDepth int, parallelism int, g *gen.Generator, pr
 		promptMetadata.ThinkingTokens += resp.Metadata.ThinkingTokens
 		promptMetadata.OutputTokens += resp.Metadata.OutputTokens
 		promptMetadata.TotalTokens += resp.Metadata.TotalTokens
+		promptMetadata.ThrottleWaitMs += resp.Metadata.ThrottleWaitMs
+		promptMetadata.FinishReason = resp.Metadata.FinishReason
+		thinking = append(thinking, resp.Thinking)
+
+		// models, e.g. gemini, may answer in text on the last turn even if a tool call is required
+		if resp.IsText() {
+			text, _ := resp.AsText()
+			result, ok := parseTextResult[T](text, opts.LenientJSON)
+			if ok {
+				// a text result is the expected finish of a hybrid run, not a fallback
+				if !opts.Hybrid {
+					fallback = FallbackText
+				}
+				return done(result, i), nil
+			}
+			if fallback == FallbackNudged {
+				return nil, fmt.Errorf("%w, at depth %d", ErrNoResult, i)
+			}
+			// not the result, so require the return tool from here on
+			fallback = FallbackNudged
+			prompts = append(prompts,
+				prompt.AsAssistant(text),
+				prompt.AsUser(fmt.Sprintf("Return the final result by calling the %s tool.", customResultCalculatedTool)),
+			)
+			g = g.SetToolConfig(tools.RequiredTool)
+			continue
+		}
 
 		callbacks, err := resp.AsTools()
 		if err != nil {
@@ -137,35 +363,42 @@ func RunWithToolsOnly[T any](maxDepth int, parallelism int, g *gen.Generator, pr
 		}
 
 		// Pre-validate all callbacks before execution
-		for _, callback := range callbacks {
+		for j, callback := range callbacks {
 			if callback.Name == customResultCalculatedTool {
 				var finalResult T
 				err = json.Unmarshal(callback.Argument, &finalResult)
 				if err != nil {
 					return nil, fmt.Errorf("could not unmarshal final result: %w, at depth %d", err, i)
 				}
-				return &Result[T]{
-					Prompts:  prompts,
-					Result:   finalResult,
-					Metadata: promptMetadata,
-					Depth:    i,
-				}, nil
+				return done(finalResult, i), nil
 			}
 			if callback.Ref == nil {
-				return nil, fmt.Errorf("tool %s not found in local setup", callback.Name)
+				ref, err := lookupTool(g, callback.Name)
+				if err != nil {
+					return nil, fmt.Errorf("%w, at depth %d", err, i)
+				}
+				callbacks[j].Ref = ref
+				callback.Ref = ref
 			}
 			if callback.Ref.Function == nil {
 				return nil, fmt.Errorf("tool %s has no callback function attached", callback.Name)
 			}
 		}
-
-		var callbackResults []callbackResult
-		if parallelism <= 1 {
-			callbackResults = executeCallbacksSequential(g.Request.Context, callbacks)
-		} else {
-			callbackResults = executeCallbacksParallel(g.Request.Context, callbacks, parallelism)
+		if err := opts.checkTokenBudget(promptMetadata); err != nil {
+			return nil, fmt.Errorf("%w, at depth %d", err, i)
 		}
 
+		callbackResults := opts.executeCallbacks(toolCtx, callbacks)
+		addToolStats(toolStats, callbackResults)
+		opts.observeToolCalls(callbackResults)
+
+		// tool responses must follow the order of the tool calls, regardless of execution and completion order
+		sort.SliceStable(callbackResults, func(a, b int) bool {
+			return callbackResults[a].Index < callbackResults[b].Index
+		})
+		truncated = append(truncated, limitResponses(g, opts, i, callbacks, callbackResults)...)
+		calls.add(opts, toolStats, i, callbacks, callbackResults)
+
 		// Process results and check for errors
 		for _, cbResult := range callbackResults {
 			callback := callbacks[cbResult.Index]
@@ -178,7 +411,7 @@ func RunWithToolsOnly[T any](maxDepth int, parallelism int, g *gen.Generator, pr
 			prompts = append(prompts, prompt.AsToolResponse(cbResult.ID, cbResult.Name, cbResult.Response))
 		}
 	}
-	return nil, fmt.Errorf("max depth %d reached", maxDepth)
+	return nil, fmt.Errorf("max depth %d reached", opts.MaxDepth)
 }
 
 type Result[T any] struct {
@@ -186,6 +419,136 @@ type Result[T any] struct {
 	Result   T
 	Metadata models.Metadata
 	Depth    int
+	PTCCalls int // executed code_execution calls during the run
+	PTCDedup int // tool calls inside code_execution answered from the dedup cache
+
+	ToolStats map[string]ToolStats // execution stats per tool name, tools called from code included
+	Calls     []ToolInvocation     // executed tool calls in order, tools called from code included
+	Thinking  [][]string           // thinking parts of each prompt, indexed by depth, if returned by the provider
+
+	Compactions []Compaction        // compactions of the conversation, if a HistoryCompactor is set and the history was altered
+	Truncated   []TruncatedResponse // full tool responses that were truncated in the conversation by the response limit
+
+	TraceID string // trace id of the generator, see gen.Generator.WithTraceID
+
+	Fallback string // why a tools only run did not finish cleanly by the return tool, e.g. FallbackText, empty otherwise and for the text result of a hybrid run
+}
+
+// Fallbacks of a tools only run, see Result.Fallback
+const (
+	FallbackText   = "text"   // the final response was text, parsed as the result, instead of a call to the return tool
+	FallbackNudged = "nudged" // a text response was not the result, and the model was asked to call the return tool
+)
+
+// TruncatedResponse holds the full response of a tool call, whose response was truncated in the conversation
+type TruncatedResponse struct {
+	Depth    int    `json:"depth"`
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Response string `json:"response"`
+}
+
+// ToolStats holds aggregated execution stats of a tool during an agent run
+type ToolStats struct {
+	Calls  int           `json:"calls"`
+	Errors int           `json:"errors"` // failed tool calls from code, a failed tool call of the model ends the run with an error
+	Cached int           `json:"cached"` // calls answered from the deduplication cache, not part of the latencies
+	Total  time.Duration `json:"total"`
+	Mean   time.Duration `json:"mean"`
+	Max    time.Duration `json:"max"`
+}
+
+// ToolInvocation records an executed tool call of an agent run, see Result.Calls
+type ToolInvocation struct {
+	tools.Invocation
+	Depth int    `json:"depth"`
+	ID    string `json:"id,omitempty"`  // id of the tool call, empty for tools called from code
+	PTC   bool   `json:"ptc,omitempty"` // called from code_execution
+}
+
+// callLog records the tool calls of a run, see Result.Calls
+type callLog struct {
+	calls   []ToolInvocation
+	session *tools.CodeSession // of the run, nil if PTC is not activated
+	ptcSeen int                // tool calls from code already recorded
+}
+
+// add records the executed callbacks of a step, in call order, followed by the tool calls made from code during the
+// step. Tool calls from code are also added to the stats and observed, as they are not callbacks of the agent
+func (l *callLog) add(opts Options, stats map[string]ToolStats, depth int, callbacks []tools.Call, results []callbackResult) {
+	for _, r := range results {
+		invocation := ToolInvocation{
+			Invocation: tools.Invocation{
+				Name:     r.Name,
+				Argument: string(callbacks[r.Index].Argument),
+				Response: r.Response,
+				Duration: r.Duration,
+			},
+			Depth: depth,
+			ID:    r.ID,
+		}
+		if r.Error != nil {
+			invocation.Error = r.Error.Error()
+		}
+		l.calls = append(l.calls, invocation)
+	}
+
+	inner := l.session.ToolCalls()
+	if len(inner) <= l.ptcSeen {
+		return
+	}
+	var innerResults []callbackResult
+	for _, call := range inner[l.ptcSeen:] {
+		l.calls = append(l.calls, ToolInvocation{Invocation: call, Depth: depth, PTC: true})
+		r := callbackResult{Name: call.Name, Response: call.Response, Duration: call.Duration, Cached: call.Cached}
+		if call.Error != "" {
+			r.Error = errors.New(call.Error)
+		}
+		innerResults = append(innerResults, r)
+	}
+	l.ptcSeen = len(inner)
+	addToolStats(stats, innerResults)
+	opts.observeToolCalls(innerResults)
+}
+
+// limitResponses transforms and truncates the responses of successful callbacks in place, as they are recorded and
+// added to the conversation, and returns the truncated ones
+func limitResponses(g *gen.Generator, opts Options, depth int, callbacks []tools.Call, results []callbackResult) []TruncatedResponse {
+	var truncated []TruncatedResponse
+	for k, r := range results {
+		if r.Error != nil {
+			continue
+		}
+		callback := callbacks[r.Index]
+		transformed := opts.ToolResultTransform.Transform(r.Name, string(callback.Argument), r.Response)
+		response := tools.TruncateResponse(transformed, tools.ResponseLimit(callback.Ref, g.MaxToolResponseBytesLimit()))
+		if response != transformed {
+			truncated = append(truncated, TruncatedResponse{Depth: depth, ID: r.ID, Name: r.Name, Response: transformed})
+		}
+		results[k].Response = response
+	}
+	return truncated
+}
+
+// addToolStats aggregates executed callbacks into stats per tool name
+func addToolStats(stats map[string]ToolStats, results []callbackResult) {
+	for _, r := range results {
+		s := stats[r.Name]
+		s.Calls++
+		if r.Error != nil {
+			s.Errors++
+		}
+		if r.Cached {
+			s.Cached++
+		} else {
+			s.Total += r.Duration
+			s.Max = max(s.Max, r.Duration)
+		}
+		if n := s.Calls - s.Cached; n > 0 {
+			s.Mean = s.Total / time.Duration(n)
+		}
+		stats[r.Name] = s
+	}
 }
 
 // callbackResult holds the result of a single callback execution
@@ -195,6 +558,35 @@ type callbackResult struct {
 	Name     string
 	Response string
 	Error    error
+	Duration time.Duration
+	Cached   bool // answered from the deduplication cache of the PTC runtime
+}
+
+// executeCallbacks executes the callbacks of a step, in parallel if configured, and in random order by the random
+// source of the run if shuffled, see WithShuffle. Results are indexed by call order
+func (o Options) executeCallbacks(ctx context.Context, callbacks []tools.Call) []callbackResult {
+	var order []int
+	if o.Shuffle {
+		order = tools.RandFromContext(ctx).Perm(len(callbacks))
+		shuffled := make([]tools.Call, len(callbacks))
+		for k, i := range order {
+			shuffled[k] = callbacks[i]
+		}
+		callbacks = shuffled
+	}
+
+	var results []callbackResult
+	if o.Parallelism <= 1 {
+		results = executeCallbacksSequential(ctx, callbacks)
+	} else {
+		results = executeCallbacksParallel(ctx, callbacks, o.Parallelism)
+	}
+	if order != nil {
+		for k := range results {
+			results[k].Index = order[results[k].Index]
+		}
+	}
+	return results
 }
 
 // executeCallbacksSequential executes callbacks one by one (original behavior)
@@ -202,6 +594,7 @@ func executeCallbacksSequential(ctx context.Context, callbacks []tools.Call) []c
 	results := make([]callbackResult, len(callbacks))
 
 	for i, callback := range callbacks {
+		start := time.Now()
 		response, err := callback.Ref.Function(ctx, callback)
 		results[i] = callbackResult{
 			Index:    i,
@@ -209,13 +602,15 @@ func executeCallbacksSequential(ctx context.Context, callbacks []tools.Call) []c
 			Name:     callback.Name,
 			Response: response,
 			Error:    err,
+			Duration: time.Since(start),
 		}
 	}
 
 	return results
 }
 
-// executeCallbacksParallel executes callbacks in parallel with limited concurrency
+// executeCallbacksParallel executes callbacks in parallel with limited concurrency. Callbacks complete in arbitrary
+// order, results are indexed by call order
 func executeCallbacksParallel(ctx context.Context, callbacks []tools.Call, parallelism int) []callbackResult {
 	numCallbacks := len(callbacks)
 	results := make([]callbackResult, numCallbacks)
@@ -233,6 +628,7 @@ func executeCallbacksParallel(ctx context.Context, callbacks []tools.Call, paral
 			semaphore <- struct{}{}
 			defer func() { <-semaphore }()
 
+			start := time.Now()
 			response, err := cb.Ref.Function(ctx, cb)
 			results[index] = callbackResult{
 				Index:    index,
@@ -240,6 +636,7 @@ func executeCallbacksParallel(ctx context.Context, callbacks []tools.Call, paral
 				Name:     cb.Name,
 				Response: response,
 				Error:    err,
+				Duration: time.Since(start),
 			}
 		}(i, callback)
 	}
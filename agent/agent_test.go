@@ -0,0 +1,934 @@
+package agent_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/modfin/bellman/agent"
+	"github.com/modfin/bellman/metrics"
+	"github.com/modfin/bellman/models"
+	"github.com/modfin/bellman/models/gen"
+	"github.com/modfin/bellman/models/pricing"
+	"github.com/modfin/bellman/prompt"
+	"github.com/modfin/bellman/tools"
+	"github.com/modfin/bellman/tools/ptc"
+)
+
+type ownerArgs struct {
+	Name string `json:"name"`
+}
+
+func TestForkedRuntimesRunConcurrently(t *testing.T) {
+	names := []string{"a", "b"}
+
+	// every runtime waits in the tool for the others, which only returns if they run at the same time
+	var barrier sync.WaitGroup
+	barrier.Add(len(names))
+	arrived := make(chan struct{})
+	go func() {
+		barrier.Wait()
+		close(arrived)
+	}()
+	echo := tools.NewTool("echo",
+		tools.WithPTC(true),
+		tools.WithArgSchema(ownerArgs{}),
+		tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
+			barrier.Done()
+			select {
+			case <-arrived:
+			case <-time.After(5 * time.Second):
+				return "", errors.New("runtimes did not run concurrently")
+			}
+			return string(call.Argument), nil
+		}),
+	)
+	base, err := (&gen.Generator{}).SetTools(echo).ActivatePTC(ptc.JavaScript)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := make([]*agent.Result[string], len(names))
+	errs := make([]error, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		g, err := base.Model(gen.Model{Name: name}).ForkRuntime()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if g.Runtime == base.Runtime {
+			t.Fatal("expected forked generator to have its own runtime")
+		}
+		g.Prompter = gen.NewMockPrompter(
+			codeExecution("call_0", fmt.Sprintf(`var owner = echo({name: %q}).name; __setResult(owner)`, name)),
+			codeExecution("call_1", `__setResult(owner)`),
+			gen.MockText("done"),
+		)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = agent.Run[string](5, 0, g)
+		}()
+	}
+	wg.Wait()
+
+	for i, name := range names {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		last := results[i].Prompts[len(results[i].Prompts)-1]
+		if last.ToolResponse == nil || last.ToolResponse.Response != fmt.Sprintf("%q", name) {
+			t.Fatalf("expected generator %s to keep its own VM state, got %+v", name, last)
+		}
+	}
+}
+
+// TestSharedRuntimeRunsConcurrently runs agents on clones of one generator, i.e. sharing its runtime, at the same time.
+// Each run keeps its own PTC budget, tool calls and stats
+func TestSharedRuntimeRunsConcurrently(t *testing.T) {
+	echo := tools.NewTool("echo",
+		tools.WithPTC(true),
+		tools.WithArgSchema(ownerArgs{}),
+		tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
+			return string(call.Argument), nil
+		}),
+	)
+	// a run of budget n executes n scripts calling echo twice, and is refused a last one
+	budgets := []int{1, 2, 3, 1, 2, 3, 1, 2, 3}
+
+	// every run first waits in the sync tool for the others, so that all have started before any executes code
+	var barrier sync.WaitGroup
+	barrier.Add(len(budgets))
+	arrived := make(chan struct{})
+	go func() {
+		barrier.Wait()
+		close(arrived)
+	}()
+	wait := tools.NewTool("sync", tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
+		barrier.Done()
+		select {
+		case <-arrived:
+		case <-time.After(5 * time.Second):
+			return "", errors.New("runs did not run concurrently")
+		}
+		return "{}", nil
+	}))
+	base, err := (&gen.Generator{}).SetTools(echo, wait).ActivatePTC(ptc.JavaScript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := make([]*agent.Result[string], len(budgets))
+	errs := make([]error, len(budgets))
+	var wg sync.WaitGroup
+	for i, budget := range budgets {
+		name := fmt.Sprintf("run_%d", i)
+		g := base.Model(gen.Model{Name: name}).MaxPTCCalls(budget)
+		if g.Runtime != base.Runtime {
+			t.Fatal("expected clones to share the runtime")
+		}
+		responses := []*gen.Response{gen.MockToolCall("sync", "sync", `{}`)}
+		for k := 0; k <= budget; k++ {
+			code := fmt.Sprintf(`__setResult(echo({name: %q}).name + echo({name: %q}).name)`, name, name)
+			responses = append(responses, codeExecution(fmt.Sprintf("call_%d", k), code))
+		}
+		g.Prompter = gen.NewMockPrompter(append(responses, gen.MockText("done"))...)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = agent.Run[string](10, 0, g)
+		}()
+	}
+	wg.Wait()
+
+	for i, budget := range budgets {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		res := results[i]
+		name := fmt.Sprintf("run_%d", i)
+		if res.PTCCalls != budget || res.ToolStats["echo"].Calls != 2*budget || res.ToolStats[ptc.ToolName].Calls != budget+1 {
+			t.Fatalf("expected %s to count its own calls, got %d executions and stats %+v", name, res.PTCCalls, res.ToolStats)
+		}
+		var echoed int
+		for _, call := range res.Calls {
+			if !call.PTC {
+				continue
+			}
+			if call.Argument != fmt.Sprintf(`{"name":%q}`, name) {
+				t.Fatalf("expected %s to record only its own calls from code, got %+v", name, call)
+			}
+			echoed++
+		}
+		if echoed != 2*budget {
+			t.Fatalf("expected %s to record %d calls from code, got %d", name, 2*budget, echoed)
+		}
+		refused := res.Prompts[len(res.Prompts)-1]
+		if refused.ToolResponse == nil || !strings.Contains(refused.ToolResponse.Response, "budget exhausted") {
+			t.Fatalf("expected the budget of %s to refuse its last execution, got %+v", name, refused)
+		}
+	}
+}
+
+// codeExecution returns a response calling the PTC tool with the code
+func codeExecution(id string, code string) *gen.Response {
+	arg, _ := json.Marshal(map[string]string{"code": code})
+	return gen.MockToolCall(id, ptc.ToolName, string(arg))
+}
+
+func TestToolStats(t *testing.T) {
+	slow := tools.NewTool("slow", tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
+		time.Sleep(20 * time.Millisecond)
+		return "{}", nil
+	}))
+	fast := tools.NewTool("fast", tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
+		return "{}", nil
+	}))
+
+	g := (&gen.Generator{}).SetTools(slow, fast)
+	g.Prompter = gen.NewMockPrompter(&gen.Response{Tools: []tools.Call{
+		{ID: "1", Name: "slow"}, {ID: "2", Name: "slow"}, {ID: "3", Name: "slow"}, {ID: "4", Name: "fast"},
+	}}, gen.MockText("done"))
+
+	res, err := agent.Run[string](3, 4, g)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := res.ToolStats["slow"]
+	if s.Calls != 3 || s.Errors != 0 {
+		t.Fatalf("unexpected slow stats: %+v", s)
+	}
+	if s.Max < 20*time.Millisecond || s.Total < 60*time.Millisecond || s.Mean != s.Total/3 {
+		t.Fatalf("unexpected slow durations: %+v", s)
+	}
+	if res.ToolStats["fast"].Calls != 1 {
+		t.Fatalf("unexpected fast stats: %+v", res.ToolStats["fast"])
+	}
+}
+
+func TestParallelToolOrdering(t *testing.T) {
+	var toolList []tools.Tool
+	var calls []tools.Call
+	for i := 0; i < 5; i++ {
+		latency := time.Duration(5-i) * 10 * time.Millisecond // first call completes last
+		name := fmt.Sprintf("tool_%d", i)
+		toolList = append(toolList, tools.NewTool(name, tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
+			time.Sleep(latency)
+			return fmt.Sprintf(`{"tool":%q}`, name), nil
+		})))
+		calls = append(calls, tools.Call{ID: fmt.Sprintf("call_%d", i), Name: name})
+	}
+
+	g := (&gen.Generator{}).SetTools(toolList...)
+	g.Prompter = gen.NewMockPrompter(&gen.Response{Tools: calls}, gen.MockText("done"))
+
+	res, err := agent.Run[string](3, 5, g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Prompts) != 10 {
+		t.Fatalf("expected 10 prompts, got %d", len(res.Prompts))
+	}
+	for i := 0; i < 5; i++ {
+		call, resp := res.Prompts[2*i], res.Prompts[2*i+1]
+		id := fmt.Sprintf("call_%d", i)
+		if call.Role != prompt.ToolCallRole || call.ToolCall.ToolCallID != id {
+			t.Fatalf("expected tool call %s at position %d, got %+v", id, 2*i, call)
+		}
+		if resp.Role != prompt.ToolResponseRole || resp.ToolResponse.ToolCallID != id {
+			t.Fatalf("expected tool response %s at position %d, got %+v", id, 2*i+1, resp)
+		}
+	}
+}
+
+func TestShuffledToolOrdering(t *testing.T) {
+	var mu sync.Mutex
+	var executed []string
+	var toolList []tools.Tool
+	var calls []tools.Call
+	for i := 0; i < 5; i++ {
+		name := fmt.Sprintf("tool_%d", i)
+		toolList = append(toolList, tools.NewTool(name, tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			executed = append(executed, call.ID)
+			return fmt.Sprintf(`{"tool":%q}`, name), nil
+		})))
+		calls = append(calls, tools.Call{ID: fmt.Sprintf("call_%d", i), Name: name})
+	}
+
+	run := func(parallelism int) []prompt.Prompt {
+		executed = nil
+		g := (&gen.Generator{}).SetTools(toolList...).PTCSeed(1)
+		g.Prompter = gen.NewMockPrompter(&gen.Response{Tools: calls}, gen.MockText("done"))
+		res, err := agent.RunWith[string](g, agent.NewOptions(agent.WithParallelism(parallelism), agent.WithShuffle(true)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.Prompts
+	}
+
+	run(1)
+	shuffled := slices.Clone(executed)
+	if slices.IsSorted(shuffled) {
+		t.Fatalf("expected the calls to be executed in random order, got %v", shuffled)
+	}
+	if run(1); !slices.Equal(executed, shuffled) {
+		t.Fatalf("expected a seeded run to execute in the same order, got %v and %v", shuffled, executed)
+	}
+	for _, parallelism := range []int{1, 2} {
+		prompts := run(parallelism)
+		for i := 0; i < 5; i++ {
+			call, resp := prompts[2*i], prompts[2*i+1]
+			id := fmt.Sprintf("call_%d", i)
+			if call.ToolCall == nil || call.ToolCall.ToolCallID != id || resp.ToolResponse == nil || resp.ToolResponse.ToolCallID != id {
+				t.Fatalf("expected tool call and response %s at position %d, got %+v, %+v", id, 2*i, call, resp)
+			}
+			if resp.ToolResponse.Response != fmt.Sprintf(`{"tool":"tool_%d"}`, i) {
+				t.Fatalf("expected the response of tool_%d, got %s", i, resp.ToolResponse.Response)
+			}
+		}
+	}
+}
+
+func TestToolValues(t *testing.T) {
+	tenant := func(ctx context.Context, call tools.Call) (string, error) {
+		return fmt.Sprintf(`{"tenant":%q}`, tools.ValueFromContext(ctx, "tenant")), nil
+	}
+	direct := tools.NewTool("direct", tools.WithFunction(tenant))
+	inPTC := tools.NewTool("in_ptc", tools.WithPTC(true), tools.WithArgSchema(ownerArgs{}), tools.WithFunction(tenant))
+
+	g, err := (&gen.Generator{}).SetTools(direct, inPTC).ActivatePTC(ptc.JavaScript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _ := json.Marshal(map[string]string{"code": `__setResult(in_ptc({}))`})
+	g = g.WithToolValues(map[string]any{"tenant": "acme"})
+	g.Prompter = gen.NewMockPrompter(&gen.Response{Tools: []tools.Call{
+		{ID: "1", Name: "direct", Argument: []byte(`{}`)},
+		{ID: "2", Name: ptc.ToolName, Argument: code},
+	}}, gen.MockText("done"))
+
+	res, err := agent.Run[string](3, 0, g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range res.Prompts {
+		if p.Role == prompt.ToolResponseRole && p.ToolResponse.Response != `{"tenant":"acme"}` {
+			t.Fatalf("expected tool value in %s response, got %s", p.ToolResponse.Name, p.ToolResponse.Response)
+		}
+	}
+}
+
+func TestEmptyCandidateRetry(t *testing.T) {
+	empty := &gen.Response{Thinking: []string{"hmm"}, Metadata: models.Metadata{FinishReason: "STOP"}}
+
+	// no retry by default, the provider may retry already
+	g, p := gen.NewMockGenerator(empty, gen.MockText("done"))
+	if _, err := agent.Run[string](3, 0, g); !errors.Is(err, gen.ErrEmptyCandidate) || len(p.Prompts) != 1 {
+		t.Fatalf("expected the empty candidate error without a re-prompt, got %v after %d prompts", err, len(p.Prompts))
+	}
+
+	retry := agent.NewOptions(agent.WithMaxDepth(3), agent.WithRetryEmpty(true))
+	g, p = gen.NewMockGenerator(empty, gen.MockText("done"))
+	res, err := agent.RunWith[string](g, retry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Result != "done" || len(p.Prompts) != 2 {
+		t.Fatalf("expected a single re-prompt, got %q after %d prompts", res.Result, len(p.Prompts))
+	}
+
+	g, _ = gen.NewMockGenerator(empty, empty, gen.MockText("done"))
+	_, err = agent.RunWith[string](g, retry)
+	var emptyErr *gen.EmptyCandidateError
+	if !errors.As(err, &emptyErr) || emptyErr.FinishReason != "STOP" || !emptyErr.ThinkingOnly {
+		t.Fatalf("expected empty candidate error after retry, got %v", err)
+	}
+}
+
+func TestRunWithOptions(t *testing.T) {
+	echo := tools.NewTool("echo", tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
+		return "{}", nil
+	}))
+	newGenerator := func() *gen.Generator {
+		g, _ := gen.NewMockGenerator(
+			&gen.Response{Tools: []tools.Call{{ID: "1", Name: "echo"}}, Metadata: models.Metadata{TotalTokens: 100}},
+			&gen.Response{Texts: []string{"done"}, Metadata: models.Metadata{TotalTokens: 100}},
+		)
+		return g.SetTools(echo)
+	}
+
+	opts := agent.NewOptions(agent.WithParallelism(2))
+	if opts.MaxDepth != agent.DefaultMaxDepth || opts.Parallelism != 2 {
+		t.Fatalf("unexpected options %+v", opts)
+	}
+	res, err := agent.RunWith[string](newGenerator(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Result != "done" || res.Depth != 1 || res.Metadata.TotalTokens != 200 {
+		t.Fatalf("unexpected result %+v", res)
+	}
+
+	_, err = agent.RunWith[string](newGenerator(), agent.NewOptions(agent.WithTokenBudget(50)))
+	if !errors.Is(err, agent.ErrTokenBudgetExceeded) {
+		t.Fatalf("expected token budget error, got %v", err)
+	}
+
+	_, err = agent.RunWith[string](newGenerator(), agent.NewOptions(agent.WithMaxDepth(1)))
+	if err == nil {
+		t.Fatal("expected max depth error")
+	}
+
+	// a max depth of 0 is not defaulted, as before options, only NewOptions sets the default
+	g := newGenerator()
+	_, err = agent.Run[string](0, 1, g)
+	if err == nil || len(g.Prompter.(*gen.MockPrompter).Prompts) != 0 {
+		t.Fatalf("expected max depth error without prompting, got %v", err)
+	}
+}
+
+func TestRunWithPricing(t *testing.T) {
+	newGenerator := func() *gen.Generator {
+		g, _ := gen.NewMockGenerator(&gen.Response{Texts: []string{"done"}, Metadata: models.Metadata{InputTokens: 1_000_000, OutputTokens: 500_000, ThinkingTokens: 500_000}})
+		g.Request.Model = gen.Model{Provider: models.ProviderOpenAI, Name: "gpt-4o-mini-2024-07-18"}
+		return g
+	}
+
+	res, err := agent.RunWith[string](newGenerator(), agent.NewOptions(agent.WithPricing(pricing.Default)), prompt.AsUser("hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 1M input tokens, and 1M output tokens with thinking, at the gpt-4o-mini price
+	if res.Metadata.CostUSD != 0.75 {
+		t.Fatalf("expected cost of 0.75, got %v", res.Metadata.CostUSD)
+	}
+
+	res, err = agent.RunWith[string](newGenerator(), agent.NewOptions(), prompt.AsUser("hi"))
+	if err != nil || res.Metadata.CostUSD != 0 {
+		t.Fatalf("expected no cost without pricing, got %v, %v", res.Metadata.CostUSD, err)
+	}
+}
+
+func TestToolRefFallback(t *testing.T) {
+	var called []string
+	newTool := func(name string) tools.Tool {
+		return tools.NewTool(name, tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
+			called = append(called, name)
+			return "{}", nil
+		}))
+	}
+
+	g := (&gen.Generator{}).SetTools(newTool("first"), newTool("second"))
+	noRefs := gen.NewMockPrompter(&gen.Response{Tools: []tools.Call{{ID: "1", Name: "second"}, {ID: "2", Name: "first"}}}, gen.MockText("done"))
+	noRefs.NoRefs = true
+	g.Prompter = noRefs
+	if _, err := agent.Run[string](3, 1, g); err != nil {
+		t.Fatal(err)
+	}
+	if len(called) != 2 || called[0] != "second" || called[1] != "first" {
+		t.Fatalf("expected tools to be resolved by name, got %v", called)
+	}
+
+	g.Prompter = gen.NewMockPrompter(gen.MockToolCall("1", "missing", `{}`))
+	_, err := agent.Run[string](3, 1, g)
+	var notFound *agent.ToolNotFoundError
+	if !errors.Is(err, agent.ErrToolNotFound) || !errors.As(err, &notFound) || notFound.Name != "missing" {
+		t.Fatalf("expected tool not found error, got %v", err)
+	}
+}
+
+func TestThinking(t *testing.T) {
+	echo := tools.NewTool("echo", tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
+		return "{}", nil
+	}))
+	g, _ := gen.NewMockGenerator(
+		&gen.Response{Tools: []tools.Call{{ID: "1", Name: "echo"}}, Thinking: []string{"step 1"}, Metadata: models.Metadata{ThinkingTokens: 10}},
+		&gen.Response{Texts: []string{"done"}, Thinking: []string{"step 2"}, Metadata: models.Metadata{ThinkingTokens: 10}},
+	)
+	g = g.SetTools(echo)
+
+	res, err := agent.Run[string](3, 1, g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Metadata.ThinkingTokens != 20 {
+		t.Fatalf("expected thinking tokens of both steps, got %d", res.Metadata.ThinkingTokens)
+	}
+	if len(res.Thinking) != 2 || res.Thinking[0][0] != "step 1" || res.Thinking[1][0] != "step 2" {
+		t.Fatalf("expected thinking per step, got %v", res.Thinking)
+	}
+}
+
+func TestHistoryCompaction(t *testing.T) {
+	big := tools.NewTool("big", tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
+		return strings.Repeat("x", 10000), nil
+	}))
+	call := gen.MockToolCall("1", "big", `{}`)
+	newGenerator := func(responses ...*gen.Response) (*gen.Generator, *gen.MockPrompter) {
+		g, p := gen.NewMockGenerator(responses...)
+		return g.SetTools(big), p
+	}
+
+	g, p := newGenerator(call, gen.MockText("done"))
+	res, err := agent.RunWith[string](g, agent.NewOptions(agent.WithHistoryCompactor(agent.TruncateToolResponses{MaxChars: 100}, 1000)), prompt.AsUser("task"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Compactions) != 1 || res.Compactions[0].Depth != 1 || res.Compactions[0].TokensAfter >= res.Compactions[0].TokensBefore {
+		t.Fatalf("expected a compaction at depth 1, got %+v", res.Compactions)
+	}
+	last := p.Prompts[1][len(p.Prompts[1])-1]
+	if last.ToolResponse.Response != strings.Repeat("x", 100)+"...[truncated 9900 of 10000 bytes]" {
+		t.Fatalf("expected truncated tool response, got %d bytes", len(last.ToolResponse.Response))
+	}
+
+	// responses are cut at a UTF-8 boundary
+	multibyte := []prompt.Prompt{prompt.AsToolResponse("1", "big", strings.Repeat("é", 100))}
+	compacted, _, err := agent.TruncateToolResponses{MaxChars: 9}.Compact(nil, multibyte)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := compacted[0].ToolResponse.Response; r != strings.Repeat("é", 4)+"...[truncated 192 of 200 bytes]" {
+		t.Fatalf("expected response cut before the multibyte rune, got %s", r)
+	}
+
+	g, p = newGenerator(call, gen.MockText("the tool returned a lot of x"), gen.MockText("done"))
+	res, err = agent.RunWith[string](g, agent.NewOptions(agent.WithHistoryCompactor(agent.SummarizeOldest{}, 1000)), prompt.AsUser("task"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Compactions) != 1 {
+		t.Fatalf("expected a compaction, got %+v", res.Compactions)
+	}
+	if len(p.Requests[1].Tools) != 0 {
+		t.Fatalf("expected the summary to be prompted without tools, got %d", len(p.Requests[1].Tools))
+	}
+	final := p.Prompts[len(p.Prompts)-1]
+	if len(final) != 2 || final[0].Text != "task" || !strings.Contains(final[1].Text, "the tool returned a lot of x") {
+		t.Fatalf("expected task and summary, got %+v", final)
+	}
+
+	g, _ = newGenerator(call, gen.MockText("done"))
+	res, err = agent.RunWith[string](g, agent.NewOptions(agent.WithHistoryCompactor(agent.TruncateToolResponses{MaxChars: 100}, 100000)), prompt.AsUser("task"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Compactions) != 0 {
+		t.Fatalf("expected no compaction below the threshold, got %+v", res.Compactions)
+	}
+}
+
+func TestMaxToolResponseBytes(t *testing.T) {
+	big := tools.NewTool("big", tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
+		return strings.Repeat("x", 1000), nil
+	}))
+	small := tools.NewTool("small", tools.WithMaxResponseBytes(10), tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
+		return strings.Repeat("y", 50), nil
+	}))
+	g, p := gen.NewMockGenerator(&gen.Response{Tools: []tools.Call{{ID: "1", Name: "big"}, {ID: "2", Name: "small"}}}, gen.MockText("done"))
+	g = g.SetTools(big, small).MaxToolResponseBytes(100)
+
+	res, err := agent.Run[string](3, 1, g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conversation := p.Prompts[1]
+	if r := conversation[1].ToolResponse.Response; r != strings.Repeat("x", 100)+"...[truncated 900 of 1000 bytes]" {
+		t.Fatalf("expected response truncated to the generator default, got %s", r)
+	}
+	if r := conversation[3].ToolResponse.Response; r != strings.Repeat("y", 10)+"...[truncated 40 of 50 bytes]" {
+		t.Fatalf("expected response truncated to the tool limit, got %s", r)
+	}
+	if len(res.Truncated) != 2 || len(res.Truncated[0].Response) != 1000 || res.Truncated[1].Name != "small" {
+		t.Fatalf("expected full responses in the result, got %+v", res.Truncated)
+	}
+	if len(res.Calls) != 2 || res.Calls[0].Response != conversation[1].ToolResponse.Response {
+		t.Fatalf("expected the truncated responses to be recorded, got %+v", res.Calls)
+	}
+}
+
+func TestWithMaxToolResponseBytes(t *testing.T) {
+	exact := tools.NewTool("exact", tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
+		return strings.Repeat("x", 10), nil
+	}))
+	multibyte := tools.NewTool("multibyte", tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
+		return strings.Repeat("x", 9) + "éé", nil
+	}))
+	g, p := gen.NewMockGenerator(&gen.Response{Tools: []tools.Call{{ID: "1", Name: "exact"}, {ID: "2", Name: "multibyte"}}}, gen.MockText("done"))
+	g = gen.WithMaxToolResponseBytes(10)(g.SetTools(exact, multibyte))
+
+	_, err := agent.RunWith[string](g, agent.NewOptions(), prompt.AsUser("task"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conversation := p.Prompts[1]
+	if r := conversation[2].ToolResponse.Response; r != strings.Repeat("x", 10) {
+		t.Fatalf("expected response at the limit to be kept, got %s", r)
+	}
+	r := conversation[4].ToolResponse.Response
+	if r != strings.Repeat("x", 9)+"...[truncated 4 of 13 bytes]" {
+		t.Fatalf("expected response cut before the multibyte rune, got %s", r)
+	}
+	b, err := json.Marshal(conversation[4])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded prompt.Prompt
+	if err := json.Unmarshal(b, &decoded); err != nil || decoded.ToolResponse.Response != r {
+		t.Fatalf("expected truncated response to round trip, got %+v, %v", decoded.ToolResponse, err)
+	}
+}
+
+type priceArgs struct {
+	Ticker string `json:"ticker"`
+}
+
+func TestMockPrompter(t *testing.T) {
+	lookup := tools.NewTool("lookup", tools.WithPTC(true), tools.WithArgSchema(priceArgs{}), tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
+		return `{"price":42}`, nil
+	}))
+
+	g, p := gen.NewMockGenerator(
+		gen.MockToolCall("1", "lookup", `{"ticker":"ABC"}`),
+		gen.MockToolCall("2", "lookup", `{"ticker":"DEF"}`),
+		gen.MockText(`{"total":84}`),
+	)
+	res, err := agent.Run[struct {
+		Total int `json:"total"`
+	}](5, 1, g.SetTools(lookup), prompt.AsUser("sum the prices of ABC and DEF"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Result.Total != 84 || res.Depth != 2 {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	if last := p.Prompts[2]; len(last) != 5 || last[4].ToolResponse.Response != `{"price":42}` {
+		t.Fatalf("expected both tool calls and responses in the final prompt, got %+v", last)
+	}
+
+	// the same loop through PTC, with the model calling code_execution
+	g, _ = gen.NewMockGenerator(
+		gen.MockToolCall("1", ptc.ToolName, `{"code":"__setResult(lookup({ticker: \"ABC\"}).price * 2)"}`),
+		gen.MockText("84"),
+	)
+	g, err = g.SetTools(lookup).ActivatePTC(ptc.JavaScript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ptcRes, err := agent.Run[string](5, 1, g, prompt.AsUser("double the price of ABC"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ptcRes.Result != "84" || ptcRes.PTCCalls != 1 || ptcRes.Prompts[2].ToolResponse.Response != "84" {
+		t.Fatalf("unexpected PTC result %+v", ptcRes)
+	}
+
+	if _, err := g.Prompt(prompt.AsUser("again")); !errors.Is(err, gen.ErrMockExhausted) {
+		t.Fatalf("expected exhausted mock, got %v", err)
+	}
+}
+
+func TestTraceID(t *testing.T) {
+	g, p := gen.NewMockGenerator(gen.MockText("done"))
+	res, err := agent.Run[string](2, 1, g.WithTraceID("nestful/q7/0"), prompt.AsUser("hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.TraceID != "nestful/q7/0" || p.Requests[0].TraceID != "nestful/q7/0" {
+		t.Fatalf("expected the trace id on the result and request, got %q, %q", res.TraceID, p.Requests[0].TraceID)
+	}
+}
+
+func TestRunWithoutToolsWithOutput(t *testing.T) {
+	lookup := tools.NewTool("lookup", tools.WithArgSchema(priceArgs{}), tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
+		return `{"price":42}`, nil
+	}))
+	type total struct {
+		Total int `json:"total"`
+	}
+
+	g, p := gen.NewMockGenerator(
+		gen.MockToolCall("1", "lookup", `{"ticker":"ABC"}`),
+		gen.MockToolCall("2", "__return_result_tool__", `{"total":42}`),
+	)
+	g = g.Model(gen.Model{Provider: "VertexAI", Name: "gemini-2.5-flash"}).SetTools(lookup)
+	res, err := agent.Run[total](5, 1, g, prompt.AsUser("price of ABC"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Result.Total != 42 {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	request := p.Requests[0]
+	if request.OutputSchema != nil || len(request.Tools) != 2 || request.Tools[1].Name != "__return_result_tool__" {
+		t.Fatalf("expected the tools only strategy without an output schema, got %+v", request)
+	}
+
+	// models supporting tools with output use the output schema
+	g, p = gen.NewMockGenerator(gen.MockText(`{"total":42}`))
+	if _, err = agent.Run[total](5, 1, g.Model(gen.Model{Provider: "OpenAI", Name: "gpt-4o"}).SetTools(lookup), prompt.AsUser("price of ABC")); err != nil {
+		t.Fatal(err)
+	}
+	if p.Requests[0].OutputSchema == nil || len(p.Requests[0].Tools) != 1 {
+		t.Fatalf("expected an output schema and no result tool, got %+v", p.Requests[0])
+	}
+}
+
+func TestHybrid(t *testing.T) {
+	lookup := tools.NewTool("lookup", tools.WithArgSchema(priceArgs{}), tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
+		return `{"price":42}`, nil
+	}))
+	type total struct {
+		Total int `json:"total"`
+	}
+	opts := agent.NewOptions(agent.WithToolsOnly(true), agent.WithHybrid(true))
+
+	// a final text response is parsed as the result, without a call to the return tool
+	g, p := gen.NewMockGenerator(
+		gen.MockToolCall("1", "lookup", `{"ticker":"ABC"}`),
+		gen.MockText("```json\n{\"total\":42}\n```"),
+	)
+	res, err := agent.RunWith[total](g.SetTools(lookup), opts, prompt.AsUser("price of ABC"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Result.Total != 42 || res.Depth != 1 || len(p.Requests) != 2 || res.Fallback != "" {
+		t.Fatalf("expected the result from the text response, got %+v", res)
+	}
+	if p.Requests[0].ToolConfig == nil || p.Requests[0].ToolConfig.Name != tools.AutoTool.Name {
+		t.Fatalf("expected auto tool choice, got %+v", p.Requests[0].ToolConfig)
+	}
+
+	// other text falls back to the return tool
+	g, p = gen.NewMockGenerator(
+		gen.MockText("The total is 42"),
+		gen.MockToolCall("2", "__return_result_tool__", `{"total":42}`),
+	)
+	res, err = agent.RunWith[total](g.SetTools(lookup), opts, prompt.AsUser("price of ABC"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Result.Total != 42 || res.Depth != 1 {
+		t.Fatalf("expected the result from the return tool, got %+v", res)
+	}
+	last := p.Prompts[1]
+	if len(last) != 3 || last[1].Text != "The total is 42" || !strings.Contains(last[2].Text, "__return_result_tool__") {
+		t.Fatalf("expected the text and a request to call the return tool, got %+v", last)
+	}
+	if p.Requests[1].ToolConfig == nil || p.Requests[1].ToolConfig.Name != tools.RequiredTool.Name {
+		t.Fatalf("expected the return tool to be required, got %+v", p.Requests[1].ToolConfig)
+	}
+}
+
+func TestLenientJSON(t *testing.T) {
+	type total struct {
+		Total int `json:"total"`
+	}
+	text := "Sure, here you go:\n```json\n{\"total\":42}\n```"
+
+	g, _ := gen.NewMockGenerator(gen.MockText(text))
+	if _, err := agent.Run[total](2, 1, g, prompt.AsUser("total?")); err == nil {
+		t.Fatal("expected strict parsing to fail on fenced json")
+	}
+
+	g, _ = gen.NewMockGenerator(gen.MockText(text))
+	res, err := agent.RunWith[total](g, agent.NewOptions(agent.WithLenientJSON(true)), prompt.AsUser("total?"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Result.Total != 42 {
+		t.Fatalf("unexpected result %+v", res.Result)
+	}
+
+	// the text result of a tools only run
+	toolsOnly := agent.NewOptions(agent.WithMaxDepth(2), agent.WithToolsOnly(true))
+	g, _ = gen.NewMockGenerator(gen.MockText("```json\n{\"total\":42}\n```"))
+	if res, err := agent.RunWith[total](g, toolsOnly, prompt.AsUser("total?")); err != nil || res.Result.Total != 42 {
+		t.Fatalf("expected a fenced result to be parsed, got %+v, %v", res, err)
+	}
+
+	g, _ = gen.NewMockGenerator(gen.MockText(text))
+	if _, err := agent.RunWith[total](g, toolsOnly, prompt.AsUser("total?")); err == nil {
+		t.Fatal("expected strict parsing to fail on prose wrapped json")
+	}
+
+	g, _ = gen.NewMockGenerator(gen.MockText(text))
+	lenient := agent.NewOptions(agent.WithMaxDepth(2), agent.WithToolsOnly(true), agent.WithLenientJSON(true))
+	if res, err := agent.RunWith[total](g, lenient, prompt.AsUser("total?")); err != nil || res.Result.Total != 42 {
+		t.Fatalf("expected a prose wrapped result to be parsed, got %+v, %v", res, err)
+	}
+}
+
+func TestToolFilter(t *testing.T) {
+	newTool := func(name string, usePTC bool) tools.Tool {
+		return tools.NewTool(name, tools.WithPTC(usePTC), tools.WithArgSchema(priceArgs{}), tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
+			return `{"ok":true}`, nil
+		}))
+	}
+	review, send := newTool("review_draft", false), newTool("send_email", false)
+
+	// send_email is only allowed once review_draft has run, which is withdrawn after its use
+	filter := func(step int, history []prompt.Prompt) []tools.Tool {
+		for _, p := range history {
+			if p.ToolCall != nil && p.ToolCall.Name == review.Name {
+				return []tools.Tool{send}
+			}
+		}
+		return []tools.Tool{review}
+	}
+
+	g, p := gen.NewMockGenerator(
+		gen.MockToolCall("1", "review_draft", `{"ticker":"draft"}`),
+		gen.MockToolCall("2", "send_email", `{"ticker":"draft"}`),
+		gen.MockText("sent"),
+	)
+	res, err := agent.RunWith[string](g.SetTools(review, send), agent.NewOptions(agent.WithToolFilter(filter)), prompt.AsUser("review and send"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Result != "sent" {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	for i, expected := range []string{"review_draft", "send_email", "send_email"} {
+		if active := p.Requests[i].Tools; len(active) != 1 || active[0].Name != expected {
+			t.Fatalf("expected only %s at step %d, got %+v", expected, i, active)
+		}
+	}
+
+	// with PTC the code execution tool is kept for the PTC tools of the step
+	g, p = gen.NewMockGenerator(gen.MockText("done"))
+	g, err = g.SetTools(newTool("lookup", true), review).ActivatePTC(ptc.JavaScript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	onlyLookup := agent.WithToolFilter(func(int, []prompt.Prompt) []tools.Tool { return []tools.Tool{newTool("lookup", true)} })
+	if _, err = agent.RunWith[string](g, agent.NewOptions(onlyLookup), prompt.AsUser("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if active := p.Requests[0].Tools; len(active) != 1 || active[0].Name != ptc.ToolName || len(p.Requests[0].PTCTools) != 1 {
+		t.Fatalf("expected only the code execution tool, got %+v", active)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	lookup := tools.NewTool("lookup", tools.WithArgSchema(priceArgs{}), tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
+		return `{"price":42}`, nil
+	}))
+	g, _ := gen.NewMockGenerator(
+		gen.MockToolCall("1", "lookup", `{"ticker":"ABC"}`),
+		gen.MockToolCall("2", "lookup", `{"ticker":"DEF"}`),
+		gen.MockText("done"),
+	)
+	counters := &metrics.Counters{}
+	_, err := agent.RunWith[string](g.SetTools(lookup), agent.NewOptions(agent.WithMetrics(counters)), prompt.AsUser("prices"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counters.ToolCalls("lookup") != 2 || counters.Operations() != 1 || counters.Errors() != 0 {
+		t.Fatalf("unexpected metrics, %d tool calls, %d runs, %d errors", counters.ToolCalls("lookup"), counters.Operations(), counters.Errors())
+	}
+}
+
+func TestToolsOnlyTextFallback(t *testing.T) {
+	type total struct {
+		Total int `json:"total"`
+	}
+	opts := agent.NewOptions(agent.WithToolsOnly(true))
+
+	g, _ := gen.NewMockGenerator(gen.MockToolCall("1", "__return_result_tool__", `{"total":42}`))
+	res, err := agent.RunWith[total](g, opts, prompt.AsUser("total?"))
+	if err != nil || res.Fallback != "" {
+		t.Fatalf("expected a clean finish, got %+v, %v", res, err)
+	}
+
+	// a text response is terminal even when a tool call is required
+	g, _ = gen.NewMockGenerator(gen.MockText(`{"total":42}`))
+	res, err = agent.RunWith[total](g, opts, prompt.AsUser("total?"))
+	if err != nil || res.Result.Total != 42 || res.Fallback != agent.FallbackText {
+		t.Fatalf("expected the text result, got %+v, %v", res, err)
+	}
+
+	g, _ = gen.NewMockGenerator(gen.MockText("The total is 42"))
+	str, err := agent.RunWith[string](g, opts, prompt.AsUser("total?"))
+	if err != nil || str.Result != "The total is 42" || str.Fallback != agent.FallbackText {
+		t.Fatalf("expected the text as a string result, got %+v, %v", str, err)
+	}
+
+	g, _ = gen.NewMockGenerator(gen.MockText("The total is 42"), gen.MockToolCall("1", "__return_result_tool__", `{"total":42}`))
+	res, err = agent.RunWith[total](g, opts, prompt.AsUser("total?"))
+	if err != nil || res.Result.Total != 42 || res.Fallback != agent.FallbackNudged {
+		t.Fatalf("expected the result after a nudge, got %+v, %v", res, err)
+	}
+
+	g, _ = gen.NewMockGenerator(gen.MockText("The total is 42"), gen.MockText("It is 42"))
+	if _, err = agent.RunWith[total](g, opts, prompt.AsUser("total?")); !errors.Is(err, agent.ErrNoResult) {
+		t.Fatalf("expected no result after a nudge, got %v", err)
+	}
+}
+
+func TestToolResultTransform(t *testing.T) {
+	lookup := tools.NewTool("lookup", tools.WithArgSchema(priceArgs{}), tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
+		return strings.Repeat("x", 100), nil
+	}))
+	g, p := gen.NewMockGenerator(
+		gen.MockToolCall("1", "lookup", `{"ticker":"ABC"}`),
+		gen.MockText("done"),
+	)
+	capped := func(name string, argument string, response string) string {
+		return fmt.Sprintf("%s %s: %s [%d bytes]", name, argument, response[:10], len(response))
+	}
+	_, err := agent.RunWith[string](g.SetTools(lookup), agent.NewOptions(agent.WithToolResultTransform(capped)), prompt.AsUser("price of ABC"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := p.Prompts[1][2].ToolResponse
+	if response == nil || response.Response != `lookup {"ticker":"ABC"}: xxxxxxxxxx [100 bytes]` {
+		t.Fatalf("expected the transformed response, got %+v", p.Prompts[1])
+	}
+}
+
+func TestCalls(t *testing.T) {
+	lookup := tools.NewTool("lookup", tools.WithPTC(true), tools.WithArgSchema(priceArgs{}), tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
+		return `{"price":42}`, nil
+	}))
+	review := tools.NewTool("review", tools.WithPTC(true), tools.WithArgSchema(priceArgs{}), tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
+		return "", errors.New("reviewer unavailable")
+	}))
+	g, _ := gen.NewMockGenerator(
+		gen.MockToolCall("1", ptc.ToolName, `{"code":"__setResult(lookup({ticker: \"ABC\"}).price + lookup({ticker: \"DEF\"}).price + (review({ticker: \"ABC\"}).price || 0))"}`),
+		gen.MockText("84"),
+	)
+	g, err := g.SetTools(lookup, review).ActivatePTC(ptc.JavaScript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := agent.Run[string](5, 1, g, prompt.AsUser("sum the prices of ABC and DEF"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Calls) != 4 {
+		t.Fatalf("expected the code execution, both lookups and the review, got %+v", res.Calls)
+	}
+	if c := res.Calls[0]; c.Name != ptc.ToolName || c.ID != "1" || c.PTC || c.Response != "84" {
+		t.Fatalf("expected the code execution call first, got %+v", c)
+	}
+	if c := res.Calls[2]; c.Name != "lookup" || !c.PTC || c.Argument != `{"ticker":"DEF"}` || c.Response != `{"price":42}` || c.Depth != 0 {
+		t.Fatalf("expected the second lookup from code, got %+v", c)
+	}
+	if c := res.Calls[3]; c.Name != "review" || c.Error != "reviewer unavailable" {
+		t.Fatalf("expected the failed review, got %+v", c)
+	}
+	if res.ToolStats["lookup"].Calls != 2 || res.ToolStats["review"].Errors != 1 || res.ToolStats[ptc.ToolName].Calls != 1 {
+		t.Fatalf("expected the calls from code in the stats, got %+v", res.ToolStats)
+	}
+}
@@ -0,0 +1,131 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/modfin/bellman/models/gen"
+	"github.com/modfin/bellman/prompt"
+	"github.com/modfin/bellman/tools"
+)
+
+// HistoryCompactor shrinks the conversation of an agent run, e.g. to keep it within the context window of the model.
+// It is called before a prompt when the estimated prompt tokens exceed the threshold set by WithHistoryCompactor.
+type HistoryCompactor interface {
+	// Compact returns the compacted prompts and a description of what was changed, or an empty description if the
+	// prompts were left as is
+	Compact(g *gen.Generator, prompts []prompt.Prompt) ([]prompt.Prompt, string, error)
+}
+
+// Compaction records a compaction of the conversation during an agent run
+type Compaction struct {
+	Depth        int    `json:"depth"`
+	TokensBefore int    `json:"tokens_before"` // estimated prompt tokens before compaction
+	TokensAfter  int    `json:"tokens_after"`  // estimated prompt tokens after compaction
+	Description  string `json:"description"`
+}
+
+// EstimateTokens approximates the number of prompt tokens of the generator and the conversation, see
+// gen.EstimateTokens
+func EstimateTokens(g *gen.Generator, prompts []prompt.Prompt) int {
+	return gen.EstimateTokens(g.Request, prompts...)
+}
+
+// compact applies the history compactor if the estimated prompt tokens exceed the threshold
+func (o Options) compact(g *gen.Generator, prompts []prompt.Prompt, depth int) ([]prompt.Prompt, *Compaction, error) {
+	if o.Compactor == nil {
+		return prompts, nil, nil
+	}
+	before := EstimateTokens(g, prompts)
+	if before <= o.CompactThreshold {
+		return prompts, nil, nil
+	}
+	compacted, description, err := o.Compactor.Compact(g, prompts)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not compact history; %w", err)
+	}
+	if description == "" {
+		return prompts, nil, nil
+	}
+	return compacted, &Compaction{
+		Depth:        depth,
+		TokensBefore: before,
+		TokensAfter:  EstimateTokens(g, compacted),
+		Description:  description,
+	}, nil
+}
+
+// TruncateToolResponses truncates tool responses longer than MaxChars bytes, at a UTF-8 boundary, with a note on how
+// much was left out, see tools.TruncateResponse. A MaxChars <= 0 leaves the responses as is
+type TruncateToolResponses struct {
+	MaxChars int
+}
+
+func (t TruncateToolResponses) Compact(_ *gen.Generator, prompts []prompt.Prompt) ([]prompt.Prompt, string, error) {
+	var res []prompt.Prompt
+	var truncated int
+	for i, p := range prompts {
+		if t.MaxChars <= 0 || p.ToolResponse == nil || len(p.ToolResponse.Response) <= t.MaxChars {
+			continue
+		}
+		if res == nil {
+			res = append([]prompt.Prompt{}, prompts...)
+		}
+		response := *p.ToolResponse
+		response.Response = tools.TruncateResponse(response.Response, t.MaxChars)
+		p.ToolResponse = &response
+		res[i] = p
+		truncated++
+	}
+	if res == nil {
+		return prompts, "", nil
+	}
+	return res, fmt.Sprintf("truncated %d tool responses to %d bytes", truncated, t.MaxChars), nil
+}
+
+const summarizeSystem = `You summarize the conversation of an agent solving a task with tools. Keep all facts, ` +
+	`values and identifiers from tool responses that may be needed to finish the task, and leave out the rest.`
+
+// SummarizeOldest replaces the oldest turns, except the first prompt holding the task, by a summary written by the
+// model of the run. The last KeepLast prompts are kept as is.
+type SummarizeOldest struct {
+	KeepLast int
+}
+
+func (s SummarizeOldest) Compact(g *gen.Generator, prompts []prompt.Prompt) ([]prompt.Prompt, string, error) {
+	cut := len(prompts) - max(s.KeepLast, 0)
+	// a tool response must follow its tool call, so the kept turns may not start with a tool response
+	for cut > 1 && cut < len(prompts) && prompts[cut].Role == prompt.ToolResponseRole {
+		cut--
+	}
+	if cut <= 2 {
+		return prompts, "", nil
+	}
+
+	var history strings.Builder
+	for _, p := range prompts[1:cut] {
+		switch {
+		case p.ToolCall != nil:
+			fmt.Fprintf(&history, "[tool call %s] %s\n", p.ToolCall.Name, p.ToolCall.Arguments)
+		case p.ToolResponse != nil:
+			fmt.Fprintf(&history, "[tool response %s] %s\n", p.ToolResponse.Name, p.ToolResponse.Response)
+		default:
+			fmt.Fprintf(&history, "[%s] %s\n", p.Role, p.Text)
+		}
+	}
+
+	summarizer := g.SetTools().Output(nil).System(summarizeSystem)
+	summarizer.Request.ToolConfig = nil
+	summarizer.Request.PTCSystemFragment = nil
+	resp, err := summarizer.Prompt(prompt.AsUser(history.String()))
+	if err != nil {
+		return nil, "", fmt.Errorf("could not summarize history; %w", err)
+	}
+	summary, err := resp.AsText()
+	if err != nil {
+		return nil, "", fmt.Errorf("could not get summary; %w", err)
+	}
+
+	res := append([]prompt.Prompt{prompts[0], prompt.AsUser("Summary of the conversation so far:\n" + summary)}, prompts[cut:]...)
+	return res, fmt.Sprintf("summarized %d prompts", cut-1), nil
+}
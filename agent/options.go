@@ -0,0 +1,190 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/modfin/bellman/metrics"
+	"github.com/modfin/bellman/models"
+	"github.com/modfin/bellman/models/gen"
+	"github.com/modfin/bellman/models/pricing"
+	"github.com/modfin/bellman/prompt"
+	"github.com/modfin/bellman/tools"
+)
+
+// DefaultMaxDepth is the max depth of NewOptions, unless set by WithMaxDepth
+const DefaultMaxDepth = 10
+
+// ErrTokenBudgetExceeded is returned, wrapped, when a run uses more tokens than the budget set by WithTokenBudget
+var ErrTokenBudgetExceeded = errors.New("token budget exceeded")
+
+// ErrNoResult is returned, wrapped, when a tools only run responds in text that is not the result, even after being
+// asked to call the return tool
+var ErrNoResult = errors.New("no result, the model did not call the return tool")
+
+// Options configures an agent run, see RunWith
+type Options struct {
+	MaxDepth    int  // maximum number of prompts, DefaultMaxDepth by NewOptions
+	Parallelism int  // maximum number of concurrent tool calls, tools are executed sequentially if <= 1
+	Shuffle     bool // execute the tool calls of a step in random order, see WithShuffle
+	TokenBudget int  // maximum number of total tokens for the run, 0 means no limit
+	ToolsOnly   bool // return the result through a tool call, for models not supporting tools and structured output together
+	Hybrid      bool // with ToolsOnly, let the model choose between tool calls and a final text response, see WithHybrid
+	LenientJSON bool // extract the JSON result from fenced or prose wrapped text, see gen.ExtractJSON
+	RetryEmpty  bool // re-prompt once on an empty candidate, see WithRetryEmpty
+
+	ToolFilter func(step int, history []prompt.Prompt) []tools.Tool // active tools of each step, see WithToolFilter
+
+	ToolResultTransform tools.ResultTransform // post-processes tool responses, also of tools called from code, see WithToolResultTransform
+
+	Metrics metrics.Metrics // instruments the run and its tool calls, nil if not instrumented, see WithMetrics
+	Pricing pricing.Table   // estimates the cost of the run, nil if not estimated, see WithPricing
+
+	Compactor        HistoryCompactor // compacts the conversation when it grows beyond CompactThreshold, nil disables compaction
+	CompactThreshold int              // estimated prompt tokens above which the conversation is compacted, see EstimateTokens
+}
+
+type Option func(*Options)
+
+// NewOptions returns the options with the defaults, overridden by opts
+func NewOptions(opts ...Option) Options {
+	o := Options{MaxDepth: DefaultMaxDepth}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+func WithMaxDepth(maxDepth int) Option {
+	return func(o *Options) {
+		o.MaxDepth = maxDepth
+	}
+}
+
+func WithParallelism(parallelism int) Option {
+	return func(o *Options) {
+		o.Parallelism = parallelism
+	}
+}
+
+// WithShuffle executes the tool calls of a step in random order, by the random source of the run, seeded by
+// gen.Generator.PTCSeed if set, e.g. to surface tools depending on the call order. Tool responses are still added to
+// the conversation in call order
+func WithShuffle(shuffle bool) Option {
+	return func(o *Options) {
+		o.Shuffle = shuffle
+	}
+}
+
+// WithTokenBudget stops the run with ErrTokenBudgetExceeded when the total tokens exceed the budget before a final
+// result is returned
+func WithTokenBudget(tokens int) Option {
+	return func(o *Options) {
+		o.TokenBudget = tokens
+	}
+}
+
+func WithToolsOnly(toolsOnly bool) Option {
+	return func(o *Options) {
+		o.ToolsOnly = toolsOnly
+	}
+}
+
+// WithHybrid lets the model of a tools only run, see WithToolsOnly, choose between tool calls and a text response,
+// instead of requiring a tool call, saving the extra turn of calling the return tool. A final text response is parsed
+// as the result, and only if it is not valid JSON of the result is the model asked to call the return tool, see
+// Result.Fallback
+func WithHybrid(hybrid bool) Option {
+	return func(o *Options) {
+		o.Hybrid = hybrid
+	}
+}
+
+// WithLenientJSON extracts the JSON of a text result before unmarshalling it, for models wrapping it in a markdown
+// code fence or prose despite the output schema. Parsing is strict by default
+func WithLenientJSON(lenient bool) Option {
+	return func(o *Options) {
+		o.LenientJSON = lenient
+	}
+}
+
+// WithRetryEmpty re-prompts once if the model responds with an empty candidate, see gen.ErrEmptyCandidate, which is
+// usually intermittent. Off by default, since providers may already retry, e.g. vertexai.Config.RetryEmptyCandidate
+func WithRetryEmpty(retry bool) Option {
+	return func(o *Options) {
+		o.RetryEmpty = retry
+	}
+}
+
+// WithToolFilter sets the tools of each step of the run, by the depth and the conversation so far, e.g. to withdraw a
+// tool once used or to allow a tool only after another has run. The filter is called before each prompt and returns
+// all tools of the step, PTC tools included. With PTC activated the tools are re-adapted on the same runtime, see
+// gen.Generator.SetActiveTools, so variables set by earlier code executions are kept, while calls of withdrawn
+// tools from code fail
+func WithToolFilter(filter func(step int, history []prompt.Prompt) []tools.Tool) Option {
+	return func(o *Options) {
+		o.ToolFilter = filter
+	}
+}
+
+// WithHistoryCompactor compacts the conversation before a prompt when its estimated tokens exceed the threshold, e.g.
+// using TruncateToolResponses or SummarizeOldest. Compactions are recorded in the Result
+func WithHistoryCompactor(compactor HistoryCompactor, threshold int) Option {
+	return func(o *Options) {
+		o.Compactor = compactor
+		o.CompactThreshold = threshold
+	}
+}
+
+// activeTools sets the tools of the step by the tool filter, if any, along with extra tools of the run, e.g. the return
+// tool of a tools only run
+func (o Options) activeTools(g *gen.Generator, step int, prompts []prompt.Prompt, extra ...tools.Tool) (*gen.Generator, error) {
+	if o.ToolFilter == nil {
+		return g, nil
+	}
+	g, err := g.SetActiveTools(append(o.ToolFilter(step, prompts), extra...)...)
+	if err != nil {
+		return nil, fmt.Errorf("could not set active tools; %w", err)
+	}
+	return g, nil
+}
+
+func (o Options) checkTokenBudget(metadata models.Metadata) error {
+	if o.TokenBudget > 0 && metadata.TotalTokens > o.TokenBudget {
+		return fmt.Errorf("%w, used %d of %d tokens", ErrTokenBudgetExceeded, metadata.TotalTokens, o.TokenBudget)
+	}
+	return nil
+}
+
+// WithMetrics reports the latency and error of the run, and each tool call, to m. Tokens are reported by the client,
+// see bellman.WithMetrics
+func WithMetrics(m metrics.Metrics) Option {
+	return func(o *Options) {
+		o.Metrics = m
+	}
+}
+
+// WithPricing estimates the cost of the run from its tokens by the price table, e.g. pricing.Default, see
+// Result.Metadata.CostUSD and models.Metadata.EstimateCost. The cost is left 0 for models not in the table
+func WithPricing(table pricing.Table) Option {
+	return func(o *Options) {
+		o.Pricing = table
+	}
+}
+
+// WithToolResultTransform post-processes tool responses before they are added to the conversation, e.g. to cap their
+// size or redact them, without modifying each tool. It is applied before the response size limit, and with PTC
+// also to the tools called from code
+func WithToolResultTransform(fn tools.ResultTransform) Option {
+	return func(o *Options) {
+		o.ToolResultTransform = fn
+	}
+}
+
+// observeToolCalls reports executed callbacks to the metrics
+func (o Options) observeToolCalls(results []callbackResult) {
+	m := metrics.OrNop(o.Metrics)
+	for _, r := range results {
+		m.IncToolCall(r.Name, r.Error)
+	}
+}
@@ -152,6 +152,13 @@ func main() {
 				EnvVars: []string{"BELLMAN_DISABLE_EMBED_MODELS"},
 			},
 
+			&cli.IntFlag{
+				Name:    "files-max-mb",
+				EnvVars: []string{"BELLMAN_FILES_MAX_MB"},
+				Value:   512,
+				Usage:   "max total size, in MB, of the uploaded prompt payloads kept in memory, uploads are rejected when full",
+			},
+
 			&cli.StringFlag{
 				Name:    "prometheus-metrics-basic-auth",
 				EnvVars: []string{"BELLMAN_PROMETHEUS_METRICS_BASIC_AUTH"},
@@ -271,6 +278,8 @@ type Config struct {
 	DisableGenModels   bool `cli:"disable-gen-models"`
 	DisableEmbedModels bool `cli:"disable-embed-models"`
 
+	FilesMaxMB int `cli:"files-max-mb"`
+
 	AnthropicKey string `cli:"anthropic-key"`
 	OpenAiKey    string `cli:"openai-key"`
 	Google       GoogleConfig
@@ -390,7 +399,13 @@ func serve(cfg Config, apiKeyConfigs map[string]ApiKeyConfig) error {
 		r.Route("/embed", Embed(proxy, apiKeyConfigs, rateLimiter))
 	}
 	if !cfg.DisableGenModels {
-		r.Route("/gen", Gen(proxy, apiKeyConfigs, rateLimiter))
+		files := NewFileStore(fileTTL, int64(cfg.FilesMaxMB)<<20)
+		go func() {
+			for range time.Tick(time.Minute) {
+				files.EvictExpired()
+			}
+		}()
+		r.Route("/gen", Gen(proxy, apiKeyConfigs, rateLimiter, files))
 	}
 
 	server := &http.Server{Addr: fmt.Sprintf(":%d", cfg.HttpPort), Handler: h}
@@ -501,7 +516,17 @@ func (p *PromPusher) Stop(ctx context.Context) error {
 	return nil
 }
 
-func Gen(proxy *bellman.Proxy, apiKeyConfigs map[string]ApiKeyConfig, rateLimiter *RateLimiter) func(r chi.Router) {
+// traceLogger returns the logger with the trace id of the request, and echoes the trace header, if sent by the client
+func traceLogger(w http.ResponseWriter, r *http.Request) *slog.Logger {
+	traceID := r.Header.Get(bellman.TraceHeader)
+	if traceID == "" {
+		return logger
+	}
+	w.Header().Set(bellman.TraceHeader, traceID)
+	return logger.With("trace_id", traceID)
+}
+
+func Gen(proxy *bellman.Proxy, apiKeyConfigs map[string]ApiKeyConfig, rateLimiter *RateLimiter, files *FileStore) func(r chi.Router) {
 
 	var reqCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
@@ -543,7 +568,38 @@ func Gen(proxy *bellman.Proxy, apiKeyConfigs map[string]ApiKeyConfig, rateLimite
 	return func(r chi.Router) {
 		r.Use(auth(apiKeyConfigs, featureTypeGen))
 
+		// Large prompt payloads are uploaded as multipart and referred to by the returned uri in gen requests
+		r.Post("/files", func(w http.ResponseWriter, r *http.Request) {
+			// bounds the multipart body, a file larger than the store could never be stored
+			r.Body = http.MaxBytesReader(w, r.Body, files.maxBytes+1<<20)
+			file, header, err := r.FormFile("file")
+			if err != nil {
+				err = fmt.Errorf("could not read file, %w", err)
+				httpErr(w, err, http.StatusBadRequest)
+				return
+			}
+			defer file.Close()
+			data, err := io.ReadAll(file)
+			if err != nil {
+				err = fmt.Errorf("could not read file, %w", err)
+				httpErr(w, err, http.StatusBadRequest)
+				return
+			}
+
+			uri, err := files.Put(header.Header.Get("Content-Type"), data)
+			if err != nil {
+				httpErr(w, err, http.StatusInsufficientStorage)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			_ = json.NewEncoder(w).Encode(struct {
+				Uri string `json:"uri"`
+			}{Uri: uri})
+		})
+
 		r.Post("/", func(w http.ResponseWriter, r *http.Request) {
+			logger := traceLogger(w, r)
 
 			body, err := io.ReadAll(r.Body)
 			if err != nil {
@@ -559,6 +615,12 @@ func Gen(proxy *bellman.Proxy, apiKeyConfigs map[string]ApiKeyConfig, rateLimite
 				httpErr(w, err, http.StatusBadRequest)
 				return
 			}
+			req.Prompts, err = files.Resolve(req.Prompts)
+			if err != nil {
+				err = fmt.Errorf("could not resolve payload, %w", err)
+				httpErr(w, err, http.StatusBadRequest)
+				return
+			}
 
 			apiKeyId := r.Context().Value("api-key-id").(string)
 			keyName := r.Context().Value("api-key-name").(string)
@@ -615,7 +677,45 @@ func Gen(proxy *bellman.Proxy, apiKeyConfigs map[string]ApiKeyConfig, rateLimite
 
 		})
 
+		r.Post("/count", func(w http.ResponseWriter, r *http.Request) {
+			logger := traceLogger(w, r)
+
+			var req gen.FullRequest
+			err := json.NewDecoder(r.Body).Decode(&req)
+			if err != nil {
+				err = fmt.Errorf("could not decode request, %w", err)
+				httpErr(w, err, http.StatusBadRequest)
+				return
+			}
+			req.Prompts, err = files.Resolve(req.Prompts)
+			if err != nil {
+				err = fmt.Errorf("could not resolve payload, %w", err)
+				httpErr(w, err, http.StatusBadRequest)
+				return
+			}
+
+			generator, err := proxy.Gen(req.Model)
+			if err != nil {
+				err = fmt.Errorf("could not get generator, %w", err)
+				httpErr(w, err, http.StatusInternalServerError)
+				return
+			}
+
+			tokens, err := generator.SetConfig(req.Request).WithContext(r.Context()).CountTokens(req.Prompts...)
+			if err != nil {
+				logger.Error("gen count request", "err", err, "model", req.Model.FQN())
+				err = fmt.Errorf("could not count tokens, %w", err)
+				httpErr(w, err, http.StatusInternalServerError)
+				return
+			}
+
+			logger.Info("gen count request", "model", req.Model.FQN(), "tokens", tokens)
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(gen.CountResponse{Tokens: tokens})
+		})
+
 		r.Post("/stream", func(w http.ResponseWriter, r *http.Request) {
+			logger := traceLogger(w, r)
 			body, err := io.ReadAll(r.Body)
 			if err != nil {
 				err = fmt.Errorf("could not read request, %w", err)
@@ -630,6 +730,12 @@ func Gen(proxy *bellman.Proxy, apiKeyConfigs map[string]ApiKeyConfig, rateLimite
 				httpErr(w, err, http.StatusBadRequest)
 				return
 			}
+			req.Prompts, err = files.Resolve(req.Prompts)
+			if err != nil {
+				err = fmt.Errorf("could not resolve payload, %w", err)
+				httpErr(w, err, http.StatusBadRequest)
+				return
+			}
 
 			// Force streaming mode
 			req.Stream = true
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/modfin/bellman/prompt"
+)
+
+// fileURIPrefix marks payload uris that refer to a file uploaded to this server
+const fileURIPrefix = "bellman://files/"
+
+const fileTTL = 30 * time.Minute
+
+// ErrFileStoreFull is returned by Put when the file does not fit in the store, until stored files expire
+var ErrFileStoreFull = errors.New("file store is full")
+
+type storedFile struct {
+	mime    string
+	data    []byte
+	expires time.Time
+}
+
+// FileStore keeps uploaded prompt payloads in memory, until they expire, so that large payloads can be sent as
+// multipart instead of base64 encoded in the JSON request. The total size of the stored files is bounded by maxBytes
+type FileStore struct {
+	mu       sync.Mutex
+	files    map[string]storedFile
+	ttl      time.Duration
+	maxBytes int64
+	size     int64
+}
+
+func NewFileStore(ttl time.Duration, maxBytes int64) *FileStore {
+	return &FileStore{files: map[string]storedFile{}, ttl: ttl, maxBytes: maxBytes}
+}
+
+// Put stores the file and returns the uri to use as payload uri in prompts. ErrFileStoreFull is returned if the file
+// does not fit in the store
+func (s *FileStore) Put(mime string, data []byte) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.evict(time.Now())
+	if s.size+int64(len(data)) > s.maxBytes {
+		return "", fmt.Errorf("%w, %d of %d bytes used", ErrFileStoreFull, s.size, s.maxBytes)
+	}
+	id := uuid.New().String()
+	s.files[id] = storedFile{mime: mime, data: data, expires: time.Now().Add(s.ttl)}
+	s.size += int64(len(data))
+	return fileURIPrefix + id, nil
+}
+
+// EvictExpired drops the expired files, run it periodically so that memory is freed also without new uploads
+func (s *FileStore) EvictExpired() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.evict(time.Now())
+}
+
+func (s *FileStore) evict(now time.Time) {
+	for id, f := range s.files {
+		if now.After(f.expires) {
+			delete(s.files, id)
+			s.size -= int64(len(f.data))
+		}
+	}
+}
+
+// Resolve replaces payload uris of uploaded files by the inline file data. Prompts are copied, not modified.
+func (s *FileStore) Resolve(prompts []prompt.Prompt) ([]prompt.Prompt, error) {
+	var res []prompt.Prompt
+	for i, p := range prompts {
+		if p.Payload == nil || !strings.HasPrefix(p.Payload.Uri, fileURIPrefix) {
+			continue
+		}
+		id := strings.TrimPrefix(p.Payload.Uri, fileURIPrefix)
+		s.mu.Lock()
+		f, ok := s.files[id]
+		s.mu.Unlock()
+		if !ok || time.Now().After(f.expires) {
+			return nil, fmt.Errorf("file %s not found or expired", id)
+		}
+		if res == nil {
+			res = append([]prompt.Prompt{}, prompts...)
+		}
+		mime := p.Payload.Mime
+		if mime == "" {
+			mime = f.mime
+		}
+		p.Payload = &prompt.Payload{Mime: mime, Data: base64.StdEncoding.EncodeToString(f.data)}
+		res[i] = p
+	}
+	if res == nil {
+		return prompts, nil
+	}
+	return res, nil
+}
@@ -4,28 +4,55 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"mime/multipart"
 	"net"
 	"net/http"
+	"net/textproto"
 	"net/url"
 	"sync/atomic"
+	"time"
 
+	"github.com/modfin/bellman/metrics"
+	"github.com/modfin/bellman/models"
 	"github.com/modfin/bellman/models/embed"
 	"github.com/modfin/bellman/models/gen"
+	"github.com/modfin/bellman/models/limit"
 	"github.com/modfin/bellman/prompt"
 	"github.com/modfin/bellman/tools"
 )
 
 const Provider = "Bellman"
 
+// TraceHeader carries the trace id of a request, see gen.Generator.WithTraceID
+const TraceHeader = "X-Bellman-Trace"
+
 type Bellman struct {
 	Log *slog.Logger `json:"-"`
 	url string
 	key Key
+
+	streamBufferSize int               // buffer size of stream channels
+	streamTransport  http.RoundTripper // transport used for streaming requests, defaults to an uncompressed transport
+
+	payloadUploadThreshold int // payloads larger than this, in bytes, are uploaded as multipart, 0 disables uploads
+	embedBatchSize         int // max number of texts per embed request in EmbedTexts
+
+	httpClient *http.Client // client of all non-streaming requests, defaults to http.DefaultClient
+	userAgent  string       // User-Agent header of all requests, the Go default if empty
+
+	rps           float64        // requests per second, see WithRateLimit
+	burst         int            // burst of the rate limit, see WithRateLimit
+	maxConcurrent int            // see WithMaxConcurrent
+	limiter       *limit.Limiter // gates Prompt, Stream and Embed calls, nil if not limited
+	breaker       *limit.Breaker // fails Prompt, Stream and Embed calls fast during outages, nil if disabled
+
+	metrics metrics.Metrics // instruments Prompt, Stream and Embed calls, nil if not instrumented
 }
 
 func (g *Bellman) Provider() string {
@@ -41,12 +68,144 @@ func (l Key) String() string {
 	return l.Name + "_" + l.Token
 }
 
-func New(url string, key Key) *Bellman {
-	return &Bellman{
-		url: url,
-		key: key,
+// Option configures the client created by New
+type Option func(*Bellman)
+
+// WithHTTPClient sets the client of all non-streaming requests, e.g. to set TLS settings, an outbound proxy or tune
+// keep-alive. Streaming requests use its Transport, but not its Timeout, unless SetStreamTransport is used
+func WithHTTPClient(client *http.Client) Option {
+	return func(b *Bellman) {
+		b.httpClient = client
+	}
+}
+
+// WithTimeout sets the timeout of all non-streaming requests, without modifying a client set by WithHTTPClient
+func WithTimeout(timeout time.Duration) Option {
+	return func(b *Bellman) {
+		client := http.Client{}
+		if b.httpClient != nil {
+			client = *b.httpClient
+		}
+		client.Timeout = timeout
+		b.httpClient = &client
+	}
+}
+
+// WithUserAgent sets the User-Agent header of all requests
+func WithUserAgent(userAgent string) Option {
+	return func(b *Bellman) {
+		b.userAgent = userAgent
 	}
+}
+
+// WithRateLimit limits Prompt, Stream and Embed calls to rps requests per second, with bursts of up to burst
+// requests. Calls wait for their turn, or until their context is done, and the wait is added to the ThrottleWaitMs of
+// the response metadata
+func WithRateLimit(rps float64, burst int) Option {
+	return func(b *Bellman) {
+		b.rps = rps
+		b.burst = burst
+	}
+}
+
+// WithMaxConcurrent limits the number of concurrent Prompt, Stream and Embed calls, a stream holds its slot until it
+// is closed
+func WithMaxConcurrent(n int) Option {
+	return func(b *Bellman) {
+		b.maxConcurrent = n
+	}
+}
 
+// WithMetrics reports the latency, tokens and errors of Prompt, Stream and Embed calls to m, see metrics.Metrics
+func WithMetrics(m metrics.Metrics) Option {
+	return func(b *Bellman) {
+		b.metrics = m
+	}
+}
+
+// WithCircuitBreaker fails Prompt, Stream and Embed calls fast, with limit.ErrCircuitOpen, after threshold consecutive
+// upstream errors, i.e. transport errors, 408, 429 and 5xx. A trial call is let through once the cooldown has passed
+func WithCircuitBreaker(threshold int, cooldown time.Duration) Option {
+	return func(b *Bellman) {
+		b.breaker = limit.NewBreaker(threshold, cooldown)
+	}
+}
+
+func New(url string, key Key, opts ...Option) *Bellman {
+	b := &Bellman{
+		url:              url,
+		key:              key,
+		streamBufferSize: 100,
+
+		embedBatchSize: DefaultEmbedBatchSize,
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	b.limiter = limit.New(b.rps, b.burst, b.maxConcurrent)
+	return b
+}
+
+// wait waits for the limiter, logging the time spent waiting
+func (g *Bellman) wait(ctx context.Context, log func(msg string, args ...any), reqc int64) (func(), time.Duration, error) {
+	release, waited, err := g.limiter.Wait(ctx)
+	if err != nil {
+		return nil, waited, fmt.Errorf("could not wait for rate limit; %w", err)
+	}
+	if waited > 0 {
+		log("[limit] throttled", "request", reqc, "wait", waited)
+	}
+	return release, waited, nil
+}
+
+// do sends a request to be proxied upstream, failing fast while the circuit breaker is open. Transport errors and
+// retryable statuses count as failures of the breaker, any other response as a success
+func (g *Bellman) do(client *http.Client, req *http.Request) (*http.Response, error) {
+	if err := g.breaker.Allow(); err != nil {
+		return nil, err
+	}
+	res, err := client.Do(req)
+	switch {
+	case err != nil && errors.Is(err, context.Canceled):
+		g.breaker.Release()
+	case err != nil:
+		g.breaker.Failure()
+	case res.StatusCode == http.StatusRequestTimeout || res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500:
+		g.breaker.Failure()
+	default:
+		g.breaker.Success()
+	}
+	return res, err
+}
+
+// observe reports a request to the metrics, with the tokens of its metadata if it succeeded or its error otherwise
+func (g *Bellman) observe(op string, model string, start time.Time, metadata *models.Metadata, err error) {
+	m := metrics.OrNop(g.metrics)
+	m.ObserveLatency(op, model, time.Since(start))
+	if err != nil {
+		m.IncError(op, model, err)
+		return
+	}
+	if metadata == nil {
+		return
+	}
+	m.AddTokens(model, metrics.TokensInput, metadata.InputTokens)
+	m.AddTokens(model, metrics.TokensOutput, metadata.OutputTokens)
+	m.AddTokens(model, metrics.TokensThinking, metadata.ThinkingTokens)
+}
+
+func (g *Bellman) client() *http.Client {
+	if g.httpClient == nil {
+		return http.DefaultClient
+	}
+	return g.httpClient
+}
+
+func (g *Bellman) setHeaders(req *http.Request) {
+	req.Header.Set("Authorization", "Bearer "+g.key.String())
+	if g.userAgent != "" {
+		req.Header.Set("User-Agent", g.userAgent)
+	}
 }
 
 func (g *Bellman) log(msg string, args ...any) {
@@ -67,8 +226,8 @@ func (v *Bellman) EmbedModels() ([]embed.Model, error) {
 	if err != nil {
 		return nil, fmt.Errorf("could not create bellman request; %w", err)
 	}
-	req.Header.Set("Authorization", "Bearer "+v.key.String())
-	res, err := http.DefaultClient.Do(req)
+	v.setHeaders(req)
+	res, err := v.client().Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("could not post bellman request to %s; %w", u, err)
 	}
@@ -79,7 +238,7 @@ func (v *Bellman) EmbedModels() ([]embed.Model, error) {
 		return nil, fmt.Errorf("could not read bellman response; %w", err)
 	}
 	if res.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status code %d; %s", res.StatusCode, string(body))
+		return nil, fmt.Errorf("could not list embed models; %w", newAPIError(res, body))
 	}
 
 	var models []embed.Model
@@ -100,8 +259,8 @@ func (v *Bellman) GenModels() ([]gen.Model, error) {
 	if err != nil {
 		return nil, fmt.Errorf("could not create bellman request; %w", err)
 	}
-	req.Header.Set("Authorization", "Bearer "+v.key.String())
-	res, err := http.DefaultClient.Do(req)
+	v.setHeaders(req)
+	res, err := v.client().Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("could not post bellman request to %s; %w", u, err)
 	}
@@ -112,7 +271,7 @@ func (v *Bellman) GenModels() ([]gen.Model, error) {
 		return nil, fmt.Errorf("could not read bellman response; %w", err)
 	}
 	if res.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status code %d; %s", res.StatusCode, string(body))
+		return nil, fmt.Errorf("could not list gen models; %w", newAPIError(res, body))
 	}
 
 	var models []gen.Model
@@ -124,8 +283,16 @@ func (v *Bellman) GenModels() ([]gen.Model, error) {
 	return models, nil
 }
 
-func (v *Bellman) Embed(request *embed.Request) (*embed.Response, error) {
+func (v *Bellman) Embed(request *embed.Request) (result *embed.Response, err error) {
 	var reqc = atomic.AddInt64(&bellmanRequestNo, 1)
+	start := time.Now()
+	defer func() {
+		var metadata *models.Metadata
+		if result != nil {
+			metadata = &result.Metadata
+		}
+		v.observe(metrics.OpEmbed, request.Model.FQN(), start, metadata, err)
+	}()
 
 	u, err := url.JoinPath(v.url, "embed")
 	if err != nil {
@@ -141,13 +308,18 @@ func (v *Bellman) Embed(request *embed.Request) (*embed.Response, error) {
 	if ctx == nil {
 		ctx = context.Background()
 	}
+	release, waited, err := v.wait(ctx, v.log, reqc)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
 	req, err := http.NewRequestWithContext(ctx, "POST", u, bytes.NewReader(body))
 	if err != nil {
 		return nil, fmt.Errorf("could not create bellman request; %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+v.key.String())
-	res, err := http.DefaultClient.Do(req)
+	v.setHeaders(req)
+	res, err := v.do(v.client(), req)
 	if err != nil {
 		return nil, fmt.Errorf("could not post bellman request to %s; %w", u, err)
 	}
@@ -158,7 +330,7 @@ func (v *Bellman) Embed(request *embed.Request) (*embed.Response, error) {
 		return nil, fmt.Errorf("could not read bellman response; %w", err)
 	}
 	if res.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status code %d; %s", res.StatusCode, string(body))
+		return nil, fmt.Errorf("could not embed; %w", newAPIError(res, body))
 	}
 
 	var response embed.Response
@@ -168,12 +340,21 @@ func (v *Bellman) Embed(request *embed.Request) (*embed.Response, error) {
 		return nil, fmt.Errorf("could not unmarshal bellman response; %w", err)
 	}
 
+	response.Metadata.ThrottleWaitMs += waited.Milliseconds()
 	v.log("[embed] response", "request", reqc, "model", request.Model.FQN(), "token-total", response.Metadata.TotalTokens)
 
 	return &response, nil
 }
-func (v *Bellman) EmbedDocument(request *embed.DocumentRequest) (*embed.DocumentResponse, error) {
+func (v *Bellman) EmbedDocument(request *embed.DocumentRequest) (result *embed.DocumentResponse, err error) {
 	var reqc = atomic.AddInt64(&bellmanRequestNo, 1)
+	start := time.Now()
+	defer func() {
+		var metadata *models.Metadata
+		if result != nil {
+			metadata = &result.Metadata
+		}
+		v.observe(metrics.OpEmbed, request.Model.FQN(), start, metadata, err)
+	}()
 
 	u, err := url.JoinPath(v.url, "embed", "document")
 	if err != nil {
@@ -189,13 +370,18 @@ func (v *Bellman) EmbedDocument(request *embed.DocumentRequest) (*embed.Document
 	if ctx == nil {
 		ctx = context.Background()
 	}
+	release, waited, err := v.wait(ctx, v.log, reqc)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
 	req, err := http.NewRequestWithContext(ctx, "POST", u, bytes.NewReader(body))
 	if err != nil {
 		return nil, fmt.Errorf("could not create bellman request; %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+v.key.String())
-	res, err := http.DefaultClient.Do(req)
+	v.setHeaders(req)
+	res, err := v.do(v.client(), req)
 	if err != nil {
 		return nil, fmt.Errorf("could not post bellman request to %s; %w", u, err)
 	}
@@ -206,7 +392,7 @@ func (v *Bellman) EmbedDocument(request *embed.DocumentRequest) (*embed.Document
 		return nil, fmt.Errorf("could not read bellman response; %w", err)
 	}
 	if res.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status code %d; %s", res.StatusCode, string(body))
+		return nil, fmt.Errorf("could not embed document; %w", newAPIError(res, body))
 	}
 
 	var response embed.DocumentResponse
@@ -216,11 +402,41 @@ func (v *Bellman) EmbedDocument(request *embed.DocumentRequest) (*embed.Document
 		return nil, fmt.Errorf("could not unmarshal bellman response; %w", err)
 	}
 
+	response.Metadata.ThrottleWaitMs += waited.Milliseconds()
 	v.log("[embed] response", "request", reqc, "model", request.Model.FQN(), "token-total", response.Metadata.TotalTokens)
 
 	return &response, nil
 }
 
+// DefaultEmbedBatchSize is the max number of texts per embed request in EmbedTexts, within the limits of the providers
+const DefaultEmbedBatchSize = 96
+
+// SetEmbedBatchSize sets the max number of texts per embed request in EmbedTexts, values < 1 are ignored
+func (v *Bellman) SetEmbedBatchSize(size int) *Bellman {
+	if size > 0 {
+		v.embedBatchSize = size
+	}
+	return v
+}
+
+// EmbedTexts embeds the texts, split into batches of at most the embed batch size, and returns the vectors in the
+// order of the texts
+func (v *Bellman) EmbedTexts(ctx context.Context, model embed.Model, texts []string) ([][]float32, error) {
+	vectors := make([][]float32, 0, len(texts))
+	for start := 0; start < len(texts); start += v.embedBatchSize {
+		batch := texts[start:min(start+v.embedBatchSize, len(texts))]
+		response, err := v.Embed(embed.NewManyRequest(ctx, model, batch))
+		if err != nil {
+			return nil, fmt.Errorf("could not embed texts %d to %d; %w", start, start+len(batch), err)
+		}
+		if len(response.Embeddings) != len(batch) {
+			return nil, fmt.Errorf("expected %d embeddings, got %d", len(batch), len(response.Embeddings))
+		}
+		vectors = append(vectors, response.AsFloat32()...)
+	}
+	return vectors, nil
+}
+
 func (a *Bellman) Generator(options ...gen.Option) *gen.Generator {
 	var gen = &gen.Generator{
 		Prompter: &generator{
@@ -239,6 +455,29 @@ func (g *Bellman) SetLogger(logger *slog.Logger) *Bellman {
 	return g
 }
 
+// SetStreamBufferSize sets the buffer size of the channel returned by Stream, 0 means unbuffered. A larger buffer
+// lets the stream read ahead of slow consumers
+func (g *Bellman) SetStreamBufferSize(size int) *Bellman {
+	g.streamBufferSize = max(size, 0)
+	return g
+}
+
+// SetStreamTransport sets the transport used for streaming requests, e.g. to enable compression or tune connection
+// pooling. By default, a new transport with compression disabled is created per stream
+func (g *Bellman) SetStreamTransport(transport http.RoundTripper) *Bellman {
+	g.streamTransport = transport
+	return g
+}
+
+// SetPayloadUploadThreshold sets the payload size, in bytes, above which prompt payloads are uploaded to the files
+// endpoint as multipart and replaced by a uri reference, instead of being sent base64 encoded in the request. Smaller
+// payloads are sent inline. Uploads are opt-in, the default 0 sends all payloads inline. Payloads are also sent inline
+// if the proxy has no files endpoint, i.e. responds 404
+func (g *Bellman) SetPayloadUploadThreshold(size int) *Bellman {
+	g.payloadUploadThreshold = max(size, 0)
+	return g
+}
+
 type generator struct {
 	bellman *Bellman
 	request gen.Request
@@ -248,29 +487,118 @@ func (g *generator) SetRequest(request gen.Request) {
 	g.request = request
 }
 
-func (g *generator) Prompt(conversation ...prompt.Prompt) (*gen.Response, error) {
+// log logs with the trace id of the request, if any
+func (g *generator) log(msg string, args ...any) {
+	if g.request.TraceID != "" {
+		args = append(args, "trace_id", g.request.TraceID)
+	}
+	g.bellman.log(msg, args...)
+}
+
+func (g *generator) setHeaders(req *http.Request) {
+	g.bellman.setHeaders(req)
+	if g.request.TraceID != "" {
+		req.Header.Set(TraceHeader, g.request.TraceID)
+	}
+}
+
+// CountTokens counts the input tokens of the conversation by the proxy, see gen.Generator.CountTokens. Payloads are
+// sent inline, since the count is not worth an upload, and the tokens are estimated, see gen.EstimateTokens, if the
+// proxy has no count endpoint
+func (g *generator) CountTokens(conversation ...prompt.Prompt) (int, error) {
+	var reqc = atomic.AddInt64(&bellmanRequestNo, 1)
+
+	u, err := url.JoinPath(g.bellman.url, "gen", "count")
+	if err != nil {
+		return 0, fmt.Errorf("could not join url %s; %w", g.bellman.url, err)
+	}
+	ctx := g.request.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	config, conversation := g.request.WithPTCSystemFragment(conversation)
+	body, err := json.Marshal(gen.FullRequest{Request: config, Prompts: conversation})
+	if err != nil {
+		return 0, fmt.Errorf("could not marshal bellman request; %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", u, bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("could not create bellman request; %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	g.setHeaders(req)
+
+	release, _, err := g.bellman.wait(ctx, g.log, reqc)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	res, err := g.bellman.do(g.bellman.client(), req)
+	if err != nil {
+		return 0, fmt.Errorf("could not post bellman request to %s; %w", u, err)
+	}
+	defer res.Body.Close()
+
+	body, err = io.ReadAll(res.Body)
+	if err != nil {
+		return 0, fmt.Errorf("could not read bellman response; %w", err)
+	}
+	if res.StatusCode == http.StatusNotFound {
+		g.log("[gen] count endpoint not found, estimating tokens", "request", reqc, "url", u)
+		return gen.EstimateTokens(config, conversation...), nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("could not count tokens; %w", newAPIError(res, body))
+	}
+	var count gen.CountResponse
+	err = json.Unmarshal(body, &count)
+	if err != nil {
+		return 0, fmt.Errorf("could not unmarshal bellman response; %w", err)
+	}
+	g.log("[gen] count tokens", "request", reqc, "model", g.request.Model.FQN(), "tokens", count.Tokens)
+	return count.Tokens, nil
+}
+
+func (g *generator) Prompt(conversation ...prompt.Prompt) (result *gen.Response, err error) {
 	var reqc = atomic.AddInt64(&bellmanRequestNo, 1)
+	start := time.Now()
+	defer func() {
+		var metadata *models.Metadata
+		if result != nil {
+			metadata = &result.Metadata
+		}
+		g.bellman.observe(metrics.OpPrompt, g.request.Model.FQN(), start, metadata, err)
+	}()
 
 	u, err := url.JoinPath(g.bellman.url, "gen")
 	if err != nil {
 		return nil, fmt.Errorf("could not join url %s; %w", g.bellman.url, err)
 	}
-	request := gen.FullRequest{
-		Request: g.request,
-		Prompts: conversation,
+	ctx := g.request.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	conversation, err = g.uploadPayloads(ctx, conversation)
+	if err != nil {
+		return nil, err
 	}
 
 	// add PTC system fragment to request
-	if g.request.PTCSystemFragment != nil {
-		request.SystemPrompt += *g.request.PTCSystemFragment
+	config, conversation := g.request.WithPTCSystemFragment(conversation)
+	request := gen.FullRequest{
+		Request: config,
+		Prompts: conversation,
 	}
 
 	toolBelt := map[string]*tools.Tool{}
-	for _, tool := range request.Tools {
-		toolBelt[tool.Name] = &tool
+	for i := range request.Tools {
+		toolBelt[request.Tools[i].Name] = &request.Tools[i]
 	}
 
-	g.bellman.log("[gen] request",
+	g.log("[gen] request",
 		"request", reqc,
 		"model", g.request.Model.FQN(),
 		"tools", len(g.request.Tools) > 0,
@@ -288,19 +616,19 @@ func (g *generator) Prompt(conversation ...prompt.Prompt) (*gen.Response, error)
 		return nil, fmt.Errorf("could not marshal bellman request; %w", err)
 	}
 
-	ctx := g.request.Context
-	if ctx == nil {
-		ctx = context.Background()
-	}
-
 	req, err := http.NewRequestWithContext(ctx, "POST", u, bytes.NewReader(body))
 	if err != nil {
 		return nil, fmt.Errorf("could not create bellman request; %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+g.bellman.key.String())
+	g.setHeaders(req)
 
-	res, err := http.DefaultClient.Do(req)
+	release, waited, err := g.bellman.wait(ctx, g.log, reqc)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	res, err := g.bellman.do(g.bellman.client(), req)
 	if err != nil {
 		return nil, fmt.Errorf("could not post bellman request to %s; %w", u, err)
 	}
@@ -311,16 +639,17 @@ func (g *generator) Prompt(conversation ...prompt.Prompt) (*gen.Response, error)
 		return nil, fmt.Errorf("could not read bellman response; %w", err)
 	}
 	if res.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status code %d; %s", res.StatusCode, string(body))
+		return nil, fmt.Errorf("could not prompt; %w", newAPIError(res, body))
 	}
 	response := gen.Response{}
 	err = json.Unmarshal(body, &response)
 	if err != nil {
-		g.bellman.log("[gen] unmarshal response error", "error", err, "body", string(body))
+		g.log("[gen] unmarshal response error", "error", err, "body", string(body))
 		return nil, fmt.Errorf("could not unmarshal bellman response; %w", err)
 	}
+	response.Metadata.ThrottleWaitMs += waited.Milliseconds()
 
-	g.bellman.log("[gen] response",
+	g.log("[gen] response",
 		"request", reqc,
 		"model", g.request.Model.FQN(),
 		"token-input", response.Metadata.InputTokens,
@@ -340,8 +669,25 @@ func (g *generator) Prompt(conversation ...prompt.Prompt) (*gen.Response, error)
 
 }
 
-func (g *generator) Stream(conversation ...prompt.Prompt) (<-chan *gen.StreamResponse, error) {
+func (g *generator) Stream(conversation ...prompt.Prompt) (_ <-chan *gen.StreamResponse, err error) {
 	var reqc = atomic.AddInt64(&bellmanRequestNo, 1)
+	start := time.Now()
+	defer func() {
+		// successful streams are observed by their metadata
+		if err != nil {
+			g.bellman.observe(metrics.OpStream, g.request.Model.FQN(), start, nil, err)
+		}
+	}()
+
+	ctx := g.request.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	conversation, err = g.uploadPayloads(ctx, conversation)
+	if err != nil {
+		return nil, err
+	}
 
 	// Build streaming request with proper formatting
 	request, toolBelt, err := g.buildStreamingRequest(conversation)
@@ -354,7 +700,7 @@ func (g *generator) Stream(conversation ...prompt.Prompt) (<-chan *gen.StreamRes
 		return nil, fmt.Errorf("could not get streaming endpoint: %w", err)
 	}
 
-	g.bellman.log("[gen] stream request",
+	g.log("[gen] stream request",
 		"request", reqc,
 		"model", g.request.Model.FQN(),
 		"tools", len(g.request.Tools) > 0,
@@ -373,65 +719,84 @@ func (g *generator) Stream(conversation ...prompt.Prompt) (<-chan *gen.StreamRes
 		return nil, fmt.Errorf("could not marshal bellman request; %w", err)
 	}
 
-	ctx := g.request.Context
-	if ctx == nil {
-		ctx = context.Background()
-	}
-
 	req, err := http.NewRequestWithContext(ctx, "POST", u, bytes.NewReader(body))
 	if err != nil {
 		return nil, fmt.Errorf("could not create bellman request; %w", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+g.bellman.key.String())
+	g.setHeaders(req)
 	req.Header.Set("Accept", "text/event-stream")
 	req.Header.Set("Cache-Control", "no-cache")
 	req.Header.Set("Connection", "keep-alive")
 	req.Header.Set("X-Requested-With", "XMLHttpRequest")
 
+	release, waited, err := g.bellman.wait(ctx, g.log, reqc)
+	if err != nil {
+		return nil, err
+	}
 	client := g.createStreamingHTTPClient()
-	res, err := client.Do(req)
+	res, err := g.bellman.do(client, req)
 	if err != nil {
+		release()
 		return nil, g.handleStreamingError(fmt.Errorf("could not post bellman request to %s; %w", u, err), reqc)
 	}
 
 	if res.StatusCode != http.StatusOK {
+		release()
 		b, readErr := io.ReadAll(res.Body)
 		res.Body.Close()
 		if readErr != nil {
 			return nil, g.handleStreamingError(fmt.Errorf("unexpected status code, %d, and failed to read response body: %w", res.StatusCode, readErr), reqc)
 		}
-		return nil, g.handleStreamingError(fmt.Errorf("unexpected status code, %d, err: {%s}", res.StatusCode, string(b)), reqc)
+		return nil, g.handleStreamingError(newAPIError(res, b), reqc)
 	}
 
 	reader := bufio.NewReader(res.Body)
-	stream := make(chan *gen.StreamResponse, 100)
+	stream := make(chan *gen.StreamResponse, g.bellman.streamBufferSize)
 
 	go func() {
+		defer release()
 		defer res.Body.Close()
 		defer close(stream)
 
-		defer func() {
-			stream <- &gen.StreamResponse{
-				Type: gen.TYPE_EOF,
-			}
-		}()
-
 		// Handle context cancellation
 		ctx := g.request.Context
 		if ctx == nil {
 			ctx = context.Background()
 		}
 
+		// send blocks until the consumer reads or the context is cancelled, so the goroutine never outlives a
+		// cancelled consumer
+		send := func(resp *gen.StreamResponse) bool {
+			select {
+			case stream <- resp:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		defer func() {
+			if ctx.Err() == nil {
+				send(&gen.StreamResponse{
+					Type: gen.TYPE_EOF,
+				})
+			}
+		}()
+
 		for {
 			// Check for context cancellation
 			select {
 			case <-ctx.Done():
-				g.bellman.log("[gen] stream cancelled by context", "request", reqc, "error", ctx.Err())
-				stream <- &gen.StreamResponse{
+				g.log("[gen] stream cancelled by context", "request", reqc, "error", ctx.Err())
+				// best effort, the consumer might not be reading anymore
+				select {
+				case stream <- &gen.StreamResponse{
 					Type:    gen.TYPE_ERROR,
 					Content: fmt.Sprintf("stream cancelled: %v", ctx.Err()),
+				}:
+				default:
 				}
 				return
 			default:
@@ -442,18 +807,18 @@ func (g *generator) Stream(conversation ...prompt.Prompt) (<-chan *gen.StreamRes
 			if err != nil {
 				// If there's an error, check if it's EOF (end of stream)
 				if errors.Is(err, http.ErrBodyReadAfterClose) {
-					g.bellman.log("[gen] stream closed by server (Read after close)", "request", reqc)
+					g.log("[gen] stream closed by server (Read after close)", "request", reqc)
 					break
 				}
 				if errors.Is(err, io.EOF) {
-					g.bellman.log("[gen] stream ended (EOF)", "request", reqc)
+					g.log("[gen] stream ended (EOF)", "request", reqc)
 					break
 				}
-				g.bellman.log("[gen] error reading from stream", "request", reqc, "error", err)
-				stream <- &gen.StreamResponse{
+				g.log("[gen] error reading from stream", "request", reqc, "error", err)
+				send(&gen.StreamResponse{
 					Type:    gen.TYPE_ERROR,
 					Content: fmt.Sprintf("error reading stream: %v", err),
-				}
+				})
 				break // Exit the loop on any other error
 			}
 
@@ -461,40 +826,41 @@ func (g *generator) Stream(conversation ...prompt.Prompt) (<-chan *gen.StreamRes
 				continue
 			}
 			if !bytes.HasPrefix(line, []byte("data: ")) {
-				stream <- &gen.StreamResponse{
+				send(&gen.StreamResponse{
 					Type:    gen.TYPE_ERROR,
 					Content: "expected 'data' header from sse",
-				}
+				})
 				break
 			}
 			line = line[6:] // removing header
 
 			if bytes.Equal(line, []byte("[DONE]")) {
-				g.bellman.log("[gen] stream completed", "request", reqc)
+				g.log("[gen] stream completed", "request", reqc)
 				break // Exit the loop on end of stream
 			}
 
 			var streamResp gen.StreamResponse
 			err = json.Unmarshal(line, &streamResp)
 			if err != nil {
-				g.bellman.log("[gen] could not unmarshal stream chunk", "request", reqc, "error", err, "line", string(line))
-				stream <- &gen.StreamResponse{
+				g.log("[gen] could not unmarshal stream chunk", "request", reqc, "error", err, "line", string(line))
+				send(&gen.StreamResponse{
 					Type:    gen.TYPE_ERROR,
 					Content: fmt.Sprintf("could not unmarshal stream chunk: %v", err),
-				}
+				})
 				break
 			}
 
 			// Process the streaming response
 			g.processStreamingResponse(&streamResp, toolBelt, reqc)
+			if streamResp.Type == gen.TYPE_METADATA && streamResp.Metadata != nil {
+				streamResp.Metadata.ThrottleWaitMs += waited.Milliseconds()
+				g.bellman.observe(metrics.OpStream, g.request.Model.FQN(), start, streamResp.Metadata, nil)
+			}
 
 			// Send the response to the stream
-			select {
-			case stream <- &streamResp:
-				// Successfully sent
-			case <-ctx.Done():
+			if !send(&streamResp) {
 				// Context was cancelled while trying to send
-				g.bellman.log("[gen] stream cancelled while sending response", "request", reqc, "error", ctx.Err())
+				g.log("[gen] stream cancelled while sending response", "request", reqc, "error", ctx.Err())
 				return
 			}
 		}
@@ -505,19 +871,16 @@ func (g *generator) Stream(conversation ...prompt.Prompt) (<-chan *gen.StreamRes
 
 // buildStreamingRequest creates a properly formatted streaming request
 func (g *generator) buildStreamingRequest(conversation []prompt.Prompt) (gen.FullRequest, map[string]*tools.Tool, error) {
+	// add PTC system fragment to request
+	config, conversation := g.request.WithPTCSystemFragment(conversation)
 	request := gen.FullRequest{
-		Request: g.request,
+		Request: config,
 		Prompts: conversation,
 	}
 
 	// Ensure streaming is enabled
 	request.Stream = true
 
-	// add PTC system fragment to request
-	if g.request.PTCSystemFragment != nil {
-		request.SystemPrompt += *g.request.PTCSystemFragment
-	}
-
 	// Validate request parameters for streaming
 	if err := g.validateStreamingRequest(&request); err != nil {
 		return request, nil, err
@@ -525,8 +888,8 @@ func (g *generator) buildStreamingRequest(conversation []prompt.Prompt) (gen.Ful
 
 	// Build tool belt for tool call references
 	toolBelt := map[string]*tools.Tool{}
-	for _, tool := range request.Tools {
-		toolBelt[tool.Name] = &tool
+	for i := range request.Tools {
+		toolBelt[request.Tools[i].Name] = &request.Tools[i]
 	}
 
 	return request, toolBelt, nil
@@ -548,6 +911,18 @@ func (g *generator) validateStreamingRequest(request *gen.FullRequest) error {
 
 // createStreamingHTTPClient creates an HTTP client optimized for streaming
 func (g *generator) createStreamingHTTPClient() *http.Client {
+	if g.bellman.streamTransport != nil {
+		return &http.Client{
+			Transport: g.bellman.streamTransport,
+		}
+	}
+	// honor the transport of a custom client, e.g. its proxy, but not its timeout
+	if g.bellman.httpClient != nil && g.bellman.httpClient.Transport != nil {
+		return &http.Client{
+			Transport: g.bellman.httpClient.Transport,
+		}
+	}
+
 	// Use a longer timeout for streaming requests
 	transport := &http.Transport{
 		DisableCompression: true,  // Disable compression for streaming
@@ -567,7 +942,7 @@ func (g *generator) isRetryableError(err error) bool {
 	}
 
 	// Check for network-related errors that might be retryable
-	if errors.Is(err, context.DeadlineExceeded) {
+	if errors.Is(err, context.DeadlineExceeded) || IsRetryable(err) {
 		return true
 	}
 
@@ -583,11 +958,11 @@ func (g *generator) isRetryableError(err error) bool {
 // handleStreamingError handles streaming-specific errors
 func (g *generator) handleStreamingError(err error, reqc int64) error {
 	if g.isRetryableError(err) {
-		g.bellman.log("[gen] retryable streaming error", "request", reqc, "error", err)
+		g.log("[gen] retryable streaming error", "request", reqc, "error", err)
 		return fmt.Errorf("retryable streaming error: %w", err)
 	}
 
-	g.bellman.log("[gen] streaming error", "request", reqc, "error", err)
+	g.log("[gen] streaming error", "request", reqc, "error", err)
 	return fmt.Errorf("streaming error: %w", err)
 }
 
@@ -602,7 +977,7 @@ func (g *generator) processStreamingResponse(streamResp *gen.StreamResponse, too
 
 	// Log metrics if metadata is present
 	if streamResp.Type == gen.TYPE_METADATA && streamResp.Metadata != nil {
-		g.bellman.log("[gen] stream metrics",
+		g.log("[gen] stream metrics",
 			"request", reqc,
 			"model", g.request.Model.FQN(),
 			"token-input", streamResp.Metadata.InputTokens,
@@ -612,3 +987,104 @@ func (g *generator) processStreamingResponse(streamResp *gen.StreamResponse, too
 		)
 	}
 }
+
+// uploadPayloads uploads inline payloads above the upload threshold to the files endpoint and replaces them by the
+// returned uri. The conversation is copied, not modified. If the proxy has no files endpoint, i.e. the first upload
+// returns a 404, the payloads are sent inline. A 404 after payloads have been uploaded returns an error.
+func (g *generator) uploadPayloads(ctx context.Context, conversation []prompt.Prompt) ([]prompt.Prompt, error) {
+	threshold := g.bellman.payloadUploadThreshold
+	if threshold <= 0 {
+		return conversation, nil
+	}
+	var res []prompt.Prompt
+	for i, p := range conversation {
+		if p.Payload == nil || p.Payload.Data == "" || base64.StdEncoding.DecodedLen(len(p.Payload.Data)) <= threshold {
+			continue
+		}
+		data, err := base64.StdEncoding.DecodeString(p.Payload.Data)
+		if err != nil {
+			return nil, fmt.Errorf("could not decode payload; %w", err)
+		}
+		if len(data) <= threshold {
+			continue
+		}
+		uri, err := g.uploadFile(ctx, p.Payload.Mime, data)
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && apiErr.Status == http.StatusNotFound {
+			if res == nil {
+				g.log("[gen] files endpoint not found, sending payloads inline", "url", g.bellman.url)
+				return conversation, nil
+			}
+			g.log("[gen] files endpoint not found after uploading payloads", "url", g.bellman.url, "error", err)
+			return nil, err
+		}
+		if err != nil {
+			return nil, err
+		}
+		if res == nil {
+			res = append([]prompt.Prompt{}, conversation...)
+		}
+		p.Payload = &prompt.Payload{Mime: p.Payload.Mime, Uri: uri}
+		res[i] = p
+	}
+	if res == nil {
+		return conversation, nil
+	}
+	return res, nil
+}
+
+func (g *generator) uploadFile(ctx context.Context, mime string, data []byte) (string, error) {
+	u, err := url.JoinPath(g.bellman.url, "gen", "files")
+	if err != nil {
+		return "", fmt.Errorf("could not join url %s; %w", g.bellman.url, err)
+	}
+
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="file"; filename="payload"`)
+	header.Set("Content-Type", mime)
+	part, err := mw.CreatePart(header)
+	if err != nil {
+		return "", fmt.Errorf("could not create multipart file; %w", err)
+	}
+	if _, err := part.Write(data); err != nil {
+		return "", fmt.Errorf("could not write multipart file; %w", err)
+	}
+	if err := mw.Close(); err != nil {
+		return "", fmt.Errorf("could not close multipart body; %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", u, body)
+	if err != nil {
+		return "", fmt.Errorf("could not create upload request; %w", err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	g.setHeaders(req)
+
+	res, err := g.bellman.client().Do(req)
+	if err != nil {
+		return "", fmt.Errorf("could not upload payload to %s; %w", u, err)
+	}
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return "", fmt.Errorf("could not read upload response; %w", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("could not upload payload; %w", newAPIError(res, b))
+	}
+	var uploaded struct {
+		Uri string `json:"uri"`
+	}
+	if err := json.Unmarshal(b, &uploaded); err != nil {
+		return "", fmt.Errorf("could not unmarshal upload response; %w", err)
+	}
+	if uploaded.Uri == "" {
+		return "", fmt.Errorf("upload response has no uri")
+	}
+
+	g.log("[gen] uploaded payload", "mime", mime, "size", len(data), "uri", uploaded.Uri)
+	return uploaded.Uri, nil
+}
@@ -0,0 +1,618 @@
+package bellman_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/modfin/bellman"
+	"github.com/modfin/bellman/agent"
+	"github.com/modfin/bellman/metrics"
+	"github.com/modfin/bellman/models"
+	"github.com/modfin/bellman/models/embed"
+	"github.com/modfin/bellman/models/gen"
+	"github.com/modfin/bellman/models/limit"
+	"github.com/modfin/bellman/prompt"
+	"github.com/modfin/bellman/tools"
+)
+
+func TestStreamCancel(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; ; i++ {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(time.Millisecond):
+			}
+			fmt.Fprintf(w, "data: {\"type\":\"delta\",\"content\":\"%d\"}\n\n", i)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer srv.Close()
+
+	const bufferSize = 2
+	client := bellman.New(srv.URL, bellman.Key{Name: "test", Token: "test"}).SetStreamBufferSize(bufferSize)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := client.Generator().Model(gen.Model{Provider: "test", Name: "test"}).WithContext(ctx).Stream(prompt.AsUser("hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-stream
+
+	// stop reading, cancel and give the producer time to exit
+	cancel()
+	time.Sleep(100 * time.Millisecond)
+
+	// a terminated producer leaves at most the buffered responses before the channel is closed
+	received := 0
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case _, ok := <-stream:
+			if !ok {
+				if received > bufferSize {
+					t.Fatalf("expected at most %d buffered responses after cancel, got %d", bufferSize, received)
+				}
+				return
+			}
+			received++
+		case <-timeout:
+			t.Fatal("expected stream to be closed after cancel")
+		}
+	}
+}
+
+func TestToolRefs(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"tools":[{"id":"1","name":"second","argument":"e30="},{"id":"2","name":"third","argument":"e30="},{"id":"3","name":"first","argument":"e30="}]}`))
+	}))
+	defer srv.Close()
+
+	var toolList []tools.Tool
+	for _, name := range []string{"first", "second", "third"} {
+		toolList = append(toolList, tools.NewTool(name, tools.WithDescription("the "+name+" tool")))
+	}
+
+	client := bellman.New(srv.URL, bellman.Key{Name: "test", Token: "test"})
+	res, err := client.Generator().Model(gen.Model{Provider: "test", Name: "test"}).SetTools(toolList...).Prompt(prompt.AsUser("hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Tools) != 3 {
+		t.Fatalf("expected 3 tool calls, got %d", len(res.Tools))
+	}
+	for _, call := range res.Tools {
+		if call.Ref == nil || call.Ref.Name != call.Name || call.Ref.Description != "the "+call.Name+" tool" {
+			t.Fatalf("expected ref of %s to point at its own tool, got %+v", call.Name, call.Ref)
+		}
+	}
+}
+
+func TestPayloadUpload(t *testing.T) {
+	var uploads [][]byte
+	var prompts []prompt.Prompt
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/gen/files":
+			file, header, err := r.FormFile("file")
+			if err != nil {
+				t.Errorf("expected multipart file, got %v", err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			defer file.Close()
+			b, _ := io.ReadAll(file)
+			if header.Header.Get("Content-Type") != prompt.MimeApplicationPDF {
+				t.Errorf("expected pdf mime type, got %s", header.Header.Get("Content-Type"))
+			}
+			uploads = append(uploads, b)
+			_, _ = fmt.Fprintf(w, `{"uri":"bellman://files/%d"}`, len(uploads))
+		case "/gen":
+			var req gen.FullRequest
+			_ = json.NewDecoder(r.Body).Decode(&req)
+			prompts = req.Prompts
+			_, _ = w.Write([]byte(`{"texts":["ok"]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	client := bellman.New(srv.URL, bellman.Key{Name: "test", Token: "test"}).SetPayloadUploadThreshold(1024)
+	small := bytes.Repeat([]byte("a"), 1024)
+	big := bytes.Repeat([]byte("b"), 4096)
+
+	conversation := []prompt.Prompt{prompt.AsUserWithData(prompt.MimeApplicationPDF, small), prompt.AsUserWithData(prompt.MimeApplicationPDF, big)}
+	_, err := client.Generator().Model(gen.Model{Provider: "test", Name: "test"}).Prompt(conversation...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(uploads) != 1 || !bytes.Equal(uploads[0], big) {
+		t.Fatalf("expected only the big payload to be uploaded, got %d uploads", len(uploads))
+	}
+	if len(prompts) != 2 {
+		t.Fatalf("expected 2 prompts, got %d", len(prompts))
+	}
+	if p := prompts[0].Payload; p.Uri != "" || p.Data != base64.StdEncoding.EncodeToString(small) {
+		t.Fatalf("expected small payload inline, got %+v", p)
+	}
+	if p := prompts[1].Payload; p.Uri != "bellman://files/1" || p.Data != "" || p.Mime != prompt.MimeApplicationPDF {
+		t.Fatalf("expected big payload as uri reference, got %+v", p)
+	}
+	if conversation[1].Payload.Uri != "" {
+		t.Fatal("expected the callers conversation to be left as is")
+	}
+}
+
+func TestPayloadUploadFallback(t *testing.T) {
+	var uploads int
+	var prompts []prompt.Prompt
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/gen":
+			var req gen.FullRequest
+			_ = json.NewDecoder(r.Body).Decode(&req)
+			prompts = req.Prompts
+			_, _ = w.Write([]byte(`{"texts":["ok"]}`))
+		default:
+			uploads++
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	big := bytes.Repeat([]byte("b"), 4096)
+	model := gen.Model{Provider: "test", Name: "test"}
+
+	// uploads are opt-in
+	_, err := bellman.New(srv.URL, bellman.Key{}).Generator().Model(model).Prompt(prompt.AsUserWithData(prompt.MimeApplicationPDF, big))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uploads != 0 || prompts[0].Payload.Data != base64.StdEncoding.EncodeToString(big) {
+		t.Fatalf("expected the payload inline without uploads by default, got %d uploads", uploads)
+	}
+
+	// a proxy without the files endpoint gets the payloads inline
+	client := bellman.New(srv.URL, bellman.Key{}).SetPayloadUploadThreshold(1024)
+	_, err = client.Generator().Model(model).Prompt(prompt.AsUserWithData(prompt.MimeApplicationPDF, big))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uploads != 1 || prompts[0].Payload.Uri != "" || prompts[0].Payload.Data != base64.StdEncoding.EncodeToString(big) {
+		t.Fatalf("expected a fallback to the inline payload after a 404, got %d uploads, %+v", uploads, prompts[0].Payload)
+	}
+}
+
+func TestPayloadUploadPartialFallback(t *testing.T) {
+	var uploads, prompts int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/gen":
+			prompts++
+			_, _ = w.Write([]byte(`{"texts":["ok"]}`))
+		default:
+			uploads++
+			if uploads > 1 {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			_, _ = w.Write([]byte(`{"uri":"bellman://files/1"}`))
+		}
+	}))
+	defer srv.Close()
+	big := bytes.Repeat([]byte("b"), 4096)
+
+	// a 404 after a payload is uploaded is an error, rather than orphaning the upload
+	client := bellman.New(srv.URL, bellman.Key{}).SetPayloadUploadThreshold(1024)
+	_, err := client.Generator().Model(gen.Model{Provider: "test", Name: "test"}).Prompt(
+		prompt.AsUserWithData(prompt.MimeApplicationPDF, big),
+		prompt.AsUserWithData(prompt.MimeApplicationPDF, big),
+	)
+	if !errors.Is(err, bellman.ErrAPI) {
+		t.Fatalf("expected an api error, got %v", err)
+	}
+	if uploads != 2 || prompts != 0 {
+		t.Fatalf("expected no prompt after the failed upload, got %d uploads, %d prompts", uploads, prompts)
+	}
+}
+
+func TestEmbedTexts(t *testing.T) {
+	var batches [][]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req embed.Request
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		batches = append(batches, req.Texts)
+
+		res := embed.Response{}
+		for _, text := range req.Texts {
+			n, _ := strconv.Atoi(text)
+			res.Embeddings = append(res.Embeddings, []float64{float64(n), float64(n) / 2})
+		}
+		_ = json.NewEncoder(w).Encode(res)
+	}))
+	defer srv.Close()
+
+	client := bellman.New(srv.URL, bellman.Key{Name: "test", Token: "test"}).SetEmbedBatchSize(2)
+	vectors, err := client.EmbedTexts(context.Background(), embed.Model{Provider: "test", Name: "test"}, []string{"1", "2", "3", "4", "5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batches) != 3 || len(batches[2]) != 1 {
+		t.Fatalf("expected 3 batches of at most 2 texts, got %v", batches)
+	}
+	if len(vectors) != 5 {
+		t.Fatalf("expected 5 vectors, got %d", len(vectors))
+	}
+	for i, v := range vectors {
+		if v[0] != float32(i+1) || v[1] != float32(i+1)/2 {
+			t.Fatalf("expected vector %d in order, got %v", i, v)
+		}
+	}
+}
+
+func TestTraceID(t *testing.T) {
+	var headers []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = append(headers, r.Header.Get(bellman.TraceHeader))
+		_, _ = w.Write([]byte(`{"texts":["ok"]}`))
+	}))
+	defer srv.Close()
+
+	var logs bytes.Buffer
+	client := bellman.New(srv.URL, bellman.Key{Name: "test", Token: "test"})
+	client.Log = slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	g := client.Generator().Model(gen.Model{Provider: "test", Name: "test"})
+	if _, err := g.WithTraceID("bfcl/simple_1/0").Prompt(prompt.AsUser("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.Prompt(prompt.AsUser("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if len(headers) != 2 || headers[0] != "bfcl/simple_1/0" || headers[1] != "" {
+		t.Fatalf("expected trace header only on the traced request, got %q", headers)
+	}
+
+	var traced int
+	for _, line := range bytes.Split(bytes.TrimSpace(logs.Bytes()), []byte("\n")) {
+		var entry map[string]any
+		if err := json.Unmarshal(line, &entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry["trace_id"] == "bfcl/simple_1/0" {
+			traced++
+		}
+	}
+	if traced != 2 {
+		t.Fatalf("expected the request and response logs of the traced request to have the trace id, got %s", logs.String())
+	}
+}
+
+type recordingTransport struct {
+	mu       sync.Mutex
+	requests []string
+}
+
+func (rt *recordingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	rt.mu.Lock()
+	rt.requests = append(rt.requests, r.Method+" "+r.URL.Path+" "+r.Header.Get("User-Agent"))
+	rt.mu.Unlock()
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestHTTPClientOptions(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/embed/models", "/gen/models":
+			_, _ = w.Write([]byte(`[]`))
+		case "/embed":
+			_, _ = w.Write([]byte(`{"embeddings":[[1]]}`))
+		case "/embed/document":
+			_, _ = w.Write([]byte(`{"embeddings":[[1]]}`))
+		case "/gen":
+			_, _ = w.Write([]byte(`{"texts":["ok"]}`))
+		case "/gen/stream":
+			w.Header().Set("Content-Type", "text/event-stream")
+			_, _ = w.Write([]byte("data: {\"type\":\"delta\",\"content\":\"ok\"}\n\ndata: [DONE]\n\n"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	transport := &recordingTransport{}
+	client := bellman.New(srv.URL, bellman.Key{Name: "test", Token: "test"},
+		bellman.WithHTTPClient(&http.Client{Transport: transport}),
+		bellman.WithTimeout(5*time.Second),
+		bellman.WithUserAgent("bench/1.0"),
+	)
+
+	if _, err := client.EmbedModels(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.GenModels(); err != nil {
+		t.Fatal(err)
+	}
+	model := embed.Model{Provider: "test", Name: "test"}
+	if _, err := client.Embed(embed.NewSingleRequest(context.Background(), model, "hi")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.EmbedDocument(embed.NewDocumentRequest(context.Background(), model, []string{"hi"})); err != nil {
+		t.Fatal(err)
+	}
+	g := client.Generator().Model(gen.Model{Provider: "test", Name: "test"})
+	if _, err := g.Prompt(prompt.AsUser("hi")); err != nil {
+		t.Fatal(err)
+	}
+	stream, err := g.Stream(prompt.AsUser("hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range stream {
+	}
+
+	expected := []string{
+		"GET /embed/models bench/1.0",
+		"GET /gen/models bench/1.0",
+		"POST /embed bench/1.0",
+		"POST /embed/document bench/1.0",
+		"POST /gen bench/1.0",
+		"POST /gen/stream bench/1.0",
+	}
+	if !reflect.DeepEqual(transport.requests, expected) {
+		t.Fatalf("expected requests %v through the custom transport, got %v", expected, transport.requests)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	var mu sync.Mutex
+	var inFlight, maxInFlight int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		maxInFlight = max(maxInFlight, inFlight)
+		mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		_, _ = w.Write([]byte(`{"texts":["ok"]}`))
+	}))
+	defer srv.Close()
+
+	model := gen.Model{Provider: "test", Name: "test"}
+	client := bellman.New(srv.URL, bellman.Key{Name: "test", Token: "test"}, bellman.WithMaxConcurrent(1))
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := client.Generator().Model(model).Prompt(prompt.AsUser("hi")); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if maxInFlight != 1 {
+		t.Fatalf("expected at most 1 concurrent request, got %d", maxInFlight)
+	}
+
+	// 20 rps without burst paces the requests 50ms apart
+	client = bellman.New(srv.URL, bellman.Key{Name: "test", Token: "test"}, bellman.WithRateLimit(20, 1))
+	var waited int64
+	for i := 0; i < 3; i++ {
+		res, err := client.Generator().Model(model).Prompt(prompt.AsUser("hi"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		waited += res.Metadata.ThrottleWaitMs
+	}
+	if waited < 50 {
+		t.Fatalf("expected the throttle wait in the metadata, got %dms", waited)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := client.Generator().Model(model).WithContext(ctx).Prompt(prompt.AsUser("hi")); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected a throttled prompt to respect its context, got %v", err)
+	}
+}
+
+func TestValidateModel(t *testing.T) {
+	var listed int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		listed++
+		_, _ = w.Write([]byte(`[{"provider":"OpenAI","name":"gpt-4o"},{"provider":"OpenAI","name":"gpt-4o-mini"},` +
+			`{"provider":"VertexAI","name":"gemini-2.5-flash","support_tools":true},{"provider":"Anthropic","name":"claude-3-haiku"}]`))
+	}))
+	defer srv.Close()
+	client := bellman.New(srv.URL, bellman.Key{Name: "test", Token: "test"})
+
+	model, suggestions, err := bellman.ValidateModel(client, "VertexAI/gemini-2.5-flash")
+	if err != nil || !model.SupportTools || suggestions != nil {
+		t.Fatalf("expected the listed model, got %+v, %v, %v", model, suggestions, err)
+	}
+
+	_, suggestions, err = bellman.ValidateModel(client, "OpenAI/gpt-4o-mni")
+	if !errors.Is(err, bellman.ErrUnknownModel) {
+		t.Fatalf("expected an unknown model error, got %v", err)
+	}
+	if len(suggestions) != 3 || suggestions[0] != "OpenAI/gpt-4o-mini" || suggestions[1] != "OpenAI/gpt-4o" {
+		t.Fatalf("expected the closest models as suggestions, got %v", suggestions)
+	}
+	if listed != 1 {
+		t.Fatalf("expected the model list to be cached, listed %d times", listed)
+	}
+
+	if _, _, err = bellman.ValidateModel(client, "gpt-4o"); err == nil || errors.Is(err, bellman.ErrUnknownModel) {
+		t.Fatalf("expected an invalid fqn error, got %v", err)
+	}
+}
+
+func TestAPIError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/gen/models":
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"error":"invalid token"}`))
+		case "/embed":
+			w.WriteHeader(http.StatusBadGateway)
+			_, _ = w.Write([]byte("<html>bad gateway</html>"))
+		case "/gen":
+			var req gen.FullRequest
+			_ = json.NewDecoder(r.Body).Decode(&req)
+			if req.Model.Name == "gpt-5o" {
+				w.WriteHeader(http.StatusNotFound)
+				_, _ = w.Write([]byte(`{"error":{"code":"model_not_found","message":"model gpt-5o does not exist"}}`))
+				return
+			}
+			w.Header().Set("Retry-After", "7")
+			w.WriteHeader(http.StatusTooManyRequests)
+			_, _ = w.Write([]byte(`{"error":{"type":"rate_limit_error","message":"slow down"}}`))
+		}
+	}))
+	defer srv.Close()
+	client := bellman.New(srv.URL, bellman.Key{Name: "test", Token: "test"})
+
+	var apiErr *bellman.APIError
+	_, err := client.GenModels()
+	if !errors.As(err, &apiErr) || !errors.Is(err, bellman.ErrAPI) {
+		t.Fatalf("expected an api error, got %v", err)
+	}
+	if apiErr.Status != http.StatusUnauthorized || apiErr.Message != "invalid token" || apiErr.Retryable {
+		t.Fatalf("unexpected 401 error %+v", apiErr)
+	}
+
+	_, err = client.Generator().Model(gen.Model{Provider: "OpenAI", Name: "gpt-5o"}).Prompt(prompt.AsUser("hi"))
+	if !errors.As(err, &apiErr) || apiErr.Status != http.StatusNotFound || apiErr.Code != "model_not_found" ||
+		apiErr.Message != "model gpt-5o does not exist" || apiErr.Retryable {
+		t.Fatalf("unexpected 404 error %+v", err)
+	}
+
+	// errors propagate through the agent
+	_, err = agent.Run[string](2, 1, client.Generator().Model(gen.Model{Provider: "OpenAI", Name: "gpt-4o"}), prompt.AsUser("hi"))
+	if !errors.As(err, &apiErr) || apiErr.Status != http.StatusTooManyRequests || apiErr.Code != "rate_limit_error" ||
+		!apiErr.Retryable || apiErr.RetryAfter != 7*time.Second || !bellman.IsRetryable(err) {
+		t.Fatalf("unexpected 429 error %+v", err)
+	}
+	if bellman.ErrorClass(err) != "4xx" || bellman.ErrorClass(errors.New("timeout")) != "other" {
+		t.Fatalf("unexpected error classes %s", bellman.ErrorClass(err))
+	}
+
+	_, err = client.Embed(embed.NewSingleRequest(context.Background(), embed.Model{Provider: "OpenAI", Name: "text-embedding-3-small"}, "hi"))
+	if !errors.As(err, &apiErr) || apiErr.Status != http.StatusBadGateway || apiErr.Message != "<html>bad gateway</html>" || !apiErr.Retryable {
+		t.Fatalf("unexpected 502 error %+v", err)
+	}
+}
+
+func TestCountTokens(t *testing.T) {
+	var uploads int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/gen/count" {
+			uploads++
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var req gen.FullRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		if req.SystemPrompt != "be brief" || len(req.Prompts) != 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(gen.CountResponse{Tokens: 17})
+	}))
+	defer srv.Close()
+	client := bellman.New(srv.URL, bellman.Key{Name: "test", Token: "test"})
+
+	n, err := client.Generator().Model(gen.Model{Provider: "VertexAI", Name: "gemini-2.5-flash"}).System("be brief").CountTokens(prompt.AsUser("hi"))
+	if err != nil || n != 17 {
+		t.Fatalf("expected the count of the proxy, got %d, %v", n, err)
+	}
+
+	// payloads are not uploaded for a count
+	big := bytes.Repeat([]byte("b"), 4096)
+	uploading := bellman.New(srv.URL, bellman.Key{Name: "test", Token: "test"}).SetPayloadUploadThreshold(1024)
+	n, err = uploading.Generator().Model(gen.Model{Provider: "VertexAI", Name: "gemini-2.5-flash"}).System("be brief").CountTokens(prompt.AsUserWithData(prompt.MimeApplicationPDF, big))
+	if err != nil || n != 17 || uploads != 0 {
+		t.Fatalf("expected the count without an upload, got %d, %v after %d uploads", n, err, uploads)
+	}
+
+	// a proxy without the count endpoint gets the tokens estimated
+	old := httptest.NewServer(http.NotFoundHandler())
+	defer old.Close()
+	g := bellman.New(old.URL, bellman.Key{Name: "test", Token: "test"}).Generator().Model(gen.Model{Provider: "VertexAI", Name: "gemini-2.5-flash"}).System("be brief")
+	conversation := []prompt.Prompt{prompt.AsUser("how many tokens is this?")}
+	n, err = g.CountTokens(conversation...)
+	if err != nil || n != gen.EstimateTokens(g.Request, conversation...) {
+		t.Fatalf("expected the estimate after a 404, got %d, %v", n, err)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	client := bellman.New(srv.URL, bellman.Key{Name: "test", Token: "test"}, bellman.WithCircuitBreaker(2, time.Hour))
+	g := client.Generator().Model(gen.Model{Provider: "OpenAI", Name: "gpt-4o"})
+
+	for i := 0; i < 2; i++ {
+		if _, err := g.Prompt(prompt.AsUser("hi")); !errors.Is(err, bellman.ErrAPI) {
+			t.Fatalf("expected an api error, got %v", err)
+		}
+	}
+	if _, err := g.Prompt(prompt.AsUser("hi")); !errors.Is(err, limit.ErrCircuitOpen) {
+		t.Fatalf("expected the circuit to open, got %v", err)
+	}
+	if calls != 2 {
+		t.Fatalf("expected an open circuit to fail fast, got %d calls", calls)
+	}
+
+	if _, err := client.Embed(embed.NewSingleRequest(context.Background(), embed.Model{Provider: "OpenAI", Name: "text-embedding-3-small"}, "hi")); !errors.Is(err, limit.ErrCircuitOpen) {
+		t.Fatalf("expected the circuit to be shared, got %v", err)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req gen.FullRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		if req.Model.Name != "gpt-4o" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(gen.Response{Texts: []string{"hi"}, Metadata: models.Metadata{InputTokens: 10, OutputTokens: 3}})
+	}))
+	defer srv.Close()
+	counters := &metrics.Counters{}
+	client := bellman.New(srv.URL, bellman.Key{Name: "test", Token: "test"}, bellman.WithMetrics(counters))
+
+	if _, err := client.Generator().Model(gen.Model{Provider: "OpenAI", Name: "gpt-4o"}).Prompt(prompt.AsUser("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Generator().Model(gen.Model{Provider: "OpenAI", Name: "gpt-5o"}).Prompt(prompt.AsUser("hi")); err == nil {
+		t.Fatal("expected an error")
+	}
+	if counters.Operations() != 2 || counters.Errors() != 1 || counters.Tokens(metrics.TokensInput) != 10 || counters.Tokens(metrics.TokensOutput) != 3 {
+		t.Fatalf("unexpected metrics, %d operations, %d errors, %d input and %d output tokens", counters.Operations(), counters.Errors(),
+			counters.Tokens(metrics.TokensInput), counters.Tokens(metrics.TokensOutput))
+	}
+}
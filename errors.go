@@ -0,0 +1,124 @@
+package bellman
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrAPI is matched, using errors.Is, by an APIError
+var ErrAPI = errors.New("bellman api error")
+
+// APIError is returned, wrapped, when the proxy responds with a non 200 status. Use errors.As to branch on it, e.g.
+// on Retryable, rather than on the error string.
+type APIError struct {
+	Status     int
+	Code       string        // error code of the upstream, if any
+	Message    string        // error message of the upstream, or the raw body if it is not json
+	Retryable  bool          // true for 408, 429 and 5xx
+	RetryAfter time.Duration // parsed from the Retry-After header, if present
+}
+
+func (e *APIError) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("unexpected status code %d; %s: %s", e.Status, e.Code, e.Message)
+	}
+	return fmt.Sprintf("unexpected status code %d; %s", e.Status, e.Message)
+}
+
+func (e *APIError) Is(target error) bool {
+	return target == ErrAPI
+}
+
+// IsRetryable reports whether err is, or wraps, a retryable APIError
+func IsRetryable(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.Retryable
+}
+
+// ErrorClass returns the status class of err if it is, or wraps, an APIError, e.g. 4xx or 5xx, and other otherwise,
+// e.g. as a metric label
+func ErrorClass(err error) string {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return fmt.Sprintf("%dxx", apiErr.Status/100)
+	}
+	return "other"
+}
+
+// newAPIError parses the error body of res, which is either the {"error": "..."} of bellmand or the
+// {"error": {"code": ..., "message": ...}} of most providers, falling back to the raw body
+func newAPIError(res *http.Response, body []byte) *APIError {
+	e := &APIError{
+		Status:     res.StatusCode,
+		Message:    strings.TrimSpace(string(body)),
+		Retryable:  res.StatusCode == http.StatusRequestTimeout || res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500,
+		RetryAfter: parseRetryAfter(res.Header.Get("Retry-After")),
+	}
+
+	var msg struct {
+		Error   json.RawMessage `json:"error"`
+		Code    json.RawMessage `json:"code"`
+		Message string          `json:"message"`
+	}
+	if json.Unmarshal(body, &msg) != nil {
+		return e
+	}
+	if msg.Message != "" {
+		e.Message = msg.Message
+	}
+	e.Code = rawString(msg.Code)
+
+	var str string
+	if json.Unmarshal(msg.Error, &str) == nil && str != "" {
+		e.Message = str
+		return e
+	}
+	var obj struct {
+		Code    json.RawMessage `json:"code"`
+		Type    string          `json:"type"`
+		Message string          `json:"message"`
+	}
+	if json.Unmarshal(msg.Error, &obj) == nil {
+		if obj.Message != "" {
+			e.Message = obj.Message
+		}
+		if code := rawString(obj.Code); code != "" {
+			e.Code = code
+		} else if obj.Type != "" {
+			e.Code = obj.Type
+		}
+	}
+	return e
+}
+
+// rawString returns a json string or number as a string
+func rawString(raw json.RawMessage) string {
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+	var n json.Number
+	if json.Unmarshal(raw, &n) == nil {
+		return n.String()
+	}
+	return ""
+}
+
+// parseRetryAfter parses a Retry-After header, in seconds or as a http date
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if s, err := strconv.Atoi(v); err == nil {
+		return time.Duration(max(s, 0)) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0)
+	}
+	return 0
+}
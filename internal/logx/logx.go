@@ -0,0 +1,77 @@
+// Package logx sets up the structured logging shared by the binaries of the repository, e.g. the bench server
+package logx
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Log formats of New
+const (
+	FormatJSON = "json"
+	FormatText = "text"
+)
+
+// New returns a logger writing to w in the format, json or text, at the level, i.e. DEBUG, INFO, WARN or ERROR
+func New(w io.Writer, format string, level string) (*slog.Logger, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("could not parse log level; %w", err)
+	}
+	opts := &slog.HandlerOptions{Level: l}
+	switch strings.ToLower(format) {
+	case FormatJSON:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	case FormatText:
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q, expected json or text", format)
+}
+
+// Flags registers --log-format and --log-level on fs, defaulting to the env vars <prefix>_LOG_FORMAT and
+// <prefix>_LOG_LEVEL, and returns a func creating the logger, writing to stdout, once fs is parsed
+func Flags(fs *flag.FlagSet, envPrefix string) func() (*slog.Logger, error) {
+	format := fs.String("log-format", envOr(envPrefix+"_LOG_FORMAT", FormatText), "log format, json or text")
+	level := fs.String("log-level", envOr(envPrefix+"_LOG_LEVEL", "INFO"), "log level, DEBUG, INFO, WARN or ERROR")
+	return func() (*slog.Logger, error) {
+		return New(os.Stdout, *format, *level)
+	}
+}
+
+// WithRun returns the logger with the fields of a benchmark run, i.e. the model, the test group and the method, e.g.
+// ptc-fc, so that every line of the run can be attributed. Empty fields are omitted. A nil logger is the default logger
+func WithRun(logger *slog.Logger, model string, group string, method string) *slog.Logger {
+	logger = OrDefault(logger)
+	var args []any
+	for _, f := range [][2]string{{"model", model}, {"group", group}, {"method", method}} {
+		if f[1] != "" {
+			args = append(args, f[0], f[1])
+		}
+	}
+	return logger.With(args...)
+}
+
+// OrDefault returns logger, or the default logger if it is nil
+func OrDefault(logger *slog.Logger) *slog.Logger {
+	if logger == nil {
+		return slog.Default()
+	}
+	return logger
+}
+
+// Fatal logs the message at error level and exits, like log.Fatal
+func Fatal(logger *slog.Logger, msg string, args ...any) {
+	OrDefault(logger).Error(msg, args...)
+	os.Exit(1)
+}
+
+func envOr(key string, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
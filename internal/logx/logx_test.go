@@ -0,0 +1,50 @@
+package logx_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/modfin/bellman/internal/logx"
+)
+
+func TestNew(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := logx.New(&buf, logx.FormatJSON, "warn")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	logger.Info("dropped")
+	logx.WithRun(logger, "OpenAI/gpt-4o", "simple", "ptc-fc").Warn("kept", "test_id", "simple_1")
+
+	var line map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("expected a single json line, got %q; %v", buf.String(), err)
+	}
+	expected := map[string]any{
+		"level": "WARN", "msg": "kept", "model": "OpenAI/gpt-4o", "group": "simple", "method": "ptc-fc", "test_id": "simple_1",
+	}
+	for k, v := range expected {
+		if line[k] != v {
+			t.Fatalf("expected %s=%v, got %v", k, v, line[k])
+		}
+	}
+
+	buf.Reset()
+	logger, err = logx.New(&buf, logx.FormatText, "DEBUG")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	logx.WithRun(logger, "", "", "fc").Debug("text")
+	if out := buf.String(); !strings.Contains(out, "msg=text method=fc") || strings.Contains(out, "model=") {
+		t.Fatalf("expected text line with only the method, got %q", out)
+	}
+
+	if _, err := logx.New(&buf, "xml", "INFO"); err == nil {
+		t.Fatalf("expected error for unknown format")
+	}
+	if _, err := logx.New(&buf, logx.FormatText, "loud"); err == nil {
+		t.Fatalf("expected error for unknown level")
+	}
+}
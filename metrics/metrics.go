@@ -0,0 +1,108 @@
+package metrics
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Operations observed by the client and the agent
+const (
+	OpPrompt = "prompt"
+	OpStream = "stream"
+	OpEmbed  = "embed"
+	OpAgent  = "agent"
+)
+
+// Token kinds of AddTokens
+const (
+	TokensInput    = "input"
+	TokensOutput   = "output"
+	TokensThinking = "thinking"
+)
+
+// Metrics is called by the bellman client and the agent to instrument requests, tokens, tool calls, latencies and
+// errors. Implementations must be safe for concurrent use, see Nop, Counters and the
+// github.com/modfin/bellman/metrics/prometheus module.
+type Metrics interface {
+	ObserveLatency(op string, model string, d time.Duration)
+	AddTokens(model string, kind string, n int)
+	IncError(op string, model string, err error)
+	IncToolCall(tool string, err error)
+}
+
+// Nop discards all metrics, it is the default of the client and the agent
+type Nop struct{}
+
+func (Nop) ObserveLatency(string, string, time.Duration) {}
+func (Nop) AddTokens(string, string, int)                {}
+func (Nop) IncError(string, string, error)               {}
+func (Nop) IncToolCall(string, error)                    {}
+
+// OrNop returns m, or Nop if m is nil
+func OrNop(m Metrics) Metrics {
+	if m == nil {
+		return Nop{}
+	}
+	return m
+}
+
+// Counters keeps process wide totals in memory, e.g. to log running token totals of a benchmark
+type Counters struct {
+	operations atomic.Uint64
+	errors     atomic.Uint64
+
+	mu        sync.Mutex
+	tokens    map[string]uint64
+	toolCalls map[string]uint64
+}
+
+func (c *Counters) ObserveLatency(string, string, time.Duration) {
+	c.operations.Add(1)
+}
+
+func (c *Counters) AddTokens(_ string, kind string, n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.tokens == nil {
+		c.tokens = map[string]uint64{}
+	}
+	c.tokens[kind] += uint64(max(n, 0))
+}
+
+func (c *Counters) IncError(string, string, error) {
+	c.errors.Add(1)
+}
+
+func (c *Counters) IncToolCall(tool string, _ error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.toolCalls == nil {
+		c.toolCalls = map[string]uint64{}
+	}
+	c.toolCalls[tool]++
+}
+
+// Operations returns the number of observed operations, i.e. prompts, streams, embeddings and agent runs
+func (c *Counters) Operations() uint64 {
+	return c.operations.Load()
+}
+
+// Errors returns the number of errors
+func (c *Counters) Errors() uint64 {
+	return c.errors.Load()
+}
+
+// Tokens returns the total tokens of a kind, e.g. TokensInput
+func (c *Counters) Tokens(kind string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tokens[kind]
+}
+
+// ToolCalls returns the number of calls of a tool
+func (c *Counters) ToolCalls(tool string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.toolCalls[tool]
+}
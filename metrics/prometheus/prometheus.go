@@ -0,0 +1,75 @@
+package prometheus
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/modfin/bellman"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics implements metrics.Metrics with Prometheus collectors, register them with Register
+type Metrics struct {
+	latency   *prometheus.HistogramVec
+	tokens    *prometheus.CounterVec
+	errors    *prometheus.CounterVec
+	toolCalls *prometheus.CounterVec
+}
+
+// New returns collectors named <namespace>_request_duration_seconds, <namespace>_tokens_total,
+// <namespace>_errors_total and <namespace>_tool_calls_total
+func New(namespace string) *Metrics {
+	return &Metrics{
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "request_duration_seconds",
+			Help:      "Duration of requests by operation and model",
+			Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+		}, []string{"op", "model"}),
+		tokens: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "tokens_total",
+			Help:      "Tokens by model and kind, i.e. input, output or thinking",
+		}, []string{"model", "kind"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "errors_total",
+			Help:      "Errors by operation, model and class, i.e. the upstream status class or other",
+		}, []string{"op", "model", "class"}),
+		toolCalls: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "tool_calls_total",
+			Help:      "Tool calls by tool and outcome",
+		}, []string{"tool", "outcome"}),
+	}
+}
+
+// Register registers the collectors with the registerer, e.g. prometheus.DefaultRegisterer
+func (m *Metrics) Register(r prometheus.Registerer) error {
+	for _, c := range []prometheus.Collector{m.latency, m.tokens, m.errors, m.toolCalls} {
+		if err := r.Register(c); err != nil {
+			return fmt.Errorf("could not register collector; %w", err)
+		}
+	}
+	return nil
+}
+
+func (m *Metrics) ObserveLatency(op string, model string, d time.Duration) {
+	m.latency.WithLabelValues(op, model).Observe(d.Seconds())
+}
+
+func (m *Metrics) AddTokens(model string, kind string, n int) {
+	m.tokens.WithLabelValues(model, kind).Add(float64(max(n, 0)))
+}
+
+func (m *Metrics) IncError(op string, model string, err error) {
+	m.errors.WithLabelValues(op, model, bellman.ErrorClass(err)).Inc()
+}
+
+func (m *Metrics) IncToolCall(tool string, err error) {
+	outcome := "ok"
+	if err != nil {
+		outcome = "error"
+	}
+	m.toolCalls.WithLabelValues(tool, outcome).Inc()
+}
@@ -0,0 +1,49 @@
+package prometheus_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/modfin/bellman"
+	"github.com/modfin/bellman/metrics"
+	bprom "github.com/modfin/bellman/metrics/prometheus"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestMetrics(t *testing.T) {
+	var m metrics.Metrics = bprom.New("bellman_test")
+	registry := prometheus.NewRegistry()
+	if err := m.(*bprom.Metrics).Register(registry); err != nil {
+		t.Fatal(err)
+	}
+
+	m.AddTokens("OpenAI/gpt-4o", metrics.TokensInput, 10)
+	m.IncError(metrics.OpPrompt, "OpenAI/gpt-4o", fmt.Errorf("could not prompt; %w", &bellman.APIError{Status: 503}))
+	m.IncToolCall("lookup", errors.New("boom"))
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := map[string]string{}
+	for _, f := range families {
+		for _, metric := range f.GetMetric() {
+			labels := ""
+			for _, l := range metric.GetLabel() {
+				labels += l.GetName() + "=" + l.GetValue() + ","
+			}
+			found[f.GetName()] = labels
+		}
+	}
+	expected := map[string]string{
+		"bellman_test_tokens_total":     "kind=input,model=OpenAI/gpt-4o,",
+		"bellman_test_errors_total":     "class=5xx,model=OpenAI/gpt-4o,op=prompt,",
+		"bellman_test_tool_calls_total": "outcome=error,tool=lookup,",
+	}
+	for name, labels := range expected {
+		if found[name] != labels {
+			t.Fatalf("expected %s with %s, got %v", name, labels, found)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package gen
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/modfin/bellman/prompt"
+)
+
+// TokenCounter is implemented by prompters whose provider can count the input tokens of a request, e.g. the
+// countTokens endpoint of Vertex AI
+type TokenCounter interface {
+	CountTokens(prompts ...prompt.Prompt) (int, error)
+}
+
+// CountResponse is the response of the token count endpoint of bellmand
+type CountResponse struct {
+	Tokens int `json:"tokens"`
+}
+
+// CountTokens returns the number of input tokens of the prompts, including the system prompt, tools and output
+// schema of the generator. The count endpoint of the provider is used where available, see TokenCounter, and
+// otherwise the tokens are estimated, see EstimateTokens.
+func (b *Generator) CountTokens(prompts ...prompt.Prompt) (int, error) {
+	prompter := b.Prompter
+	if prompter == nil {
+		return 0, errors.New("prompter is required")
+	}
+	counter, ok := prompter.(TokenCounter)
+	if !ok {
+		request, prompts := b.Request.WithPTCSystemFragment(prompts)
+		return EstimateTokens(request, prompts...), nil
+	}
+	prompter.SetRequest(b.clone().Request)
+	return counter.CountTokens(prompts...)
+}
+
+// EstimateTokens estimates the input tokens of a request by the common heuristic of 4 characters per token, e.g. for
+// providers without a count endpoint. Payloads, such as images, are not counted.
+func EstimateTokens(request Request, prompts ...prompt.Prompt) int {
+	chars := len(request.SystemPrompt)
+	for _, t := range request.Tools {
+		chars += len(t.Name) + len(t.Description)
+		if t.ArgumentSchema != nil {
+			b, _ := json.Marshal(t.ArgumentSchema)
+			chars += len(b)
+		}
+	}
+	if request.OutputSchema != nil {
+		b, _ := json.Marshal(request.OutputSchema)
+		chars += len(b)
+	}
+	for _, p := range prompts {
+		chars += len(p.Text)
+		if p.ToolCall != nil {
+			chars += len(p.ToolCall.Name) + len(p.ToolCall.Arguments)
+		}
+		if p.ToolResponse != nil {
+			chars += len(p.ToolResponse.Name) + len(p.ToolResponse.Response)
+		}
+	}
+	return (chars + 3) / 4
+}
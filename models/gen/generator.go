@@ -3,6 +3,7 @@ package gen
 import (
 	"context"
 	"errors"
+	"log/slog"
 
 	"github.com/modfin/bellman/prompt"
 	"github.com/modfin/bellman/schema"
@@ -10,10 +11,19 @@ import (
 	"github.com/modfin/bellman/tools/ptc"
 )
 
+// Generator is an immutable request builder, every setter returns a modified clone. Note that the PTC Runtime is
+// shared by reference between a generator and all clones derived from it, i.e., they share one VM with its global
+// variables and counters. Use ForkRuntime to give a clone its own runtime, e.g. before running it concurrently with
+// other clones of the same base generator.
 type Generator struct {
 	Prompter Prompter
 	Request  Request
 	Runtime  ptc.Runtime
+
+	ptcLanguage       ptc.ProgramLanguage
+	ptcLog            *slog.Logger
+	customPTCFragment bool // fragment set by SetPTCSystemFragment, kept when PTC is re-activated
+	schemaValidation  bool // validate tool schemas before prompting and when activating PTC, see SchemaValidation
 }
 
 func Float(f float64) *float64 {
@@ -34,17 +44,44 @@ func (b *Generator) Stream(prompts ...prompt.Prompt) (<-chan *StreamResponse, er
 		return nil, errors.New("prompter is required")
 	}
 	r := b.clone().Request
+	if err := r.ValidateToolConfig(); err != nil {
+		return nil, err
+	}
+	if b.schemaValidation {
+		if err := r.ValidateToolSchemas(); err != nil {
+			return nil, err
+		}
+	}
 	r.Stream = true
 	prompter.SetRequest(r)
 	return prompter.Stream(prompts...)
 }
 
+// StreamAggregated works like Stream, but emits each tool call as one complete response at the end of the turn
+// instead of as argument deltas, see AggregateToolCalls. Stops once the request context is done
+func (b *Generator) StreamAggregated(prompts ...prompt.Prompt) (<-chan *StreamResponse, error) {
+	stream, err := b.Stream(prompts...)
+	if err != nil {
+		return nil, err
+	}
+	return AggregateToolCalls(b.Request.Context, stream), nil
+}
+
 func (b *Generator) Prompt(prompts ...prompt.Prompt) (*Response, error) {
 	prompter := b.Prompter
 	if prompter == nil {
 		return nil, errors.New("prompter is required")
 	}
-	prompter.SetRequest(b.clone().Request)
+	r := b.clone().Request
+	if err := r.ValidateToolConfig(); err != nil {
+		return nil, err
+	}
+	if b.schemaValidation {
+		if err := r.ValidateToolSchemas(); err != nil {
+			return nil, err
+		}
+	}
+	prompter.SetRequest(r)
 	return prompter.Prompt(prompts...)
 }
 
@@ -97,9 +134,35 @@ func (b *Generator) clone() *Generator {
 		cp := *b.Request.ThinkingParts
 		bb.Request.ThinkingParts = &cp
 	}
+	if b.Request.ToolValues != nil {
+		bb.Request.ToolValues = make(map[string]any, len(b.Request.ToolValues))
+		for k, v := range b.Request.ToolValues {
+			bb.Request.ToolValues[k] = v
+		}
+	}
 	if b.Request.StopSequences != nil {
 		bb.Request.StopSequences = append([]string{}, b.Request.StopSequences...)
 	}
+	if b.Request.MaxPTCCalls != nil {
+		cp := *b.Request.MaxPTCCalls
+		bb.Request.MaxPTCCalls = &cp
+	}
+	if b.Request.MaxToolResponseBytes != nil {
+		cp := *b.Request.MaxToolResponseBytes
+		bb.Request.MaxToolResponseBytes = &cp
+	}
+	if b.Request.StructuredToolResponses != nil {
+		cp := *b.Request.StructuredToolResponses
+		bb.Request.StructuredToolResponses = &cp
+	}
+	if b.Request.PTCDeduplication != nil {
+		cp := *b.Request.PTCDeduplication
+		bb.Request.PTCDeduplication = &cp
+	}
+	if b.Request.PTCSeed != nil {
+		cp := *b.Request.PTCSeed
+		bb.Request.PTCSeed = &cp
+	}
 
 	return &bb
 }
@@ -130,6 +193,24 @@ func (b *Generator) Tools() []tools.Tool {
 	return b.Request.Tools
 }
 
+// ToolsJSONSchema returns a JSON Schema (draft-07) document for the arguments of each configured tool, see tools.ToJSONSchema
+func (b *Generator) ToolsJSONSchema() []map[string]any {
+	res := make([]map[string]any, 0, len(b.Request.Tools))
+	for _, t := range b.Request.Tools {
+		res = append(res, tools.ToJSONSchema(t))
+	}
+	return res
+}
+
+// ToolsOpenAISpec returns an OpenAI function tool definition for each configured tool, see tools.ToOpenAISpec
+func (b *Generator) ToolsOpenAISpec() []map[string]any {
+	res := make([]map[string]any, 0, len(b.Request.Tools))
+	for _, t := range b.Request.Tools {
+		res = append(res, tools.ToOpenAISpec(t))
+	}
+	return res
+}
+
 func (b *Generator) SetTools(tool ...tools.Tool) *Generator {
 	bb := b.clone()
 
@@ -140,18 +221,46 @@ func (b *Generator) AddTools(tool ...tools.Tool) *Generator {
 	return b.SetTools(append(b.Request.Tools, tool...)...)
 }
 
+// ActivatePTC moves all tools with PTC enabled into a code_execution tool of the given language. It may be called
+// again, e.g. after adding tools or to switch language, which re-adapts all PTC tools on the returned clone. An empty
+// language is the language of the generator, i.e. of a previous activation or of Defaults, and JavaScript if none.
 func (b *Generator) ActivatePTC(lang ptc.ProgramLanguage) (*Generator, error) {
+	if lang == "" {
+		lang = b.ptcLanguage
+	}
+	if lang == "" {
+		lang = ptc.JavaScript
+	}
 	bb := b.clone()
 
-	bb.Request.Tools, bb.Request.PTCTools = ptc.SplitTools(bb.Tools())
+	// restore tools from a previous activation, dropping the old code_execution tool
+	var toolList []tools.Tool
+	for _, t := range bb.Tools() {
+		if b.Runtime != nil && t.Name == ptc.ToolName {
+			continue
+		}
+		toolList = append(toolList, t)
+	}
+	toolList = append(toolList, bb.Request.PTCTools...)
+	if !bb.customPTCFragment {
+		bb.Request.PTCSystemFragment = nil
+	}
+
+	bb.Request.Tools, bb.Request.PTCTools = ptc.SplitTools(toolList)
 	if len(bb.Request.PTCTools) == 0 {
 		return b, errors.New("no tools with ptc enabled")
 	}
+	if bb.schemaValidation {
+		if err := bb.Request.ValidateToolSchemas(); err != nil {
+			return b, err
+		}
+	}
 
 	bb, err := bb.SetupRuntimeSession(lang)
 	if err != nil {
 		return b, err
 	}
+	bb.ptcLanguage = lang
 
 	tool, err := bb.Runtime.AdaptTools(bb.Request.PTCTools...)
 	if err != nil {
@@ -170,13 +279,139 @@ func (b *Generator) ActivatePTC(lang ptc.ProgramLanguage) (*Generator, error) {
 	return bb, err
 }
 
+// SetActiveTools sets the tools like SetTools, but keeps PTC activated on the same runtime: PTC tools are re-adapted,
+// keeping the variables of the session, and code executed by the new code_execution tool can not call PTC tools not
+// in the list. The runtime is shared with the generator it was derived from, see ForkRuntime. The tools are set as is if PTC is not activated
+func (b *Generator) SetActiveTools(tool ...tools.Tool) (*Generator, error) {
+	if b.Runtime == nil {
+		return b.SetTools(tool...), nil
+	}
+	bb := b.clone()
+
+	var toolList []tools.Tool
+	for _, t := range tool {
+		if t.Name != ptc.ToolName {
+			toolList = append(toolList, t)
+		}
+	}
+	bb.Request.Tools, bb.Request.PTCTools = ptc.SplitTools(toolList)
+
+	adapted, err := bb.Runtime.AdaptTools(bb.Request.PTCTools...)
+	if err != nil {
+		return b, err
+	}
+	if len(bb.Request.PTCTools) == 0 {
+		if !bb.customPTCFragment {
+			bb.Request.PTCSystemFragment = nil
+		}
+		return bb, nil
+	}
+	bb.Request.Tools = append(bb.Request.Tools, adapted)
+
+	if !bb.customPTCFragment {
+		fragment, err := bb.Runtime.SystemFragment(bb.Request.PTCTools...)
+		if err != nil {
+			return b, err
+		}
+		bb.Request.PTCSystemFragment = &fragment
+	}
+	return bb, nil
+}
+
+// ForkRuntime returns a clone with a new PTC runtime of the same language and the PTC tools re-adapted to it, so
+// that it no longer shares VM state with the generator it was derived from. No-op if PTC is not activated.
+func (b *Generator) ForkRuntime() (*Generator, error) {
+	if b.Runtime == nil {
+		return b, nil
+	}
+	return b.ActivatePTC(b.ptcLanguage)
+}
+
+// SystemFragmentPosition sets where the PTC system fragment is placed, i.e. appended to or prepended to the system
+// prompt, or in a synthetic user message before the conversation. Some models follow the tool docs better in one place
+func (b *Generator) SystemFragmentPosition(position FragmentPosition) *Generator {
+	bb := b.clone()
+	bb.Request.PTCFragmentPosition = position
+
+	return bb
+}
+
 func (b *Generator) SetPTCSystemFragment(fragment string) *Generator {
 	bb := b.clone()
 	bb.Request.PTCSystemFragment = &fragment
+	bb.customPTCFragment = true
+
+	return bb
+}
+
+// MaxPTCCalls caps the number of executed code_execution calls per agent run. Further calls get a tool response
+// telling the model that the budget is exhausted and that it must answer in text. 0 means unlimited. Applied to the
+// code session of each run by ToolContext.
+func (b *Generator) MaxPTCCalls(n int) *Generator {
+	bb := b.clone()
+	bb.Request.MaxPTCCalls = &n
+
+	return bb
+}
+
+// PTCDeduplication toggles caching of identical tool calls (same tool and arguments) inside code_execution,
+// repeated calls return the cached result. Leave disabled if tools are intentionally non-deterministic. Applied to
+// the code session of each run by ToolContext.
+func (b *Generator) PTCDeduplication(enabled bool) *Generator {
+	bb := b.clone()
+	bb.Request.PTCDeduplication = &enabled
 
 	return bb
 }
 
+// SchemaValidation toggles validation of the argument schemas of the tools, see schema.JSON.Validate, e.g. for tools
+// with schemas converted from another format. Malformed schemas fail Prompt, Stream and ActivatePTC with an error
+// naming the tool and the path in the schema, rather than producing a bad provider request
+func (b *Generator) SchemaValidation(enabled bool) *Generator {
+	bb := b.clone()
+	bb.schemaValidation = enabled
+
+	return bb
+}
+
+// PTCSeed makes the randomness of the PTC path reproducible: Math.random of the runtime and the random source of tools
+// called from code, see tools.RandFromContext, draw from a source seeded anew by each call of ToolContext, i.e. for
+// each agent run. Runs with the same seed, model responses and tools thus execute code identically.
+func (b *Generator) PTCSeed(seed int64) *Generator {
+	bb := b.clone()
+	bb.Request.PTCSeed = &seed
+
+	return bb
+}
+
+// PTCLogger sets the logger the runtime uses for debug logs of each code_execution call, i.e. the submitted code,
+// the guardrail decision, the tool calls and the result. Nil, the default, keeps the logger of the runtime. Passed to
+// the runtime by the context of ToolContext.
+func (b *Generator) PTCLogger(logger *slog.Logger) *Generator {
+	bb := b.clone()
+	bb.ptcLog = logger
+
+	return bb
+}
+
+// MaxToolResponseBytes sets the default response size limit of tools, for tools without a limit of their own. Longer
+// responses are truncated with a notice, see tools.TruncateResponse. 0 means unlimited. Tools called from code get the
+// limit by the context of ToolContext
+func (b *Generator) MaxToolResponseBytes(n int) *Generator {
+	bb := b.clone()
+	bb.Request.MaxToolResponseBytes = &n
+
+	return bb
+}
+
+// MaxToolResponseBytesLimit returns the default response size limit of tools, 0 if not set
+func (b *Generator) MaxToolResponseBytesLimit() int {
+	if b.Request.MaxToolResponseBytes == nil {
+		return 0
+	}
+	return max(*b.Request.MaxToolResponseBytes, 0)
+}
+
 func (b *Generator) SetToolConfig(choice tools.ToolChoice) *Generator {
 	bb := b.clone()
 	bb.Request.ToolConfig = &choice
@@ -239,6 +474,57 @@ func (b *Generator) WithContext(ctx context.Context) *Generator {
 	return bb
 }
 
+// WithTraceID sets the trace id of the requests, e.g. "<group>/<qid>/<attempt>". It is sent to the Bellman proxy as
+// the X-Bellman-Trace header, included in the client logs and attached to agent results.
+func (b *Generator) WithTraceID(traceID string) *Generator {
+	bb := b.clone()
+	bb.Request.TraceID = traceID
+
+	return bb
+}
+
+// WithToolValues adds request scoped values, e.g. auth tokens or tenant ids, that are available to every tool
+// Function invoked by the agent, including tools called from code_execution, through tools.ValueFromContext.
+// The values are never sent to the model.
+func (b *Generator) WithToolValues(values map[string]any) *Generator {
+	bb := b.clone()
+	if bb.Request.ToolValues == nil {
+		bb.Request.ToolValues = map[string]any{}
+	}
+	for k, v := range values {
+		bb.Request.ToolValues[k] = v
+	}
+
+	return bb
+}
+
+// ToolContext returns the context tool functions should be invoked with, i.e. the request context carrying the
+// tool values, the default response size limit of tools called from code, the PTC logger and the seeded random source.
+// If PTC is activated, it also carries a new code session, see tools.CodeSession, with the MaxPTCCalls and
+// PTCDeduplication settings. Call it once per run, e.g. as agent.Run does, since the runtime is shared with the
+// generators cloned from this one, which may run concurrently
+func (b *Generator) ToolContext() context.Context {
+	ctx := tools.ContextWithValues(b.Request.Context, b.Request.ToolValues)
+	if n := b.MaxToolResponseBytesLimit(); n > 0 {
+		ctx = tools.ContextWithMaxResponseBytes(ctx, n)
+	}
+	if b.ptcLog != nil {
+		ctx = tools.ContextWithLogger(ctx, b.ptcLog)
+	}
+	if b.Request.PTCSeed != nil {
+		ctx = tools.ContextWithRand(ctx, tools.NewRand(*b.Request.PTCSeed))
+	}
+	if b.Runtime != nil {
+		limit := 0
+		if b.Request.MaxPTCCalls != nil {
+			limit = *b.Request.MaxPTCCalls
+		}
+		dedup := b.Request.PTCDeduplication != nil && *b.Request.PTCDeduplication
+		ctx = tools.ContextWithCodeSession(ctx, tools.NewCodeSession(limit, dedup))
+	}
+	return ctx
+}
+
 func (b *Generator) MaxTokens(maxTokens int) *Generator {
 	bb := b.clone()
 	bb.Request.MaxTokens = &maxTokens
@@ -261,8 +547,47 @@ func (b *Generator) IncludeThinkingParts(thinkingParts bool) *Generator {
 	return bb
 }
 
+// StructuredToolResponses sends tool responses that are valid JSON as structured objects instead of strings, for
+// providers that support it, i.e. VertexAI. Non-JSON responses are sent as before.
+func (b *Generator) StructuredToolResponses(enabled bool) *Generator {
+	bb := b.clone()
+	bb.Request.StructuredToolResponses = &enabled
+
+	return bb
+}
+
 type Option func(generator *Generator) *Generator
 
+// Defaults are request settings a server configures once, e.g. for all benchmark handlers, and applies with
+// WithDefaults. Nil or empty fields are left as is
+type Defaults struct {
+	Temperature    *float64
+	MaxTokens      *int
+	ThinkingBudget *int
+	PTCLanguage    ptc.ProgramLanguage // the language of ActivatePTC with an empty language
+}
+
+// WithDefaults sets the defaults on the fields that are not yet set, so that explicit settings win regardless of
+// whether they are made before or after, e.g. client.Generator(gen.WithDefaults(d)).Temperature(0)
+func WithDefaults(d Defaults) Option {
+	return func(g *Generator) *Generator {
+		if d.Temperature != nil && g.Request.Temperature == nil {
+			g = g.Temperature(*d.Temperature)
+		}
+		if d.MaxTokens != nil && g.Request.MaxTokens == nil {
+			g = g.MaxTokens(*d.MaxTokens)
+		}
+		if d.ThinkingBudget != nil && g.Request.ThinkingBudget == nil {
+			g = g.ThinkingBudget(*d.ThinkingBudget)
+		}
+		if d.PTCLanguage != "" && g.ptcLanguage == "" {
+			g = g.clone()
+			g.ptcLanguage = d.PTCLanguage
+		}
+		return g
+	}
+}
+
 func WithRequest(req Request) Option {
 	return func(g *Generator) *Generator {
 		return g.SetConfig(req)
@@ -348,13 +673,59 @@ func WithContext(ctx context.Context) Option {
 		return g.WithContext(ctx)
 	}
 }
+func WithTraceID(traceID string) Option {
+	return func(g *Generator) *Generator {
+		return g.WithTraceID(traceID)
+	}
+}
+func WithToolValues(values map[string]any) Option {
+	return func(g *Generator) *Generator {
+		return g.WithToolValues(values)
+	}
+}
 func WithThinkingBudget(thinkingBudget int) Option {
 	return func(g *Generator) *Generator {
 		return g.ThinkingBudget(thinkingBudget)
 	}
 }
+func WithMaxPTCCalls(n int) Option {
+	return func(g *Generator) *Generator {
+		return g.MaxPTCCalls(n)
+	}
+}
+func WithSystemFragmentPosition(position FragmentPosition) Option {
+	return func(g *Generator) *Generator {
+		return g.SystemFragmentPosition(position)
+	}
+}
+func WithMaxToolResponseBytes(n int) Option {
+	return func(g *Generator) *Generator {
+		return g.MaxToolResponseBytes(n)
+	}
+}
+func WithPTCDeduplication(enabled bool) Option {
+	return func(g *Generator) *Generator {
+		return g.PTCDeduplication(enabled)
+	}
+}
+func WithSchemaValidation(enabled bool) Option {
+	return func(g *Generator) *Generator {
+		return g.SchemaValidation(enabled)
+	}
+}
+func WithPTCSeed(seed int64) Option {
+	return func(g *Generator) *Generator {
+		return g.PTCSeed(seed)
+	}
+}
 func WithThinkingParts(thinkingParts bool) Option {
 	return func(g *Generator) *Generator {
 		return g.IncludeThinkingParts(thinkingParts)
 	}
 }
+
+func WithStructuredToolResponses(enabled bool) Option {
+	return func(g *Generator) *Generator {
+		return g.StructuredToolResponses(enabled)
+	}
+}
@@ -0,0 +1,485 @@
+package gen_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/modfin/bellman/models"
+	"github.com/modfin/bellman/models/gen"
+	"github.com/modfin/bellman/prompt"
+	"github.com/modfin/bellman/schema"
+	"github.com/modfin/bellman/tools"
+	"github.com/modfin/bellman/tools/ptc"
+)
+
+type ptcArgs struct {
+	Query string `json:"query"`
+}
+
+func ptcTool(name string) tools.Tool {
+	return tools.NewTool(name,
+		tools.WithPTC(true),
+		tools.WithArgSchema(ptcArgs{}),
+		tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) { return "{}", nil }),
+	)
+}
+
+func countTools(g *gen.Generator, name string) int {
+	var n int
+	for _, t := range g.Request.Tools {
+		if t.Name == name {
+			n++
+		}
+	}
+	return n
+}
+
+func TestActivatePTCReentrant(t *testing.T) {
+	base := (&gen.Generator{}).SetTools(ptcTool("get_weather"), tools.NewTool("regular"))
+
+	first, err := base.ActivatePTC(ptc.JavaScript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if countTools(first, ptc.ToolName) != 1 || countTools(first, "regular") != 1 || len(first.Request.PTCTools) != 1 {
+		t.Fatalf("unexpected tools after activation: %+v", first.Request.Tools)
+	}
+
+	second, err := first.AddTools(ptcTool("get_time")).ActivatePTC(ptc.JavaScript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if countTools(second, ptc.ToolName) != 1 || len(second.Request.Tools) != 2 {
+		t.Fatalf("expected a single code_execution tool after re-activation, got %+v", second.Request.Tools)
+	}
+	if len(second.Request.PTCTools) != 2 {
+		t.Fatalf("expected 2 ptc tools, got %d", len(second.Request.PTCTools))
+	}
+	if !strings.Contains(*second.Request.PTCSystemFragment, "get_time") {
+		t.Fatal("expected system fragment to be regenerated with the added tool")
+	}
+	if second.Runtime == first.Runtime {
+		t.Fatal("expected re-activation to create a new runtime")
+	}
+
+	// the original generators are untouched
+	if len(first.Request.PTCTools) != 1 || strings.Contains(*first.Request.PTCSystemFragment, "get_time") {
+		t.Fatal("expected first generator to be untouched")
+	}
+	if base.Runtime != nil || len(base.Request.PTCTools) != 0 || countTools(base, ptc.ToolName) != 0 {
+		t.Fatal("expected base generator to be untouched")
+	}
+}
+
+func TestActivatePTCKeepsCustomFragment(t *testing.T) {
+	g, err := (&gen.Generator{}).SetTools(ptcTool("get_weather")).SetPTCSystemFragment("custom").ActivatePTC(ptc.JavaScript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err = g.ActivatePTC(ptc.JavaScript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *g.Request.PTCSystemFragment != "custom" {
+		t.Fatalf("expected custom fragment to be kept, got %s", *g.Request.PTCSystemFragment)
+	}
+}
+
+func TestActivatePTCUnsupportedLanguage(t *testing.T) {
+	g, err := (&gen.Generator{}).SetTools(ptcTool("get_weather")).ActivatePTC(ptc.JavaScript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := g.ActivatePTC(ptc.Lua)
+	if err == nil {
+		t.Fatal("expected error for unsupported language")
+	}
+	if res != g {
+		t.Fatal("expected the receiver to be returned on error")
+	}
+}
+
+func TestPTCSettersDoNotMutateSharedRuntime(t *testing.T) {
+	base, err := (&gen.Generator{}).SetTools(ptcTool("get_weather")).ActivatePTC(ptc.JavaScript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limited := base.MaxPTCCalls(1)
+	if limited.Runtime != base.Runtime {
+		t.Fatal("expected runtime to be shared between clones")
+	}
+
+	var codeExecution tools.Tool
+	for _, tool := range base.Request.Tools {
+		if tool.Name == ptc.ToolName {
+			codeExecution = tool
+		}
+	}
+	call := tools.Call{Name: ptc.ToolName, Argument: []byte(`{"code": "__setResult(1)"}`)}
+	baseCtx := base.ToolContext()
+	for i := 0; i < 2; i++ {
+		res, err := codeExecution.Function(baseCtx, call)
+		if err != nil || res != "1" {
+			t.Fatalf("expected base generator to be unlimited, got %s, %v", res, err)
+		}
+	}
+
+	// settings apply to the code session of each run, e.g. of agent.Run, not to the shared runtime
+	for run := 0; run < 2; run++ {
+		ctx := limited.ToolContext()
+		res, _ := codeExecution.Function(ctx, call)
+		if res != "1" {
+			t.Fatalf("expected first call of run %d to run, got %s", run, res)
+		}
+		res, _ = codeExecution.Function(ctx, call)
+		if !strings.Contains(res, "budget exhausted") {
+			t.Fatalf("expected limit to apply to run %d, got %s", run, res)
+		}
+	}
+	if session := tools.CodeSessionFromContext(baseCtx); session.Executions() != 2 {
+		t.Fatalf("expected the runs of the clone to leave the session of the base run alone, got %d executions", session.Executions())
+	}
+}
+
+type orderArgs struct {
+	Customer string `json:"customer" json-description:"Customer id"`
+	Lines    []struct {
+		SKU      string `json:"sku"`
+		Quantity int    `json:"quantity" json-minimum:"1"`
+	} `json:"lines"`
+	Shipping struct {
+		Method string `json:"method" json-enum:"standard,express"`
+	} `json:"shipping"`
+}
+
+func TestToolsJSONSchema(t *testing.T) {
+	g := gen.Generator{}
+	g = *g.SetTools(tools.NewTool("create_order",
+		tools.WithDescription("Creates an order"),
+		tools.WithArgSchema(orderArgs{}),
+	))
+
+	raw, err := json.Marshal(g.ToolsJSONSchema())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var docs []struct {
+		Schema      string   `json:"$schema"`
+		Title       string   `json:"title"`
+		Description string   `json:"description"`
+		Required    []string `json:"required"`
+		Properties  struct {
+			Customer struct {
+				Description string `json:"description"`
+			} `json:"customer"`
+			Lines struct {
+				Type  string `json:"type"`
+				Items struct {
+					Properties struct {
+						Quantity struct {
+							Minimum float64 `json:"minimum"`
+						} `json:"quantity"`
+					} `json:"properties"`
+					AdditionalProperties *bool `json:"additionalProperties"`
+				} `json:"items"`
+			} `json:"lines"`
+			Shipping struct {
+				Properties struct {
+					Method struct {
+						Enum []string `json:"enum"`
+					} `json:"method"`
+				} `json:"properties"`
+			} `json:"shipping"`
+		} `json:"properties"`
+	}
+	if err := json.Unmarshal(raw, &docs); err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 1 {
+		t.Fatalf("expected 1 schema, got %s", raw)
+	}
+	doc := docs[0]
+	if doc.Schema != "http://json-schema.org/draft-07/schema#" || doc.Title != "create_order" || doc.Description != "Creates an order" {
+		t.Fatalf("unexpected schema header: %s", raw)
+	}
+	if len(doc.Required) != 3 || doc.Properties.Customer.Description != "Customer id" {
+		t.Fatalf("unexpected top level properties: %s", raw)
+	}
+	if doc.Properties.Lines.Type != "array" || doc.Properties.Lines.Items.Properties.Quantity.Minimum != 1 {
+		t.Fatalf("expected nested array items: %s", raw)
+	}
+	if doc.Properties.Lines.Items.AdditionalProperties != nil {
+		t.Fatalf("expected raw json schema objects to be left open: %s", raw)
+	}
+	if len(doc.Properties.Shipping.Properties.Method.Enum) != 2 {
+		t.Fatalf("expected nested enum: %s", raw)
+	}
+
+	spec := g.ToolsOpenAISpec()
+	fn, _ := spec[0]["function"].(map[string]any)
+	params, _ := fn["parameters"].(map[string]any)
+	if fn["name"] != "create_order" || params["additionalProperties"] != false {
+		t.Fatalf("unexpected openai spec: %v", spec)
+	}
+}
+
+func TestSystemFragmentPosition(t *testing.T) {
+	g := (&gen.Generator{}).System("system.").SetPTCSystemFragment("fragment.")
+	conversation := []prompt.Prompt{prompt.AsUser("hi")}
+
+	tests := []struct {
+		position gen.FragmentPosition
+		system   string
+		prompts  int
+	}{
+		{position: gen.FragmentAppend, system: "system.fragment.", prompts: 1},
+		{position: gen.FragmentPrepend, system: "fragment.system.", prompts: 1},
+		{position: gen.FragmentUserMessage, system: "system.", prompts: 2},
+	}
+	for _, tt := range tests {
+		req, prompts := g.SystemFragmentPosition(tt.position).Request.WithPTCSystemFragment(conversation)
+		if req.SystemPrompt != tt.system || len(prompts) != tt.prompts {
+			t.Fatalf("%q: unexpected system prompt %q and %d prompts", tt.position, req.SystemPrompt, len(prompts))
+		}
+		if tt.position == gen.FragmentUserMessage && (prompts[0].Role != prompt.UserRole || prompts[0].Text != "fragment." || prompts[1].Text != "hi") {
+			t.Fatalf("expected fragment in a first user message, got %+v", prompts)
+		}
+	}
+
+	req, prompts := (&gen.Generator{}).System("system.").Request.WithPTCSystemFragment(conversation)
+	if req.SystemPrompt != "system." || len(prompts) != 1 {
+		t.Fatal("expected request without fragment to be left as is")
+	}
+}
+
+func TestMockPrompterLast(t *testing.T) {
+	recorder := gen.NewMockPrompter(gen.MockText("ok"))
+	g := (&gen.Generator{Prompter: recorder}).
+		System("system.").
+		Temperature(0.5).
+		SetTools(ptcTool("search"), tools.NewTool("plain", tools.WithArgSchema(ptcArgs{})))
+	g, err := g.ActivatePTC(ptc.JavaScript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// re-activation must not duplicate the tool or the fragment
+	g, err = g.ActivatePTC(ptc.JavaScript)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := g.Prompt(prompt.AsUser("hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text, _ := resp.AsText(); text != "ok" {
+		t.Fatalf("expected canned response, got %q", text)
+	}
+	sent, ok := recorder.Last()
+	if !ok || len(recorder.Requests) != 1 {
+		t.Fatalf("expected one recorded request, got %d", len(recorder.Requests))
+	}
+
+	var names []string
+	for _, tool := range sent.Tools {
+		names = append(names, tool.Name)
+	}
+	if strings.Join(names, ",") != "plain,"+ptc.ToolName {
+		t.Fatalf("expected the plain tool and a single %s tool, got %v", ptc.ToolName, names)
+	}
+	fragment := *sent.PTCSystemFragment
+	if !strings.HasPrefix(sent.SystemPrompt, "system.") || strings.Count(sent.SystemPrompt, fragment) != 1 {
+		t.Fatalf("expected the fragment once after the system prompt, got %q", sent.SystemPrompt)
+	}
+	if sent.Temperature == nil || *sent.Temperature != 0.5 || len(sent.Prompts) != 1 {
+		t.Fatalf("unexpected request %+v", sent)
+	}
+}
+
+func TestSupportsToolsWithOutput(t *testing.T) {
+	if !(gen.Model{Provider: "OpenAI", Name: "gpt-4o"}).SupportsToolsWithOutput() {
+		t.Fatal("expected models to support tools with output by default")
+	}
+	if (gen.Model{Provider: "VertexAI", Name: "gemini-2.5-flash"}).SupportsToolsWithOutput() {
+		t.Fatal("expected vertexai models not to support tools with output")
+	}
+
+	gen.SetToolsWithOutput("VertexAI/gemini-3-pro", true)
+	gen.SetToolsWithOutput("test/legacy", false)
+	defer gen.SetToolsWithOutput("VertexAI/gemini-3-pro", false)
+	defer gen.SetToolsWithOutput("test/legacy", true)
+	if !(gen.Model{Provider: "VertexAI", Name: "gemini-3-pro"}).SupportsToolsWithOutput() {
+		t.Fatal("expected a registered model to take precedence over its provider")
+	}
+	if (gen.Model{Provider: "test", Name: "legacy"}).SupportsToolsWithOutput() {
+		t.Fatal("expected a registered model not to support tools with output")
+	}
+}
+
+func TestParseFQN(t *testing.T) {
+	tests := []struct {
+		fqn      string
+		lenient  bool
+		expected string // fqn of the parsed model, empty if invalid
+	}{
+		{fqn: "OpenAI/gpt-4o-mini", expected: "OpenAI/gpt-4o-mini"},
+		{fqn: "openai/gpt4o_mini", expected: "openai/gpt4o_mini"},
+		{fqn: "openai/gpt4o_mini", lenient: true, expected: "OpenAI/gpt-4o-mini"},
+		{fqn: "VertexAI.gemini-2.5-flash", expected: ""},
+		{fqn: "VertexAI.gemini-2.5-flash", lenient: true, expected: "VertexAI/gemini-2.5-flash"},
+		{fqn: "vertexai/gemini-2.5-flash", lenient: true, expected: "VertexAI/gemini-2.5-flash"},
+		{fqn: "vllm/weird_model", expected: "vllm/weird_model"},
+		{fqn: "vllm/weird_model", lenient: true, expected: "vLLM/weird_model"},
+		{fqn: "vLLM/Qwen/Qwen3-8B", lenient: true, expected: "vLLM/Qwen/Qwen3-8B"},
+		{fqn: "custom/my_model", lenient: true, expected: "custom/my-model"},
+		{fqn: " Anthropic/claude-3-haiku ", expected: "Anthropic/claude-3-haiku"},
+		{fqn: "", lenient: true, expected: ""},
+		{fqn: "gpt-4o", expected: ""},
+		{fqn: "/gpt-4o", lenient: true, expected: ""},
+		{fqn: "OpenAI/", expected: ""},
+	}
+	for _, tt := range tests {
+		var opts []gen.ParseOption
+		if tt.lenient {
+			opts = gen.Lenient()
+		}
+		model, err := gen.ParseFQN(tt.fqn, opts...)
+		if tt.expected == "" {
+			if !errors.Is(err, gen.ErrInvalidFQN) {
+				t.Fatalf("%q: expected invalid fqn, got %v, %v", tt.fqn, model, err)
+			}
+			continue
+		}
+		if err != nil || model.FQN() != tt.expected {
+			t.Fatalf("%q (lenient %v): expected %s, got %s, %v", tt.fqn, tt.lenient, tt.expected, model.FQN(), err)
+		}
+	}
+
+	for _, provider := range models.Providers() {
+		model, err := gen.ParseFQN(strings.ToLower(provider)+"/model", gen.Lenient()...)
+		if err != nil || model.Provider != provider {
+			t.Fatalf("expected provider %s, got %s, %v", provider, model.Provider, err)
+		}
+	}
+
+	if _, err := gen.ToModel("openai.gpt-4o"); err == nil {
+		t.Fatal("expected ToModel to be strict")
+	}
+}
+
+type countingPrompter struct {
+	gen.MockPrompter
+	counted []gen.Request
+}
+
+func (p *countingPrompter) SetRequest(request gen.Request) {
+	p.MockPrompter.SetRequest(request)
+	p.counted = append(p.counted, request)
+}
+
+func (p *countingPrompter) CountTokens(prompts ...prompt.Prompt) (int, error) {
+	return 42 * len(prompts), nil
+}
+
+func TestCountTokens(t *testing.T) {
+	g := &gen.Generator{Prompter: gen.NewMockPrompter()}
+	n, err := g.System(strings.Repeat("s", 8)).CountTokens(prompt.AsUser(strings.Repeat("u", 11)))
+	if err != nil || n != 5 {
+		t.Fatalf("expected 5 estimated tokens, got %d, %v", n, err)
+	}
+
+	withTool, err := g.SetTools(ptcTool("lookup")).CountTokens(prompt.AsUser("hi"))
+	if err != nil || withTool <= gen.EstimateTokens(gen.Request{}, prompt.AsUser("hi")) {
+		t.Fatalf("expected the tools to be counted, got %d, %v", withTool, err)
+	}
+
+	counter := &countingPrompter{}
+	n, err = (&gen.Generator{Prompter: counter}).System("be brief").CountTokens(prompt.AsUser("hi"), prompt.AsUser("there"))
+	if err != nil || n != 84 {
+		t.Fatalf("expected the count of the prompter, got %d, %v", n, err)
+	}
+	if len(counter.counted) != 1 || counter.counted[0].SystemPrompt != "be brief" {
+		t.Fatalf("expected the request to be set on the prompter, got %+v", counter.counted)
+	}
+}
+
+func TestValidateToolConfig(t *testing.T) {
+	weather := tools.NewTool("weather", tools.WithArgSchema(ptcArgs{}))
+	choices := append(tools.ControlTools, tools.ToolChoice{Name: "weather"})
+	responses := slices.Repeat([]*gen.Response{gen.MockText("sunny")}, len(choices))
+	g := (&gen.Generator{Prompter: gen.NewMockPrompter(responses...)}).SetTools(weather)
+
+	for _, choice := range choices {
+		if _, err := g.SetToolConfig(choice).Prompt(prompt.AsUser("hi")); err != nil {
+			t.Fatalf("expected %s to be valid, got %v", choice.Name, err)
+		}
+	}
+
+	unknown := g.SetToolConfig(tools.ToolChoice{Name: "time"})
+	if _, err := unknown.Prompt(prompt.AsUser("hi")); !errors.Is(err, gen.ErrUnknownToolChoice) {
+		t.Fatalf("expected an unknown tool choice error from Prompt, got %v", err)
+	}
+	if _, err := unknown.Stream(prompt.AsUser("hi")); !errors.Is(err, gen.ErrUnknownToolChoice) {
+		t.Fatalf("expected an unknown tool choice error from Stream, got %v", err)
+	}
+}
+
+func TestSchemaValidation(t *testing.T) {
+	malformed := tools.NewTool("search", tools.WithPTC(true))
+	malformed.ArgumentSchema = &schema.JSON{
+		Type:       schema.Object,
+		Properties: map[string]*schema.JSON{"filters": {Type: schema.Array}},
+	}
+	g := (&gen.Generator{Prompter: gen.NewMockPrompter(gen.MockText("ok"))}).SetTools(malformed)
+
+	if _, err := g.Prompt(prompt.AsUser("hi")); err != nil {
+		t.Fatalf("expected no validation by default, got %v", err)
+	}
+
+	g = g.SchemaValidation(true)
+	_, err := g.Prompt(prompt.AsUser("hi"))
+	if !errors.Is(err, schema.ErrInvalid) || !strings.Contains(err.Error(), "tool search") || !strings.Contains(err.Error(), "$.properties.filters") {
+		t.Fatalf("expected an invalid schema error naming the tool and path, got %v", err)
+	}
+	if _, err := g.ActivatePTC(ptc.JavaScript); !errors.Is(err, schema.ErrInvalid) {
+		t.Fatalf("expected PTC activation to fail, got %v", err)
+	}
+}
+
+func TestWithDefaults(t *testing.T) {
+	defaults := gen.WithDefaults(gen.Defaults{
+		Temperature:    gen.Float(0.2),
+		MaxTokens:      gen.Int(2000),
+		ThinkingBudget: gen.Int(0),
+		PTCLanguage:    ptc.Lua,
+	})
+
+	g := defaults(&gen.Generator{})
+	if *g.Request.Temperature != 0.2 || *g.Request.MaxTokens != 2000 || *g.Request.ThinkingBudget != 0 {
+		t.Fatalf("expected the defaults to be set, got %+v", g.Request)
+	}
+
+	after := g.Temperature(0.7)
+	if *after.Request.Temperature != 0.7 || *g.Request.Temperature != 0.2 {
+		t.Fatalf("expected an explicit temperature after the defaults to win on the clone only")
+	}
+	before := defaults((&gen.Generator{}).Temperature(0.7).ThinkingBudget(1024))
+	if *before.Request.Temperature != 0.7 || *before.Request.ThinkingBudget != 1024 || *before.Request.MaxTokens != 2000 {
+		t.Fatalf("expected explicit settings before the defaults to win, got %+v", before.Request)
+	}
+
+	g = g.SetTools(ptcTool("get_weather"))
+	if _, err := g.ActivatePTC(""); err == nil {
+		t.Fatal("expected an empty language to activate the default, unsupported, language")
+	}
+	if _, err := g.ActivatePTC(ptc.JavaScript); err != nil {
+		t.Fatalf("expected an explicit language to win, got %v", err)
+	}
+	if _, err := (&gen.Generator{}).SetTools(ptcTool("get_weather")).ActivatePTC(""); err != nil {
+		t.Fatalf("expected an empty language to default to javascript, got %v", err)
+	}
+}
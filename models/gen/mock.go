@@ -0,0 +1,125 @@
+package gen
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/modfin/bellman/prompt"
+	"github.com/modfin/bellman/tools"
+)
+
+// ErrMockExhausted is returned by a MockPrompter prompted more times than it has responses
+var ErrMockExhausted = errors.New("mock prompter has no more responses")
+
+// MockPrompter is a Prompter returning scripted responses in order, for testing agent and PTC flows without a live
+// backend. Tool calls without a Ref get it wired from the request tools by name, unless NoRefs is set, and a response
+// without texts or tool calls is returned as an EmptyCandidateError, like the providers do. The requests and prompts
+// it receives are recorded.
+type MockPrompter struct {
+	mu        sync.Mutex
+	request   Request
+	responses []*Response
+
+	NoRefs bool // leave the Ref of tool calls unset, like a provider that does not wire them
+
+	Requests []Request
+	Prompts  [][]prompt.Prompt
+}
+
+func NewMockPrompter(responses ...*Response) *MockPrompter {
+	return &MockPrompter{responses: responses}
+}
+
+// NewMockGenerator returns a generator around a MockPrompter with the responses, and the prompter for inspection
+func NewMockGenerator(responses ...*Response) (*Generator, *MockPrompter) {
+	p := NewMockPrompter(responses...)
+	return &Generator{Prompter: p}, p
+}
+
+// MockText returns a response with a single text, e.g. a final answer or a JSON result
+func MockText(text string) *Response {
+	return &Response{Texts: []string{text}}
+}
+
+// MockToolCall returns a response with a single tool call
+func MockToolCall(id, name, argument string) *Response {
+	return &Response{Tools: []tools.Call{{ID: id, Name: name, Argument: []byte(argument)}}}
+}
+
+func (m *MockPrompter) SetRequest(request Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.request = request
+}
+
+func (m *MockPrompter) Prompt(prompts ...prompt.Prompt) (*Response, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Requests = append(m.Requests, m.request)
+	m.Prompts = append(m.Prompts, append([]prompt.Prompt{}, prompts...))
+	if len(m.responses) == 0 {
+		return nil, ErrMockExhausted
+	}
+	scripted := m.responses[0]
+	m.responses = m.responses[1:]
+	if len(scripted.Texts) == 0 && len(scripted.Tools) == 0 {
+		return nil, fmt.Errorf("no text or tool calls in response, %w", &EmptyCandidateError{
+			FinishReason: scripted.Metadata.FinishReason,
+			ThinkingOnly: len(scripted.Thinking) > 0,
+		})
+	}
+
+	resp := *scripted
+	resp.Tools = append([]tools.Call{}, scripted.Tools...)
+	for i := range resp.Tools {
+		if resp.Tools[i].Ref != nil || m.NoRefs {
+			continue
+		}
+		for j := range m.request.Tools {
+			if m.request.Tools[j].Name == resp.Tools[i].Name {
+				resp.Tools[i].Ref = &m.request.Tools[j]
+			}
+		}
+	}
+	if resp.Metadata.Model == "" {
+		resp.Metadata.Model = m.request.Model.FQN()
+	}
+	return &resp, nil
+}
+
+// Stream sends the next response as a stream of deltas, i.e. its texts and tool calls, followed by its metadata
+func (m *MockPrompter) Stream(prompts ...prompt.Prompt) (<-chan *StreamResponse, error) {
+	resp, err := m.Prompt(prompts...)
+	if err != nil {
+		return nil, err
+	}
+	return streamResponse(resp), nil
+}
+
+func streamResponse(resp *Response) <-chan *StreamResponse {
+	stream := make(chan *StreamResponse, len(resp.Texts)+len(resp.Tools)+2)
+	for _, text := range resp.Texts {
+		stream <- &StreamResponse{Type: TYPE_DELTA, Role: prompt.AssistantRole, Content: text}
+	}
+	for i := range resp.Tools {
+		stream <- &StreamResponse{Type: TYPE_DELTA, Role: prompt.ToolCallRole, Index: i, ToolCall: &resp.Tools[i]}
+	}
+	metadata := resp.Metadata
+	stream <- &StreamResponse{Type: TYPE_METADATA, Metadata: &metadata}
+	stream <- &StreamResponse{Type: TYPE_EOF}
+	close(stream)
+	return stream
+}
+
+// Last returns the last prompted request and prompts, with the PTC system fragment applied as a provider would, for
+// golden tests of what a Generator sends, e.g. that the PTC code_execution tool and system fragment are injected once
+func (m *MockPrompter) Last() (FullRequest, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.Requests) == 0 {
+		return FullRequest{}, false
+	}
+	request, conversation := m.Requests[len(m.Requests)-1].WithPTCSystemFragment(m.Prompts[len(m.Prompts)-1])
+	return FullRequest{Request: request, Prompts: conversation}, true
+}
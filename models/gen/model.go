@@ -2,8 +2,11 @@ package gen
 
 import (
 	"errors"
+	"fmt"
+	"github.com/modfin/bellman/models"
 	"github.com/modfin/bellman/prompt"
 	"strings"
+	"sync"
 )
 
 type Prompter interface {
@@ -40,10 +43,117 @@ func (m Model) String() string {
 	return m.Provider + "/" + m.Name
 }
 
+var toolsWithOutput = struct {
+	sync.RWMutex
+	unsupported map[string]bool
+}{unsupported: map[string]bool{
+	models.ProviderVertexAI: true, // gemini rejects tools with a response schema as of 2025-02-17
+}}
+
+// SetToolsWithOutput registers whether models support tools and structured output in the same request, by provider,
+// e.g. "VertexAI", or by fqn, e.g. "OpenAI/gpt-4o", which takes precedence over the provider
+func SetToolsWithOutput(providerOrFQN string, supported bool) {
+	toolsWithOutput.Lock()
+	defer toolsWithOutput.Unlock()
+	toolsWithOutput.unsupported[providerOrFQN] = !supported
+}
+
+// SupportsToolsWithOutput reports whether the model supports tools and structured output in the same request, see
+// SetToolsWithOutput. Models are assumed to support it unless registered otherwise.
+func (m Model) SupportsToolsWithOutput() bool {
+	toolsWithOutput.RLock()
+	defer toolsWithOutput.RUnlock()
+	if unsupported, ok := toolsWithOutput.unsupported[m.FQN()]; ok {
+		return !unsupported
+	}
+	return !toolsWithOutput.unsupported[m.Provider]
+}
+
+// ToModel parses a strict fqn, i.e. "<provider>/<name>", see ParseFQN
 func ToModel(fqn string) (Model, error) {
+	return ParseFQN(fqn)
+}
+
+// ErrInvalidFQN is returned, wrapped, by ParseFQN
+var ErrInvalidFQN = errors.New("invalid fqn")
+
+// providers are the providers of the services by lower case name, for LenientProvider
+var providers = func() map[string]string {
+	m := map[string]string{}
+	for _, p := range models.Providers() {
+		m[strings.ToLower(p)] = p
+	}
+	return m
+}()
+
+// servedAsIs are the providers serving arbitrary model names, e.g. from Hugging Face, which are never normalized
+var servedAsIs = map[string]bool{models.ProviderVLLM: true, models.ProviderOllama: true}
+
+type parseOptions struct {
+	dotSeparator    bool
+	lenientProvider bool
+	normalizeName   bool
+}
+
+type ParseOption func(*parseOptions)
+
+// DotSeparator also accepts a '.' separating provider and name, e.g. "VertexAI.gemini-2.5-flash", if there is no '/'
+func DotSeparator() ParseOption {
+	return func(o *parseOptions) {
+		o.dotSeparator = true
+	}
+}
+
+// LenientProvider matches known providers case-insensitively, e.g. "openai" is parsed as "OpenAI". Unknown providers
+// are kept as is
+func LenientProvider() ParseOption {
+	return func(o *parseOptions) {
+		o.lenientProvider = true
+	}
+}
+
+// NormalizeName rewrites common spellings of model names, i.e. underscores to dashes and "gpt4" to "gpt-4", e.g.
+// "gpt4o_mini" is parsed as "gpt-4o-mini". Names of providers serving arbitrary models, i.e. vLLM and Ollama, are kept
+// as is
+func NormalizeName() ParseOption {
+	return func(o *parseOptions) {
+		o.normalizeName = true
+	}
+}
+
+// Lenient returns all options of ParseFQN, for model strings given by users, e.g. on the command line
+func Lenient() []ParseOption {
+	return []ParseOption{DotSeparator(), LenientProvider(), NormalizeName()}
+}
+
+// ParseFQN parses a model fqn, "<provider>/<name>", into a model. Both parts are required, and the name may contain
+// further '/', e.g. "vLLM/Qwen/Qwen3-8B". The options relax the parsing, see Lenient
+func ParseFQN(fqn string, opts ...ParseOption) (Model, error) {
+	var o parseOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	fqn = strings.TrimSpace(fqn)
 	provider, name, found := strings.Cut(fqn, "/")
+	if !found && o.dotSeparator {
+		provider, name, found = strings.Cut(fqn, ".")
+	}
 	if !found {
-		return Model{}, errors.New("invalid fqn, did not find a '/' separating provider and model")
+		return Model{}, fmt.Errorf("%w %q, did not find a '/' separating provider and model", ErrInvalidFQN, fqn)
+	}
+	if provider == "" || name == "" {
+		return Model{}, fmt.Errorf("%w %q, provider and model are required", ErrInvalidFQN, fqn)
+	}
+
+	if canonical, ok := providers[strings.ToLower(provider)]; ok && o.lenientProvider {
+		provider = canonical
+	}
+	if o.normalizeName && !servedAsIs[provider] {
+		name = strings.ReplaceAll(name, "_", "-")
+		if strings.HasPrefix(name, "gpt4") {
+			name = "gpt-4" + strings.TrimPrefix(name, "gpt4")
+		}
 	}
 	return Model{
 		Provider: provider,
@@ -2,6 +2,8 @@ package gen
 
 import (
 	"context"
+	"errors"
+	"fmt"
 
 	"github.com/modfin/bellman/prompt"
 	"github.com/modfin/bellman/schema"
@@ -9,7 +11,9 @@ import (
 )
 
 type Request struct {
-	Context context.Context `json:"-"`
+	Context    context.Context `json:"-"`
+	ToolValues map[string]any  `json:"-"` // request scoped values for tool functions, see tools.ValueFromContext
+	TraceID    string          `json:"-"` // correlates logs of a request across client, agent and proxy, see Generator.WithTraceID
 
 	Stream bool `json:"stream"`
 
@@ -19,14 +23,22 @@ type Request struct {
 	OutputSchema *schema.JSON `json:"output_schema,omitempty"`
 	StrictOutput bool         `json:"output_strict,omitempty"`
 
-	Tools             []tools.Tool      `json:"tools,omitempty"`
-	ToolConfig        *tools.ToolChoice `json:"tool,omitempty"`
-	PTCTools          []tools.Tool      `json:"ptc_tools,omitempty"`
-	PTCSystemFragment *string           `json:"ptc_system_fragment,omitempty"`
+	Tools               []tools.Tool      `json:"tools,omitempty"`
+	ToolConfig          *tools.ToolChoice `json:"tool,omitempty"`
+	PTCTools            []tools.Tool      `json:"ptc_tools,omitempty"`
+	PTCSystemFragment   *string           `json:"ptc_system_fragment,omitempty"`
+	PTCFragmentPosition FragmentPosition  `json:"ptc_fragment_position,omitempty"` // where the PTC system fragment is placed, defaults to FragmentAppend
+	MaxPTCCalls         *int              `json:"max_ptc_calls,omitempty"`
+	PTCDeduplication    *bool             `json:"ptc_deduplication,omitempty"`
+	PTCSeed             *int64            `json:"ptc_seed,omitempty"` // seeds the randomness of the PTC runtime, see Generator.PTCSeed
+
+	MaxToolResponseBytes *int `json:"max_tool_response_bytes,omitempty"` // default response size limit of tools, see tools.WithMaxResponseBytes
 
 	ThinkingBudget *int  `json:"thinking_budget,omitempty"`
 	ThinkingParts  *bool `json:"thinking_parts,omitempty"`
 
+	StructuredToolResponses *bool `json:"structured_tool_responses,omitempty"` // send JSON tool responses as objects, VertexAI only
+
 	TopP             *float64 `json:"top_p,omitempty"`
 	TopK             *int     `json:"top_k,omitempty"`
 	Temperature      *float64 `json:"temperature,omitempty"`
@@ -36,6 +48,69 @@ type Request struct {
 	StopSequences    []string `json:"stop_sequences,omitempty"`
 }
 
+// FragmentPosition controls where the PTC system fragment is placed in a request
+type FragmentPosition string
+
+const (
+	FragmentAppend      FragmentPosition = ""             // after the system prompt, the default
+	FragmentPrepend     FragmentPosition = "prepend"      // before the system prompt
+	FragmentUserMessage FragmentPosition = "user_message" // in a synthetic user message before the conversation
+)
+
+// WithPTCSystemFragment returns the request and the conversation with the PTC system fragment placed as set by
+// PTCFragmentPosition. The request and the conversation are left as is if there is no fragment.
+func (r Request) WithPTCSystemFragment(conversation []prompt.Prompt) (Request, []prompt.Prompt) {
+	if r.PTCSystemFragment == nil {
+		return r, conversation
+	}
+	fragment := *r.PTCSystemFragment
+	switch r.PTCFragmentPosition {
+	case FragmentPrepend:
+		r.SystemPrompt = fragment + r.SystemPrompt
+	case FragmentUserMessage:
+		conversation = append([]prompt.Prompt{prompt.AsUser(fragment)}, conversation...)
+	default:
+		r.SystemPrompt += fragment
+	}
+	return r, conversation
+}
+
+// ErrUnknownToolChoice is returned, wrapped, when the tool config names a tool that is not in the tool set
+var ErrUnknownToolChoice = errors.New("tool config references an unknown tool")
+
+// ValidateToolConfig checks that a named tool config, i.e. other than tools.NoTool, tools.AutoTool and
+// tools.RequiredTool, references one of the tools of the request
+func (r Request) ValidateToolConfig() error {
+	if r.ToolConfig == nil {
+		return nil
+	}
+	for _, c := range tools.ControlTools {
+		if r.ToolConfig.Name == c.Name {
+			return nil
+		}
+	}
+	for _, t := range r.Tools {
+		if t.Name == r.ToolConfig.Name {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w, %s", ErrUnknownToolChoice, r.ToolConfig.Name)
+}
+
+// ValidateToolSchemas checks that the argument schemas of the tools, PTC tools included, are well-formed, see
+// schema.JSON.Validate. Tools without arguments, i.e. a nil schema, are valid
+func (r Request) ValidateToolSchemas() error {
+	for _, t := range append(append([]tools.Tool{}, r.Tools...), r.PTCTools...) {
+		if t.ArgumentSchema == nil {
+			continue
+		}
+		if err := t.ArgumentSchema.Validate(); err != nil {
+			return fmt.Errorf("invalid argument schema of tool %s; %w", t.Name, err)
+		}
+	}
+	return nil
+}
+
 type FullRequest struct {
 	Request
 	Prompts []prompt.Prompt `json:"prompts"`
@@ -3,7 +3,10 @@ package gen
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
+
 	"github.com/modfin/bellman/models"
 	"github.com/modfin/bellman/prompt"
 	"github.com/modfin/bellman/tools"
@@ -23,6 +26,48 @@ func (s StreamResponseError) Error() string {
 	return string(s)
 }
 
+// ErrEmptyCandidate is matched, using errors.Is, by an EmptyCandidateError
+var ErrEmptyCandidate = errors.New("empty candidate in response")
+
+// EmptyCandidateError is returned by a prompter when the model responded without any text or tool calls, e.g.
+// due to safety filtering or a thinking-only turn. Such responses are usually intermittent and worth a re-prompt.
+type EmptyCandidateError struct {
+	FinishReason string // the finish or block reason reported by the provider, if any
+	ThinkingOnly bool   // the response only contained thinking parts
+}
+
+func (e *EmptyCandidateError) Error() string {
+	msg := ErrEmptyCandidate.Error()
+	if e.ThinkingOnly {
+		msg += ", only thinking parts"
+	}
+	if e.FinishReason != "" {
+		msg += ", finish reason: " + e.FinishReason
+	}
+	return msg
+}
+
+func (e *EmptyCandidateError) Is(target error) bool {
+	return target == ErrEmptyCandidate
+}
+
+// ErrBlocked is matched, using errors.Is, by a BlockedError
+var ErrBlocked = errors.New("response blocked")
+
+// BlockedError is returned by a prompter when the provider blocked the prompt or response, e.g. by safety filters.
+// Unlike an empty candidate, re-sending the same prompt is unlikely to help.
+type BlockedError struct {
+	Reason string // the finish or block reason reported by the provider, e.g. SAFETY
+}
+
+func (e *BlockedError) Error() string {
+	return ErrBlocked.Error() + ", reason: " + e.Reason
+}
+
+func (e *BlockedError) Is(target error) bool {
+	return target == ErrBlocked
+}
+
 type StreamResponse struct {
 	Type     StreamingResponseType `json:"type"`
 	Role     prompt.Role           `json:"role"`
@@ -84,12 +129,20 @@ func (r *Response) AsTools() ([]tools.Call, error) {
 	return r.Tools, nil
 }
 
+// AsText returns the text of the response. Thinking parts are never included, see ThinkingText
 func (r *Response) AsText() (string, error) {
 	if !r.IsText() {
 		return "", fmt.Errorf("no choices in response")
 	}
 	return r.Texts[0], nil
 }
+
+// ThinkingText returns the thinking parts of the response, joined by new lines, or an empty string if the provider
+// returned none
+func (r *Response) ThinkingText() string {
+	return strings.Join(r.Thinking, "\n")
+}
+
 func (r *Response) Unmarshal(ref any) error {
 	text, err := r.AsText()
 	if err != nil {
@@ -98,6 +151,58 @@ func (r *Response) Unmarshal(ref any) error {
 	return json.Unmarshal([]byte(text), ref)
 }
 
+// UnmarshalLenient is Unmarshal for models not strictly following the output schema. The JSON is extracted from the
+// text, see ExtractJSON, before unmarshalling
+func (r *Response) UnmarshalLenient(ref any) error {
+	text, err := r.AsText()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(ExtractJSON(text)), ref)
+}
+
+// ExtractJSON returns the first balanced JSON object or array of the text, e.g. from within a markdown code fence or
+// surrounded by prose. The text is returned trimmed if no object or array is found
+func ExtractJSON(text string) string {
+	text = strings.TrimSpace(text)
+	if _, fenced, ok := strings.Cut(text, "```"); ok {
+		// skip the language tag, e.g. ```json
+		if i := strings.IndexAny(fenced, "\n{["); i >= 0 && fenced[i] == '\n' {
+			fenced = fenced[i+1:]
+		}
+		if body, _, ok := strings.Cut(fenced, "```"); ok {
+			text = strings.TrimSpace(body)
+		}
+	}
+
+	start := strings.IndexAny(text, "{[")
+	if start < 0 {
+		return text
+	}
+	var depth int
+	var inString, escaped bool
+	for i := start; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case escaped:
+			escaped = false
+		case inString && c == '\\':
+			escaped = true
+		case c == '"':
+			inString = !inString
+		case inString:
+		case c == '{' || c == '[':
+			depth++
+		case c == '}' || c == ']':
+			depth--
+			if depth == 0 {
+				return text[start : i+1]
+			}
+		}
+	}
+	return text[start:]
+}
+
 func (r *Response) IsText() bool {
 	return len(r.Texts) > 0 && len(r.Tools) == 0
 }
@@ -0,0 +1,80 @@
+package gen_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/modfin/bellman/models/gen"
+)
+
+func TestResponseErrors(t *testing.T) {
+	blocked := fmt.Errorf("response blocked, %w", &gen.BlockedError{Reason: "SAFETY"})
+	if !errors.Is(blocked, gen.ErrBlocked) || errors.Is(blocked, gen.ErrEmptyCandidate) {
+		t.Fatalf("expected blocked error to only match ErrBlocked: %v", blocked)
+	}
+	var b *gen.BlockedError
+	if !errors.As(blocked, &b) || b.Reason != "SAFETY" {
+		t.Fatalf("expected reason to be accessible, got %v", b)
+	}
+
+	empty := fmt.Errorf("no parts in response, %w", &gen.EmptyCandidateError{FinishReason: "STOP", ThinkingOnly: true})
+	if !errors.Is(empty, gen.ErrEmptyCandidate) || errors.Is(empty, gen.ErrBlocked) {
+		t.Fatalf("expected empty candidate error to only match ErrEmptyCandidate: %v", empty)
+	}
+	if empty.Error() != "no parts in response, empty candidate in response, only thinking parts, finish reason: STOP" {
+		t.Fatalf("unexpected message %q", empty.Error())
+	}
+}
+
+func TestExtractJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		json string
+	}{
+		{name: "plain", text: `{"a":1}`, json: `{"a":1}`},
+		{name: "fenced", text: "```json\n{\"a\":1}\n```", json: `{"a":1}`},
+		{name: "fenced without tag", text: "```\n[1,2]\n```", json: `[1,2]`},
+		{name: "prose", text: `Here is the result: {"a":{"b":"}"}} Hope this helps!`, json: `{"a":{"b":"}"}}`},
+		{name: "prose and fence", text: "Sure!\n```json\n{\"a\":\"x\\\"y\"}\n```\nAnything else?", json: `{"a":"x\"y"}`},
+		{name: "no json", text: "  no json here ", json: "no json here"},
+	}
+	for _, tt := range tests {
+		if got := gen.ExtractJSON(tt.text); got != tt.json {
+			t.Fatalf("%s: expected %s, got %s", tt.name, tt.json, got)
+		}
+	}
+
+	var out struct {
+		A int `json:"a"`
+	}
+	resp := &gen.Response{Texts: []string{"The answer:\n```json\n{\"a\":1}\n```"}}
+	if err := resp.Unmarshal(&out); err == nil {
+		t.Fatal("expected strict unmarshal to fail on fenced json")
+	}
+	if err := resp.UnmarshalLenient(&out); err != nil || out.A != 1 {
+		t.Fatalf("expected lenient unmarshal to succeed, got %+v, %v", out, err)
+	}
+}
+
+func TestThinkingText(t *testing.T) {
+	res := &gen.Response{
+		Thinking: []string{"the user wants a greeting", "keep it short"},
+		Texts:    []string{"hello"},
+	}
+	if text, err := res.AsText(); err != nil || text != "hello" {
+		t.Fatalf("expected only the answer as text, got %q, %v", text, err)
+	}
+	if res.ThinkingText() != "the user wants a greeting\nkeep it short" {
+		t.Fatalf("unexpected thinking text %q", res.ThinkingText())
+	}
+
+	thinkingOnly := &gen.Response{Thinking: []string{"hmm"}}
+	if _, err := thinkingOnly.AsText(); err == nil {
+		t.Fatal("expected no text of a thinking only response")
+	}
+	if (&gen.Response{Texts: []string{"hello"}}).ThinkingText() != "" {
+		t.Fatal("expected no thinking text")
+	}
+}
@@ -0,0 +1,118 @@
+package gen
+
+import (
+	"context"
+
+	"github.com/modfin/bellman/prompt"
+)
+
+// send passes resp on to out, or reports false once ctx is done, i.e. the reader has stopped reading
+func send(ctx context.Context, out chan<- *StreamResponse, resp *StreamResponse) bool {
+	select {
+	case out <- resp:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// drain discards the rest of in, so that the producer of the stream is not blocked either
+func drain(in <-chan *StreamResponse) {
+	for range in {
+	}
+}
+
+// AggregateToolCalls wraps a stream and assembles tool call argument deltas into complete tool calls. Text, thinking
+// and metadata responses are passed through as is, while the assembled tool calls are emitted, in the order they
+// started, once the turn finishes, i.e. before EOF or when the input stream closes. Once ctx is done, the output
+// stream is closed and the rest of the input stream is discarded.
+func AggregateToolCalls(ctx context.Context, in <-chan *StreamResponse) <-chan *StreamResponse {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	out := make(chan *StreamResponse, cap(in))
+
+	go func() {
+		defer close(out)
+
+		var calls []*StreamResponse
+		byKey := map[any]*StreamResponse{}
+		flush := func() bool {
+			for _, c := range calls {
+				if !send(ctx, out, c) {
+					return false
+				}
+			}
+			calls = nil
+			byKey = map[any]*StreamResponse{}
+			return true
+		}
+
+		for resp := range in {
+			if resp.Type != TYPE_DELTA || resp.ToolCall == nil {
+				if resp.Type == TYPE_EOF && !flush() {
+					drain(in)
+					return
+				}
+				if !send(ctx, out, resp) {
+					drain(in)
+					return
+				}
+				continue
+			}
+
+			// providers repeat the id with every delta, fall back on the index if they don't
+			var key any = resp.ToolCall.ID
+			if resp.ToolCall.ID == "" {
+				key = resp.Index
+			}
+			agg, ok := byKey[key]
+			if !ok {
+				call := *resp.ToolCall
+				call.Argument = append([]byte{}, resp.ToolCall.Argument...)
+				agg = &StreamResponse{
+					Type:     TYPE_DELTA,
+					Role:     prompt.ToolCallRole,
+					Index:    resp.Index,
+					ToolCall: &call,
+				}
+				byKey[key] = agg
+				calls = append(calls, agg)
+				continue
+			}
+			agg.ToolCall.Argument = append(agg.ToolCall.Argument, resp.ToolCall.Argument...)
+			if agg.ToolCall.Ref == nil {
+				agg.ToolCall.Ref = resp.ToolCall.Ref
+			}
+		}
+		flush()
+	}()
+
+	return out
+}
+
+// SeparateThinking wraps a stream and passes the content of thinking deltas to onThinking, e.g. to display the chain of
+// thought apart from the answer, while all other responses are passed through as is. Once ctx is done, the output
+// stream is closed and the rest of the input stream is discarded.
+func SeparateThinking(ctx context.Context, in <-chan *StreamResponse, onThinking func(content string)) <-chan *StreamResponse {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	out := make(chan *StreamResponse, cap(in))
+
+	go func() {
+		defer close(out)
+		for resp := range in {
+			if resp.Type == TYPE_THINKING_DELTA {
+				onThinking(resp.Content)
+				continue
+			}
+			if !send(ctx, out, resp) {
+				drain(in)
+				return
+			}
+		}
+	}()
+
+	return out
+}
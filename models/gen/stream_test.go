@@ -0,0 +1,133 @@
+package gen_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/modfin/bellman/models/gen"
+	"github.com/modfin/bellman/prompt"
+	"github.com/modfin/bellman/tools"
+)
+
+func toolDelta(id, name, arg string) *gen.StreamResponse {
+	return &gen.StreamResponse{
+		Type:     gen.TYPE_DELTA,
+		Role:     prompt.ToolCallRole,
+		ToolCall: &tools.Call{ID: id, Name: name, Argument: []byte(arg)},
+	}
+}
+
+func TestAggregateToolCalls(t *testing.T) {
+	in := make(chan *gen.StreamResponse, 10)
+	in <- &gen.StreamResponse{Type: gen.TYPE_DELTA, Role: prompt.AssistantRole, Content: "let me check"}
+	in <- toolDelta("a", "weather", `{"city":`)
+	in <- toolDelta("b", "time", `{"zone":"CET"}`)
+	in <- toolDelta("a", "weather", `"Stockholm"}`)
+	in <- &gen.StreamResponse{Type: gen.TYPE_EOF}
+	close(in)
+
+	var out []*gen.StreamResponse
+	for r := range gen.AggregateToolCalls(context.Background(), in) {
+		out = append(out, r)
+	}
+
+	if len(out) != 4 {
+		t.Fatalf("expected 4 responses, got %d", len(out))
+	}
+	if out[0].Content != "let me check" {
+		t.Fatalf("expected text delta to pass through, got %+v", out[0])
+	}
+	if out[1].ToolCall.ID != "a" || string(out[1].ToolCall.Argument) != `{"city":"Stockholm"}` {
+		t.Fatalf("expected assembled weather call, got %+v", out[1].ToolCall)
+	}
+	if out[2].ToolCall.ID != "b" || string(out[2].ToolCall.Argument) != `{"zone":"CET"}` {
+		t.Fatalf("expected time call, got %+v", out[2].ToolCall)
+	}
+	if out[3].Type != gen.TYPE_EOF {
+		t.Fatalf("expected EOF last, got %+v", out[3])
+	}
+}
+
+func TestAggregateToolCallsStopReading(t *testing.T) {
+	in := make(chan *gen.StreamResponse)
+	ctx, cancel := context.WithCancel(context.Background())
+	out := gen.AggregateToolCalls(ctx, in)
+
+	in <- &gen.StreamResponse{Type: gen.TYPE_DELTA, Role: prompt.AssistantRole, Content: "first"}
+	if r := <-out; r.Content != "first" {
+		t.Fatalf("expected the first response, got %+v", r)
+	}
+
+	// the reader stops reading, the producer must not block on further responses
+	cancel()
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		for i := 0; i < 10; i++ {
+			in <- &gen.StreamResponse{Type: gen.TYPE_DELTA, Role: prompt.AssistantRole, Content: "more"}
+		}
+		in <- &gen.StreamResponse{Type: gen.TYPE_EOF}
+		close(in)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("expected the rest of the input to be drained")
+	}
+	for range out {
+	}
+}
+
+func TestSeparateThinking(t *testing.T) {
+	in := make(chan *gen.StreamResponse, 10)
+	in <- &gen.StreamResponse{Type: gen.TYPE_THINKING_DELTA, Role: prompt.AssistantRole, Content: "thinking "}
+	in <- &gen.StreamResponse{Type: gen.TYPE_DELTA, Role: prompt.AssistantRole, Content: "hel"}
+	in <- &gen.StreamResponse{Type: gen.TYPE_THINKING_DELTA, Role: prompt.AssistantRole, Content: "more"}
+	in <- &gen.StreamResponse{Type: gen.TYPE_DELTA, Role: prompt.AssistantRole, Content: "lo"}
+	in <- &gen.StreamResponse{Type: gen.TYPE_EOF}
+	close(in)
+
+	var thinking, text string
+	var out []*gen.StreamResponse
+	for r := range gen.SeparateThinking(context.Background(), in, func(content string) { thinking += content }) {
+		text += r.Content
+		out = append(out, r)
+	}
+
+	if thinking != "thinking more" || text != "hello" {
+		t.Fatalf("expected thinking and text apart, got %q and %q", thinking, text)
+	}
+	if len(out) != 3 || out[2].Type != gen.TYPE_EOF {
+		t.Fatalf("expected the other responses to pass through, got %d", len(out))
+	}
+}
+
+func TestSeparateThinkingStopReading(t *testing.T) {
+	in := make(chan *gen.StreamResponse)
+	ctx, cancel := context.WithCancel(context.Background())
+	out := gen.SeparateThinking(ctx, in, func(content string) {})
+
+	in <- &gen.StreamResponse{Type: gen.TYPE_DELTA, Role: prompt.AssistantRole, Content: "first"}
+	if r := <-out; r.Content != "first" {
+		t.Fatalf("expected the first response, got %+v", r)
+	}
+
+	// the reader stops reading, the producer must not block on further responses
+	cancel()
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		for i := 0; i < 10; i++ {
+			in <- &gen.StreamResponse{Type: gen.TYPE_DELTA, Role: prompt.AssistantRole, Content: "more"}
+		}
+		close(in)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("expected the rest of the input to be drained")
+	}
+	for range out {
+	}
+}
@@ -0,0 +1,92 @@
+package limit
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned by Breaker.Allow while the circuit is open
+var ErrCircuitOpen = errors.New("circuit open, too many consecutive upstream errors")
+
+// Breaker fast-fails requests after a number of consecutive upstream errors, e.g. to stop wasting quota during an
+// outage. Once the cooldown has passed, a single trial request is let through, closing the circuit if it succeeds
+// and opening it for another cooldown if it fails. A nil Breaker never opens.
+type Breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+
+	now func() time.Time
+}
+
+// NewBreaker returns a breaker that opens after threshold consecutive failures, for cooldown. A threshold <= 0
+// disables the breaker, and nil is returned.
+func NewBreaker(threshold int, cooldown time.Duration) *Breaker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &Breaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+	}
+}
+
+// Allow returns ErrCircuitOpen if the request should fail fast. Otherwise, the outcome of the request must be
+// reported by Success or Failure, or Release if it has no outcome, e.g. it was canceled.
+func (b *Breaker) Allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return nil
+	}
+	if b.probing || b.now().Before(b.openUntil) {
+		return ErrCircuitOpen
+	}
+	b.probing = true
+	return nil
+}
+
+// Success closes the circuit
+func (b *Breaker) Success() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.probing = false
+}
+
+// Failure counts a consecutive failure, opening the circuit for the cooldown once the threshold is reached
+func (b *Breaker) Failure() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.probing = false
+	if b.failures >= b.threshold {
+		b.openUntil = b.now().Add(b.cooldown)
+	}
+}
+
+// Release reports a request without an outcome, e.g. a canceled one. The state is left as is, but a trial request
+// is given up, letting the next request through as the trial
+func (b *Breaker) Release() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
@@ -0,0 +1,70 @@
+package limit
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	b := NewBreaker(2, time.Minute)
+	now := time.Unix(0, 0)
+	b.now = func() time.Time { return now }
+
+	b.Failure()
+	b.Success()
+	b.Failure()
+	if err := b.Allow(); err != nil {
+		t.Fatalf("expected a success to reset the failures, got %v", err)
+	}
+	b.Failure()
+	if err := b.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected an open circuit, got %v", err)
+	}
+
+	// a single trial after the cooldown, opening again on failure
+	now = now.Add(time.Minute)
+	if err := b.Allow(); err != nil {
+		t.Fatalf("expected a trial after the cooldown, got %v", err)
+	}
+	if err := b.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected a single trial, got %v", err)
+	}
+	b.Failure()
+	if err := b.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected a failed trial to open the circuit, got %v", err)
+	}
+
+	now = now.Add(time.Minute)
+	if err := b.Allow(); err != nil {
+		t.Fatal(err)
+	}
+	b.Success()
+	if err := b.Allow(); err != nil {
+		t.Fatalf("expected a successful trial to close the circuit, got %v", err)
+	}
+
+	// a canceled trial leaves the circuit open, but lets the next request through as the trial
+	b.Failure()
+	b.Failure()
+	now = now.Add(time.Minute)
+	if err := b.Allow(); err != nil {
+		t.Fatal(err)
+	}
+	b.Release()
+	if err := b.Allow(); err != nil {
+		t.Fatalf("expected a new trial after a released one, got %v", err)
+	}
+	b.Release()
+	b.Failure()
+	if err := b.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected a release not to close the circuit, got %v", err)
+	}
+
+	var none *Breaker
+	none.Release()
+	none.Failure()
+	if NewBreaker(0, time.Minute) != nil || none.Allow() != nil {
+		t.Fatal("expected a nil breaker never to open")
+	}
+}
@@ -0,0 +1,107 @@
+package limit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// Limiter gates requests to a provider by a token bucket of requests per second and a maximum number of concurrent
+// requests, e.g. to avoid bursts of 429s from parallel benchmark workers. A nil Limiter does not limit.
+type Limiter struct {
+	rps   float64
+	burst float64
+	slots chan struct{}
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+
+	now   func() time.Time
+	after func(time.Duration) <-chan time.Time
+}
+
+// New returns a limiter of rps requests per second, with bursts of up to burst requests, and at most maxConcurrent
+// requests at a time. A rps or maxConcurrent <= 0 disables that limit, and nil is returned if both are disabled.
+func New(rps float64, burst int, maxConcurrent int) *Limiter {
+	if rps <= 0 && maxConcurrent <= 0 {
+		return nil
+	}
+	l := &Limiter{
+		rps:   max(rps, 0),
+		burst: float64(max(burst, 1)),
+		now:   time.Now,
+		after: time.After,
+	}
+	l.tokens = l.burst
+	if maxConcurrent > 0 {
+		l.slots = make(chan struct{}, maxConcurrent)
+	}
+	return l
+}
+
+// Wait blocks until a request may be made, or the context is done. It returns a release func, to be called when the
+// request is done, and the time spent waiting.
+func (l *Limiter) Wait(ctx context.Context) (release func(), waited time.Duration, err error) {
+	if l == nil {
+		return func() {}, 0, nil
+	}
+	start := l.now()
+
+	if l.rps > 0 {
+		delay := l.reserve()
+		if delay > 0 {
+			select {
+			case <-l.after(delay):
+			case <-ctx.Done():
+				l.unreserve()
+				return nil, l.now().Sub(start), ctx.Err()
+			}
+		}
+	}
+
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		case <-ctx.Done():
+			if l.rps > 0 {
+				l.unreserve()
+			}
+			return nil, l.now().Sub(start), ctx.Err()
+		}
+	}
+
+	var once sync.Once
+	release = func() {
+		once.Do(func() {
+			if l.slots != nil {
+				<-l.slots
+			}
+		})
+	}
+	return release, l.now().Sub(start), nil
+}
+
+// reserve takes a token from the bucket, which may go negative, and returns how long to wait until it is available
+func (l *Limiter) reserve() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if !l.last.IsZero() {
+		l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rps)
+	}
+	l.last = now
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rps * float64(time.Second))
+}
+
+// unreserve returns a token of a cancelled wait
+func (l *Limiter) unreserve() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tokens = math.Min(l.burst, l.tokens+1)
+}
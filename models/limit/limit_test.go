@@ -0,0 +1,133 @@
+package limit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// fakeClock advances when waited on, so pacing is verified without sleeping
+type fakeClock struct {
+	now    time.Time
+	delays []time.Duration
+}
+
+func (c *fakeClock) after(d time.Duration) <-chan time.Time {
+	c.delays = append(c.delays, d)
+	c.now = c.now.Add(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+func withClock(l *Limiter) *fakeClock {
+	c := &fakeClock{now: time.Unix(0, 0)}
+	l.now = func() time.Time { return c.now }
+	l.after = c.after
+	return c
+}
+
+func TestRateLimit(t *testing.T) {
+	l := New(10, 2, 0)
+	clock := withClock(l)
+
+	var waits []time.Duration
+	for i := 0; i < 4; i++ {
+		release, waited, err := l.Wait(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		release()
+		waits = append(waits, waited)
+	}
+	// a burst of 2, then one request per 100ms
+	expected := []time.Duration{0, 0, 100 * time.Millisecond, 100 * time.Millisecond}
+	for i := range expected {
+		if waits[i] != expected[i] {
+			t.Fatalf("expected waits %v, got %v", expected, waits)
+		}
+	}
+
+	// idle time refills the bucket up to the burst
+	clock.now = clock.now.Add(time.Second)
+	for i := 0; i < 2; i++ {
+		if _, waited, _ := l.Wait(context.Background()); waited != 0 {
+			t.Fatalf("expected a refilled burst, waited %v", waited)
+		}
+	}
+}
+
+func TestMaxConcurrent(t *testing.T) {
+	l := New(0, 0, 1)
+	release, _, err := l.Wait(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, _, err := l.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the wait for a slot to respect the context, got %v", err)
+	}
+
+	release()
+	release() // releasing twice frees a single slot
+	if release, _, err = l.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, _, err := l.Wait(ctx); err == nil {
+		t.Fatal("expected a single slot after a double release")
+	}
+	release()
+}
+
+func TestCancelledWait(t *testing.T) {
+	l := New(1, 1, 0)
+	withClock(l)
+	l.after = func(time.Duration) <-chan time.Time { return nil }
+
+	if _, _, err := l.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := l.Wait(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected a cancelled wait, got %v", err)
+	}
+	if l.tokens != 0 {
+		t.Fatalf("expected the token of the cancelled wait to be returned, got %v tokens", l.tokens)
+	}
+
+	if New(0, 0, 0) != nil {
+		t.Fatal("expected no limiter without limits")
+	}
+	var none *Limiter
+	if release, waited, err := none.Wait(context.Background()); err != nil || waited != 0 {
+		t.Fatalf("expected a nil limiter not to limit, got %v, %v", waited, err)
+	} else {
+		release()
+	}
+}
+
+func TestCancelledSlotWait(t *testing.T) {
+	l := New(10, 2, 1)
+	withClock(l)
+
+	release, _, err := l.Wait(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := l.Wait(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected a cancelled wait for a slot, got %v", err)
+	}
+	if l.tokens != 1 {
+		t.Fatalf("expected the token of the cancelled wait for a slot to be returned, got %v tokens", l.tokens)
+	}
+}
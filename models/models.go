@@ -1,10 +1,41 @@
 package models
 
+import "github.com/modfin/bellman/models/pricing"
+
+// Providers of the services, i.e. the Provider of each service package, e.g. openai.Provider
+const (
+	ProviderAnthropic = "Anthropic"
+	ProviderOllama    = "Ollama"
+	ProviderOpenAI    = "OpenAI"
+	ProviderVertexAI  = "VertexAI"
+	ProviderVLLM      = "vLLM"
+	ProviderVoyageAI  = "VoyageAI"
+)
+
+// Providers returns the providers of the services
+func Providers() []string {
+	return []string{ProviderAnthropic, ProviderOllama, ProviderOpenAI, ProviderVertexAI, ProviderVLLM, ProviderVoyageAI}
+}
+
 type Metadata struct {
 	Model          string         `json:"model,omitempty"`
 	InputTokens    int            `json:"input_tokens,omitempty"`
 	ThinkingTokens int            `json:"thinking_tokens,omitempty"`
 	OutputTokens   int            `json:"output_tokens,omitempty"`
 	TotalTokens    int            `json:"total_tokens,omitempty"`
+	CostUSD        float64        `json:"cost_usd,omitempty"`
+	FinishReason   string         `json:"finish_reason,omitempty"`    // as reported by the provider, e.g. STOP or MAX_TOKENS
+	ThrottleWaitMs int64          `json:"throttle_wait_ms,omitempty"` // time spent waiting for a client side rate limit
 	Other          map[string]any `json:"other,omitempty"`
 }
+
+// EstimateCost sets CostUSD from the token counts using the price table, thinking tokens are billed as output.
+// Returns false, leaving CostUSD untouched, if the model is not in the table
+func (m *Metadata) EstimateCost(table pricing.Table) bool {
+	price, ok := table.Lookup(m.Model)
+	if !ok {
+		return false
+	}
+	m.CostUSD = price.Cost(m.InputTokens, m.OutputTokens+m.ThinkingTokens)
+	return true
+}
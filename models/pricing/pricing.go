@@ -0,0 +1,52 @@
+package pricing
+
+import "strings"
+
+// Price holds the USD cost per million tokens for a model
+type Price struct {
+	InputPerMillion  float64 `json:"input_per_million"`
+	OutputPerMillion float64 `json:"output_per_million"`
+}
+
+// Cost returns the USD cost of the given token counts
+func (p Price) Cost(inputTokens, outputTokens int) float64 {
+	return (float64(inputTokens)*p.InputPerMillion + float64(outputTokens)*p.OutputPerMillion) / 1_000_000.0
+}
+
+// Table maps model FQN, e.g. "OpenAI/gpt-4o-mini", to its price
+type Table map[string]Price
+
+// Lookup finds the price of a model by FQN, falling back to matching the model name only, since not all
+// providers report the FQN in the response metadata. A name matches the longest model name of the table it starts
+// with, e.g. "gpt-4o-mini-2024-07-18" matches "gpt-4o-mini" rather than "gpt-4o", ties broken by the smallest FQN
+func (t Table) Lookup(model string) (Price, bool) {
+	if p, ok := t[model]; ok {
+		return p, true
+	}
+	_, name, found := strings.Cut(model, "/")
+	if !found {
+		name = model
+	}
+	var match string
+	for fqn := range t {
+		_, n, _ := strings.Cut(fqn, "/")
+		if !strings.HasPrefix(name, n) {
+			continue
+		}
+		_, m, _ := strings.Cut(match, "/")
+		if match == "" || len(n) > len(m) || len(n) == len(m) && fqn < match {
+			match = fqn
+		}
+	}
+	if match == "" {
+		return Price{}, false
+	}
+	return t[match], true
+}
+
+// Default contains list prices for a few commonly used models, extend or replace it as needed
+var Default = Table{
+	"OpenAI/gpt-4o":             {InputPerMillion: 2.50, OutputPerMillion: 10.00},
+	"OpenAI/gpt-4o-mini":        {InputPerMillion: 0.15, OutputPerMillion: 0.60},
+	"VertexAI/gemini-2.5-flash": {InputPerMillion: 0.30, OutputPerMillion: 2.50},
+}
@@ -0,0 +1,30 @@
+package pricing
+
+import "testing"
+
+func TestLookup(t *testing.T) {
+	for model, expected := range map[string]string{
+		"OpenAI/gpt-4o":               "OpenAI/gpt-4o",
+		"gpt-4o-mini":                 "OpenAI/gpt-4o-mini",
+		"gpt-4o-mini-2024-07-18":      "OpenAI/gpt-4o-mini",
+		"gpt-4o-2024-08-06":           "OpenAI/gpt-4o",
+		"VertexAI/gemini-2.5-flash-1": "VertexAI/gemini-2.5-flash",
+	} {
+		for range 10 { // map iteration order must not matter
+			price, ok := Default.Lookup(model)
+			if !ok || price != Default[expected] {
+				t.Fatalf("expected %s to be priced as %s, got %+v", model, expected, price)
+			}
+		}
+	}
+	if _, ok := Default.Lookup("claude-sonnet"); ok {
+		t.Fatal("expected unknown model to have no price")
+	}
+
+	tied := Table{"B/model": {InputPerMillion: 2}, "A/model": {InputPerMillion: 1}}
+	for range 10 {
+		if price, _ := tied.Lookup("model-x"); price.InputPerMillion != 1 {
+			t.Fatalf("expected the smallest FQN to win a tie, got %+v", price)
+		}
+	}
+}
@@ -125,6 +125,10 @@ func fieldToSchema(field reflect.StructField) *JSON {
 		schema.Type = JSONType(typeName)
 	}
 
+	if def := field.Tag.Get("json-default"); def != "" && schema.Type != "array" {
+		schema.Default = parseTagValue(def, fieldKind(field))
+	}
+
 	if schema.Type == "array" {
 		if maxItems := getIntFromField(field, "json-max-items"); maxItems != nil {
 			schema.MaxItems = maxItems
@@ -209,6 +213,15 @@ func parseEnum(enumStr string, field reflect.StructField) []interface{} {
 	values := strings.Split(enumStr, ",")
 	enum := make([]interface{}, len(values))
 
+	kind := fieldKind(field)
+	for i, v := range values {
+		enum[i] = parseTagValue(v, kind)
+	}
+	return enum
+}
+
+// fieldKind returns the kind of the field, or of its elements for pointers and slices
+func fieldKind(field reflect.StructField) reflect.Kind {
 	t := field.Type
 	kind := t.Kind()
 	if kind == reflect.Ptr {
@@ -219,26 +232,28 @@ func parseEnum(enumStr string, field reflect.StructField) []interface{} {
 	if kind == reflect.Slice {
 		kind = t.Elem().Kind()
 	}
+	return kind
+}
 
-	for i, v := range values {
-		v = strings.TrimSpace(v)
-
-		switch kind {
-		case reflect.String:
-			enum[i] = v
-		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-			if n, err := strconv.ParseInt(v, 10, 64); err == nil {
-				enum[i] = n
-			}
-		case reflect.Float32, reflect.Float64:
-			if f, err := strconv.ParseFloat(v, 64); err == nil {
-				enum[i] = f
-			}
-		case reflect.Bool:
-			if b, err := strconv.ParseBool(v); err == nil {
-				enum[i] = b
-			}
+// parseTagValue parses a struct tag value into the given kind, returns nil if it cannot be parsed
+func parseTagValue(v string, kind reflect.Kind) interface{} {
+	v = strings.TrimSpace(v)
+
+	switch kind {
+	case reflect.String:
+		return v
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return n
+		}
+	case reflect.Float32, reflect.Float64:
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return f
+		}
+	case reflect.Bool:
+		if b, err := strconv.ParseBool(v); err == nil {
+			return b
 		}
 	}
-	return enum
+	return nil
 }
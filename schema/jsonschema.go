@@ -0,0 +1,15 @@
+package schema
+
+// Draft07 is the meta schema URI set on schemas exported by ToJSONSchema
+const Draft07 = "http://json-schema.org/draft-07/schema#"
+
+var draft07Dialect = dialect{closedObjects: false, defsKey: "definitions"}
+
+// ToJSONSchema converts the schema into a standalone JSON Schema (draft-07) document. Unlike ToOpenAI, objects are
+// left open unless additionalProperties is set, and definitions are exported under "definitions" with any
+// "#/$defs/..." references rewritten accordingly.
+func ToJSONSchema(s *JSON) map[string]any {
+	m := toDialect(s, draft07Dialect)
+	m["$schema"] = Draft07
+	return m
+}
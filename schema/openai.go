@@ -0,0 +1,165 @@
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// ToOpenAI converts the schema into the OpenAI function parameters dialect, i.e. a plain JSON schema map with nested
+// properties, array items, enums, required lists and additionalProperties. Objects without additionalProperties are
+// closed, as expected by OpenAI. A nil schema results in an empty object schema.
+func ToOpenAI(s *JSON) map[string]any {
+	return toDialect(s, openAIDialect)
+}
+
+// dialect describes how the JSON schema variants differ when exported
+type dialect struct {
+	closedObjects bool   // objects without additionalProperties are exported with additionalProperties false
+	defsKey       string // key holding the definitions, e.g. $defs or definitions
+}
+
+var openAIDialect = dialect{closedObjects: true, defsKey: "$defs"}
+
+func toDialect(s *JSON, d dialect) map[string]any {
+	if s == nil {
+		return map[string]any{
+			"type":       string(Object),
+			"properties": map[string]any{},
+		}
+	}
+	if s.Ref != "" {
+		return map[string]any{"$ref": strings.Replace(s.Ref, "#/$defs/", "#/"+d.defsKey+"/", 1)}
+	}
+
+	m := map[string]any{}
+	if s.Type != "" {
+		m["type"] = string(s.Type)
+		if s.Nullable {
+			m["type"] = []any{string(s.Type), "null"}
+		}
+	}
+	if s.Description != "" {
+		m["description"] = s.Description
+	}
+	if s.Default != nil {
+		m["default"] = s.Default
+	}
+	if len(s.Enum) > 0 {
+		m["enum"] = append([]any{}, s.Enum...)
+	}
+
+	if s.Type == Object || len(s.Properties) > 0 {
+		props := map[string]any{}
+		for k, p := range s.Properties {
+			props[k] = toDialect(p, d)
+		}
+		m["properties"] = props
+		if len(s.Required) > 0 {
+			m["required"] = toAny(s.Required)
+		}
+		if s.AdditionalProperties != nil {
+			m["additionalProperties"] = toDialect(s.AdditionalProperties, d)
+		} else if d.closedObjects {
+			m["additionalProperties"] = false
+		}
+	}
+	if s.Items != nil {
+		m["items"] = toDialect(s.Items, d)
+	} else if s.Type == Array {
+		m["items"] = map[string]any{}
+	}
+
+	if len(s.Defs) > 0 {
+		defs := map[string]any{}
+		for k, def := range s.Defs {
+			defs[k] = toDialect(def, d)
+		}
+		m[d.defsKey] = defs
+	}
+
+	setIfNotNil(m, "maximum", s.Maximum)
+	setIfNotNil(m, "minimum", s.Minimum)
+	setIfNotNil(m, "exclusiveMaximum", s.ExclusiveMaximum)
+	setIfNotNil(m, "exclusiveMinimum", s.ExclusiveMinimum)
+	setIfNotNil(m, "maxLength", s.MaxLength)
+	setIfNotNil(m, "minLength", s.MinLength)
+	setIfNotNil(m, "pattern", s.Pattern)
+	setIfNotNil(m, "format", s.Format)
+	setIfNotNil(m, "maxItems", s.MaxItems)
+	setIfNotNil(m, "minItems", s.MinItems)
+
+	return m
+}
+
+func toAny[T any](values []T) []any {
+	res := make([]any, len(values))
+	for i, v := range values {
+		res[i] = v
+	}
+	return res
+}
+
+func setIfNotNil[T any](m map[string]any, key string, v *T) {
+	if v != nil {
+		m[key] = *v
+	}
+}
+
+// FromOpenAI parses a schema in the OpenAI function parameters dialect, the inverse of ToOpenAI. Boolean
+// additionalProperties are dropped and nullable type lists, e.g. ["string", "null"], are mapped to Nullable.
+func FromOpenAI(m map[string]any) (*JSON, error) {
+	b, err := json.Marshal(fromOpenAIDialect(m))
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal openai schema; %w", err)
+	}
+	var s JSON
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, fmt.Errorf("could not unmarshal openai schema; %w", err)
+	}
+	return &s, nil
+}
+
+// fromOpenAIDialect rewrites the parts of the OpenAI dialect that JSON cannot represent
+func fromOpenAIDialect(v any) any {
+	switch t := v.(type) {
+	case map[string]any:
+		res := make(map[string]any, len(t))
+		for k, val := range t {
+			switch {
+			case k == "additionalProperties":
+				if _, isBool := val.(bool); isBool {
+					continue
+				}
+				res[k] = fromOpenAIDialect(val)
+			case k == "type":
+				types, isList := val.([]any)
+				if !isList {
+					res[k] = val
+					continue
+				}
+				for _, typ := range types {
+					if typ == "null" {
+						res["nullable"] = true
+						continue
+					}
+					res[k] = typ
+				}
+			case k == "properties" || k == "$defs":
+				props, _ := val.(map[string]any)
+				converted := make(map[string]any, len(props))
+				for name, p := range props {
+					converted[name] = fromOpenAIDialect(p)
+				}
+				res[k] = converted
+			case k == "items":
+				res[k] = fromOpenAIDialect(val)
+			default:
+				res[k] = val
+			}
+		}
+		return res
+	default:
+		return v
+	}
+}
@@ -0,0 +1,119 @@
+package schema_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/modfin/bellman/schema"
+)
+
+func TestOpenAIRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema *schema.JSON
+	}{
+		{
+			name: "flat api parameters",
+			schema: &schema.JSON{
+				Type: schema.Object,
+				Properties: map[string]*schema.JSON{
+					"query":   {Type: schema.String, Description: "search query"},
+					"page":    {Type: schema.Integer, Minimum: ptr(1.), Default: 1.},
+					"country": {Type: schema.String, Enum: []any{"se", "no", "dk"}},
+				},
+				Required: []string{"query"},
+			},
+		},
+		{
+			name: "nested objects and arrays",
+			schema: &schema.JSON{
+				Type: schema.Object,
+				Properties: map[string]*schema.JSON{
+					"orders": {
+						Type: schema.Array,
+						Items: &schema.JSON{
+							Type: schema.Object,
+							Properties: map[string]*schema.JSON{
+								"id":    {Type: schema.String},
+								"tags":  {Type: schema.Array, Items: &schema.JSON{Type: schema.String}, MinItems: ptr(1)},
+								"total": {Type: schema.Number, Nullable: true},
+							},
+							Required: []string{"id", "tags"},
+						},
+					},
+				},
+				Required: []string{"orders"},
+			},
+		},
+		{
+			name: "map with additional properties",
+			schema: &schema.JSON{
+				Type: schema.Object,
+				Properties: map[string]*schema.JSON{
+					"labels": {Type: schema.Object, Properties: map[string]*schema.JSON{}, AdditionalProperties: &schema.JSON{Type: schema.String}},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := schema.ToOpenAI(tt.schema)
+			if m["additionalProperties"] != false {
+				t.Fatalf("expected closed top level object, got %v", m["additionalProperties"])
+			}
+
+			// through json, as it would be sent to and read from an api
+			b, err := json.Marshal(m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var decoded map[string]any
+			if err := json.Unmarshal(b, &decoded); err != nil {
+				t.Fatal(err)
+			}
+
+			back, err := schema.FromOpenAI(decoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected, _ := json.Marshal(tt.schema)
+			actual, _ := json.Marshal(back)
+			if string(expected) != string(actual) {
+				t.Fatalf("round trip mismatch\nexpected: %s\nactual:   %s", expected, actual)
+			}
+		})
+	}
+}
+
+func TestToJSONSchemaDefinitions(t *testing.T) {
+	s := &schema.JSON{
+		Type: schema.Object,
+		Properties: map[string]*schema.JSON{
+			"address": {Ref: "#/$defs/address"},
+		},
+		Defs: map[string]*schema.JSON{
+			"address": {Type: schema.Object, Properties: map[string]*schema.JSON{"city": {Type: schema.String}}},
+		},
+	}
+
+	m := schema.ToJSONSchema(s)
+	if m["$schema"] != schema.Draft07 {
+		t.Fatalf("expected draft-07 meta schema, got %v", m["$schema"])
+	}
+	if _, ok := m["$defs"]; ok {
+		t.Fatalf("expected definitions instead of $defs, got %v", m)
+	}
+	defs, _ := m["definitions"].(map[string]any)
+	if _, ok := defs["address"]; !ok {
+		t.Fatalf("expected address definition, got %v", m)
+	}
+	props, _ := m["properties"].(map[string]any)
+	address, _ := props["address"].(map[string]any)
+	if address["$ref"] != "#/definitions/address" {
+		t.Fatalf("expected rewritten reference, got %v", address)
+	}
+	if _, ok := m["additionalProperties"]; ok {
+		t.Fatalf("expected open object, got %v", m)
+	}
+}
@@ -48,7 +48,8 @@ type JSON struct {
 	Defs map[string]*JSON `json:"$defs,omitempty"` // for $ref
 
 	// JSON Metadata
-	Description string `json:"description,omitempty"`
+	Description string      `json:"description,omitempty"`
+	Default     interface{} `json:"default,omitempty"`
 
 	// Type System
 	Type     JSONType `json:"type,omitempty"`
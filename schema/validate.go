@@ -0,0 +1,117 @@
+package schema
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ErrInvalid is returned, wrapped, by Validate for a malformed schema
+var ErrInvalid = errors.New("invalid schema")
+
+// Validate checks that the schema is well-formed, e.g. that an object has properties and an array has items, so that
+// it converts into valid provider requests. The error names the path of the offending schema, e.g.
+// $.properties.tags.items
+func (s *JSON) Validate() error {
+	if s == nil {
+		return fmt.Errorf("%w at $: schema is nil", ErrInvalid)
+	}
+	return s.validate(s, "$")
+}
+
+func (s *JSON) validate(root *JSON, path string) error {
+	invalid := func(format string, args ...any) error {
+		return fmt.Errorf("%w at %s: %s", ErrInvalid, path, fmt.Sprintf(format, args...))
+	}
+
+	if s.Ref != "" {
+		name, ok := strings.CutPrefix(s.Ref, "#/$defs/")
+		if !ok {
+			return invalid("unsupported $ref %q, expected #/$defs/...", s.Ref)
+		}
+		if root.Defs[name] == nil {
+			return invalid("$ref %q is not defined", s.Ref)
+		}
+	}
+	for _, name := range sortedKeys(s.Defs) {
+		if s.Defs[name] == nil {
+			return invalid("$defs %s is nil", name)
+		}
+		if err := s.Defs[name].validate(root, path+".$defs."+name); err != nil {
+			return err
+		}
+	}
+	if s.Ref != "" {
+		return nil
+	}
+
+	switch s.Type {
+	case "", String, Number, Integer, Boolean:
+		if len(s.Properties) > 0 || s.Items != nil {
+			return invalid("type %q has properties or items", s.Type)
+		}
+	case Object:
+		if s.Properties == nil && s.AdditionalProperties == nil {
+			return invalid("object without properties or additionalProperties")
+		}
+	case Array:
+		if s.Items == nil {
+			return invalid("array without items")
+		}
+	default:
+		return invalid("unknown type %q", s.Type)
+	}
+
+	for _, name := range s.Required {
+		if _, ok := s.Properties[name]; !ok {
+			return invalid("required property %s is not defined", name)
+		}
+	}
+	if s.Minimum != nil && s.Maximum != nil && *s.Minimum > *s.Maximum {
+		return invalid("minimum %v is greater than maximum %v", *s.Minimum, *s.Maximum)
+	}
+	if s.MinLength != nil && s.MaxLength != nil && *s.MinLength > *s.MaxLength {
+		return invalid("minLength %d is greater than maxLength %d", *s.MinLength, *s.MaxLength)
+	}
+	if s.MinItems != nil && s.MaxItems != nil && *s.MinItems > *s.MaxItems {
+		return invalid("minItems %d is greater than maxItems %d", *s.MinItems, *s.MaxItems)
+	}
+	if s.Pattern != nil {
+		if _, err := regexp.Compile(*s.Pattern); err != nil {
+			return invalid("pattern does not compile; %v", err)
+		}
+	}
+
+	for _, name := range sortedKeys(s.Properties) {
+		p := s.Properties[name]
+		if p == nil {
+			return invalid("property %s is nil", name)
+		}
+		if err := p.validate(root, path+".properties."+name); err != nil {
+			return err
+		}
+	}
+	if s.AdditionalProperties != nil {
+		if err := s.AdditionalProperties.validate(root, path+".additionalProperties"); err != nil {
+			return err
+		}
+	}
+	if s.Items != nil {
+		if err := s.Items.validate(root, path+".items"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sortedKeys returns the keys in order, so that the first error is reported deterministically
+func sortedKeys(m map[string]*JSON) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,77 @@
+package schema_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/modfin/bellman/schema"
+)
+
+func TestValidate(t *testing.T) {
+	type Address struct {
+		Street string   `json:"street"`
+		Tags   []string `json:"tags"`
+	}
+	type Person struct {
+		Name    string            `json:"name"`
+		Age     int               `json:"age" json-minimum:"0" json-maximum:"150"`
+		Address *Address          `json:"address"`
+		Labels  map[string]string `json:"labels"`
+	}
+	if err := schema.From(Person{}).Validate(); err != nil {
+		t.Fatalf("expected a schema from a struct to be valid, got %v", err)
+	}
+
+	minimum, maximum := 2.0, 1.0
+	pattern := "[a-"
+	tests := []struct {
+		name   string
+		schema *schema.JSON
+		path   string
+	}{
+		{"nil schema", nil, "$"},
+		{"object without properties", &schema.JSON{Type: schema.Object}, "$"},
+		{"array without items", &schema.JSON{
+			Type:       schema.Object,
+			Properties: map[string]*schema.JSON{"tags": {Type: schema.Array}},
+		}, "$.properties.tags"},
+		{"nested array without items", &schema.JSON{
+			Type:  schema.Array,
+			Items: &schema.JSON{Type: schema.Object, Properties: map[string]*schema.JSON{"ids": {Type: schema.Array}}},
+		}, "$.items.properties.ids"},
+		{"nil property", &schema.JSON{Type: schema.Object, Properties: map[string]*schema.JSON{"name": nil}}, "$"},
+		{"unknown type", &schema.JSON{Type: "date"}, "$"},
+		{"required property not defined", &schema.JSON{
+			Type:       schema.Object,
+			Properties: map[string]*schema.JSON{"name": {Type: schema.String}},
+			Required:   []string{"name", "age"},
+		}, "$"},
+		{"minimum greater than maximum", &schema.JSON{Type: schema.Number, Minimum: &minimum, Maximum: &maximum}, "$"},
+		{"invalid pattern", &schema.JSON{Type: schema.String, Pattern: &pattern}, "$"},
+		{"undefined ref", &schema.JSON{
+			Type:       schema.Object,
+			Properties: map[string]*schema.JSON{"address": {Ref: "#/$defs/address"}},
+		}, "$.properties.address"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.schema.Validate()
+			if !errors.Is(err, schema.ErrInvalid) {
+				t.Fatalf("expected ErrInvalid, got %v", err)
+			}
+			if !strings.Contains(err.Error(), "at "+tt.path+":") {
+				t.Fatalf("expected the error at %s, got %v", tt.path, err)
+			}
+		})
+	}
+
+	ref := &schema.JSON{
+		Type:       schema.Object,
+		Properties: map[string]*schema.JSON{"address": {Ref: "#/$defs/address"}},
+		Defs:       map[string]*schema.JSON{"address": {Type: schema.String}},
+	}
+	if err := ref.Validate(); err != nil {
+		t.Fatalf("expected a defined ref to be valid, got %v", err)
+	}
+}
@@ -357,13 +357,13 @@ func (g *generator) prompt(conversation ...prompt.Prompt) (*http.Request, reques
 	}
 
 	if len(g.request.Tools) > 0 {
-		for _, t := range g.request.Tools {
+		for i, t := range g.request.Tools {
 			model.Tools = append(model.Tools, reqTool{
 				Name:        t.Name,
 				Description: t.Description,
 				InputSchema: fromBellmanSchema(t.ArgumentSchema),
 			})
-			model.toolBelt[t.Name] = &t
+			model.toolBelt[t.Name] = &g.request.Tools[i]
 		}
 	}
 
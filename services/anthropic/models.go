@@ -1,10 +1,11 @@
 package anthropic
 
 import (
+	"github.com/modfin/bellman/models"
 	"github.com/modfin/bellman/models/gen"
 )
 
-const Provider = "Anthropic"
+const Provider = models.ProviderAnthropic
 
 const Version = "2023-06-01"
 
@@ -66,7 +66,7 @@ func (g *generator) Prompt(conversation ...prompt.Prompt) (*gen.Response, error)
 
 	toolBelt := map[string]*tools.Tool{}
 	// Dealing with Tools
-	for _, t := range g.request.Tools {
+	for i, t := range g.request.Tools {
 		reqModel.Tools = append(reqModel.Tools, tool{
 			Type: "function",
 			Function: toolFunction{
@@ -75,7 +75,7 @@ func (g *generator) Prompt(conversation ...prompt.Prompt) (*gen.Response, error)
 				Description: t.Description,
 			},
 		})
-		toolBelt[t.Name] = &t
+		toolBelt[t.Name] = &g.request.Tools[i]
 	}
 	//// Selecting specific tool
 	//if g.request.ToolConfig != nil {
@@ -1,11 +1,12 @@
 package ollama
 
 import (
+	"github.com/modfin/bellman/models"
 	"github.com/modfin/bellman/models/embed"
 	"github.com/modfin/bellman/models/gen"
 )
 
-const Provider = "Ollama"
+const Provider = models.ProviderOllama
 
 var GenModel_llama_3_3 = gen.Model{
 	Provider:    Provider,
@@ -345,7 +345,7 @@ func (g *generator) prompt(conversation ...prompt.Prompt) (*http.Request, genReq
 
 	reqModel.toolBelt = map[string]*tools.Tool{}
 	// Dealing with Tools
-	for _, t := range g.request.Tools {
+	for i, t := range g.request.Tools {
 		reqModel.Tools = append(reqModel.Tools, requestTool{
 			Type: "function",
 			Function: toolFunc{
@@ -355,7 +355,7 @@ func (g *generator) prompt(conversation ...prompt.Prompt) (*http.Request, genReq
 				Strict:      g.request.StrictOutput,
 			},
 		})
-		reqModel.toolBelt[t.Name] = &t
+		reqModel.toolBelt[t.Name] = &g.request.Tools[i]
 	}
 	// Selecting specific tool
 	if g.request.ToolConfig != nil {
@@ -1,11 +1,12 @@
 package openai
 
 import (
+	"github.com/modfin/bellman/models"
 	"github.com/modfin/bellman/models/embed"
 	"github.com/modfin/bellman/models/gen"
 )
 
-const Provider = "OpenAI"
+const Provider = models.ProviderOpenAI
 
 // curl https://api.openai.com/v1/models \                                                                                                                                                                           130 master!
 // -H "Authorization: Bearer $OPENAI_API_KEY" | jq
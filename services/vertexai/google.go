@@ -8,12 +8,14 @@ import (
 	"github.com/modfin/bellman/models"
 	"github.com/modfin/bellman/models/embed"
 	"github.com/modfin/bellman/models/gen"
+	"github.com/modfin/bellman/models/limit"
 	"golang.org/x/oauth2"
 	"io"
 	"log/slog"
 	"net/http"
 	"regexp"
 	"sync/atomic"
+	"time"
 
 	"golang.org/x/oauth2/google"
 )
@@ -43,11 +45,21 @@ type GoogleConfig struct {
 	Project    string
 	Region     string
 	Credential string
+
+	// RetryEmptyCandidate re-sends a prompt once if the response has no text or tool calls, see gen.ErrEmptyCandidate
+	RetryEmptyCandidate bool
+
+	// RateLimit limits prompts, streams and embeddings to this many requests per second, with bursts of up to
+	// RateBurst requests, 0 disables it. MaxConcurrent limits the number of concurrent requests, 0 disables it
+	RateLimit     float64
+	RateBurst     int
+	MaxConcurrent int
 }
 
 type Google struct {
-	config GoogleConfig
-	client *http.Client
+	config  GoogleConfig
+	client  *http.Client
+	limiter *limit.Limiter
 
 	Log *slog.Logger `json:"-"`
 }
@@ -79,11 +91,41 @@ func New(config GoogleConfig) (*Google, error) {
 	}
 
 	return &Google{
-		config: config,
-		client: client,
+		config:  config,
+		client:  client,
+		limiter: limit.New(config.RateLimit, config.RateBurst, config.MaxConcurrent),
 	}, nil
 }
 
+// do sends the request once the limiter allows it, and returns the time spent waiting. The limiter is released when
+// the response body is closed
+func (g *Google) do(req *http.Request) (*http.Response, time.Duration, error) {
+	release, waited, err := g.limiter.Wait(req.Context())
+	if err != nil {
+		return nil, waited, fmt.Errorf("could not wait for rate limit, %w", err)
+	}
+	if waited > 0 {
+		g.log("[limit] throttled", "url", req.URL.String(), "wait", waited)
+	}
+	resp, err := g.client.Do(req)
+	if err != nil {
+		release()
+		return nil, waited, err
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+	return resp, waited, nil
+}
+
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	defer b.release()
+	return b.ReadCloser.Close()
+}
+
 func (g *Google) Provider() string {
 	return Provider
 }
@@ -170,7 +212,7 @@ func (g *Google) Embed(request *embed.Request) (*embed.Response, error) {
 		return nil, fmt.Errorf("could not create google request, %w", err)
 	}
 	hreq.Header.Set("Content-Type", "application/json")
-	resp, err := g.client.Do(hreq)
+	resp, waited, err := g.do(hreq)
 	if err != nil {
 		return nil, fmt.Errorf("could not post google request, %w", err)
 	}
@@ -197,7 +239,8 @@ func (g *Google) Embed(request *embed.Request) (*embed.Response, error) {
 	embedResp := &embed.Response{
 		Embeddings: make([][]float64, len(embeddings.Predictions)),
 		Metadata: models.Metadata{
-			Model: request.Model.FQN(),
+			Model:          request.Model.FQN(),
+			ThrottleWaitMs: waited.Milliseconds(),
 		},
 	}
 	for idx, prediction := range embeddings.Predictions {
@@ -11,7 +11,6 @@ import (
 	"log"
 	"net/http"
 	"sync/atomic"
-	"time"
 
 	"github.com/modfin/bellman/models"
 	"github.com/modfin/bellman/models/gen"
@@ -21,6 +20,16 @@ import (
 
 var requestNo int64
 
+// blockingFinishReasons are the finish reasons for which gemini withholds, or cuts, the response
+var blockingFinishReasons = map[string]bool{
+	"SAFETY":             true,
+	"RECITATION":         true,
+	"BLOCKLIST":          true,
+	"PROHIBITED_CONTENT": true,
+	"SPII":               true,
+	"IMAGE_SAFETY":       true,
+}
+
 type generator struct {
 	google  *Google
 	request gen.Request
@@ -54,6 +63,7 @@ func (g *generator) Stream(prompts ...prompt.Prompt) (<-chan *gen.StreamResponse
 
 	if resp.StatusCode != http.StatusOK {
 		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
 		return nil, errors.Join(fmt.Errorf("unexpected status code, %d, err: {%s}, for url: {%s} ", resp.StatusCode, string(b), model.url), err)
 	}
 
@@ -62,6 +72,7 @@ func (g *generator) Stream(prompts ...prompt.Prompt) (<-chan *gen.StreamResponse
 	stream := make(chan *gen.StreamResponse)
 
 	go func() {
+		var toolCalls int // numbers tool calls across chunks, which are indexed per chunk
 		defer resp.Body.Close()
 		defer close(stream)
 
@@ -104,10 +115,15 @@ func (g *generator) Stream(prompts ...prompt.Prompt) (<-chan *gen.StreamResponse
 			}
 
 			if len(ss.Candidates) == 0 {
+				msg := "there where no candidates in response"
+				if ss.PromptFeedback.BlockReason != "" {
+					msg = (&gen.BlockedError{Reason: ss.PromptFeedback.BlockReason}).Error()
+				}
 				stream <- &gen.StreamResponse{
 					Type:    gen.TYPE_ERROR,
-					Content: "there where no candidates in response",
+					Content: msg,
 				}
+				break
 			}
 			candidate := ss.Candidates[0]
 
@@ -115,8 +131,11 @@ func (g *generator) Stream(prompts ...prompt.Prompt) (<-chan *gen.StreamResponse
 			if candidate.Content.Role == "user" {
 				role = prompt.UserRole
 			}
-			t := time.Now().UnixNano()
-			for idx, part := range candidate.Content.Parts {
+			prefix := ss.ResponseID
+			if prefix == "" {
+				prefix = fmt.Sprint(reqc)
+			}
+			for _, part := range candidate.Content.Parts {
 				if part.Text != nil {
 					if part.Thought != nil && *part.Thought {
 						stream <- &gen.StreamResponse{
@@ -151,10 +170,11 @@ func (g *generator) Stream(prompts ...prompt.Prompt) (<-chan *gen.StreamResponse
 						ToolCall: &tools.Call{
 							Name:     f.Name,
 							Argument: arg,
-							ID:       fmt.Sprintf("%d-%d", t, idx),
+							ID:       toolCallID(f.ID, prefix, toolCalls),
 							Ref:      model.toolBelt[f.Name],
 						},
 					}
+					toolCalls++
 				}
 
 			}
@@ -169,10 +189,18 @@ func (g *generator) Stream(prompts ...prompt.Prompt) (<-chan *gen.StreamResponse
 						OutputTokens:   outputTokens,
 						ThinkingTokens: thinkingTokens,
 						TotalTokens:    ss.UsageMetadata.PromptTokenCount + outputTokens + thinkingTokens,
+						FinishReason:   candidate.FinishReason,
+						ThrottleWaitMs: model.waited.Milliseconds(),
 					},
 				}
 			}
 
+			if blockingFinishReasons[candidate.FinishReason] {
+				stream <- &gen.StreamResponse{
+					Type:    gen.TYPE_ERROR,
+					Content: (&gen.BlockedError{Reason: candidate.FinishReason}).Error(),
+				}
+			}
 			if len(candidate.FinishReason) > 0 {
 				break
 			}
@@ -183,7 +211,47 @@ func (g *generator) Stream(prompts ...prompt.Prompt) (<-chan *gen.StreamResponse
 	return stream, nil
 }
 
+// toolCallID returns the id gemini assigned to the function call, if any, otherwise an id derived from the
+// response and the position of the call, so that tool responses can be paired with their calls
+func toolCallID(id string, prefix string, idx int) string {
+	if id != "" {
+		return id
+	}
+	return fmt.Sprintf("%s-%d", prefix, idx)
+}
+
+// toolResponsePart wraps the tool response as {"name": ..., "content": "<response>"}. If structured is set, a
+// response that is a JSON object is sent as is, and other JSON values as the parsed content of the wrapper.
+func toolResponsePart(r *prompt.ToolResponse, structured bool) genRequestContentPart {
+	var response any = functionResponseContent{Name: r.Name, Content: r.Response}
+	if structured {
+		var parsed any
+		if err := json.Unmarshal([]byte(r.Response), &parsed); err == nil {
+			response = functionResponseContent{Name: r.Name, Content: parsed}
+			if obj, ok := parsed.(map[string]any); ok {
+				response = obj
+			}
+		}
+	}
+	return genRequestContentPart{
+		FunctionResponse: &functionResponse{
+			ID:       r.ToolCallID,
+			Name:     r.Name,
+			Response: response,
+		},
+	}
+}
+
 func (g *generator) Prompt(prompts ...prompt.Prompt) (*gen.Response, error) {
+	res, err := g.promptOnce(prompts...)
+	if err != nil && errors.Is(err, gen.ErrEmptyCandidate) && g.google.config.RetryEmptyCandidate {
+		g.google.log("[gen] retrying empty candidate", "model", g.request.Model.FQN(), "err", err)
+		res, err = g.promptOnce(prompts...)
+	}
+	return res, err
+}
+
+func (g *generator) promptOnce(prompts ...prompt.Prompt) (*gen.Response, error) {
 	resp, model, err := g.prompt(prompts...)
 	if err != nil {
 		return nil, fmt.Errorf("could not make http request for prompt, %w", err)
@@ -208,6 +276,7 @@ func (g *generator) Prompt(prompts ...prompt.Prompt) (*gen.Response, error) {
 
 	if resp.StatusCode != http.StatusOK {
 		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
 		return nil, errors.Join(fmt.Errorf("unexpected status code, %d, err: {%s}, for url: {%s} ", resp.StatusCode, string(b), model.url), err)
 	}
 
@@ -219,15 +288,26 @@ func (g *generator) Prompt(prompts ...prompt.Prompt) (*gen.Response, error) {
 	}
 
 	if len(respModel.Candidates) == 0 {
-		return nil, fmt.Errorf("no candidates in response")
+		if respModel.PromptFeedback.BlockReason != "" {
+			g.google.log("[gen] prompt blocked", "request", reqc, "reason", respModel.PromptFeedback.BlockReason)
+			return nil, fmt.Errorf("no candidates in response, %w", &gen.BlockedError{Reason: respModel.PromptFeedback.BlockReason})
+		}
+		return nil, fmt.Errorf("no candidates in response, %w", &gen.EmptyCandidateError{})
+	}
+	finishReason := respModel.Candidates[0].FinishReason
+	if blockingFinishReasons[finishReason] {
+		g.google.log("[gen] response blocked", "request", reqc, "reason", finishReason)
+		return nil, fmt.Errorf("response blocked, %w", &gen.BlockedError{Reason: finishReason})
 	}
 	if len(respModel.Candidates[0].Content.Parts) == 0 {
-		return nil, fmt.Errorf("no parts in response")
+		return nil, fmt.Errorf("no parts in response, %w", &gen.EmptyCandidateError{FinishReason: finishReason})
 	}
 
 	res := &gen.Response{
 		Metadata: models.Metadata{
-			Model: g.request.Model.FQN(),
+			Model:          g.request.Model.FQN(),
+			FinishReason:   finishReason,
+			ThrottleWaitMs: model.waited.Milliseconds(),
 		},
 	}
 	thinkingTokens := respModel.UsageMetadata.ThoughtsTokenCount
@@ -236,8 +316,12 @@ func (g *generator) Prompt(prompts ...prompt.Prompt) (*gen.Response, error) {
 	res.Metadata.OutputTokens = outputTokens
 	res.Metadata.ThinkingTokens = thinkingTokens
 	res.Metadata.TotalTokens = respModel.UsageMetadata.PromptTokenCount + outputTokens + thinkingTokens
+	prefix := respModel.ResponseID
+	if prefix == "" {
+		prefix = fmt.Sprint(reqc)
+	}
 	for _, c := range respModel.Candidates {
-		for _, p := range c.Content.Parts {
+		for idx, p := range c.Content.Parts {
 			if p.Thought != nil && *p.Thought {
 				res.Thinking = append(res.Thinking, p.Text)
 				continue
@@ -253,6 +337,7 @@ func (g *generator) Prompt(prompts ...prompt.Prompt) (*gen.Response, error) {
 					return nil, fmt.Errorf("could not marshal google request, %w", err)
 				}
 				res.Tools = append(res.Tools, tools.Call{
+					ID:       toolCallID(f.ID, prefix, idx),
 					Name:     f.Name,
 					Argument: arg,
 					Ref:      model.toolBelt[f.Name],
@@ -263,6 +348,13 @@ func (g *generator) Prompt(prompts ...prompt.Prompt) (*gen.Response, error) {
 		}
 	}
 
+	if len(res.Texts) == 0 && len(res.Tools) == 0 {
+		return nil, fmt.Errorf("no text or tool calls in response, %w", &gen.EmptyCandidateError{
+			FinishReason: finishReason,
+			ThinkingOnly: len(res.Thinking) > 0,
+		})
+	}
+
 	g.google.log("[gen] response",
 		"request", reqc,
 		"model", g.request.Model.FQN(),
@@ -270,6 +362,7 @@ func (g *generator) Prompt(prompts ...prompt.Prompt) (*gen.Response, error) {
 		"token-output", res.Metadata.OutputTokens,
 		"token-thinking", res.Metadata.ThinkingTokens,
 		"token-total", res.Metadata.TotalTokens,
+		"finish-reason", res.Metadata.FinishReason,
 	)
 
 	return res, nil
@@ -282,7 +375,33 @@ func (g *generator) prompt(prompts ...prompt.Prompt) (*http.Response, genRequest
 	if g.request.Stream {
 		mode = "streamGenerateContent?alt=sse"
 	}
+	return g.post(mode, prompts...)
+}
+
+// CountTokens counts the input tokens of the prompts using the countTokens endpoint
+func (g *generator) CountTokens(prompts ...prompt.Prompt) (int, error) {
+	counter := *g // the request is left as is for the prompts to come
+	counter.request.Stream = false
+	resp, model, err := counter.post("countTokens", prompts...)
+	if err != nil {
+		return 0, fmt.Errorf("could not make http request for count tokens, %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, err := io.ReadAll(resp.Body)
+		return 0, errors.Join(fmt.Errorf("unexpected status code, %d, err: {%s}, for url: {%s} ", resp.StatusCode, string(b), model.url), err)
+	}
 
+	var count countTokensResponse
+	err = json.NewDecoder(resp.Body).Decode(&count)
+	if err != nil {
+		return 0, fmt.Errorf("could not decode google count tokens response, %w", err)
+	}
+	return count.TotalTokens, nil
+}
+
+// post sends the prompts to the mode, i.e. the method, of the model endpoint
+func (g *generator) post(mode string, prompts ...prompt.Prompt) (*http.Response, genRequest, error) {
 	if g.request.Model.Name == "" {
 		return nil, genRequest{}, errors.New("model is required")
 	}
@@ -323,36 +442,18 @@ func (g *generator) prompt(prompts ...prompt.Prompt) (*http.Response, genRequest
 	model.toolBelt = map[string]*tools.Tool{}
 	if len(g.request.Tools) > 0 {
 		model.Tools = []genTool{{FunctionDeclaration: []genToolFunc{}}}
-		for _, t := range g.request.Tools {
+		for i, t := range g.request.Tools {
 			model.Tools[0].FunctionDeclaration = append(model.Tools[0].FunctionDeclaration, genToolFunc{
 				Name:        t.Name,
 				Description: t.Description,
 				Parameters:  fromBellmanSchema(t.ArgumentSchema),
 			})
-			model.toolBelt[t.Name] = &t
+			model.toolBelt[t.Name] = &g.request.Tools[i]
 		}
 	}
 
 	// Dealing with SetToolConfig request
-	if g.request.ToolConfig != nil {
-		model.ToolConfig = &genToolConfig{
-			GoogleFunctionCallingConfig: genFunctionCallingConfig{
-				Mode: "ANY",
-			},
-		}
-		// https://cloud.google.com/vertex-ai/generative-ai/docs/model-reference/function-calling#functioncallingconfig
-		switch g.request.ToolConfig.Name {
-		case tools.NoTool.Name:
-			model.ToolConfig.GoogleFunctionCallingConfig.Mode = "NONE"
-		case tools.AutoTool.Name:
-			model.ToolConfig.GoogleFunctionCallingConfig.Mode = "AUTO"
-		case tools.RequiredTool.Name:
-			model.ToolConfig.GoogleFunctionCallingConfig.Mode = "ANY"
-		default:
-			model.ToolConfig.GoogleFunctionCallingConfig.Mode = "ANY"
-			model.ToolConfig.GoogleFunctionCallingConfig.AllowedFunctionNames = []string{g.request.ToolConfig.Name}
-		}
-	}
+	model.ToolConfig = toolConfig(g.request.ToolConfig)
 
 	if g.request.ThinkingBudget != nil || g.request.ThinkingParts != nil {
 		model.GenerationConfig.ThinkingConfig = &thinkingConfig{}
@@ -374,15 +475,8 @@ func (g *generator) prompt(prompts ...prompt.Prompt) (*http.Response, genRequest
 				return nil, model, fmt.Errorf("ToolResponse is required for role tool response")
 			}
 			content.Role = "tool"
-			content.Parts = append(content.Parts, genRequestContentPart{
-				FunctionResponse: &functionResponse{
-					Name: p.ToolResponse.Name,
-					Response: struct {
-						Name    string `json:"name,omitempty"`
-						Content any    `json:"content,omitempty"`
-					}{Name: p.ToolResponse.Name, Content: p.ToolResponse.Response},
-				},
-			})
+			structured := g.request.StructuredToolResponses != nil && *g.request.StructuredToolResponses
+			content.Parts = append(content.Parts, toolResponsePart(p.ToolResponse, structured))
 		case prompt.ToolCallRole:
 			if p.ToolCall == nil {
 				return nil, model, fmt.Errorf("ToolCall is required for role tool call")
@@ -394,7 +488,7 @@ func (g *generator) prompt(prompts ...prompt.Prompt) (*http.Response, genRequest
 				return nil, model, fmt.Errorf("failed to unmarshal tool call arguments: %w", err)
 			}
 			content.Parts = append(content.Parts, genRequestContentPart{
-				FunctionCall: &functionCall{Name: p.ToolCall.Name, Args: jsonArguments},
+				FunctionCall: &functionCall{ID: p.ToolCall.ToolCallID, Name: p.ToolCall.Name, Args: jsonArguments},
 			})
 		default: // prompt.UserRole, prompt.AssistantRole
 			content.Role = "user"
@@ -458,7 +552,14 @@ func (g *generator) prompt(prompts ...prompt.Prompt) (*http.Response, genRequest
 			project, g.request.Model.Name, mode)
 	}
 
-	body, err := json.Marshal(model)
+	var body []byte
+	var err error
+	if mode == "countTokens" {
+		// countTokens does not accept the generation or tool config
+		body, err = json.Marshal(genRequest{Contents: model.Contents, SystemInstruction: model.SystemInstruction, Tools: model.Tools})
+	} else {
+		body, err = json.Marshal(model)
+	}
 	if err != nil {
 		return nil, model, fmt.Errorf("could not marshal google request, %w", err)
 	}
@@ -472,10 +573,39 @@ func (g *generator) prompt(prompts ...prompt.Prompt) (*http.Response, genRequest
 		return nil, model, fmt.Errorf("could not create google request, %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
-	resp, err := g.google.client.Do(req)
-
+	var resp *http.Response
+	resp, model.waited, err = g.google.do(req)
 	if err != nil {
 		return nil, model, fmt.Errorf("could not post google request, %w", err)
 	}
 	return resp, model, nil
 }
+
+// toolConfig translates a tool choice into a function calling mode of Gemini
+//   - NoTool is NONE, no functions are called
+//   - AutoTool is AUTO, the model picks between text and function calls
+//   - RequiredTool is ANY, the model must call one or more functions
+//   - a named tool is ANY, with the tool as the only allowed function. Unlike a forced function of OpenAI, the model
+//     may call it more than once in the same turn
+//
+// https://cloud.google.com/vertex-ai/generative-ai/docs/model-reference/function-calling#functioncallingconfig
+func toolConfig(choice *tools.ToolChoice) *genToolConfig {
+	if choice == nil {
+		return nil
+	}
+	config := &genToolConfig{
+		GoogleFunctionCallingConfig: genFunctionCallingConfig{
+			Mode: "ANY",
+		},
+	}
+	switch choice.Name {
+	case tools.NoTool.Name:
+		config.GoogleFunctionCallingConfig.Mode = "NONE"
+	case tools.AutoTool.Name:
+		config.GoogleFunctionCallingConfig.Mode = "AUTO"
+	case tools.RequiredTool.Name:
+	default:
+		config.GoogleFunctionCallingConfig.AllowedFunctionNames = []string{choice.Name}
+	}
+	return config
+}
@@ -0,0 +1,118 @@
+package vertexai
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/modfin/bellman/models/gen"
+	"github.com/modfin/bellman/models/limit"
+	"github.com/modfin/bellman/prompt"
+)
+
+// handlerTransport serves the requests of a client by the handler, instead of sending them
+type handlerTransport http.HandlerFunc
+
+func (h handlerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	rec := httptest.NewRecorder()
+	h(rec, r)
+	return rec.Result(), nil
+}
+
+// newTestGenerator returns a generator whose requests are served by the handler
+func newTestGenerator(h http.HandlerFunc) *generator {
+	google := &Google{
+		config:  GoogleConfig{Project: "test-project", Region: "europe-west4"},
+		client:  &http.Client{Transport: handlerTransport(h)},
+		limiter: limit.New(0, 0, 0),
+	}
+	return &generator{google: google, request: gen.Request{Model: gen.Model{Provider: Provider, Name: "gemini-2.5-flash"}}}
+}
+
+func TestToolCallIDs(t *testing.T) {
+	var body []byte
+	g := newTestGenerator(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+		_, _ = io.WriteString(w, `{"responseId":"resp-1","candidates":[{"content":{"role":"model","parts":[
+			{"functionCall":{"name":"weather","args":{"city":"Oslo"}}},
+			{"functionCall":{"id":"fc-2","name":"weather","args":{"city":"Bergen"}}}
+		]},"finishReason":"STOP"}]}`)
+	})
+
+	res, err := g.Prompt(prompt.AsUser("weather in Oslo and Bergen?"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Tools) != 2 || res.Tools[0].ID != "resp-1-0" || res.Tools[1].ID != "fc-2" {
+		t.Fatalf("expected ids derived from the response and assigned by gemini, got %+v", res.Tools)
+	}
+
+	// the ids are echoed back, pairing each response with its call
+	_, err = g.Prompt(
+		prompt.AsUser("weather in Oslo and Bergen?"),
+		prompt.AsToolCall(res.Tools[0].ID, res.Tools[0].Name, res.Tools[0].Argument),
+		prompt.AsToolCall(res.Tools[1].ID, res.Tools[1].Name, res.Tools[1].Argument),
+		prompt.AsToolResponse(res.Tools[0].ID, "weather", `{"temp":3}`),
+		prompt.AsToolResponse(res.Tools[1].ID, "weather", `{"temp":5}`),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var req struct {
+		Contents []struct {
+			Parts []struct {
+				FunctionCall     *struct{ ID string } `json:"functionCall"`
+				FunctionResponse *struct{ ID string } `json:"functionResponse"`
+			} `json:"parts"`
+		} `json:"contents"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Fatal(err)
+	}
+	var calls, responses []string
+	for _, c := range req.Contents {
+		for _, p := range c.Parts {
+			if p.FunctionCall != nil {
+				calls = append(calls, p.FunctionCall.ID)
+			}
+			if p.FunctionResponse != nil {
+				responses = append(responses, p.FunctionResponse.ID)
+			}
+		}
+	}
+	expected := []string{"resp-1-0", "fc-2"}
+	if len(calls) != 2 || calls[0] != expected[0] || calls[1] != expected[1] {
+		t.Fatalf("expected function call ids %v, got %v in %s", expected, calls, body)
+	}
+	if len(responses) != 2 || responses[0] != expected[0] || responses[1] != expected[1] {
+		t.Fatalf("expected function response ids %v, got %v in %s", expected, responses, body)
+	}
+}
+
+func TestStreamToolCallIDs(t *testing.T) {
+	g := newTestGenerator(func(w http.ResponseWriter, r *http.Request) {
+		for _, chunk := range []string{
+			`{"responseId":"resp-2","candidates":[{"content":{"role":"model","parts":[{"functionCall":{"name":"weather","args":{"city":"Oslo"}}}]}}]}`,
+			`{"responseId":"resp-2","candidates":[{"content":{"role":"model","parts":[{"functionCall":{"name":"weather","args":{"city":"Bergen"}}}]},"finishReason":"STOP"}]}`,
+		} {
+			_, _ = io.WriteString(w, "data: "+chunk+"\n\n")
+		}
+	})
+
+	stream, err := g.Stream(prompt.AsUser("weather in Oslo and Bergen?"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for r := range stream {
+		if r.ToolCall != nil {
+			ids = append(ids, r.ToolCall.ID)
+		}
+	}
+	// calls are numbered across chunks, as each chunk indexes its parts from 0
+	if len(ids) != 2 || ids[0] != "resp-2-0" || ids[1] != "resp-2-1" {
+		t.Fatalf("expected ids numbered across chunks, got %v", ids)
+	}
+}
@@ -1,13 +1,14 @@
 package vertexai
 
 import (
+	"github.com/modfin/bellman/models"
 	"github.com/modfin/bellman/models/embed"
 	"github.com/modfin/bellman/models/gen"
 )
 
 // https://cloud.google.com/vertex-ai/generative-ai/docs/learn/models#gemini-models
 
-const Provider = "VertexAI"
+const Provider = models.ProviderVertexAI
 
 var GenModel_gemini_2_5_pro_latest = gen.Model{
 	Provider:       Provider,
@@ -1,6 +1,10 @@
 package vertexai
 
-import "github.com/modfin/bellman/tools"
+import (
+	"time"
+
+	"github.com/modfin/bellman/tools"
+)
 
 type genRequestContent struct {
 	Role  string                  `json:"role,omitempty"`
@@ -25,16 +29,20 @@ type fileData struct {
 }
 
 type functionCall struct {
+	ID   string         `json:"id,omitempty"`
 	Name string         `json:"name,omitempty"`
 	Args map[string]any `json:"args,omitempty"`
 }
 
 type functionResponse struct {
+	ID       string `json:"id,omitempty"`
 	Name     string `json:"name,omitempty"`
-	Response struct {
-		Name    string `json:"name,omitempty"`
-		Content any    `json:"content,omitempty"`
-	} `json:"response,omitempty"`
+	Response any    `json:"response,omitempty"` // a json object, either functionResponseContent or the structured tool response
+}
+
+type functionResponseContent struct {
+	Name    string `json:"name,omitempty"`
+	Content any    `json:"content,omitempty"`
 }
 
 type thinkingConfig struct {
@@ -90,4 +98,5 @@ type genRequest struct {
 
 	toolBelt map[string]*tools.Tool `json:"-"`
 	url      string                 `json:"-"`
+	waited   time.Duration          `json:"-"` // time spent waiting for the limiter
 }
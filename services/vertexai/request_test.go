@@ -0,0 +1,79 @@
+package vertexai
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/modfin/bellman/prompt"
+	"github.com/modfin/bellman/tools"
+)
+
+func TestToolResponsePart(t *testing.T) {
+	tests := []struct {
+		name       string
+		response   string
+		structured bool
+		expected   string
+	}{
+		{
+			name:     "wrapper",
+			response: `{"temp":21}`,
+			expected: `{"functionResponse":{"id":"call-1","name":"weather","response":{"name":"weather","content":"{\"temp\":21}"}}}`,
+		},
+		{
+			name:       "structured object",
+			response:   `{"temp":21}`,
+			structured: true,
+			expected:   `{"functionResponse":{"id":"call-1","name":"weather","response":{"temp":21}}}`,
+		},
+		{
+			name:       "structured array",
+			response:   `[1,2]`,
+			structured: true,
+			expected:   `{"functionResponse":{"id":"call-1","name":"weather","response":{"name":"weather","content":[1,2]}}}`,
+		},
+		{
+			name:       "structured non-json",
+			response:   `sunny`,
+			structured: true,
+			expected:   `{"functionResponse":{"id":"call-1","name":"weather","response":{"name":"weather","content":"sunny"}}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			part := toolResponsePart(&prompt.ToolResponse{ToolCallID: "call-1", Name: "weather", Response: tt.response}, tt.structured)
+			b, err := json.Marshal(part)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tt.expected {
+				t.Fatalf("expected %s, got %s", tt.expected, b)
+			}
+		})
+	}
+}
+
+func TestToolConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		choice   *tools.ToolChoice
+		expected string
+	}{
+		{name: "unset", choice: nil, expected: `null`},
+		{name: "none", choice: &tools.NoTool, expected: `{"functionCallingConfig":{"mode":"NONE"}}`},
+		{name: "auto", choice: &tools.AutoTool, expected: `{"functionCallingConfig":{"mode":"AUTO"}}`},
+		{name: "required", choice: &tools.RequiredTool, expected: `{"functionCallingConfig":{"mode":"ANY"}}`},
+		{name: "named", choice: &tools.ToolChoice{Name: "weather"}, expected: `{"functionCallingConfig":{"mode":"ANY","allowedFunctionNames":["weather"]}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := json.Marshal(toolConfig(tt.choice))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tt.expected {
+				t.Fatalf("expected %s, got %s", tt.expected, b)
+			}
+		})
+	}
+}
@@ -23,6 +23,9 @@ type geminiStreamingResponse struct {
 		} `json:"content"`
 		FinishReason string `json:"finishReason"`
 	} `json:"candidates"`
+	PromptFeedback struct {
+		BlockReason string `json:"blockReason"`
+	} `json:"promptFeedback"`
 	UsageMetadata struct {
 		PromptTokenCount     int    `json:"promptTokenCount"`
 		CandidatesTokenCount int    `json:"candidatesTokenCount"`
@@ -62,10 +65,18 @@ type geminiResponse struct {
 			SeverityScore    float64 `json:"severityScore"`
 		} `json:"safetyRatings"`
 	} `json:"candidates"`
+	PromptFeedback struct {
+		BlockReason string `json:"blockReason"`
+	} `json:"promptFeedback"`
 	UsageMetadata struct {
 		PromptTokenCount     int `json:"promptTokenCount"`
 		CandidatesTokenCount int `json:"candidatesTokenCount"`
 		ThoughtsTokenCount   int `json:"thoughtsTokenCount"`
 		TotalTokenCount      int `json:"totalTokenCount"`
 	} `json:"usageMetadata"`
+	ResponseID string `json:"responseId"`
+}
+
+type countTokensResponse struct {
+	TotalTokens int `json:"totalTokens"`
 }
@@ -37,6 +37,8 @@ type JSONSchema struct {
 	Description string `json:"description,omitempty"`
 	// Optional. Indicates if the value may be null.
 	Nullable bool `json:"nullable,omitempty"`
+	// Optional. Default value of the data.
+	Default any `json:"default,omitempty"`
 	// Optional. SCHEMA FIELDS FOR TYPE ARRAY
 	// Schema of the elements of Type.ARRAY.
 	Items *JSONSchema `json:"items,omitempty"`
@@ -71,6 +73,7 @@ func fromBellmanSchema(bellmanSchema *schema.JSON) *JSONSchema {
 		Description: bellmanSchema.Description,
 		Required:    bellmanSchema.Required,
 		Nullable:    bellmanSchema.Nullable,
+		Default:     bellmanSchema.Default,
 	}
 	switch bellmanSchema.Type {
 	case schema.Object:
@@ -1,11 +1,12 @@
 package vllm
 
 import (
+	"github.com/modfin/bellman/models"
 	"github.com/modfin/bellman/models/embed"
 	"github.com/modfin/bellman/models/gen"
 )
 
-const Provider = "vLLM"
+const Provider = models.ProviderVLLM
 
 var EmbedModel_qwen_3_8b = embed.Model{
 	Provider:         Provider,
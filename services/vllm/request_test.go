@@ -0,0 +1,107 @@
+package vllm
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/modfin/bellman/models/gen"
+	"github.com/modfin/bellman/prompt"
+	"github.com/modfin/bellman/schema"
+	"github.com/modfin/bellman/tools"
+)
+
+type weatherArgs struct {
+	City string `json:"city"`
+}
+
+func TestRequest(t *testing.T) {
+	weather := tools.NewTool("weather", tools.WithDescription("Get the weather"), tools.WithArgSchema(weatherArgs{}))
+	client := New([]string{"http://vllm:8000"}, []string{"qwen"})
+
+	g := client.Generator().
+		Model(gen.Model{Provider: Provider, Name: "qwen"}).
+		System("be brief").
+		SetTools(weather).
+		SetToolConfig(tools.ToolChoice{Name: "weather"}).
+		Output(schema.From(weatherArgs{}))
+
+	p := g.Prompter.(*generator)
+	p.SetRequest(g.Request)
+	req, reqModel, err := p.prompt(
+		prompt.AsUser("weather in Oslo?"),
+		prompt.AsToolCall("call-1", "weather", []byte(`{"city":"Oslo"}`)),
+		prompt.AsToolResponse("call-1", "weather", `{"temp":3}`),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.URL.String() != "http://vllm:8000/v1/chat/completions" {
+		t.Fatalf("unexpected url %s", req.URL)
+	}
+	if reqModel.toolBelt["weather"] != &p.request.Tools[0] {
+		t.Fatal("expected tool belt to refer to the request tool")
+	}
+
+	// re-marshal for sorted keys
+	body, _ := io.ReadAll(req.Body)
+	var sent map[string]any
+	if err := json.Unmarshal(body, &sent); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := json.Marshal(sent)
+	for _, expected := range []string{
+		`"tools":[{"function":{"description":"Get the weather","name":"weather"`,
+		`"tool_choice":{"function":{"name":"weather"`,
+		`"response_format":{"json_schema":{"name":"response"`,
+		`{"role":"assistant","tool_calls":[{"function":{"arguments":"{\"city\":\"Oslo\"}","name":"weather"},"id":"call-1","type":"function"}]}`,
+		`{"content":"{\"temp\":3}","role":"tool","tool_call_id":"call-1"}`,
+	} {
+		if !strings.Contains(string(b), expected) {
+			t.Fatalf("expected request to contain %s, got %s", expected, b)
+		}
+	}
+
+	g = g.SetToolConfig(tools.RequiredTool)
+	p.SetRequest(g.Request)
+	_, reqModel, err = p.prompt(prompt.AsUser("hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reqModel.ToolChoice != "required" {
+		t.Fatalf("expected required tool choice, got %v", reqModel.ToolChoice)
+	}
+}
+
+func TestPromptToolCalls(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"choices":[{"message":{"role":"assistant","tool_calls":[` +
+			`{"id":"call-1","type":"function","function":{"name":"second","arguments":"{}"}},` +
+			`{"id":"call-2","type":"function","function":{"name":"first","arguments":"{\"a\":1}"}}]}}],` +
+			`"usage":{"prompt_tokens":10,"completion_tokens":5}}`))
+	}))
+	defer srv.Close()
+
+	client := New([]string{srv.URL}, []string{"*"})
+	res, err := client.Generator().
+		Model(gen.Model{Provider: Provider, Name: "qwen"}).
+		SetTools(tools.NewTool("first", tools.WithArgSchema(weatherArgs{})), tools.NewTool("second", tools.WithArgSchema(weatherArgs{}))).
+		Prompt(prompt.AsUser("hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Tools) != 2 || res.Tools[0].Name != "second" || string(res.Tools[1].Argument) != `{"a":1}` {
+		t.Fatalf("unexpected tool calls %+v", res.Tools)
+	}
+	for _, call := range res.Tools {
+		if call.Ref == nil || call.Ref.Name != call.Name {
+			t.Fatalf("expected ref of %s to point at its own tool, got %+v", call.Name, call.Ref)
+		}
+	}
+	if res.Metadata.TotalTokens != 15 {
+		t.Fatalf("unexpected metadata %+v", res.Metadata)
+	}
+}
@@ -1,13 +1,14 @@
 package voyageai
 
 import (
+	"github.com/modfin/bellman/models"
 	"github.com/modfin/bellman/models/embed"
 )
 
 const TypeQuery embed.Type = "Represent the query for retrieving supporting documents"
 const TypeDocument embed.Type = "Represent the document for retrieval"
 
-const Provider = "VoyageAI"
+const Provider = models.ProviderVoyageAI
 
 // https://docs.voyageai.com/docs/embeddings
 
@@ -0,0 +1,175 @@
+package tools
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+type codeSessionKey struct{}
+
+// maxDedupEntries bounds the number of cached tool results per session
+const maxDedupEntries = 256
+
+// CodeSession holds the state of the code executions of a run, e.g. an agent run: the execution budget and counter,
+// the tool calls made from code and the deduplication cache of identical tool calls. A PTC runtime may be shared by
+// concurrent runs, e.g. of clones of a generator, so the state is kept per run, see gen.Generator.ToolContext, rather
+// than on the runtime. A nil session counts nothing. Safe for concurrent use
+type CodeSession struct {
+	executions    atomic.Int64 // executed code_execution calls since last reset
+	maxExecutions atomic.Int64 // 0 means unlimited
+
+	dedupOn atomic.Bool
+	dedups  atomic.Int64 // tool calls answered from the dedup cache since last reset
+	dedupMu sync.Mutex
+	results map[string]string
+	order   []string
+
+	callsMu sync.Mutex
+	calls   []Invocation // tool calls since last reset
+}
+
+// NewCodeSession returns a session capping the code executions at maxExecutions, 0 means unlimited, and caching
+// identical tool calls if dedup is set
+func NewCodeSession(maxExecutions int, dedup bool) *CodeSession {
+	s := &CodeSession{}
+	s.SetExecutionLimit(maxExecutions)
+	s.SetDeduplication(dedup)
+	return s
+}
+
+// ContextWithCodeSession returns a context carrying the code session of the run
+func ContextWithCodeSession(ctx context.Context, s *CodeSession) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithValue(ctx, codeSessionKey{}, s)
+}
+
+// CodeSessionFromContext returns the code session of the run, nil if not set
+func CodeSessionFromContext(ctx context.Context) *CodeSession {
+	if ctx == nil {
+		return nil
+	}
+	s, _ := ctx.Value(codeSessionKey{}).(*CodeSession)
+	return s
+}
+
+// SetExecutionLimit caps the number of code executions, 0 means unlimited
+func (s *CodeSession) SetExecutionLimit(n int) {
+	s.maxExecutions.Store(int64(max(n, 0)))
+}
+
+// ExecutionLimit returns the cap of code executions, 0 means unlimited
+func (s *CodeSession) ExecutionLimit() int {
+	if s == nil {
+		return 0
+	}
+	return int(s.maxExecutions.Load())
+}
+
+// Executions returns the number of code executions since the last reset
+func (s *CodeSession) Executions() int {
+	if s == nil {
+		return 0
+	}
+	return int(s.executions.Load())
+}
+
+// ReserveExecution counts an execution, returns false if the execution limit is reached
+func (s *CodeSession) ReserveExecution() bool {
+	for {
+		n := s.executions.Load()
+		limit := s.maxExecutions.Load()
+		if limit > 0 && n >= limit {
+			return false
+		}
+		if s.executions.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+// ResetExecutions resets the code execution counter and the recorded tool calls
+func (s *CodeSession) ResetExecutions() {
+	s.executions.Store(0)
+	s.callsMu.Lock()
+	defer s.callsMu.Unlock()
+	s.calls = nil
+}
+
+// RecordCall records a tool call made from code
+func (s *CodeSession) RecordCall(call Invocation) {
+	s.callsMu.Lock()
+	defer s.callsMu.Unlock()
+	s.calls = append(s.calls, call)
+}
+
+// ToolCalls returns the tool calls made from code since the last reset, in order. Deduplicated calls are included
+func (s *CodeSession) ToolCalls() []Invocation {
+	if s == nil {
+		return nil
+	}
+	s.callsMu.Lock()
+	defer s.callsMu.Unlock()
+	return append([]Invocation(nil), s.calls...)
+}
+
+// SetDeduplication toggles caching of identical tool calls (same tool and arguments). Disable for intentionally
+// non-deterministic tools
+func (s *CodeSession) SetDeduplication(enabled bool) {
+	s.dedupOn.Store(enabled)
+}
+
+// Deduplications returns the number of tool calls answered from cache since the last reset
+func (s *CodeSession) Deduplications() int {
+	if s == nil {
+		return 0
+	}
+	return int(s.dedups.Load())
+}
+
+// ResetDeduplication clears the tool call cache and the deduplication counter
+func (s *CodeSession) ResetDeduplication() {
+	s.dedupMu.Lock()
+	defer s.dedupMu.Unlock()
+	s.results = nil
+	s.order = nil
+	s.dedups.Store(0)
+}
+
+// LookupCall returns the cached result of a tool call by key, i.e. the tool name and canonical argument JSON, and
+// counts the deduplication. Nothing is cached if deduplication is disabled
+func (s *CodeSession) LookupCall(key string) (string, bool) {
+	if !s.dedupOn.Load() {
+		return "", false
+	}
+	s.dedupMu.Lock()
+	defer s.dedupMu.Unlock()
+	res, ok := s.results[key]
+	if ok {
+		s.dedups.Add(1)
+	}
+	return res, ok
+}
+
+// StoreCall caches the result of a tool call by key, evicting the oldest entry when full
+func (s *CodeSession) StoreCall(key string, res string) {
+	if !s.dedupOn.Load() {
+		return
+	}
+	s.dedupMu.Lock()
+	defer s.dedupMu.Unlock()
+	if s.results == nil {
+		s.results = make(map[string]string)
+	}
+	if _, ok := s.results[key]; ok {
+		return
+	}
+	if len(s.order) >= maxDedupEntries {
+		delete(s.results, s.order[0])
+		s.order = s.order[1:]
+	}
+	s.results[key] = res
+	s.order = append(s.order, key)
+}
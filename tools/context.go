@@ -0,0 +1,153 @@
+package tools
+
+import (
+	"context"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+type toolValuesKey struct{}
+
+type toolRandKey struct{}
+
+type maxResponseBytesKey struct{}
+
+type loggerKey struct{}
+
+type resultTransformKey struct{}
+
+// ContextWithValues returns a context carrying the values, merged with any values already in ctx
+func ContextWithValues(ctx context.Context, values map[string]any) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if len(values) == 0 {
+		return ctx
+	}
+	merged := map[string]any{}
+	if existing, ok := ctx.Value(toolValuesKey{}).(map[string]any); ok {
+		for k, v := range existing {
+			merged[k] = v
+		}
+	}
+	for k, v := range values {
+		merged[k] = v
+	}
+	return context.WithValue(ctx, toolValuesKey{}, merged)
+}
+
+// ValueFromContext returns a request scoped value, e.g. set by gen.Generator.WithToolValues, or nil if not set
+func ValueFromContext(ctx context.Context, key string) any {
+	if ctx == nil {
+		return nil
+	}
+	values, ok := ctx.Value(toolValuesKey{}).(map[string]any)
+	if !ok {
+		return nil
+	}
+	return values[key]
+}
+
+// ContextWithMaxResponseBytes returns a context carrying the default response size limit of tool calls, for tools
+// without a limit of their own, e.g. of tools called from code, see gen.Generator.MaxToolResponseBytes
+func ContextWithMaxResponseBytes(ctx context.Context, n int) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithValue(ctx, maxResponseBytesKey{}, max(n, 0))
+}
+
+// MaxResponseBytesFromContext returns the default response size limit of a tool call, 0, i.e. unlimited, if not set
+func MaxResponseBytesFromContext(ctx context.Context) int {
+	if ctx == nil {
+		return 0
+	}
+	n, _ := ctx.Value(maxResponseBytesKey{}).(int)
+	return n
+}
+
+// ContextWithRand returns a context carrying the random source of tool calls, e.g. seeded by the PTC runtime, see
+// gen.Generator.PTCSeed
+func ContextWithRand(ctx context.Context, r *rand.Rand) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithValue(ctx, toolRandKey{}, r)
+}
+
+// RandFromContext returns the random source of a tool call, seeded if the run is, or a randomly seeded one if none is
+// set. Tools should use it rather than the global source for runs to be reproducible
+func RandFromContext(ctx context.Context) *rand.Rand {
+	if ctx != nil {
+		if r, ok := ctx.Value(toolRandKey{}).(*rand.Rand); ok && r != nil {
+			return r
+		}
+	}
+	return rand.New(rand.NewSource(time.Now().UnixNano()))
+}
+
+// ContextWithLogger returns a context carrying the logger for debug logs of code executions and the tool calls made
+// from code, see gen.Generator.PTCLogger
+func ContextWithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// LoggerFromContext returns the logger of the context, nil if not set
+func LoggerFromContext(ctx context.Context) *slog.Logger {
+	if ctx == nil {
+		return nil
+	}
+	logger, _ := ctx.Value(loggerKey{}).(*slog.Logger)
+	return logger
+}
+
+// ContextWithResultTransform returns a context carrying the transform of responses of tools called from code, see
+// agent.WithToolResultTransform
+func ContextWithResultTransform(ctx context.Context, fn ResultTransform) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithValue(ctx, resultTransformKey{}, fn)
+}
+
+// ResultTransformFromContext returns the transform of tool responses of the context, nil, i.e. identity, if not set
+func ResultTransformFromContext(ctx context.Context) ResultTransform {
+	if ctx == nil {
+		return nil
+	}
+	fn, _ := ctx.Value(resultTransformKey{}).(ResultTransform)
+	return fn
+}
+
+// NewRand returns a random source seeded with seed that is safe for concurrent use, e.g. by tools called in parallel
+func NewRand(seed int64) *rand.Rand {
+	return rand.New(&lockedSource{src: rand.NewSource(seed).(rand.Source64)})
+}
+
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source64
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Uint64() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Uint64()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.src.Seed(seed)
+}
@@ -0,0 +1,239 @@
+package mcp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/modfin/bellman/tools"
+)
+
+// ProtocolVersion is the MCP protocol version announced when initializing a connection
+const ProtocolVersion = "2025-03-26"
+
+// Transport sends JSON-RPC messages to an MCP server over a single connection
+type Transport interface {
+	// Call sends a request and returns the result, or an *RPCError if the server responded with an error
+	Call(ctx context.Context, method string, params any) (json.RawMessage, error)
+	// Notify sends a notification, i.e. a message without a response
+	Notify(ctx context.Context, method string, params any) error
+	Close() error
+}
+
+// Dialer opens a new, not yet initialized, connection to an MCP server, see Stdio and HTTP
+type Dialer func(ctx context.Context) (Transport, error)
+
+// RPCError is a JSON-RPC error returned by the MCP server
+type RPCError struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("mcp error %d: %s", e.Code, e.Message)
+}
+
+// Tool is a tool as listed by the MCP server
+type Tool struct {
+	Name         string         `json:"name"`
+	Description  string         `json:"description,omitempty"`
+	InputSchema  map[string]any `json:"inputSchema"`
+	OutputSchema map[string]any `json:"outputSchema,omitempty"`
+}
+
+// Content is a content item of a tool result, only text content is used when converting results
+type Content struct {
+	Type     string `json:"type"`
+	Text     string `json:"text,omitempty"`
+	Data     string `json:"data,omitempty"`
+	MimeType string `json:"mimeType,omitempty"`
+}
+
+// CallResult is the result of a tool call
+type CallResult struct {
+	Content           []Content       `json:"content"`
+	StructuredContent json.RawMessage `json:"structuredContent,omitempty"`
+	IsError           bool            `json:"isError,omitempty"`
+}
+
+// Client is a connection to an MCP server shared by all of its tools. The connection is opened and initialized
+// lazily, and re-opened once if a call fails due to a broken connection.
+type Client struct {
+	dial Dialer
+
+	mu   sync.Mutex
+	conn Transport
+}
+
+// NewClient creates a client for the MCP server reached by dial
+func NewClient(dial Dialer) *Client {
+	return &Client{dial: dial}
+}
+
+// connection returns the current connection, opening and initializing a new one if needed
+func (c *Client) connection(ctx context.Context) (Transport, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil {
+		return c.conn, nil
+	}
+
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to mcp server; %w", err)
+	}
+	_, err = conn.Call(ctx, "initialize", map[string]any{
+		"protocolVersion": ProtocolVersion,
+		"capabilities":    map[string]any{},
+		"clientInfo":      map[string]any{"name": "bellman", "version": "1.0.0"},
+	})
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("could not initialize mcp session; %w", err)
+	}
+	if err := conn.Notify(ctx, "notifications/initialized", nil); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("could not initialize mcp session; %w", err)
+	}
+	c.conn = conn
+	return conn, nil
+}
+
+// drop closes the connection, unless it has already been replaced by another caller
+func (c *Client) drop(conn Transport) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == conn {
+		_ = c.conn.Close()
+		c.conn = nil
+	}
+}
+
+func (c *Client) call(ctx context.Context, method string, params any) (json.RawMessage, error) {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		var conn Transport
+		conn, err = c.connection(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var res json.RawMessage
+		res, err = conn.Call(ctx, method, params)
+		var rpcErr *RPCError
+		if err == nil || errors.As(err, &rpcErr) || ctx.Err() != nil {
+			return res, err
+		}
+		c.drop(conn)
+	}
+	return nil, err
+}
+
+// ListTools lists all tools of the MCP server, following pagination
+func (c *Client) ListTools(ctx context.Context) ([]Tool, error) {
+	var res []Tool
+	cursor := ""
+	for {
+		params := map[string]any{}
+		if cursor != "" {
+			params["cursor"] = cursor
+		}
+		raw, err := c.call(ctx, "tools/list", params)
+		if err != nil {
+			return nil, fmt.Errorf("could not list mcp tools; %w", err)
+		}
+		var page struct {
+			Tools      []Tool `json:"tools"`
+			NextCursor string `json:"nextCursor"`
+		}
+		if err := json.Unmarshal(raw, &page); err != nil {
+			return nil, fmt.Errorf("could not unmarshal mcp tools; %w", err)
+		}
+		res = append(res, page.Tools...)
+		if page.NextCursor == "" {
+			return res, nil
+		}
+		cursor = page.NextCursor
+	}
+}
+
+// CallTool calls a tool on the MCP server, arguments should be a JSON object
+func (c *Client) CallTool(ctx context.Context, name string, arguments json.RawMessage) (*CallResult, error) {
+	if len(arguments) == 0 {
+		arguments = json.RawMessage("{}")
+	}
+	raw, err := c.call(ctx, "tools/call", map[string]any{
+		"name":      name,
+		"arguments": arguments,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not call mcp tool %s; %w", name, err)
+	}
+	var res CallResult
+	if err := json.Unmarshal(raw, &res); err != nil {
+		return nil, fmt.Errorf("could not unmarshal mcp tool result; %w", err)
+	}
+	return &res, nil
+}
+
+// Tools lists the tools of the MCP server as Bellman tools, see ToolsFromMCP
+func (c *Client) Tools(ctx context.Context, opts ...tools.ToolOption) ([]tools.Tool, error) {
+	return ToolsFromMCP(ctx, c, opts...)
+}
+
+// Close closes the current connection, a later call opens a new one
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+// Text returns the structured content if present, otherwise the text content joined by new lines. Results flagged
+// as errors are returned as an error with the text content as message.
+func (r *CallResult) Text() (string, error) {
+	var texts []string
+	for _, c := range r.Content {
+		if c.Type == "text" {
+			texts = append(texts, c.Text)
+		}
+	}
+	if r.IsError {
+		return "", fmt.Errorf("mcp tool error: %s", strings.Join(texts, "\n"))
+	}
+	if len(r.StructuredContent) > 0 && string(r.StructuredContent) != "null" {
+		return string(r.StructuredContent), nil
+	}
+	if len(texts) == 0 && len(r.Content) > 0 {
+		b, err := json.Marshal(r.Content)
+		if err != nil {
+			return "", fmt.Errorf("could not marshal mcp tool content; %w", err)
+		}
+		return string(b), nil
+	}
+	return strings.Join(texts, "\n"), nil
+}
+
+// JSON returns the result as JSON, i.e. the structured content or a text content that is valid JSON as is, and
+// any other text content encoded as a JSON string
+func (r *CallResult) JSON() (string, error) {
+	text, err := r.Text()
+	if err != nil {
+		return "", err
+	}
+	if json.Valid([]byte(text)) {
+		return text, nil
+	}
+	b, err := json.Marshal(text)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal mcp tool content; %w", err)
+	}
+	return string(b), nil
+}
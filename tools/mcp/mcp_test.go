@@ -0,0 +1,262 @@
+package mcp_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/modfin/bellman/tools"
+	"github.com/modfin/bellman/tools/mcp"
+	"github.com/modfin/bellman/tools/ptc/js"
+)
+
+const serverEnv = "BELLMAN_MCP_TEST_SERVER"
+
+// TestMain lets the test binary act as a stdio MCP server when started by TestStdio
+func TestMain(m *testing.M) {
+	if os.Getenv(serverEnv) == "1" {
+		srv := &server{}
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			if resp := srv.handle(scanner.Bytes()); resp != nil {
+				b, _ := json.Marshal(resp)
+				fmt.Println(string(b))
+			}
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+type request struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+}
+
+// server is a tiny MCP server with an add and a fail tool
+type server struct {
+	mu      sync.Mutex
+	methods []string
+}
+
+func (s *server) handle(raw []byte) map[string]any {
+	var req request
+	if err := json.Unmarshal(raw, &req); err != nil {
+		return map[string]any{"jsonrpc": "2.0", "id": nil, "error": map[string]any{"code": -32700, "message": "parse error"}}
+	}
+	s.mu.Lock()
+	s.methods = append(s.methods, req.Method)
+	s.mu.Unlock()
+	if req.JSONRPC != "2.0" {
+		return map[string]any{"jsonrpc": "2.0", "id": req.ID, "error": map[string]any{"code": -32600, "message": "invalid request"}}
+	}
+	if len(req.ID) == 0 {
+		return nil // notification
+	}
+
+	var result any
+	switch req.Method {
+	case "initialize":
+		result = map[string]any{
+			"protocolVersion": mcp.ProtocolVersion,
+			"capabilities":    map[string]any{"tools": map[string]any{}},
+			"serverInfo":      map[string]any{"name": "test", "version": "0.0.1"},
+		}
+	case "tools/list":
+		result = map[string]any{"tools": []any{
+			map[string]any{
+				"name":        "add",
+				"description": "Adds two numbers",
+				"inputSchema": map[string]any{
+					"type": "object",
+					"properties": map[string]any{
+						"a": map[string]any{"type": "number"},
+						"b": map[string]any{"type": "number"},
+					},
+					"required":             []any{"a", "b"},
+					"additionalProperties": false,
+				},
+			},
+			map[string]any{
+				"name":        "fail",
+				"inputSchema": map[string]any{"type": "object"},
+			},
+		}}
+	case "tools/call":
+		var params struct {
+			Name      string             `json:"name"`
+			Arguments map[string]float64 `json:"arguments"`
+		}
+		_ = json.Unmarshal(req.Params, &params)
+		switch params.Name {
+		case "add":
+			text := fmt.Sprintf(`{"sum":%v}`, params.Arguments["a"]+params.Arguments["b"])
+			result = map[string]any{"content": []any{map[string]any{"type": "text", "text": text}}}
+		default:
+			result = map[string]any{"content": []any{map[string]any{"type": "text", "text": "something broke"}}, "isError": true}
+		}
+	default:
+		return map[string]any{"jsonrpc": "2.0", "id": req.ID, "error": map[string]any{"code": -32601, "message": "method not found"}}
+	}
+	return map[string]any{"jsonrpc": "2.0", "id": req.ID, "result": result}
+}
+
+func (s *server) count(method string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int
+	for _, m := range s.methods {
+		if m == method {
+			n++
+		}
+	}
+	return n
+}
+
+// httpServer serves the server over the streamable HTTP transport, answering tool calls as event streams
+func httpServer(t *testing.T, srv *server) (*httptest.Server, func()) {
+	var mu sync.Mutex
+	sessions := map[string]bool{}
+	var next int
+	restart := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		sessions = map[string]bool{}
+	}
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Method == http.MethodDelete {
+			mu.Lock()
+			delete(sessions, r.Header.Get("Mcp-Session-Id"))
+			mu.Unlock()
+			return
+		}
+		if !strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+			t.Errorf("expected client to accept event streams, got %q", r.Header.Get("Accept"))
+		}
+		var req request
+		body := json.NewDecoder(r.Body)
+		var raw json.RawMessage
+		_ = body.Decode(&raw)
+		_ = json.Unmarshal(raw, &req)
+
+		mu.Lock()
+		if req.Method == "initialize" {
+			next++
+			id := fmt.Sprintf("session-%d", next)
+			sessions[id] = true
+			w.Header().Set("Mcp-Session-Id", id)
+		} else if !sessions[r.Header.Get("Mcp-Session-Id")] {
+			mu.Unlock()
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		mu.Unlock()
+
+		resp := srv.handle(raw)
+		if resp == nil {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		b, _ := json.Marshal(resp)
+		if req.Method != "tools/call" {
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write(b)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = fmt.Fprintf(w, "event: message\ndata: %s\n\n", `{"jsonrpc":"2.0","method":"notifications/progress","params":{}}`)
+		_, _ = fmt.Fprintf(w, "event: message\ndata: %s\n\n", b)
+	})
+	return httptest.NewServer(h), restart
+}
+
+func TestHTTP(t *testing.T) {
+	srv := &server{}
+	ts, restart := httpServer(t, srv)
+	defer ts.Close()
+
+	client := mcp.NewClient(mcp.HTTP(ts.URL, nil, map[string]string{"Authorization": "Bearer secret"}))
+	defer client.Close()
+
+	toolset, err := client.Tools(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(toolset) != 2 || toolset[0].Name != "add" || toolset[0].Description != "Adds two numbers" {
+		t.Fatalf("unexpected tools %+v", toolset)
+	}
+	if args := toolset[0].ArgumentSchema; args == nil || len(args.Properties) != 2 || len(args.Required) != 2 {
+		t.Fatalf("expected input schema to be converted, got %+v", args)
+	}
+
+	add := toolset[0]
+	res, err := add.Function(context.Background(), tools.Call{Name: "add", Argument: []byte(`{"a":1,"b":2}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != `{"sum":3}` {
+		t.Fatalf("unexpected result %s", res)
+	}
+	if srv.count("initialize") != 1 || srv.count("notifications/initialized") != 1 {
+		t.Fatalf("expected a single shared session, got %v", srv.methods)
+	}
+
+	_, err = toolset[1].Function(context.Background(), tools.Call{Name: "fail", Argument: []byte(`{}`)})
+	if err == nil || !strings.Contains(err.Error(), "something broke") {
+		t.Fatalf("expected tool error, got %v", err)
+	}
+
+	restart()
+	res, err = add.Function(context.Background(), tools.Call{Name: "add", Argument: []byte(`{"a":2,"b":2}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != `{"sum":4}` || srv.count("initialize") != 2 {
+		t.Fatalf("expected client to reconnect after the session expired, got %s, %v", res, srv.methods)
+	}
+}
+
+func TestStdio(t *testing.T) {
+	t.Setenv(serverEnv, "1")
+	client := mcp.NewClient(mcp.Stdio(os.Args[0], "-test.run=^$"))
+	defer client.Close()
+
+	toolset, err := client.Tools(context.Background(), tools.WithPTC(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(toolset) != 2 || !toolset[0].UsePTC {
+		t.Fatalf("expected tool options to be applied, got %+v", toolset)
+	}
+
+	runtime, err := js.NewRuntime("code_execution")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := runtime.AdaptTools(toolset...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	arg, _ := json.Marshal(map[string]string{"code": `__setResult([add({a: 1, b: 2}).sum, add({a: 3, b: 4}).sum])`})
+	res, err := code.Function(context.Background(), tools.Call{Name: "code_execution", Argument: arg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != `[3,7]` {
+		t.Fatalf("expected mcp tools to be callable from ptc code, got %s", res)
+	}
+}
@@ -0,0 +1,59 @@
+package mcp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/modfin/bellman/schema"
+	"github.com/modfin/bellman/tools"
+)
+
+// ToolSource is the part of an MCP client needed to expose its tools, implemented by Client
+type ToolSource interface {
+	ListTools(ctx context.Context) ([]Tool, error)
+	CallTool(ctx context.Context, name string, arguments json.RawMessage) (*CallResult, error)
+}
+
+// ToolsFromMCP lists the tools of the MCP server as Bellman tools. The input and output schemas are mapped to
+// schema.JSON and each tool function proxies the call to the server, returning the result as JSON. The options
+// are applied to each tool, e.g. tools.WithPTC(true) to let PTC code batch calls to the MCP tools.
+func ToolsFromMCP(ctx context.Context, client ToolSource, opts ...tools.ToolOption) ([]tools.Tool, error) {
+	list, err := client.ListTools(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]tools.Tool, 0, len(list))
+	for _, t := range list {
+		args, err := schema.FromOpenAI(t.InputSchema)
+		if err != nil {
+			return nil, fmt.Errorf("could not convert input schema of mcp tool %s; %w", t.Name, err)
+		}
+		tool := tools.NewTool(t.Name,
+			tools.WithDescription(t.Description),
+			tools.WithFunction(forward(client, t.Name)),
+		)
+		tool.ArgumentSchema = args
+		if t.OutputSchema != nil {
+			tool.ResponseSchema, err = schema.FromOpenAI(t.OutputSchema)
+			if err != nil {
+				return nil, fmt.Errorf("could not convert output schema of mcp tool %s; %w", t.Name, err)
+			}
+		}
+		for _, opt := range opts {
+			tool = opt(tool)
+		}
+		res = append(res, tool)
+	}
+	return res, nil
+}
+
+func forward(client ToolSource, name string) tools.Function {
+	return func(ctx context.Context, call tools.Call) (string, error) {
+		result, err := client.CallTool(ctx, name, call.Argument)
+		if err != nil {
+			return "", err
+		}
+		return result.JSON()
+	}
+}
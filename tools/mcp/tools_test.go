@@ -0,0 +1,87 @@
+package mcp_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/modfin/bellman/schema"
+	"github.com/modfin/bellman/tools"
+	"github.com/modfin/bellman/tools/mcp"
+)
+
+type source struct {
+	calls []string
+}
+
+func (s *source) ListTools(ctx context.Context) ([]mcp.Tool, error) {
+	return []mcp.Tool{
+		{
+			Name:        "weather",
+			Description: "Current weather",
+			InputSchema: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"city":  map[string]any{"type": "string"},
+					"units": map[string]any{"type": []any{"string", "null"}, "enum": []any{"metric", "imperial"}},
+				},
+				"required": []any{"city"},
+			},
+			OutputSchema: map[string]any{
+				"type":       "object",
+				"properties": map[string]any{"temperature": map[string]any{"type": "number"}},
+			},
+		},
+		{Name: "echo", InputSchema: map[string]any{"type": "object"}},
+	}, nil
+}
+
+func (s *source) CallTool(ctx context.Context, name string, arguments json.RawMessage) (*mcp.CallResult, error) {
+	s.calls = append(s.calls, name+" "+string(arguments))
+	if name == "weather" {
+		return &mcp.CallResult{
+			Content:           []mcp.Content{{Type: "text", Text: "12 degrees"}},
+			StructuredContent: json.RawMessage(`{"temperature":12}`),
+		}, nil
+	}
+	return &mcp.CallResult{Content: []mcp.Content{{Type: "text", Text: "plain text"}}}, nil
+}
+
+func TestToolsFromMCP(t *testing.T) {
+	src := &source{}
+	toolset, err := mcp.ToolsFromMCP(context.Background(), src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(toolset) != 2 {
+		t.Fatalf("expected 2 tools, got %+v", toolset)
+	}
+
+	weather := toolset[0]
+	units := weather.ArgumentSchema.Properties["units"]
+	if units == nil || units.Type != schema.String || !units.Nullable || len(units.Enum) != 2 {
+		t.Fatalf("expected nullable enum units, got %+v", units)
+	}
+	if weather.ResponseSchema == nil || weather.ResponseSchema.Properties["temperature"] == nil {
+		t.Fatalf("expected output schema to be mapped, got %+v", weather.ResponseSchema)
+	}
+
+	res, err := weather.Function(context.Background(), tools.Call{Name: "weather", Argument: []byte(`{"city":"Stockholm"}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != `{"temperature":12}` {
+		t.Fatalf("expected structured content, got %s", res)
+	}
+
+	res, err = toolset[1].Function(context.Background(), tools.Call{Name: "echo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != `"plain text"` {
+		t.Fatalf("expected text content as json string, got %s", res)
+	}
+	if len(src.calls) != 2 || src.calls[0] != `weather {"city":"Stockholm"}` {
+		t.Fatalf("unexpected calls %v", src.calls)
+	}
+}
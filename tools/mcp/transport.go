@@ -0,0 +1,320 @@
+package mcp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type message struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      *int64          `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  any             `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *RPCError       `json:"error,omitempty"`
+}
+
+type response struct {
+	ID     *int64          `json:"id"`
+	Method string          `json:"method"`
+	Result json.RawMessage `json:"result"`
+	Error  *RPCError       `json:"error"`
+}
+
+func (r response) result() (json.RawMessage, error) {
+	if r.Error != nil {
+		return nil, r.Error
+	}
+	return r.Result, nil
+}
+
+// Stdio starts the MCP server as a sub process for each connection and exchanges newline delimited JSON-RPC
+// messages over its stdin and stdout
+func Stdio(command string, args ...string) Dialer {
+	return func(ctx context.Context) (Transport, error) {
+		cmd := exec.Command(command, args...)
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, fmt.Errorf("could not open stdin; %w", err)
+		}
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, fmt.Errorf("could not open stdout; %w", err)
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, fmt.Errorf("could not start %s; %w", command, err)
+		}
+		return newStreamTransport(stdout, stdin, func() error {
+			_ = stdin.Close()
+			if cmd.Process != nil {
+				_ = cmd.Process.Kill()
+			}
+			return cmd.Wait()
+		}), nil
+	}
+}
+
+type streamTransport struct {
+	w     io.Writer
+	close func() error
+
+	writeMu sync.Mutex
+	nextID  atomic.Int64
+
+	mu      sync.Mutex
+	pending map[int64]chan response
+	err     error
+	done    chan struct{}
+}
+
+func newStreamTransport(r io.Reader, w io.Writer, close func() error) *streamTransport {
+	t := &streamTransport{
+		w:       w,
+		close:   close,
+		pending: map[int64]chan response{},
+		done:    make(chan struct{}),
+	}
+	go t.read(r)
+	return t
+}
+
+func (t *streamTransport) read(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var resp response
+		if err := json.Unmarshal(line, &resp); err != nil || resp.ID == nil {
+			continue // not json-rpc, e.g. logging, or a notification
+		}
+		if resp.Method != "" {
+			// requests from the server, e.g. ping, are answered with an empty result
+			_ = t.write(message{JSONRPC: "2.0", ID: resp.ID, Result: json.RawMessage("{}")})
+			continue
+		}
+		t.mu.Lock()
+		ch, ok := t.pending[*resp.ID]
+		delete(t.pending, *resp.ID)
+		t.mu.Unlock()
+		if ok {
+			ch <- resp
+		}
+	}
+
+	t.mu.Lock()
+	t.err = scanner.Err()
+	if t.err == nil {
+		t.err = io.EOF
+	}
+	t.mu.Unlock()
+	close(t.done)
+}
+
+func (t *streamTransport) write(msg message) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("could not marshal message; %w", err)
+	}
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	_, err = t.w.Write(append(b, '\n'))
+	return err
+}
+
+func (t *streamTransport) Call(ctx context.Context, method string, params any) (json.RawMessage, error) {
+	id := t.nextID.Add(1)
+	ch := make(chan response, 1)
+	t.mu.Lock()
+	if t.err != nil {
+		err := t.err
+		t.mu.Unlock()
+		return nil, fmt.Errorf("connection closed; %w", err)
+	}
+	t.pending[id] = ch
+	t.mu.Unlock()
+
+	defer func() {
+		t.mu.Lock()
+		delete(t.pending, id)
+		t.mu.Unlock()
+	}()
+
+	if err := t.write(message{JSONRPC: "2.0", ID: &id, Method: method, Params: params}); err != nil {
+		return nil, fmt.Errorf("could not write request; %w", err)
+	}
+
+	select {
+	case resp := <-ch:
+		return resp.result()
+	case <-t.done:
+		return nil, fmt.Errorf("connection closed; %w", t.err)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (t *streamTransport) Notify(ctx context.Context, method string, params any) error {
+	return t.write(message{JSONRPC: "2.0", Method: method, Params: params})
+}
+
+func (t *streamTransport) Close() error {
+	return t.close()
+}
+
+// HTTP connects to an MCP server using the streamable HTTP transport, i.e. each message is POSTed to the endpoint
+// and the response is read either as JSON or from an event stream. A nil client defaults to http.DefaultClient,
+// headers, e.g. Authorization, are added to every request.
+func HTTP(endpoint string, client *http.Client, headers map[string]string) Dialer {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return func(ctx context.Context) (Transport, error) {
+		return &httpTransport{
+			endpoint: endpoint,
+			client:   client,
+			headers:  headers,
+		}, nil
+	}
+}
+
+// errSessionExpired is returned when the server no longer knows the session, the client reconnects on it
+var errSessionExpired = errors.New("mcp session expired")
+
+type httpTransport struct {
+	endpoint string
+	client   *http.Client
+	headers  map[string]string
+
+	nextID    atomic.Int64
+	mu        sync.Mutex
+	sessionID string
+}
+
+func (t *httpTransport) post(ctx context.Context, msg message) (*http.Response, error) {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal message; %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.endpoint, bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("could not create request; %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json, text/event-stream")
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+	t.mu.Lock()
+	sessionID := t.sessionID
+	t.mu.Unlock()
+	if sessionID != "" {
+		req.Header.Set("Mcp-Session-Id", sessionID)
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not post message; %w", err)
+	}
+	if id := resp.Header.Get("Mcp-Session-Id"); id != "" {
+		t.mu.Lock()
+		t.sessionID = id
+		t.mu.Unlock()
+	}
+	if resp.StatusCode == http.StatusNotFound && sessionID != "" {
+		_ = resp.Body.Close()
+		return nil, errSessionExpired
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status code, %d, err: %s", resp.StatusCode, string(body))
+	}
+	return resp, nil
+}
+
+func (t *httpTransport) Call(ctx context.Context, method string, params any) (json.RawMessage, error) {
+	id := t.nextID.Add(1)
+	resp, err := t.post(ctx, message{JSONRPC: "2.0", ID: &id, Method: method, Params: params})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		var r response
+		if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+			return nil, fmt.Errorf("could not decode response; %w", err)
+		}
+		return r.result()
+	}
+
+	// the response is the event, among possible notifications, that carries the id of the request
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	var data bytes.Buffer
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "data:") {
+			data.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+			continue
+		}
+		if line != "" || data.Len() == 0 {
+			continue
+		}
+		var r response
+		err := json.Unmarshal(data.Bytes(), &r)
+		data.Reset()
+		if err == nil && r.ID != nil && *r.ID == id && r.Method == "" {
+			return r.result()
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read event stream; %w", err)
+	}
+	return nil, fmt.Errorf("event stream ended without a response; %w", io.ErrUnexpectedEOF)
+}
+
+func (t *httpTransport) Notify(ctx context.Context, method string, params any) error {
+	resp, err := t.post(ctx, message{JSONRPC: "2.0", Method: method, Params: params})
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (t *httpTransport) Close() error {
+	t.mu.Lock()
+	sessionID := t.sessionID
+	t.sessionID = ""
+	t.mu.Unlock()
+	if sessionID == "" {
+		return nil
+	}
+	// terminating the session is best effort, servers are allowed to refuse it
+	req, err := http.NewRequest(http.MethodDelete, t.endpoint, nil)
+	if err != nil {
+		return nil
+	}
+	req.Header.Set("Mcp-Session-Id", sessionID)
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil
+	}
+	return resp.Body.Close()
+}
@@ -0,0 +1,63 @@
+package tools
+
+import (
+	"fmt"
+	"regexp"
+)
+
+var invalidNameChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// reservedWords are JavaScript reserved words, which cannot be bound as functions in the PTC runtime
+var reservedWords = map[string]bool{
+	"await": true, "break": true, "case": true, "catch": true, "class": true, "const": true, "continue": true,
+	"debugger": true, "default": true, "delete": true, "do": true, "else": true, "enum": true, "export": true,
+	"extends": true, "false": true, "finally": true, "for": true, "function": true, "if": true, "implements": true,
+	"import": true, "in": true, "instanceof": true, "interface": true, "let": true, "new": true, "null": true,
+	"package": true, "private": true, "protected": true, "public": true, "return": true, "static": true,
+	"super": true, "switch": true, "this": true, "throw": true, "true": true, "try": true, "typeof": true,
+	"var": true, "void": true, "while": true, "with": true, "yield": true,
+}
+
+// SanitizeToolName returns a tool name that is accepted by all providers and is a valid JavaScript identifier for
+// the PTC runtime, i.e. every character other than letters, digits and underscores, dashes and dots included, is
+// replaced by an underscore. Names starting with a digit are prefixed, and reserved words suffixed, by an underscore.
+func SanitizeToolName(name string) string {
+	name = invalidNameChars.ReplaceAllString(name, "_")
+	if name == "" {
+		return "_"
+	}
+	if name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	if reservedWords[name] {
+		name += "_"
+	}
+	return name
+}
+
+// NameMap maps sanitized tool names to the original names, e.g. to restore the names in benchmark output
+type NameMap map[string]string
+
+// Sanitize returns the sanitized name and records the original. A sanitized name already taken by another original
+// gets a numeric suffix, e.g. both "a-b" and "a.b" sanitize to "a_b", and the second becomes "a_b_2".
+func (m NameMap) Sanitize(name string) string {
+	base := SanitizeToolName(name)
+	sanitized := base
+	for i := 2; ; i++ {
+		original, taken := m[sanitized]
+		if !taken || original == name {
+			break
+		}
+		sanitized = fmt.Sprintf("%s_%d", base, i)
+	}
+	m[sanitized] = name
+	return sanitized
+}
+
+// Original returns the original name of a sanitized name, or the name itself if it is unknown
+func (m NameMap) Original(name string) string {
+	if original, ok := m[name]; ok {
+		return original
+	}
+	return name
+}
@@ -0,0 +1,39 @@
+package tools_test
+
+import (
+	"testing"
+
+	"github.com/modfin/bellman/tools"
+)
+
+func TestSanitizeToolName(t *testing.T) {
+	tests := map[string]string{
+		"get_weather":    "get_weather",
+		"math.factorial": "math_factorial",
+		"get-user":       "get_user",
+		"3d_render":      "_3d_render",
+		"delete":         "delete_",
+		"$price":         "_price",
+		"":               "_",
+	}
+	for name, expected := range tests {
+		if got := tools.SanitizeToolName(name); got != expected {
+			t.Errorf("expected %q to sanitize to %q, got %q", name, expected, got)
+		}
+	}
+}
+
+func TestNameMap(t *testing.T) {
+	names := tools.NameMap{}
+	a := names.Sanitize("a-b")
+	b := names.Sanitize("a.b")
+	if a != "a_b" || b != "a_b_2" {
+		t.Fatalf("expected colliding names to be made unique, got %q and %q", a, b)
+	}
+	if names.Sanitize("a-b") != "a_b" {
+		t.Fatal("expected the same original to keep its name")
+	}
+	if names.Original(b) != "a.b" || names.Original("unknown") != "unknown" {
+		t.Fatalf("unexpected originals %v", names)
+	}
+}
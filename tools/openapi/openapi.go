@@ -0,0 +1,523 @@
+package openapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/modfin/bellman/schema"
+	"github.com/modfin/bellman/tools"
+)
+
+// maxRefDepth guards against recursive $ref chains in component schemas
+const maxRefDepth = 16
+
+// bodyArgument is the argument name used for the JSON request body of an operation
+const bodyArgument = "body"
+
+var methods = []string{"get", "put", "post", "delete", "options", "head", "patch", "trace"}
+
+type config struct {
+	client   *http.Client
+	headers  http.Header
+	warnings *[]string
+}
+
+type Option func(*config)
+
+// WithHTTPClient sets the client used to perform the operations, defaults to http.DefaultClient
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *config) {
+		c.client = client
+	}
+}
+
+// WithHeader adds a header, e.g. an api key, to every request
+func WithHeader(key, value string) Option {
+	return func(c *config) {
+		c.headers.Add(key, value)
+	}
+}
+
+// WithBearerToken sets the Authorization header of every request to the bearer token
+func WithBearerToken(token string) Option {
+	return func(c *config) {
+		c.headers.Set("Authorization", "Bearer "+token)
+	}
+}
+
+// WithWarnings collects a warning for each operation that could not be converted into a tool, e.g. since it
+// does not use JSON request or response content
+func WithWarnings(warnings *[]string) Option {
+	return func(c *config) {
+		c.warnings = warnings
+	}
+}
+
+type document struct {
+	Swagger string `json:"swagger"`
+	Servers []struct {
+		URL string `json:"url"`
+	} `json:"servers"`
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Schemas map[string]any `json:"schemas"`
+	} `json:"components"`
+
+	// Swagger 2.0
+	Host        string         `json:"host"`
+	BasePath    string         `json:"basePath"`
+	Schemes     []string       `json:"schemes"`
+	Consumes    []string       `json:"consumes"`
+	Produces    []string       `json:"produces"`
+	Definitions map[string]any `json:"definitions"`
+}
+
+type operation struct {
+	OperationID string      `json:"operationId"`
+	Summary     string      `json:"summary"`
+	Description string      `json:"description"`
+	Parameters  []parameter `json:"parameters"`
+	RequestBody *struct {
+		Description string             `json:"description"`
+		Required    bool               `json:"required"`
+		Content     map[string]content `json:"content"`
+	} `json:"requestBody"`
+	Responses map[string]struct {
+		Content map[string]content `json:"content"`
+	} `json:"responses"`
+
+	// Swagger 2.0
+	Consumes []string `json:"consumes"`
+	Produces []string `json:"produces"`
+}
+
+type parameter struct {
+	Name        string         `json:"name"`
+	In          string         `json:"in"`
+	Description string         `json:"description"`
+	Required    bool           `json:"required"`
+	Schema      map[string]any `json:"schema"`
+
+	// Swagger 2.0 parameters, other than body, are typed inline
+	Type    string         `json:"type"`
+	Format  string         `json:"format"`
+	Items   map[string]any `json:"items"`
+	Enum    []any          `json:"enum"`
+	Default any            `json:"default"`
+}
+
+// schemaMap returns the schema of the parameter, built from the inline type for Swagger 2.0 parameters
+func (p parameter) schemaMap() map[string]any {
+	if p.Schema != nil || p.Type == "" {
+		return p.Schema
+	}
+	m := map[string]any{"type": p.Type}
+	if p.Format != "" {
+		m["format"] = p.Format
+	}
+	if p.Items != nil {
+		m["items"] = p.Items
+	}
+	if len(p.Enum) > 0 {
+		m["enum"] = p.Enum
+	}
+	if p.Default != nil {
+		m["default"] = p.Default
+	}
+	return m
+}
+
+type content struct {
+	Schema map[string]any `json:"schema"`
+}
+
+// ToolsFromOpenAPI turns each operation of a JSON OpenAPI 3 or Swagger 2.0 document into a tool. The tool is named
+// by the operationId, sanitized to letters, numbers, underscores and dashes, and its function performs the HTTP
+// call against baseURL, placing the arguments in the path, query, headers and JSON body as described by the
+// operation, and returns the response body as is. An empty baseURL defaults to the first server of the document.
+// Operations using other content types than JSON are skipped, see WithWarnings.
+func ToolsFromOpenAPI(spec []byte, baseURL string, opts ...Option) ([]tools.Tool, error) {
+	cfg := &config{
+		client:  http.DefaultClient,
+		headers: http.Header{},
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	var d document
+	if err := json.Unmarshal(spec, &d); err != nil {
+		return nil, fmt.Errorf("could not unmarshal openapi document; %w", err)
+	}
+	if baseURL == "" {
+		baseURL = d.serverURL()
+	}
+	if baseURL == "" {
+		return nil, fmt.Errorf("no base url given and no server in openapi document")
+	}
+
+	warn := func(format string, args ...any) {
+		if cfg.warnings != nil {
+			*cfg.warnings = append(*cfg.warnings, fmt.Sprintf(format, args...))
+		}
+	}
+
+	paths := make([]string, 0, len(d.Paths))
+	for p := range d.Paths {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	var res []tools.Tool
+	names := map[string]bool{}
+	for _, path := range paths {
+		item := d.Paths[path]
+
+		var shared []parameter
+		if raw, ok := item["parameters"]; ok {
+			if err := json.Unmarshal(raw, &shared); err != nil {
+				return nil, fmt.Errorf("could not unmarshal parameters of %s; %w", path, err)
+			}
+		}
+
+		for _, method := range methods {
+			raw, ok := item[method]
+			if !ok {
+				continue
+			}
+			var op operation
+			if err := json.Unmarshal(raw, &op); err != nil {
+				return nil, fmt.Errorf("could not unmarshal operation %s %s; %w", strings.ToUpper(method), path, err)
+			}
+
+			tool, err := toTool(d, method, path, op, shared, baseURL, cfg)
+			if err != nil {
+				warn("skipping %s %s; %v", strings.ToUpper(method), path, err)
+				continue
+			}
+			if names[tool.Name] {
+				warn("skipping %s %s; duplicate tool name %s", strings.ToUpper(method), path, tool.Name)
+				continue
+			}
+			names[tool.Name] = true
+			res = append(res, tool)
+		}
+	}
+	return res, nil
+}
+
+func (d document) serverURL() string {
+	if len(d.Servers) > 0 {
+		return d.Servers[0].URL
+	}
+	if d.Host == "" {
+		return ""
+	}
+	scheme := "https"
+	if len(d.Schemes) > 0 {
+		scheme = d.Schemes[0]
+	}
+	return scheme + "://" + d.Host + d.BasePath
+}
+
+// isJSON reports if the media types, defaulting to JSON when none are given, include JSON
+func isJSON(mediaTypes []string) bool {
+	if len(mediaTypes) == 0 {
+		return true
+	}
+	for _, t := range mediaTypes {
+		if strings.HasPrefix(t, "application/json") {
+			return true
+		}
+	}
+	return false
+}
+
+func toTool(d document, method, path string, op operation, shared []parameter, baseURL string, cfg *config) (tools.Tool, error) {
+	name := op.OperationID
+	if name == "" {
+		name = method + "_" + strings.Trim(path, "/")
+	}
+	name = tools.SanitizeToolName(name)
+
+	if !jsonResponses(op) {
+		return tools.Tool{}, fmt.Errorf("response content is not json")
+	}
+	if d.Swagger != "" {
+		if op.Produces == nil {
+			op.Produces = d.Produces
+		}
+		if op.Consumes == nil {
+			op.Consumes = d.Consumes
+		}
+		if !isJSON(op.Produces) {
+			return tools.Tool{}, fmt.Errorf("response content is not json")
+		}
+	}
+
+	args := &schema.JSON{
+		Type:       schema.Object,
+		Properties: map[string]*schema.JSON{},
+	}
+	params := map[string]parameter{}
+	hasBody := false
+	for _, p := range mergeParameters(shared, op.Parameters) {
+		switch p.In {
+		case "cookie", "formData":
+			return tools.Tool{}, fmt.Errorf("%s parameter %s is not supported", p.In, p.Name)
+		case "body":
+			if !isJSON(op.Consumes) {
+				return tools.Tool{}, fmt.Errorf("request body content is not json")
+			}
+			s, err := convertSchema(d, p.Schema)
+			if err != nil {
+				return tools.Tool{}, fmt.Errorf("request body; %w", err)
+			}
+			if p.Description != "" {
+				s.Description = p.Description
+			}
+			args.Properties[bodyArgument] = s
+			if p.Required {
+				args.Required = append(args.Required, bodyArgument)
+			}
+			hasBody = true
+			continue
+		}
+		s, err := convertSchema(d, p.schemaMap())
+		if err != nil {
+			return tools.Tool{}, fmt.Errorf("parameter %s; %w", p.Name, err)
+		}
+		if p.Description != "" {
+			s.Description = p.Description
+		}
+		args.Properties[p.Name] = s
+		if p.Required || p.In == "path" {
+			args.Required = append(args.Required, p.Name)
+		}
+		params[p.Name] = p
+	}
+
+	if op.RequestBody != nil {
+		c, ok := op.RequestBody.Content["application/json"]
+		if !ok {
+			return tools.Tool{}, fmt.Errorf("request body content is not json")
+		}
+		s, err := convertSchema(d, c.Schema)
+		if err != nil {
+			return tools.Tool{}, fmt.Errorf("request body; %w", err)
+		}
+		if op.RequestBody.Description != "" {
+			s.Description = op.RequestBody.Description
+		}
+		args.Properties[bodyArgument] = s
+		if op.RequestBody.Required {
+			args.Required = append(args.Required, bodyArgument)
+		}
+		hasBody = true
+	}
+
+	description := strings.TrimSpace(op.Summary)
+	if op.Description != "" && op.Description != op.Summary {
+		description = strings.TrimSpace(description + "\n\n" + op.Description)
+	}
+
+	return tools.Tool{
+		Name:           name,
+		Description:    description,
+		ArgumentSchema: args,
+		Function:       caller(strings.ToUpper(method), strings.TrimRight(baseURL, "/")+path, params, hasBody, cfg),
+	}, nil
+}
+
+// jsonResponses reports if all success responses with content have a JSON representation
+func jsonResponses(op operation) bool {
+	for code, r := range op.Responses {
+		if !strings.HasPrefix(code, "2") || len(r.Content) == 0 {
+			continue
+		}
+		if _, ok := r.Content["application/json"]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeParameters lets operation parameters override the path item parameters with the same name and location
+func mergeParameters(shared, own []parameter) []parameter {
+	var res []parameter
+	for _, s := range shared {
+		overridden := false
+		for _, o := range own {
+			if o.Name == s.Name && o.In == s.In {
+				overridden = true
+				break
+			}
+		}
+		if !overridden {
+			res = append(res, s)
+		}
+	}
+	return append(res, own...)
+}
+
+// convertSchema resolves local component references and converts the OpenAPI schema into a schema.JSON
+func convertSchema(d document, s map[string]any) (*schema.JSON, error) {
+	if s == nil {
+		return &schema.JSON{}, nil
+	}
+	resolved, err := resolveRefs(d, s, 0)
+	if err != nil {
+		return nil, err
+	}
+	m, _ := resolved.(map[string]any)
+	return schema.FromOpenAI(m)
+}
+
+// lookup finds the schema of a local reference, i.e. #/components/schemas/... or, for Swagger 2.0, #/definitions/...
+func (d document) lookup(ref string) (any, bool) {
+	if name, ok := strings.CutPrefix(ref, "#/components/schemas/"); ok {
+		target, ok := d.Components.Schemas[name]
+		return target, ok
+	}
+	if name, ok := strings.CutPrefix(ref, "#/definitions/"); ok {
+		target, ok := d.Definitions[name]
+		return target, ok
+	}
+	return nil, false
+}
+
+func resolveRefs(d document, v any, depth int) (any, error) {
+	switch t := v.(type) {
+	case map[string]any:
+		if ref, ok := t["$ref"].(string); ok {
+			if depth >= maxRefDepth {
+				return nil, fmt.Errorf("reference %s is nested too deep", ref)
+			}
+			target, ok := d.lookup(ref)
+			if !ok {
+				return nil, fmt.Errorf("could not resolve reference %s", ref)
+			}
+			return resolveRefs(d, target, depth+1)
+		}
+		res := make(map[string]any, len(t))
+		for k, val := range t {
+			r, err := resolveRefs(d, val, depth)
+			if err != nil {
+				return nil, err
+			}
+			res[k] = r
+		}
+		return res, nil
+	case []any:
+		res := make([]any, len(t))
+		for i, val := range t {
+			r, err := resolveRefs(d, val, depth)
+			if err != nil {
+				return nil, err
+			}
+			res[i] = r
+		}
+		return res, nil
+	default:
+		return v, nil
+	}
+}
+
+func caller(method, endpoint string, params map[string]parameter, hasBody bool, cfg *config) tools.Function {
+	return func(ctx context.Context, call tools.Call) (string, error) {
+		var args map[string]any
+		if len(call.Argument) > 0 {
+			if err := json.Unmarshal(call.Argument, &args); err != nil {
+				return "", fmt.Errorf("could not unmarshal arguments; %w", err)
+			}
+		}
+
+		u := endpoint
+		query := url.Values{}
+		header := http.Header{}
+		for name, p := range params {
+			v, ok := args[name]
+			if !ok || v == nil {
+				continue
+			}
+			switch p.In {
+			case "path":
+				u = strings.ReplaceAll(u, "{"+name+"}", url.PathEscape(stringify(v)))
+			case "query":
+				if list, isList := v.([]any); isList {
+					for _, item := range list {
+						query.Add(name, stringify(item))
+					}
+					continue
+				}
+				query.Set(name, stringify(v))
+			case "header":
+				header.Set(name, stringify(v))
+			}
+		}
+		if len(query) > 0 {
+			u += "?" + query.Encode()
+		}
+
+		var body io.Reader
+		if b, ok := args[bodyArgument]; ok && hasBody {
+			payload, err := json.Marshal(b)
+			if err != nil {
+				return "", fmt.Errorf("could not marshal request body; %w", err)
+			}
+			body = bytes.NewReader(payload)
+		}
+
+		req, err := http.NewRequestWithContext(ctx, method, u, body)
+		if err != nil {
+			return "", fmt.Errorf("could not create request; %w", err)
+		}
+		for k, v := range cfg.headers {
+			req.Header[k] = append([]string{}, v...)
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		req.Header.Set("Accept", "application/json")
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		resp, err := cfg.client.Do(req)
+		if err != nil {
+			return "", fmt.Errorf("could not perform request; %w", err)
+		}
+		defer resp.Body.Close()
+
+		respBody, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return "", fmt.Errorf("could not read response body; %w", err)
+		}
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return "", fmt.Errorf("unexpected status code, %d, err: %s", resp.StatusCode, string(respBody))
+		}
+		if len(bytes.TrimSpace(respBody)) == 0 {
+			return "{}", nil
+		}
+		return string(respBody), nil
+	}
+}
+
+func stringify(v any) string {
+	switch t := v.(type) {
+	case string:
+		return t
+	case float64, bool:
+		return fmt.Sprint(t)
+	default:
+		b, _ := json.Marshal(t)
+		return string(b)
+	}
+}
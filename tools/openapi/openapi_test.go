@@ -0,0 +1,252 @@
+package openapi_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/modfin/bellman/schema"
+	"github.com/modfin/bellman/tools"
+	"github.com/modfin/bellman/tools/openapi"
+)
+
+const petstore = `{
+  "openapi": "3.0.0",
+  "info": {"title": "Petstore", "version": "1.0.0"},
+  "paths": {
+    "/pets": {
+      "get": {
+        "operationId": "listPets",
+        "summary": "List all pets",
+        "parameters": [
+          {"name": "limit", "in": "query", "description": "How many pets to return", "schema": {"type": "integer"}}
+        ],
+        "responses": {"200": {"content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Pet"}}}}}}
+      },
+      "post": {
+        "operationId": "create.pet",
+        "summary": "Create a pet",
+        "description": "Adds a pet to the store",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Pet"}}}},
+        "responses": {"201": {"content": {"application/json": {"schema": {"$ref": "#/components/schemas/Pet"}}}}}
+      }
+    },
+    "/pets/{petId}": {
+      "parameters": [
+        {"name": "petId", "in": "path", "required": true, "schema": {"type": "string"}}
+      ],
+      "get": {
+        "operationId": "showPetById",
+        "summary": "Info for a specific pet",
+        "responses": {"200": {"content": {"application/json": {"schema": {"$ref": "#/components/schemas/Pet"}}}}}
+      }
+    },
+    "/pets/{petId}/image": {
+      "post": {
+        "operationId": "uploadImage",
+        "requestBody": {"content": {"multipart/form-data": {"schema": {"type": "object"}}}},
+        "responses": {"200": {"content": {"application/json": {"schema": {"type": "object"}}}}}
+      }
+    }
+  },
+  "components": {
+    "schemas": {
+      "Pet": {
+        "type": "object",
+        "required": ["name"],
+        "properties": {
+          "id": {"type": "integer"},
+          "name": {"type": "string"},
+          "tag": {"type": "string", "enum": ["dog", "cat"]}
+        }
+      }
+    }
+  }
+}`
+
+func TestToolsFromOpenAPI(t *testing.T) {
+	var warnings []string
+	toolset, err := openapi.ToolsFromOpenAPI([]byte(petstore), "http://localhost", openapi.WithWarnings(&warnings))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	byName := map[string]tools.Tool{}
+	for _, tool := range toolset {
+		byName[tool.Name] = tool
+	}
+	if len(byName) != 3 {
+		t.Fatalf("expected 3 tools, got %v", toolset)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "/pets/{petId}/image") {
+		t.Fatalf("expected warning for multipart operation, got %v", warnings)
+	}
+
+	create, ok := byName["create_pet"]
+	if !ok {
+		t.Fatalf("expected sanitized operationId, got %v", toolset)
+	}
+	if create.Description != "Create a pet\n\nAdds a pet to the store" {
+		t.Fatalf("unexpected description %q", create.Description)
+	}
+	body := create.ArgumentSchema.Properties["body"]
+	if body == nil || body.Type != schema.Object || body.Properties["tag"] == nil || len(body.Properties["tag"].Enum) != 2 {
+		t.Fatalf("expected resolved pet schema as body, got %+v", body)
+	}
+	if len(create.ArgumentSchema.Required) != 1 || create.ArgumentSchema.Required[0] != "body" {
+		t.Fatalf("expected required body, got %v", create.ArgumentSchema.Required)
+	}
+
+	show := byName["showPetById"]
+	if show.ArgumentSchema.Properties["petId"] == nil || len(show.ArgumentSchema.Required) != 1 {
+		t.Fatalf("expected path item parameter petId, got %+v", show.ArgumentSchema)
+	}
+}
+
+func TestToolsFromOpenAPICall(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/pets":
+			_, _ = w.Write([]byte(`[{"id":1,"name":"limit ` + r.URL.Query().Get("limit") + `"}]`))
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/pets/rex":
+			_, _ = w.Write([]byte(`{"id":1,"name":"rex"}`))
+		case r.Method == http.MethodPost && r.URL.Path == "/v1/pets":
+			b, _ := io.ReadAll(r.Body)
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write(b)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error":"not found"}`))
+		}
+	}))
+	defer server.Close()
+
+	toolset, err := openapi.ToolsFromOpenAPI([]byte(petstore), server.URL+"/v1/", openapi.WithBearerToken("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := map[string]tools.Tool{}
+	for _, tool := range toolset {
+		byName[tool.Name] = tool
+	}
+
+	call := func(name string, args any) (string, error) {
+		arg, _ := json.Marshal(args)
+		return byName[name].Function(context.Background(), tools.Call{Name: name, Argument: arg})
+	}
+
+	res, err := call("listPets", map[string]any{"limit": 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != `[{"id":1,"name":"limit 2"}]` {
+		t.Fatalf("expected query parameter to be sent, got %s", res)
+	}
+
+	res, err = call("showPetById", map[string]any{"petId": "rex"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != `{"id":1,"name":"rex"}` {
+		t.Fatalf("expected path parameter to be sent, got %s", res)
+	}
+
+	res, err = call("create_pet", map[string]any{"body": map[string]any{"name": "fido"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != `{"name":"fido"}` {
+		t.Fatalf("expected body to be sent, got %s", res)
+	}
+
+	_, err = call("showPetById", map[string]any{"petId": "missing"})
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("expected error for non 2xx response, got %v", err)
+	}
+}
+
+const swagger = `{
+  "swagger": "2.0",
+  "info": {"title": "Users", "version": "1.0.0"},
+  "host": "%s",
+  "basePath": "/api",
+  "schemes": ["http"],
+  "consumes": ["application/json"],
+  "produces": ["application/json"],
+  "paths": {
+    "/users/{id}": {
+      "put": {
+        "operationId": "users.update",
+        "parameters": [
+          {"name": "id", "in": "path", "required": true, "type": "integer"},
+          {"name": "notify", "in": "query", "type": "boolean", "default": false},
+          {"name": "user", "in": "body", "required": true, "schema": {"$ref": "#/definitions/User"}}
+        ],
+        "responses": {"200": {"schema": {"$ref": "#/definitions/User"}}}
+      }
+    },
+    "/users/{id}/avatar": {
+      "post": {
+        "operationId": "users.avatar",
+        "consumes": ["multipart/form-data"],
+        "parameters": [
+          {"name": "id", "in": "path", "required": true, "type": "integer"},
+          {"name": "file", "in": "formData", "type": "file"}
+        ],
+        "responses": {"200": {"description": "ok"}}
+      }
+    }
+  },
+  "definitions": {
+    "User": {"type": "object", "properties": {"name": {"type": "string"}}}
+  }
+}`
+
+func TestToolsFromOpenAPISwagger(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || r.URL.Path != "/api/users/7" || r.URL.Query().Get("notify") != "true" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		b, _ := io.ReadAll(r.Body)
+		_, _ = w.Write(b)
+	}))
+	defer server.Close()
+
+	var warnings []string
+	spec := strings.Replace(swagger, "%s", strings.TrimPrefix(server.URL, "http://"), 1)
+	toolset, err := openapi.ToolsFromOpenAPI([]byte(spec), "", openapi.WithWarnings(&warnings))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(toolset) != 1 || toolset[0].Name != "users_update" {
+		t.Fatalf("expected only the json operation, got %+v", toolset)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "/users/{id}/avatar") {
+		t.Fatalf("expected warning for form data operation, got %v", warnings)
+	}
+
+	update := toolset[0]
+	if id := update.ArgumentSchema.Properties["id"]; id == nil || id.Type != schema.Integer {
+		t.Fatalf("expected inline typed path parameter, got %+v", id)
+	}
+	if body := update.ArgumentSchema.Properties["body"]; body == nil || body.Properties["name"] == nil {
+		t.Fatalf("expected body parameter resolved from definitions, got %+v", body)
+	}
+
+	res, err := update.Function(context.Background(), tools.Call{Argument: []byte(`{"id":7,"notify":true,"body":{"name":"ada"}}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != `{"name":"ada"}` {
+		t.Fatalf("unexpected response %s", res)
+	}
+}
@@ -2,39 +2,58 @@ package bfcl
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
-	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	"github.com/modfin/bellman"
+	"github.com/modfin/bellman/internal/logx"
+	"github.com/modfin/bellman/metrics"
 	"github.com/modfin/bellman/models/gen"
 	"github.com/modfin/bellman/prompt"
 	"github.com/modfin/bellman/tools"
 	"github.com/modfin/bellman/tools/ptc"
 	"github.com/modfin/bellman/tools/ptc/bench/replay"
+	"github.com/modfin/bellman/tools/ptc/bench/score"
+	"github.com/modfin/bellman/tools/ptc/bench/session"
 	"github.com/modfin/bellman/tools/ptc/bench/tracer"
 	"github.com/modfin/bellman/tools/ptc/bench/utils"
-	"golang.org/x/text/language"
-	"golang.org/x/text/message"
 )
 
 type BenchmarkRequest struct {
-	Model            string          `json:"bellman_model"`
-	Messages         []Message       `json:"messages"`
-	NewToolResponses []Message       `json:"new_tool_responses"`
-	ToolmanHistory   []prompt.Prompt `json:"toolman_history"`
-	Tools            []interface{}   `json:"tools"`
-	Temperature      *float64        `json:"temperature"`
-	Thinking         *int            `json:"thinking"`
-	SystemPrompt     string          `json:"system_prompt"`
-	EnablePTC        bool            `json:"enable_ptc"`
-	TestID           string          `json:"test_entry_id"`
-	NewConv          bool
+	Model             string          `json:"bellman_model"`
+	Messages          []Message       `json:"messages"`
+	NewToolResponses  []Message       `json:"new_tool_responses"`
+	ToolmanHistory    []prompt.Prompt `json:"toolman_history"`
+	Tools             []interface{}   `json:"tools"`
+	Temperature       *float64        `json:"temperature"`
+	Thinking          *int            `json:"thinking"`
+	SystemPrompt      string          `json:"system_prompt"`
+	EnablePTC         bool            `json:"enable_ptc"`
+	ToolChoice        string          `json:"tool_choice,omitempty"` // auto|required|none|<function name>
+	TestID            string          `json:"test_entry_id"`
+	KeepAssistantText *bool           `json:"keep_assistant_text,omitempty"` // keep assistant text turns in history, default true
+	GroundTruth       []ExtractedCall `json:"ground_truth,omitempty"`        // optional, scores non-ptc tool calls in-process if set
+	NewConv           bool
+	TraceID           string `json:"-"` // from the X-Bellman-Trace header, see utils.TraceID
+	SessionKey        string `json:"-"` // see sessionKey
+}
+
+// sessionKey returns the key of the test case of the request, see session.Key, by the test id, the trace header, if
+// sent, or else the first user message, which the benchmark resends with every request of the test case
+func (r BenchmarkRequest) sessionKey(traceHeader string) string {
+	var first string
+	for _, m := range r.Messages {
+		if m.Role == "user" {
+			first = m.Content
+			break
+		}
+	}
+	return session.Key(first, r.TestID, traceHeader)
 }
 
 type Message struct {
@@ -45,41 +64,45 @@ type Message struct {
 }
 
 type BenchmarkResponse struct {
-	ToolCalls      []ExtractedCall `json:"tool_calls"`
-	ToolCallIDs    []string        `json:"tool_call_ids"`
-	ToolmanHistory []prompt.Prompt `json:"toolman_history"`
-	Content        string          `json:"content"`
-	InputTokens    int             `json:"input_tokens"`
-	OutputTokens   int             `json:"output_tokens"`
+	ToolCalls      []ExtractedCall    `json:"tool_calls"`
+	ToolCallIDs    []string           `json:"tool_call_ids"`
+	ToolmanHistory []prompt.Prompt    `json:"toolman_history"`
+	Content        string             `json:"content"`
+	InputTokens    int                `json:"input_tokens"`
+	OutputTokens   int                `json:"output_tokens"`
+	Score          *score.ScoreResult `json:"score,omitempty"`
 }
 
 // ExtractedCall is a bfcl tool call to be returned
 type ExtractedCall map[string]map[string]interface{}
 
 type Instance struct {
+	Log     *slog.Logger // logs with the fields of the run, see logx.WithRun
 	Replay  *replay.Replay
 	Tracer  *tracer.Tracer
 	timer   *time.Timer
 	mu      sync.Mutex
 	retries int
+	names   tools.NameMap // sanitized to original tool names of the request, see utils.ParseJsonSchemaTools
 }
 
 type Cache struct {
-	Instances map[string]*Instance
+	Instances map[string]*Instance // by session key, see BenchmarkRequest.sessionKey
+	Log       *slog.Logger
+	Sessions  *session.Store // optional, holds the PTC runtime of each instance, e.g. for the debug endpoints
 	mu        sync.Mutex
 }
 
-func NewCache() *Cache {
+// NewCache returns a cache of benchmark instances logging to logger, or the default logger if nil
+func NewCache(logger *slog.Logger) *Cache {
 	return &Cache{
 		Instances: make(map[string]*Instance),
+		Log:       logx.OrDefault(logger),
 	}
 }
 
-var (
-	GlobalInputTokens    uint64
-	GlobalOutputTokens   uint64
-	GlobalThinkingTokens uint64
-)
+// Tokens holds the token totals of all instances, counted by the bellman client, see utils.Suite
+var Tokens = utils.Suite("bfcl")
 
 // HandleGenerateBFCL is the handler for the BFCL benchmark
 func (c *Cache) HandleGenerateBFCL(w http.ResponseWriter, r *http.Request) {
@@ -89,10 +112,13 @@ func (c *Cache) HandleGenerateBFCL(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req BenchmarkRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	traceID := utils.TraceID(w, r)
+	// BFCL sends keys of its own test entries that are not part of the request
+	if err := utils.DecodeRequestLenient(w, r, &req); err != nil {
 		return
 	}
+	req.TraceID = traceID
+	req.SessionKey = req.sessionKey(r.Header.Get(utils.TraceHeader))
 
 	// ensure cache instance, replay cache and tracer
 	i := c.ensureCache(&req)
@@ -115,9 +141,10 @@ func (c *Cache) HandleGenerateBFCL(w http.ResponseWriter, r *http.Request) {
 func (i *Instance) replayGenerateBFCL(w http.ResponseWriter, req BenchmarkRequest, previousGen *gen.Response) {
 	bellmanUrl := os.Getenv("BELLMAN_URL")
 	bellmanToken := os.Getenv("BELLMAN_TOKEN")
-	client := bellman.New(bellmanUrl, bellman.Key{Name: "bfcl", Token: bellmanToken})
+	client := bellman.New(bellmanUrl, bellman.Key{Name: "bfcl", Token: bellmanToken}, bellman.WithMetrics(Tokens)).SetLogger(i.Log)
 
-	bellmanTools := utils.ParseJsonSchemaTools(req.Tools, req.EnablePTC)
+	bellmanTools, names := utils.ParseJsonSchemaTools(req.Tools, req.EnablePTC)
+	i.names = names
 
 	// add trailing user messages to toolman conversation
 	toolmanConversation := i.addNewUserConversation(req)
@@ -127,11 +154,12 @@ func (i *Instance) replayGenerateBFCL(w http.ResponseWriter, req BenchmarkReques
 		toolmanConversation = i.appendResponseConversation(toolmanConversation, req, nil)
 	}
 
-	model, err := gen.ToModel(req.Model)
-	if err != nil {
-		i.Tracer.TraceError(i.Tracer.RootSpan, err, true)
-		log.Fatalf("to model error: %e", err)
+	model, ok := utils.ResolveModel(w, client, req.Model, i.Log)
+	if !ok {
+		i.Tracer.TraceError(i.Tracer.RootSpan, fmt.Errorf("invalid model %s", req.Model), true)
+		return
 	}
+	var err error
 
 	// Execution replay! - run if new tool responses and PTC enabled
 	if req.EnablePTC {
@@ -144,7 +172,7 @@ func (i *Instance) replayGenerateBFCL(w http.ResponseWriter, req BenchmarkReques
 				})
 				// track tool error
 				if checkResponseError(m.Content) {
-					toolSpan, ok := i.Tracer.ToolSpans[m.ToolID]
+					toolSpan, ok := i.Tracer.ToolSpans[utils.ParentCallID(m.ToolID)]
 					if ok {
 						i.Tracer.SetTag(toolSpan, "tool_error")
 					}
@@ -160,7 +188,7 @@ func (i *Instance) replayGenerateBFCL(w http.ResponseWriter, req BenchmarkReques
 			if resp != nil {
 				w.Header().Set("Content-Type", "application/json")
 				if err = json.NewEncoder(w).Encode(resp); err != nil {
-					log.Printf("Failed to write response to client: %v", err)
+					i.Log.Error("could not write response to client", "error", err)
 				}
 				return
 			}
@@ -182,6 +210,7 @@ func (i *Instance) replayGenerateBFCL(w http.ResponseWriter, req BenchmarkReques
 	}
 
 	llm := client.Generator().Model(model).
+		WithTraceID(req.TraceID).
 		System(req.SystemPrompt).
 		SetTools(bellmanTools...) //.MaxTokens(20 * 1000)
 
@@ -196,9 +225,13 @@ func (i *Instance) replayGenerateBFCL(w http.ResponseWriter, req BenchmarkReques
 	if req.EnablePTC {
 		llm, err = llm.ActivatePTC(ptc.JavaScript)
 		if err != nil {
-			log.Printf("warning: %e", err)
+			i.Log.Warn("could not activate ptc", "error", err)
 		}
 	}
+	llm, err = utils.ApplyToolChoice(llm, req.ToolChoice)
+	if err != nil {
+		i.Log.Warn("could not apply tool choice", "tool_choice", req.ToolChoice, "error", err)
+	}
 
 	// prompt with retry (bfcl restarts on every test...)
 	maxRetries := 5
@@ -213,7 +246,7 @@ func (i *Instance) replayGenerateBFCL(w http.ResponseWriter, req BenchmarkReques
 		start := time.Now()
 		res, err = llm.Prompt(toolmanConversation...)
 		duration := time.Since(start)
-		fmt.Printf("prompt duration: %v ms\n", duration.Milliseconds())
+		i.Log.Debug("prompt done", "duration_ms", duration.Milliseconds())
 
 		if err == nil && res != nil {
 			metrics = &tracer.Metrics{
@@ -224,8 +257,10 @@ func (i *Instance) replayGenerateBFCL(w http.ResponseWriter, req BenchmarkReques
 			break
 		}
 
+		utils.UpstreamError("bfcl", err)
+
 		if i.retries >= maxRetries {
-			log.Printf("Prompt Error: %+v\n", err)
+			i.Log.Error("prompt failed, giving up", "retries", i.retries, "error", err)
 			i.Tracer.TraceError(i.Tracer.ChatSpan, err, true)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -235,14 +270,11 @@ func (i *Instance) replayGenerateBFCL(w http.ResponseWriter, req BenchmarkReques
 		i.Tracer.TraceError(i.Tracer.ChatSpan, err, false)
 		i.Tracer.Trace(prompt.AsAssistant(err.Error()), toolmanConversation, metrics)
 
-		// retry every time on rate limit!
-		if strings.Contains(err.Error(), "unexpected status code 429") ||
-			strings.Contains(err.Error(), "unexpected status code 502") ||
-			strings.Contains(err.Error(), "unexpected status code 500") ||
-			//strings.Contains(err.Error(), "unexpected status code 504") ||
-			strings.Contains(err.Error(), "unexpected status code, 429") {
-			backoff := max(time.Duration(1<<i.retries), time.Duration(10)) * time.Second
-			log.Printf("Prompt Error: %+v. Retrying in %v...\n", err, backoff)
+		// retry every time on rate limits and transient upstream errors, with a longer backoff
+		var apiErr *bellman.APIError
+		if errors.As(err, &apiErr) && apiErr.Retryable {
+			backoff := max(max(time.Duration(1<<i.retries), time.Duration(10))*time.Second, apiErr.RetryAfter)
+			i.Log.Warn("prompt failed, retrying", "backoff", backoff, "error", err)
 			time.Sleep(backoff)
 			continue
 		}
@@ -250,7 +282,7 @@ func (i *Instance) replayGenerateBFCL(w http.ResponseWriter, req BenchmarkReques
 		// update retries counter
 		i.retries++
 
-		if strings.Contains(err.Error(), "unexpected status code 403") {
+		if apiErr != nil && apiErr.Status == http.StatusForbidden {
 			// return on 403 error (llm provider fire wall)
 			resp := BenchmarkResponse{
 				ToolCalls:      nil,
@@ -261,20 +293,22 @@ func (i *Instance) replayGenerateBFCL(w http.ResponseWriter, req BenchmarkReques
 			}
 			w.Header().Set("Content-Type", "application/json")
 			json.NewEncoder(w).Encode(resp)
+			return
 		}
 
 		backoff := time.Duration(1<<i.retries) * time.Second
-		log.Printf("Prompt Error: %+v. Retrying in %v...\n", err, backoff)
+		i.Log.Warn("prompt failed, retrying", "backoff", backoff, "error", err)
 		time.Sleep(backoff)
 	}
 
 	// log token usage
-	logExecution(res)
+	i.logExecution(res)
 
 	// get tool call or text response, and add PTC scripts to cache
 	toolmanCalls, bfclCalls, bfclToolIDs, err := i.getToolCalls(res)
 	if err != nil {
-		log.Printf("error getting prompts: %v", err)
+		utils.ExtractionFailure("bfcl")
+		i.Log.Error("could not get tool calls", "error", err)
 		i.Tracer.TraceError(i.Tracer.ChatSpan, err, true)
 
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -304,6 +338,7 @@ func (i *Instance) replayGenerateBFCL(w http.ResponseWriter, req BenchmarkReques
 		ToolmanHistory: toolmanConversation,
 		InputTokens:    res.Metadata.InputTokens,
 		OutputTokens:   res.Metadata.OutputTokens,
+		Score:          i.scoreCalls(bfclCalls, req.GroundTruth),
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -330,18 +365,14 @@ func (i *Instance) getToolCalls(res *gen.Response) ([]prompt.Prompt, []Extracted
 	for _, tool := range res.Tools {
 		// PTC Tool Call
 		if tool.Name == ptc.ToolName {
-			// Unmarshal the 'argument' string/bytes to get the JS code
-			var codeArgs struct {
-				Code string `json:"code"`
-			}
-			err := json.Unmarshal(tool.Argument, &codeArgs)
+			code, err := ptc.ParseCode(tool.Argument)
 			if err != nil {
 				return nil, nil, nil, err
 			}
 
 			// add script to replay cache
 			i.Replay.AddScript(replay.Script{
-				Code:   codeArgs.Code,
+				Code:   code,
 				Done:   false,
 				ToolID: tool.ID,
 			})
@@ -352,7 +383,7 @@ func (i *Instance) getToolCalls(res *gen.Response) ([]prompt.Prompt, []Extracted
 
 		// Standard Tool Call
 		toolmanCalls = append(toolmanCalls, prompt.AsToolCall(tool.ID, tool.Name, tool.Argument))
-		call, err := toolmanToBFCLCall(tool)
+		call, err := toolmanToBFCLCall(tool, i.names)
 		if err != nil {
 			return nil, nil, nil, err
 		}
@@ -371,19 +402,19 @@ func (i *Instance) executionReplay(bellmanTools []tools.Tool, toolmanConversatio
 			i.Tracer.SetTag(i.Tracer.ChatSpan, "runtime_error")
 		} else {
 			i.Tracer.TraceError(i.Tracer.ChatSpan, result.Error, true)
-			log.Fatalf("execution replay error: %+v", result.Error)
+			logx.Fatal(i.Log, "execution replay failed", "error", result.Error)
 		}
 	}
 
 	// record --> bench tool call
 	if result.Record != nil {
-		call := recordToBFCLCall(result.Record)
+		call := recordToBFCLCall(result.Record, i.names)
 
 		// trace code execution
 		jsonBytes, err := json.Marshal(result.Record.Argument)
 		if err != nil {
 			i.Tracer.TraceError(i.Tracer.ChatSpan, err, false)
-			log.Printf("error: error marshaling arguments: %+v, args: %+v\n", err, result.Record.Argument)
+			i.Log.Error("could not marshal arguments", "args", result.Record.Argument, "error", err)
 		}
 		toolCall := prompt.AsToolCall(result.ToolID, result.Record.ToolName, jsonBytes)
 		i.Tracer.TraceExec(toolCall)
@@ -413,23 +444,47 @@ func (i *Instance) executionReplay(bellmanTools []tools.Tool, toolmanConversatio
 	return nil, &toolResponse
 }
 
+// scoreCalls scores the tool calls against the ground truth, if any
+func (i *Instance) scoreCalls(calls []ExtractedCall, groundTruth []ExtractedCall) *score.ScoreResult {
+	if len(groundTruth) == 0 {
+		return nil
+	}
+	res, err := score.BFCL{}.Score(toScoreCalls(calls), toScoreCalls(groundTruth))
+	if err != nil {
+		i.Log.Warn("could not score tool calls", "error", err)
+		return nil
+	}
+	return &res
+}
+
+// toScoreCalls converts bfcl tool calls, i.e. {name: arguments}, to scorer tool calls
+func toScoreCalls(calls []ExtractedCall) []score.ToolCall {
+	var res []score.ToolCall
+	for _, c := range calls {
+		for name, args := range c {
+			res = append(res, score.ToolCall{Name: name, Arguments: args})
+		}
+	}
+	return res
+}
+
 // recordToBFCLCall converts replay record to bfcl tool call
-func recordToBFCLCall(record *replay.CallRecord) ExtractedCall {
+func recordToBFCLCall(record *replay.CallRecord, names tools.NameMap) ExtractedCall {
 	call := ExtractedCall{
-		record.ToolName: record.Argument,
+		names.Original(record.ToolName): record.Argument,
 	}
 	return call
 }
 
 // toolmanToBFCLCall converts toolman call to bfcl tool call
-func toolmanToBFCLCall(tool tools.Call) (ExtractedCall, error) {
+func toolmanToBFCLCall(tool tools.Call, names tools.NameMap) (ExtractedCall, error) {
 	var argsMap map[string]interface{}
 	if err := json.Unmarshal(tool.Argument, &argsMap); err != nil {
 		return nil, fmt.Errorf("toolman to bfcl call error: %w", err)
 	}
 
 	call := ExtractedCall{
-		tool.Name: argsMap,
+		names.Original(tool.Name): argsMap,
 	}
 	return call, nil
 }
@@ -444,16 +499,17 @@ func (c *Cache) ensureCache(req *BenchmarkRequest) *Instance {
 	}
 
 	newInstance := false
-	i, ok := c.Instances[req.TestID]
+	i, ok := c.Instances[req.SessionKey]
 	if !ok {
 		i = &Instance{
+			Log:    logx.WithRun(c.Log, req.Model, tracer.ExtractCategoryRegex(req.TestID), ptcFlag).With("test_id", req.TestID),
 			Replay: replay.NewReplay(),
 			Tracer: tracer.NewTracer(fmt.Sprintf("%s-%s-%s", req.TestID, ptcFlag, req.Model)),
 		}
 		i.timer = time.AfterFunc(1*time.Minute, func() {
-			c.finish(req.TestID)
+			c.finish(req.SessionKey)
 		})
-		c.Instances[req.TestID] = i
+		c.Instances[req.SessionKey] = i
 		newInstance = true
 	} else {
 		i.timer.Reset(1 * time.Minute)
@@ -463,6 +519,15 @@ func (c *Cache) ensureCache(req *BenchmarkRequest) *Instance {
 	i.mu.Lock()
 	defer i.mu.Unlock()
 
+	if req.EnablePTC && c.Sessions != nil {
+		sess, err := c.Sessions.Acquire(req.SessionKey)
+		if err != nil {
+			i.Log.Warn("could not acquire session", "error", err)
+		} else {
+			i.Replay.SetSession(sess)
+		}
+	}
+
 	// reset cache if only user message, and no hist/new response
 	reset := true
 	req.NewConv = false
@@ -477,7 +542,7 @@ func (c *Cache) ensureCache(req *BenchmarkRequest) *Instance {
 	}
 
 	if !reset && newInstance {
-		log.Printf("forceful reset!")
+		i.Log.Debug("forceful reset of a new instance")
 		reset = true
 	}
 
@@ -498,11 +563,11 @@ func (c *Cache) ensureCache(req *BenchmarkRequest) *Instance {
 	return i
 }
 
-func (c *Cache) finish(testID string) {
+func (c *Cache) finish(key string) {
 	c.mu.Lock()
-	i, ok := c.Instances[testID]
+	i, ok := c.Instances[key]
 	if ok {
-		delete(c.Instances, testID)
+		delete(c.Instances, key)
 	}
 	c.mu.Unlock()
 
@@ -536,21 +601,13 @@ func checkResponseError(res string) bool {
 // addNewUserConversation adds incoming user messages to toolman conversation
 func (i *Instance) addNewUserConversation(req BenchmarkRequest) []prompt.Prompt {
 	toolmanHistory := req.ToolmanHistory
-	// count toolman user messages
-	toolmanUserCount := 0
-	for _, p := range toolmanHistory {
-		if p.Role == prompt.UserRole {
-			toolmanUserCount++
-		}
-	}
+	isNewUser := utils.NewUsers(toolmanHistory)
 	// add trailing messages from BFCL
-	bfclUserCount := 0
 	for _, m := range req.Messages {
 		switch m.Role {
 		case "user":
 			// only add new user messages from bfcl (not in toolman hist.)
-			bfclUserCount++
-			if bfclUserCount > toolmanUserCount {
+			if isNewUser() {
 				// update turn index & trace
 				i.Tracer.NewTurn()
 				userPrompt := prompt.AsUser(m.Content)
@@ -559,7 +616,7 @@ func (i *Instance) addNewUserConversation(req BenchmarkRequest) []prompt.Prompt
 			}
 		case "assistant":
 			if req.NewConv {
-				log.Printf("adding init assistant message! test id: %s", req.TestID)
+				i.Log.Debug("adding init assistant message")
 				assistantPrompt := prompt.AsAssistant(m.Content)
 				i.Tracer.Trace(assistantPrompt, toolmanHistory, nil)
 				toolmanHistory = append(toolmanHistory, assistantPrompt)
@@ -570,65 +627,46 @@ func (i *Instance) addNewUserConversation(req BenchmarkRequest) []prompt.Prompt
 	return toolmanHistory
 }
 
-// appendResponseConversation rebuilds the toolman conversation to add new tool response (after corresponding tool call)
+// appendResponseConversation rebuilds the toolman conversation to add new tool response (after corresponding tool call),
+// see utils.AppendResponseConversation, and drops or collapses the assistant texts as requested
 func (i *Instance) appendResponseConversation(toolmanHistory []prompt.Prompt, req BenchmarkRequest, response *prompt.Prompt) []prompt.Prompt {
-	// Add tool response after call!
-	var rebuiltConversation []prompt.Prompt
-	for _, p := range toolmanHistory {
-		switch p.Role {
-		case prompt.ToolCallRole:
-			rebuiltConversation = append(rebuiltConversation, p)
-
-			// add corresponding tool call response (only add once)
-			// priority order: response -> toolman history -> request messages
-			if response != nil && response.ToolResponse.ToolCallID == p.ToolCall.ToolCallID {
-				// trace tool response
-				i.Tracer.Trace(*response, nil, nil)
-				rebuiltConversation = append(rebuiltConversation, *response)
-				break
-			}
-			found := false
-			for _, h := range toolmanHistory {
-				if h.Role == prompt.ToolResponseRole && p.ToolCall.ToolCallID == h.ToolResponse.ToolCallID {
-					rebuiltConversation = append(rebuiltConversation, h)
-					found = true
-					break
-				}
+	var messages []prompt.Prompt
+	for _, m := range req.Messages {
+		if m.Role == "tool_response" {
+			messages = append(messages, prompt.AsToolResponse(m.ToolID, m.ToolName, m.Content))
+		}
+	}
+	rebuilt := utils.AppendResponseConversation(toolmanHistory, messages, response, func(p prompt.Prompt) {
+		// trace tool response
+		i.Tracer.Trace(p, nil, nil)
+	})
+
+	var conversation []prompt.Prompt
+	for _, p := range rebuilt {
+		if p.Role == prompt.AssistantRole {
+			if req.KeepAssistantText != nil && !*req.KeepAssistantText {
+				continue
 			}
-			if !found {
-				for _, m := range req.Messages {
-					if m.Role == "tool_response" && m.ToolID == p.ToolCall.ToolCallID {
-						// trace tool response
-						responsePrompt := prompt.AsToolResponse(m.ToolID, m.ToolName, m.Content)
-						i.Tracer.Trace(responsePrompt, nil, nil)
-						rebuiltConversation = append(rebuiltConversation, responsePrompt)
-						break
-					}
-				}
+			// collapse consecutive assistant texts, gemini requires alternating roles
+			if n := len(conversation); n > 0 && conversation[n-1].Role == prompt.AssistantRole {
+				conversation[n-1] = prompt.AsAssistant(conversation[n-1].Text + "\n\n" + p.Text)
+				continue
 			}
-		case prompt.UserRole:
-			rebuiltConversation = append(rebuiltConversation, p)
-		case prompt.AssistantRole:
-			rebuiltConversation = append(rebuiltConversation, p)
 		}
+		conversation = append(conversation, p)
 	}
-	return rebuiltConversation
+	return conversation
 }
 
-func logExecution(res *gen.Response) {
-	// extract tokens and update global counters
+func (i *Instance) logExecution(res *gen.Response) {
 	inputTokens := res.Metadata.InputTokens
 	outputTokens := res.Metadata.OutputTokens
 	thinkingTokens := res.Metadata.ThinkingTokens
 
-	// Thread-safe increment
-	atomic.AddUint64(&GlobalInputTokens, uint64(inputTokens))
-	atomic.AddUint64(&GlobalOutputTokens, uint64(outputTokens))
-	atomic.AddUint64(&GlobalThinkingTokens, uint64(thinkingTokens))
-
-	// Log the running total to the console
-	p := message.NewPrinter(language.English)
-	p.Printf("[Token Stats] Request: %d in / %d think / %d out | Global Total: %d in / %d think / %d out\n",
-		inputTokens, thinkingTokens, outputTokens,
-		atomic.LoadUint64(&GlobalInputTokens), atomic.LoadUint64(&GlobalThinkingTokens), atomic.LoadUint64(&GlobalOutputTokens))
+	// log the request tokens along with the running totals of the suite
+	i.Log.Info("token stats",
+		"input_tokens", inputTokens, "thinking_tokens", thinkingTokens, "output_tokens", outputTokens,
+		"total_input_tokens", Tokens.Tokens(metrics.TokensInput),
+		"total_thinking_tokens", Tokens.Tokens(metrics.TokensThinking),
+		"total_output_tokens", Tokens.Tokens(metrics.TokensOutput))
 }
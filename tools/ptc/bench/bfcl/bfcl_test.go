@@ -0,0 +1,200 @@
+package bfcl
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/modfin/bellman/models/gen"
+	"github.com/modfin/bellman/prompt"
+	"github.com/modfin/bellman/tools"
+	"github.com/modfin/bellman/tools/ptc"
+	"github.com/modfin/bellman/tools/ptc/bench/replay"
+	"github.com/modfin/bellman/tools/ptc/bench/tracer"
+	"github.com/modfin/bellman/tools/ptc/bench/utils"
+)
+
+func threeTurnHistory() []prompt.Prompt {
+	return []prompt.Prompt{
+		prompt.AsUser("turn 1"),
+		prompt.AsToolCall("a", "ls", []byte(`{}`)),
+		prompt.AsToolResponse("a", "ls", `{"files":[]}`),
+		prompt.AsAssistant("the folder is empty"),
+		prompt.AsUser("turn 2"),
+		prompt.AsAssistant("let me check"),
+		prompt.AsAssistant("one more thing"),
+		prompt.AsToolCall("b", "pwd", []byte(`{}`)),
+		prompt.AsToolResponse("b", "pwd", `{"dir":"/"}`),
+		prompt.AsUser("turn 3"),
+		prompt.AsAssistant("done"),
+	}
+}
+
+func TestAppendResponseConversationKeepsAssistantText(t *testing.T) {
+	i := &Instance{}
+	rebuilt := i.appendResponseConversation(threeTurnHistory(), BenchmarkRequest{}, nil)
+
+	expected := []prompt.Prompt{
+		prompt.AsUser("turn 1"),
+		prompt.AsToolCall("a", "ls", []byte(`{}`)),
+		prompt.AsToolResponse("a", "ls", `{"files":[]}`),
+		prompt.AsAssistant("the folder is empty"),
+		prompt.AsUser("turn 2"),
+		prompt.AsAssistant("let me check\n\none more thing"),
+		prompt.AsToolCall("b", "pwd", []byte(`{}`)),
+		prompt.AsToolResponse("b", "pwd", `{"dir":"/"}`),
+		prompt.AsUser("turn 3"),
+		prompt.AsAssistant("done"),
+	}
+	assertPrompts(t, expected, rebuilt)
+}
+
+func TestAppendResponseConversationDropsAssistantText(t *testing.T) {
+	keep := false
+	i := &Instance{}
+	rebuilt := i.appendResponseConversation(threeTurnHistory(), BenchmarkRequest{KeepAssistantText: &keep}, nil)
+
+	expected := []prompt.Prompt{
+		prompt.AsUser("turn 1"),
+		prompt.AsToolCall("a", "ls", []byte(`{}`)),
+		prompt.AsToolResponse("a", "ls", `{"files":[]}`),
+		prompt.AsUser("turn 2"),
+		prompt.AsToolCall("b", "pwd", []byte(`{}`)),
+		prompt.AsToolResponse("b", "pwd", `{"dir":"/"}`),
+		prompt.AsUser("turn 3"),
+	}
+	assertPrompts(t, expected, rebuilt)
+}
+
+func TestAppendResponseConversationReusedCallID(t *testing.T) {
+	history := []prompt.Prompt{
+		prompt.AsUser("turn 1"),
+		prompt.AsToolCall("a", "ls", []byte(`{}`)),
+		prompt.AsUser("turn 2"),
+		prompt.AsToolCall("a", "ls", []byte(`{"all":true}`)),
+	}
+	req := BenchmarkRequest{Messages: []Message{
+		{Role: "user", Content: "turn 1"},
+		{Role: "tool_response", ToolID: "a", ToolName: "ls", Content: "first"},
+		{Role: "user", Content: "turn 2"},
+		{Role: "tool_response", ToolID: "a", ToolName: "ls", Content: "second"},
+	}}
+	i := &Instance{Tracer: &tracer.Tracer{ToolSpans: map[string]tracer.Span{}}}
+	rebuilt := i.appendResponseConversation(history, req, nil)
+
+	if len(rebuilt) != 6 || rebuilt[2].ToolResponse.Response != "first" || rebuilt[5].ToolResponse.Response != "second" {
+		t.Fatalf("expected the first call paired with the first response, got %+v", rebuilt)
+	}
+
+	// the response of the request pairs with the call not yet answered in the history
+	history = append(history[:2], prompt.AsToolResponse("a", "ls", "first"), history[2], history[3])
+	response := prompt.AsToolResponse("a", "ls", "new")
+	rebuilt = i.appendResponseConversation(history, BenchmarkRequest{}, &response)
+	if len(rebuilt) != 6 || rebuilt[2].ToolResponse.Response != "first" || rebuilt[5].ToolResponse.Response != "new" {
+		t.Fatalf("expected the response paired with the second call, got %+v", rebuilt)
+	}
+}
+
+func assertPrompts(t *testing.T, expected, actual []prompt.Prompt) {
+	t.Helper()
+	if len(expected) != len(actual) {
+		t.Fatalf("expected %d prompts, got %d: %+v", len(expected), len(actual), actual)
+	}
+	for i := range expected {
+		e, a := expected[i], actual[i]
+		if e.Role != a.Role || e.Text != a.Text {
+			t.Fatalf("prompt %d: expected %s %q, got %s %q", i, e.Role, e.Text, a.Role, a.Text)
+		}
+		if e.ToolCall != nil && (a.ToolCall == nil || e.ToolCall.ToolCallID != a.ToolCall.ToolCallID) {
+			t.Fatalf("prompt %d: expected tool call %s, got %+v", i, e.ToolCall.ToolCallID, a.ToolCall)
+		}
+		if e.ToolResponse != nil && (a.ToolResponse == nil || e.ToolResponse.ToolCallID != a.ToolResponse.ToolCallID) {
+			t.Fatalf("prompt %d: expected tool response %s, got %+v", i, e.ToolResponse.ToolCallID, a.ToolResponse)
+		}
+	}
+}
+
+func TestExtractedToolCallIDs(t *testing.T) {
+	code, _ := json.Marshal(map[string]string{"code": `var a = ls({}); var b = cd({folder: "x"}); var c = ls({}); __setResult({a, b, c})`})
+	res := &gen.Response{Tools: []tools.Call{
+		{ID: "ptc_1", Name: ptc.ToolName, Argument: code},
+		{ID: "native_1", Name: "pwd", Argument: []byte(`{}`)},
+	}}
+
+	i := &Instance{Replay: replay.NewReplay()}
+	toolmanCalls, bfclCalls, bfclIDs, err := i.getToolCalls(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(toolmanCalls) != 2 || len(bfclCalls) != 1 || len(bfclIDs) != 1 || bfclIDs[0] != "native_1" {
+		t.Fatalf("unexpected calls: %+v %+v %+v", toolmanCalls, bfclCalls, bfclIDs)
+	}
+
+	benchTools, _ := utils.ParseJsonSchemaTools([]interface{}{
+		map[string]any{"name": "ls"}, map[string]any{"name": "cd"}, map[string]any{"name": "pwd"},
+	}, true)
+
+	expected := []struct{ id, name string }{{"ptc_1#0", "ls"}, {"ptc_1#1", "cd"}, {"ptc_1#2", "ls"}}
+	for _, e := range expected {
+		result := i.Replay.ExecutionReplay(benchTools)
+		if result.Record == nil {
+			t.Fatalf("expected record for %s, got %+v", e.id, result)
+		}
+		if result.ToolID != e.id || result.Record.ToolName != e.name {
+			t.Fatalf("expected %s %s, got %s %s", e.id, e.name, result.ToolID, result.Record.ToolName)
+		}
+		if utils.ParentCallID(result.ToolID) != "ptc_1" {
+			t.Fatalf("expected parent ptc_1, got %s", utils.ParentCallID(result.ToolID))
+		}
+		i.Replay.AddResponse(replay.CallRecord{ToolName: e.name, Result: `{"ok":true}`})
+	}
+
+	result := i.Replay.ExecutionReplay(benchTools)
+	if result.Record != nil || result.ToolID != "ptc_1" || result.Output == "" {
+		t.Fatalf("expected script output for ptc_1, got %+v", result)
+	}
+}
+
+func TestToolNamesRestored(t *testing.T) {
+	_, names := utils.ParseJsonSchemaTools([]interface{}{map[string]any{"name": "math.factorial"}}, false)
+	i := &Instance{Replay: replay.NewReplay(), names: names}
+
+	res := &gen.Response{Tools: []tools.Call{{ID: "1", Name: "math_factorial", Argument: []byte(`{"n":5}`)}}}
+	toolmanCalls, bfclCalls, _, err := i.getToolCalls(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if toolmanCalls[0].ToolCall.Name != "math_factorial" {
+		t.Fatalf("expected the sanitized name in the conversation, got %+v", toolmanCalls[0].ToolCall)
+	}
+	if _, ok := bfclCalls[0]["math.factorial"]; !ok {
+		t.Fatalf("expected the original name in the bench call, got %+v", bfclCalls[0])
+	}
+
+	call := recordToBFCLCall(&replay.CallRecord{ToolName: "math_factorial", Argument: map[string]any{"n": 5}}, i.names)
+	if _, ok := call["math.factorial"]; !ok {
+		t.Fatalf("expected the original name in the replayed call, got %+v", call)
+	}
+}
+
+func TestHandleGenerateBFCLBody(t *testing.T) {
+	defer func(limit int64) { utils.BodyLimit = limit }(utils.BodyLimit)
+	utils.BodyLimit = 64
+
+	c := NewCache(nil)
+	for body, status := range map[string]int{
+		`{"test_id":"` + strings.Repeat("a", 64) + `"}`: http.StatusRequestEntityTooLarge,
+		`{"test_id":`: http.StatusBadRequest,
+	} {
+		rec := httptest.NewRecorder()
+		c.HandleGenerateBFCL(rec, httptest.NewRequest(http.MethodPost, "/bfcl", strings.NewReader(body)))
+		if rec.Code != status || !strings.Contains(rec.Body.String(), `"error":`) {
+			t.Fatalf("expected a json error with status %d for %s, got %d %s", status, body, rec.Code, rec.Body.String())
+		}
+	}
+	if len(c.Instances) != 0 {
+		t.Fatalf("expected rejected requests not to create instances, got %d", len(c.Instances))
+	}
+}
@@ -2,21 +2,23 @@ package cfb
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
-	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	"github.com/modfin/bellman"
+	"github.com/modfin/bellman/internal/logx"
+	"github.com/modfin/bellman/metrics"
 	"github.com/modfin/bellman/models/gen"
 	"github.com/modfin/bellman/prompt"
 	"github.com/modfin/bellman/tools"
 	"github.com/modfin/bellman/tools/ptc"
 	"github.com/modfin/bellman/tools/ptc/bench/replay"
+	"github.com/modfin/bellman/tools/ptc/bench/session"
 	"github.com/modfin/bellman/tools/ptc/bench/tracer"
 	"github.com/modfin/bellman/tools/ptc/bench/utils"
 )
@@ -30,7 +32,23 @@ type BenchmarkRequest struct {
 	Temperature      float64         `json:"temperature"`
 	SystemPrompt     string          `json:"system_prompt"`
 	EnablePTC        bool            `json:"enable_ptc"`
+	ToolChoice       string          `json:"tool_choice,omitempty"` // auto|required|none|<function name>
 	TestID           string          `json:"test_id"`
+	TraceID          string          `json:"-"` // from the X-Bellman-Trace header, see utils.TraceID
+	SessionKey       string          `json:"-"` // see sessionKey
+}
+
+// sessionKey returns the key of the test case of the request, see session.Key, by the test id, the trace header, if
+// sent, or else the first user message, which the benchmark resends with every request of the test case
+func (r BenchmarkRequest) sessionKey(traceHeader string) string {
+	var first string
+	for _, m := range r.Messages {
+		if m.Role == "user" {
+			first = m.Content
+			break
+		}
+	}
+	return session.Key(first, r.TestID, traceHeader)
 }
 
 type Message struct {
@@ -87,28 +105,32 @@ type Usage struct {
 type ExtractedCall map[string]map[string]interface{}
 
 type Instance struct {
+	Log     *slog.Logger // logs with the fields of the run, see logx.WithRun
 	Replay  *replay.Replay
 	Tracer  *tracer.Tracer
 	timer   *time.Timer
 	mu      sync.Mutex
 	retries int
+	names   tools.NameMap // sanitized to original tool names of the request, see utils.ParseJsonSchemaTools
 }
 
 type Cache struct {
-	Instances map[string]*Instance
+	Instances map[string]*Instance // by session key, see BenchmarkRequest.sessionKey
+	Log       *slog.Logger
+	Sessions  *session.Store // optional, holds the PTC runtime of each instance, e.g. for the debug endpoints
 	mu        sync.Mutex
 }
 
-func NewCache() *Cache {
+// NewCache returns a cache of benchmark instances logging to logger, or the default logger if nil
+func NewCache(logger *slog.Logger) *Cache {
 	return &Cache{
 		Instances: make(map[string]*Instance),
+		Log:       logx.OrDefault(logger),
 	}
 }
 
-var (
-	GlobalInputTokens  uint64
-	GlobalOutputTokens uint64
-)
+// Tokens holds the token totals of all instances, counted by the bellman client, see utils.Suite
+var Tokens = utils.Suite("cfb")
 
 // HandleGenerateCFB is the handler for the CFB benchmark
 func (c *Cache) HandleGenerateCFB(w http.ResponseWriter, r *http.Request) {
@@ -118,10 +140,12 @@ func (c *Cache) HandleGenerateCFB(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req BenchmarkRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	traceID := utils.TraceID(w, r)
+	if err := utils.DecodeRequest(w, r, &req); err != nil {
 		return
 	}
+	req.TraceID = traceID
+	req.SessionKey = req.sessionKey(r.Header.Get(utils.TraceHeader))
 
 	// ensure cache instance, replay cache and tracer
 	i := c.ensureCache(req)
@@ -144,15 +168,17 @@ func (c *Cache) HandleGenerateCFB(w http.ResponseWriter, r *http.Request) {
 func (i *Instance) replayGenerateCFB(w http.ResponseWriter, req BenchmarkRequest, previousGen *gen.Response) {
 	bellmanUrl := os.Getenv("BELLMAN_URL")
 	bellmanToken := os.Getenv("BELLMAN_TOKEN")
-	client := bellman.New(bellmanUrl, bellman.Key{Name: "cfb", Token: bellmanToken})
+	client := bellman.New(bellmanUrl, bellman.Key{Name: "cfb", Token: bellmanToken}, bellman.WithMetrics(Tokens)).SetLogger(i.Log)
 
-	bellmanTools := utils.ParseJsonSchemaTools(req.Tools, req.EnablePTC)
+	bellmanTools, names := utils.ParseJsonSchemaTools(req.Tools, req.EnablePTC)
+	i.names = names
 
-	model, err := gen.ToModel(req.Model)
-	if err != nil {
-		i.Tracer.TraceError(i.Tracer.RootSpan, err, true)
-		log.Fatalf("error: %e", err)
+	model, ok := utils.ResolveModel(w, client, req.Model, i.Log)
+	if !ok {
+		i.Tracer.TraceError(i.Tracer.RootSpan, fmt.Errorf("invalid model %s", req.Model), true)
+		return
 	}
+	var err error
 
 	// add trailing user messages to toolman conversation
 	toolmanConversation := i.addNewUserConversation(req)
@@ -177,8 +203,7 @@ func (i *Instance) replayGenerateCFB(w http.ResponseWriter, req BenchmarkRequest
 			}
 		}
 		if len(req.NewToolResponses) > 0 && !i.Replay.IsPending() {
-			log.Printf("?????????")
-
+			i.Log.Debug("new tool responses without pending scripts to replay")
 		}
 		// while there are scripts to run, replay them
 		for i.Replay.IsPending() {
@@ -194,12 +219,17 @@ func (i *Instance) replayGenerateCFB(w http.ResponseWriter, req BenchmarkRequest
 	}
 
 	llm := client.Generator().Model(model).
+		WithTraceID(req.TraceID).
 		System(req.SystemPrompt).
 		SetTools(bellmanTools...) //.Temperature(req.Temperature)
 
 	if req.EnablePTC {
 		llm, _ = llm.ActivatePTC(ptc.JavaScript)
 	}
+	llm, err = utils.ApplyToolChoice(llm, req.ToolChoice)
+	if err != nil {
+		i.Log.Warn("could not apply tool choice", "tool_choice", req.ToolChoice, "error", err)
+	}
 
 	// prompt with retry (cfb restarts on every test...)
 	maxRetries := 5
@@ -214,7 +244,7 @@ func (i *Instance) replayGenerateCFB(w http.ResponseWriter, req BenchmarkRequest
 		start := time.Now()
 		res, err = llm.Prompt(toolmanConversation...)
 		duration := time.Since(start)
-		fmt.Printf("prompt duration: %v ms\n", duration.Milliseconds())
+		i.Log.Debug("prompt done", "duration_ms", duration.Milliseconds())
 
 		if res != nil {
 			metrics = &tracer.Metrics{
@@ -228,8 +258,10 @@ func (i *Instance) replayGenerateCFB(w http.ResponseWriter, req BenchmarkRequest
 			break
 		}
 
+		utils.UpstreamError("cfb", err)
+
 		if i.retries >= maxRetries {
-			log.Printf("Prompt Error: %+v\n", err)
+			i.Log.Error("prompt failed, giving up", "retries", i.retries, "error", err)
 			i.Tracer.TraceError(i.Tracer.ChatSpan, err, true)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -242,7 +274,8 @@ func (i *Instance) replayGenerateCFB(w http.ResponseWriter, req BenchmarkRequest
 		// update retry counter
 		i.retries++
 
-		if strings.Contains(err.Error(), "unexpected status code 403") {
+		var apiErr *bellman.APIError
+		if errors.As(err, &apiErr) && apiErr.Status == http.StatusForbidden {
 			// return on 403 error (llm provider fire wall)
 			completion := ChatCompletionResponse{
 				ID:      "chatcmpl-123", // Important: fill with mock data! (for completion parsing in cfb)
@@ -272,20 +305,22 @@ func (i *Instance) replayGenerateCFB(w http.ResponseWriter, req BenchmarkRequest
 			}
 			w.Header().Set("Content-Type", "application/json")
 			json.NewEncoder(w).Encode(resp)
+			return
 		}
 
 		backoff := time.Duration(1<<i.retries) * time.Second
-		log.Printf("Prompt Error: %+v. Retrying in %v...\n", err, backoff)
+		i.Log.Warn("prompt failed, retrying", "backoff", backoff, "error", err)
 		time.Sleep(backoff)
 	}
 
 	// log token usage
-	logExecution(res)
+	i.logExecution(res)
 
 	// get tool call or text response, and add PTC scripts to cache
 	toolmanCalls, cfbCalls, err := i.getToolCalls(res)
 	if err != nil {
-		log.Printf("error getting prompts: %v", err)
+		utils.ExtractionFailure("cfb")
+		i.Log.Error("could not get tool calls", "error", err)
 		i.Tracer.TraceError(i.Tracer.ChatSpan, err, true)
 
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -314,7 +349,7 @@ func (i *Instance) replayGenerateCFB(w http.ResponseWriter, req BenchmarkRequest
 	content := ""
 	if res.IsText() {
 		if content, err = res.AsText(); err != nil {
-			log.Printf("error: %v", err)
+			i.Log.Error("could not get text response", "error", err)
 			i.Tracer.TraceError(i.Tracer.ChatSpan, err, true)
 
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -377,18 +412,14 @@ func (i *Instance) getToolCalls(res *gen.Response) ([]prompt.Prompt, []ToolCall,
 	for _, tool := range res.Tools {
 		// PTC Tool Call
 		if tool.Name == ptc.ToolName {
-			// Unmarshal the 'argument' string/bytes to get the JS code
-			var codeArgs struct {
-				Code string `json:"code"`
-			}
-			err := json.Unmarshal(tool.Argument, &codeArgs)
+			code, err := ptc.ParseCode(tool.Argument)
 			if err != nil {
 				return nil, nil, err
 			}
 
 			// add script to replay cache
 			i.Replay.AddScript(replay.Script{
-				Code:   codeArgs.Code,
+				Code:   code,
 				Done:   false,
 				ToolID: tool.ID,
 			})
@@ -399,9 +430,9 @@ func (i *Instance) getToolCalls(res *gen.Response) ([]prompt.Prompt, []ToolCall,
 
 		// Standard Tool Call
 		toolmanCalls = append(toolmanCalls, prompt.AsToolCall(tool.ID, tool.Name, tool.Argument))
-		call, err := toolmanToCFBCall(tool)
+		call, err := toolmanToCFBCall(tool, i.names)
 		if err != nil {
-			log.Fatalf("error: %e", err)
+			logx.Fatal(i.Log, "could not convert tool call", "error", err)
 		}
 		cfbCalls = append(cfbCalls, call)
 	}
@@ -417,21 +448,21 @@ func (i *Instance) executionReplay(bellmanTools []tools.Tool, toolmanConversatio
 			i.Tracer.SetTag(i.Tracer.ChatSpan, "runtime_error")
 		} else {
 			i.Tracer.TraceError(i.Tracer.ChatSpan, result.Error, true)
-			log.Fatalf("execution replay error: %+v", result.Error)
+			logx.Fatal(i.Log, "execution replay failed", "error", result.Error)
 		}
 	}
 
 	// record --> bench tool call
 	if result.Record != nil {
-		call, err := recordToCFBCall(result.Record)
+		call, err := recordToCFBCall(result.Record, i.names)
 		if err != nil {
-			log.Fatalf("error: %e", err)
+			logx.Fatal(i.Log, "could not convert call record", "error", err)
 		}
 
 		// trace code execution
 		jsonBytes, err := json.Marshal(result.Record.Argument)
 		if err != nil {
-			log.Printf("error: Error marshaling arguments: %v\n", err)
+			i.Log.Error("could not marshal arguments", "args", result.Record.Argument, "error", err)
 		}
 		toolCall := prompt.AsToolCall(result.ToolID, result.Record.ToolName, jsonBytes)
 		i.Tracer.TraceExec(toolCall)
@@ -485,17 +516,16 @@ func (i *Instance) executionReplay(bellmanTools []tools.Tool, toolmanConversatio
 }
 
 // recordToCFBCall converts replay record to cfb tool call
-func recordToCFBCall(record *replay.CallRecord) (ToolCall, error) {
+func recordToCFBCall(record *replay.CallRecord, names tools.NameMap) (ToolCall, error) {
 	jsonBytes, err := json.Marshal(record.Argument)
 	if err != nil {
-		log.Printf("Error marshaling arguments: %v\n", err)
-		return ToolCall{}, err
+		return ToolCall{}, fmt.Errorf("could not marshal arguments; %w", err)
 	}
 
 	call := ToolCall{
 		Type: "function",
 		Function: ToolCallFunction{
-			Name:      record.ToolName,
+			Name:      names.Original(record.ToolName),
 			Arguments: string(jsonBytes),
 		},
 	}
@@ -503,12 +533,12 @@ func recordToCFBCall(record *replay.CallRecord) (ToolCall, error) {
 }
 
 // toolmanToCFBCall converts toolman call to cfb tool call
-func toolmanToCFBCall(tool tools.Call) (ToolCall, error) {
+func toolmanToCFBCall(tool tools.Call, names tools.NameMap) (ToolCall, error) {
 	call := ToolCall{
 		ID:   tool.ID,
 		Type: "function",
 		Function: ToolCallFunction{
-			Name:      tool.Name,
+			Name:      names.Original(tool.Name),
 			Arguments: string(tool.Argument),
 		},
 	}
@@ -524,16 +554,17 @@ func (c *Cache) ensureCache(req BenchmarkRequest) *Instance {
 		ptcFlag = "ptc-fc"
 	}
 
-	i, ok := c.Instances[req.TestID]
+	i, ok := c.Instances[req.SessionKey]
 	if !ok {
 		i = &Instance{
+			Log:    logx.WithRun(c.Log, req.Model, tracer.ExtractCategoryRegex(req.TestID), ptcFlag).With("test_id", req.TestID),
 			Replay: replay.NewReplay(),
 			Tracer: tracer.NewTracer(fmt.Sprintf("%s-%s-%s", req.TestID, ptcFlag, req.Model)),
 		}
 		i.timer = time.AfterFunc(3*time.Minute, func() {
-			c.finish(req.TestID)
+			c.finish(req.SessionKey)
 		})
-		c.Instances[req.TestID] = i
+		c.Instances[req.SessionKey] = i
 	} else {
 		i.timer.Reset(3 * time.Minute)
 	}
@@ -542,6 +573,15 @@ func (c *Cache) ensureCache(req BenchmarkRequest) *Instance {
 	i.mu.Lock()
 	defer i.mu.Unlock()
 
+	if req.EnablePTC && c.Sessions != nil {
+		sess, err := c.Sessions.Acquire(req.SessionKey)
+		if err != nil {
+			i.Log.Warn("could not acquire session", "error", err)
+		} else {
+			i.Replay.SetSession(sess)
+		}
+	}
+
 	// reset cache if only user message, and no new responses
 	reset := true
 	for _, m := range req.Messages {
@@ -568,11 +608,11 @@ func (c *Cache) ensureCache(req BenchmarkRequest) *Instance {
 	return i
 }
 
-func (c *Cache) finish(testID string) {
+func (c *Cache) finish(key string) {
 	c.mu.Lock()
-	i, ok := c.Instances[testID]
+	i, ok := c.Instances[key]
 	if ok {
-		delete(c.Instances, testID)
+		delete(c.Instances, key)
 	}
 	c.mu.Unlock()
 
@@ -589,21 +629,13 @@ func (c *Cache) finish(testID string) {
 // addNewUserConversation adds incoming user messages to toolman conversation
 func (i *Instance) addNewUserConversation(req BenchmarkRequest) []prompt.Prompt {
 	toolmanHistory := req.ToolmanHistory
-	// count toolman user messages
-	toolmanUserCount := 0
-	for _, p := range toolmanHistory {
-		if p.Role == prompt.UserRole {
-			toolmanUserCount++
-		}
-	}
+	isNewUser := utils.NewUsers(toolmanHistory)
 	// add trailing messages from CFB
-	cfbUserCount := 0
 	for _, m := range req.Messages {
 		switch m.Role {
 		case "user":
 			// only add new user messages from cfb (not in toolman hist.)
-			cfbUserCount++
-			if cfbUserCount > toolmanUserCount {
+			if isNewUser() {
 				// update turn index & trace
 				i.Tracer.NewTurn()
 				userPrompt := prompt.AsUser(m.Content)
@@ -615,62 +647,28 @@ func (i *Instance) addNewUserConversation(req BenchmarkRequest) []prompt.Prompt
 	return toolmanHistory
 }
 
-// appendResponseConversation rebuilds the toolman conversation to add new tool response (after corresponding tool call)
+// appendResponseConversation rebuilds the toolman conversation to add new tool response (after corresponding tool call),
+// see utils.AppendResponseConversation
 func (i *Instance) appendResponseConversation(toolmanHistory []prompt.Prompt, req BenchmarkRequest, response *prompt.Prompt) []prompt.Prompt {
-	// Add tool response after call!
-	var rebuiltConversation []prompt.Prompt
-	for _, p := range toolmanHistory {
-		switch p.Role {
-		case prompt.ToolCallRole:
-			rebuiltConversation = append(rebuiltConversation, p)
-
-			// add corresponding tool call response (only add once)
-			// priority order: response -> toolman history -> request messages
-			if response != nil && response.ToolResponse.ToolCallID == p.ToolCall.ToolCallID {
-				// trace tool response
-				i.Tracer.Trace(*response, nil, nil)
-				rebuiltConversation = append(rebuiltConversation, *response)
-				break
-			}
-			found := false
-			for _, h := range toolmanHistory {
-				if h.Role == prompt.ToolResponseRole && p.ToolCall.ToolCallID == h.ToolResponse.ToolCallID {
-					rebuiltConversation = append(rebuiltConversation, h)
-					found = true
-					break
-				}
-			}
-			if !found {
-				for _, m := range req.Messages {
-					if m.Role == "tool_response" && m.ToolID == p.ToolCall.ToolCallID {
-						// trace tool response
-						responsePrompt := prompt.AsToolResponse(m.ToolID, m.ToolName, m.Content)
-						i.Tracer.Trace(responsePrompt, nil, nil)
-						rebuiltConversation = append(rebuiltConversation, responsePrompt)
-						break
-					}
-				}
-			}
-		case prompt.UserRole:
-			rebuiltConversation = append(rebuiltConversation, p)
-		case prompt.AssistantRole:
-			rebuiltConversation = append(rebuiltConversation, p)
+	var messages []prompt.Prompt
+	for _, m := range req.Messages {
+		if m.Role == "tool_response" {
+			messages = append(messages, prompt.AsToolResponse(m.ToolID, m.ToolName, m.Content))
 		}
 	}
-	return rebuiltConversation
+	return utils.AppendResponseConversation(toolmanHistory, messages, response, func(p prompt.Prompt) {
+		// trace tool response
+		i.Tracer.Trace(p, nil, nil)
+	})
 }
 
-func logExecution(res *gen.Response) {
-	// extract tokens and update global counters
+func (i *Instance) logExecution(res *gen.Response) {
 	inputTokens := res.Metadata.InputTokens
 	outputTokens := res.Metadata.OutputTokens
 
-	// Thread-safe increment
-	atomic.AddUint64(&GlobalInputTokens, uint64(inputTokens))
-	atomic.AddUint64(&GlobalOutputTokens, uint64(outputTokens))
-
-	// Log the running total to the console
-	log.Printf("[Token Stats] Request: %d / %d | Global Total: %d / %d",
-		inputTokens, outputTokens,
-		atomic.LoadUint64(&GlobalInputTokens), atomic.LoadUint64(&GlobalOutputTokens))
+	// log the request tokens along with the running totals of the suite
+	i.Log.Info("token stats",
+		"input_tokens", inputTokens, "output_tokens", outputTokens,
+		"total_input_tokens", Tokens.Tokens(metrics.TokensInput),
+		"total_output_tokens", Tokens.Tokens(metrics.TokensOutput))
 }
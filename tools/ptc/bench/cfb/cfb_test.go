@@ -0,0 +1,30 @@
+package cfb
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/modfin/bellman/tools/ptc/bench/utils"
+)
+
+func TestHandleGenerateCFBBody(t *testing.T) {
+	defer func(limit int64) { utils.BodyLimit = limit }(utils.BodyLimit)
+	utils.BodyLimit = 64
+
+	c := NewCache(nil)
+	for body, status := range map[string]int{
+		`{"test_id":"` + strings.Repeat("a", 64) + `"}`: http.StatusRequestEntityTooLarge,
+		`{"test_id":"q1","temprature":0}`:               http.StatusBadRequest,
+	} {
+		rec := httptest.NewRecorder()
+		c.HandleGenerateCFB(rec, httptest.NewRequest(http.MethodPost, "/cfb", strings.NewReader(body)))
+		if rec.Code != status || !strings.Contains(rec.Body.String(), `"error":`) {
+			t.Fatalf("expected a json error with status %d for %s, got %d %s", status, body, rec.Code, rec.Body.String())
+		}
+	}
+	if len(c.Instances) != 0 {
+		t.Fatalf("expected rejected requests not to create instances, got %d", len(c.Instances))
+	}
+}
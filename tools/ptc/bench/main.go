@@ -1,30 +1,63 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/modfin/bellman/internal/logx"
 
 	"github.com/modfin/bellman/tools/ptc/bench/bfcl"
 	"github.com/modfin/bellman/tools/ptc/bench/cfb"
 	"github.com/modfin/bellman/tools/ptc/bench/nestful"
+	"github.com/modfin/bellman/tools/ptc/bench/utils"
 )
 
 func main() {
+	newLogger := logx.Flags(flag.CommandLine, "BENCH")
+	flag.Parse()
+	logger, err := newLogger()
+	if err != nil {
+		log.Fatalf("invalid logging flags: %v", err)
+	}
+	// the log package, e.g. of the tracer, writes through the same logger
+	slog.SetDefault(logger)
+
+	// request body limit in bytes, raise for very large tool lists
+	if v := os.Getenv("BENCH_BODY_LIMIT"); v != "" {
+		limit, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			log.Fatalf("invalid BENCH_BODY_LIMIT: %v", err)
+		}
+		utils.BodyLimit = limit
+	}
+
 	// Create persistent handler caches
-	bfclCache := bfcl.NewCache()
-	cfbCache := cfb.NewCache()
+	bfclCache := bfcl.NewCache(logger)
+	cfbCache := cfb.NewCache(logger)
+	// all suites share one session store, so the debug endpoints see the runtimes of every suite
+	bfclCache.Sessions = nestful.Sessions
+	cfbCache.Sessions = nestful.Sessions
 
 	// Register API Endpoint
-	http.HandleFunc("/bfcl", bfclCache.HandleGenerateBFCL)
-	http.HandleFunc("/cfb", cfbCache.HandleGenerateCFB)
-	http.HandleFunc("/nestful", nestful.NesfulHandlerFromEnv())
+	http.HandleFunc("/bfcl", utils.Instrument("bfcl", bfclCache.HandleGenerateBFCL))
+	http.HandleFunc("/cfb", utils.Instrument("cfb", cfbCache.HandleGenerateCFB))
+	http.HandleFunc("/nestful", utils.Instrument("nestful", nestful.NesfulHandlerFromEnv(logger)))
+	http.Handle("/metrics", utils.MetricsHandler())
+	http.HandleFunc("/ptc/debug/globals", nestful.Sessions.HandleGlobals)
+	http.HandleFunc("/ptc/debug/reset", nestful.Sessions.HandleReset)
 
 	fmt.Println("---------------------------------------------------------")
 	fmt.Println(" Toolman Bench Server Running")
 	fmt.Println(" BFCL API Endpoint:   		http://localhost:8080/bfcl")
 	fmt.Println(" CFB API Endpoint:    		http://localhost:8080/cfb")
 	fmt.Println(" NESTFUL API Endpoint:    	http://localhost:8080/nestful")
+	fmt.Println(" PTC Debug Endpoints:    	http://localhost:8080/ptc/debug/{globals,reset}")
+	fmt.Println(" Metrics Endpoint:    		http://localhost:8080/metrics")
 	fmt.Println("---------------------------------------------------------")
 
 	fmt.Println("Toolman Benchmark Server running on :8080")
@@ -6,11 +6,12 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
-	"regexp"
+	"slices"
 	"sort"
 	"strings"
 	"sync/atomic"
@@ -18,12 +19,16 @@ import (
 	"github.com/dop251/goja"
 	"github.com/joho/godotenv"
 	"github.com/modfin/bellman"
+	"github.com/modfin/bellman/internal/logx"
 	"github.com/modfin/bellman/models/gen"
 	"github.com/modfin/bellman/prompt"
 	"github.com/modfin/bellman/schema"
 	"github.com/modfin/bellman/services/openai"
 	"github.com/modfin/bellman/tools"
 	"github.com/modfin/bellman/tools/ptc"
+	"github.com/modfin/bellman/tools/ptc/bench/score"
+	"github.com/modfin/bellman/tools/ptc/bench/session"
+	"github.com/modfin/bellman/tools/ptc/bench/utils"
 	"github.com/modfin/bellman/tools/ptc/js"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
@@ -49,14 +54,22 @@ type NestfulBenchmarkRequest struct {
 	ToolChoice         string  `json:"tool_choice,omitempty"` // auto|required|none
 	JSExtractTimeoutMs int     `json:"js_extract_timeout_ms,omitempty"`
 	TestID             string  `json:"test_id"`
+	TraceID            string  `json:"trace_id,omitempty"`         // optional, keeps the PTC runtime and its variables across requests, see Sessions
+	IncludeThinking    bool    `json:"include_thinking,omitempty"` // return the raw thinking text, off by default because of its size
+
+	Gold []score.ToolCall `json:"gold,omitempty"` // optional, scores the generated sequence in-process if set
 }
 
 type NestfulBenchmarkResponse struct {
-	GeneratedText string `json:"generated_text"` // JSON list string, NESTFUL scorer input
-	Content       string `json:"content,omitempty"`
-	InputTokens   int    `json:"input_tokens"`
-	OutputTokens  int    `json:"output_tokens"`
-	TotalTokens   int    `json:"total_tokens"`
+	GeneratedText  string   `json:"generated_text"` // JSON list string, NESTFUL scorer input
+	Content        string   `json:"content,omitempty"`
+	InputTokens    int      `json:"input_tokens"`
+	OutputTokens   int      `json:"output_tokens"`
+	ThinkingTokens int      `json:"thinking_tokens"`
+	TotalTokens    int      `json:"total_tokens"`
+	Thinking       []string `json:"thinking,omitempty"` // only set if the request has include_thinking
+
+	Score *score.ScoreResult `json:"score,omitempty"` // only set if the request has gold calls
 }
 
 type nestfulToolDef struct {
@@ -72,28 +85,39 @@ type extractMeta struct {
 	CapturedJSONTrunc string
 }
 
-// Regex to find invalid tool-name characters.
-var invalidNameChars = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+// Sessions keeps the PTC runtimes of requests with a trace id, see NestfulBenchmarkRequest.TraceID
+var Sessions = session.NewStore(session.DefaultTTL)
+
+// Tokens holds the token totals of all requests, counted by the bellman client, see utils.Suite
+var Tokens = utils.Suite("nestful")
 
-func NesfulHandlerFromEnv() http.HandlerFunc {
+// NesfulHandlerFromEnv returns the nestful handler with a client from the env, logging to logger, or the default
+// logger if nil
+func NesfulHandlerFromEnv(logger *slog.Logger) http.HandlerFunc {
+	logger = logx.OrDefault(logger)
 	_ = godotenv.Load(".env")
 	bellmanURL := os.Getenv("BELLMAN_URL")
 	bellmanToken := os.Getenv("BELLMAN_TOKEN")
 
-	client := bellman.New(bellmanURL, bellman.Key{Name: "nestful", Token: bellmanToken})
+	client := bellman.New(bellmanURL, bellman.Key{Name: "nestful", Token: bellmanToken}, bellman.WithMetrics(Tokens)).SetLogger(logger)
 	model := openai.GenModel_gpt5_mini_250807
 	//model := vertexai.GenModel_gemini_2_5_flash_latest
+	if _, _, err := bellman.ValidateModel(client, model.FQN()); errors.Is(err, bellman.ErrUnknownModel) {
+		logx.Fatal(logger, "unknown nestful model", "model", model.FQN(), "error", err)
+	} else if err != nil {
+		logger.Warn("could not validate nestful model", "model", model.FQN(), "error", err)
+	}
 
 	ctx := context.Background()
-	tp, err := setupHttpLangfuse(ctx)
+	tp, err := setupHttpLangfuse(ctx, logger)
 
 	if err != nil {
-		fmt.Println("otel desabled: ", err)
+		logger.Warn("otel disabled", "error", err)
 	} else {
 		_ = tp
 	}
 
-	return NestfulHandlerWrapper(client, model)
+	return NestfulHandlerWrapper(client, model, logger)
 }
 
 // NestfulHandler exposes a single-shot endpoint that returns predicted tool-call sequences in NESTFUL's format.
@@ -103,17 +127,21 @@ func NesfulHandlerFromEnv() http.HandlerFunc {
 //
 // Tools are never executed.
 
-func NestfulHandler(w http.ResponseWriter, r *http.Request, client *bellman.Bellman, model gen.Model) {
+func NestfulHandler(w http.ResponseWriter, r *http.Request, client *bellman.Bellman, model gen.Model, logger *slog.Logger) {
 
 	if r.Method != http.MethodPost {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 	var req NestfulBenchmarkRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		httpErr(w, fmt.Errorf("invalid json: %w", err), http.StatusBadRequest)
+	if err := utils.DecodeRequest(w, r, &req); err != nil {
 		return
 	}
+	// the body trace id, which also keys the session, is used when no trace header is sent
+	if r.Header.Get(utils.TraceHeader) == "" && req.TraceID != "" {
+		r.Header.Set(utils.TraceHeader, req.TraceID)
+	}
+	traceID := utils.TraceID(w, r)
 	if strings.TrimSpace(req.Query) == "" {
 		httpErr(w, fmt.Errorf("query is required"), http.StatusBadRequest)
 		return
@@ -132,6 +160,7 @@ func NestfulHandler(w http.ResponseWriter, r *http.Request, client *bellman.Bell
 	if req.EnablePTC {
 		ptcFlag = "ptc-fc"
 	}
+	logger = logx.WithRun(logger, model.FQN(), "", ptcFlag).With("test_id", req.TestID)
 	tracer := otel.Tracer(fmt.Sprintf("nestful-%s-%s", ptcFlag, model.String()))
 	ctx := r.Context()
 
@@ -208,6 +237,7 @@ func NestfulHandler(w http.ResponseWriter, r *http.Request, client *bellman.Bell
 	}
 	llm := client.Generator().
 		Model(model).
+		WithTraceID(traceID).
 		System(req.SystemPrompt).
 		SetTools(parsedTools...)
 	//Temperature(req.Temperature).
@@ -216,7 +246,7 @@ func NestfulHandler(w http.ResponseWriter, r *http.Request, client *bellman.Bell
 	if req.EnablePTC {
 		llm, err = llm.ActivatePTC(ptc.JavaScript)
 		if err != nil {
-			log.Printf("failed to activate ptc: %v", err)
+			logger.Warn("could not activate ptc", "error", err)
 		}
 	}
 
@@ -236,6 +266,7 @@ func NestfulHandler(w http.ResponseWriter, r *http.Request, client *bellman.Bell
 	//fmt.Println("LMM resp", res.Tools)
 
 	if err != nil {
+		utils.UpstreamError("nestful", err)
 		llmSpan.RecordError(err)
 		llmSpan.SetStatus(codes.Error, err.Error())
 		//llmSpan.End()
@@ -265,30 +296,72 @@ func NestfulHandler(w http.ResponseWriter, r *http.Request, client *bellman.Bell
 		return
 	}*/
 
+	// a trace keeps its runtime, so variables set by earlier requests are visible to the code
+	var runtime *js.JavaScript
+	if req.TraceID != "" {
+		sess, err := Sessions.Acquire(req.TraceID)
+		if err != nil {
+			httpErr(w, err, http.StatusInternalServerError)
+			return
+		}
+		sess.Lock()
+		defer sess.Unlock()
+		runtime = sess.Runtime
+	}
+
 	//tracer := otel.Tracer("toolman/nestful")
-	generated, content := nestfulGeneratedText(llmCtx, tracer, res, parsedTools, nameMap, outKeysByTool, req.JSExtractTimeoutMs)
+	generated, content := nestfulGeneratedText(llmCtx, tracer, res, parsedTools, nameMap, outKeysByTool, req.JSExtractTimeoutMs, runtime)
 	if strings.TrimSpace(generated) == "" {
 		generated = "[]"
 	}
 	//llmSpan.End()
 	writeJSON(w, http.StatusOK, NestfulBenchmarkResponse{
-		GeneratedText: generated,
-		Content:       content,
-		InputTokens:   res.Metadata.InputTokens,
-		OutputTokens:  res.Metadata.OutputTokens,
-		TotalTokens:   res.Metadata.TotalTokens,
+		GeneratedText:  generated,
+		Content:        content,
+		InputTokens:    res.Metadata.InputTokens,
+		OutputTokens:   res.Metadata.OutputTokens,
+		ThinkingTokens: res.Metadata.ThinkingTokens,
+		TotalTokens:    res.Metadata.TotalTokens,
+		Thinking:       thinkingText(res, req.IncludeThinking),
+		Score:          scoreGenerated(logger, generated, req.Gold),
 	})
 }
 
-func NestfulHandlerWrapper(client *bellman.Bellman, model gen.Model) http.HandlerFunc {
+// thinkingText returns the thinking parts of the response, if requested
+func thinkingText(res *gen.Response, include bool) []string {
+	if !include {
+		return nil
+	}
+	return res.Thinking
+}
+
+// scoreGenerated scores the generated sequence against the gold sequence, if any
+func scoreGenerated(logger *slog.Logger, generated string, gold []score.ToolCall) *score.ScoreResult {
+	if len(gold) == 0 {
+		return nil
+	}
+	var predicted []score.ToolCall
+	if err := json.Unmarshal([]byte(generated), &predicted); err != nil {
+		logger.Warn("could not parse generated sequence for scoring", "error", err)
+		return nil
+	}
+	res, err := score.Nestful{}.Score(predicted, gold)
+	if err != nil {
+		logger.Warn("could not score generated sequence", "error", err)
+		return nil
+	}
+	return &res
+}
+
+func NestfulHandlerWrapper(client *bellman.Bellman, model gen.Model, logger *slog.Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		NestfulHandler(w, r, client, model)
+		NestfulHandler(w, r, client, model, logger)
 	}
 }
 
-func parseNestfulTools(raw []any) ([]tools.Tool, map[string]string, map[string][]string, error) {
+func parseNestfulTools(raw []any) ([]tools.Tool, tools.NameMap, map[string][]string, error) {
 	// nameMap: sanitized -> original
-	nameMap := map[string]string{}
+	nameMap := tools.NameMap{}
 	// outKeysByTool: sanitized tool name -> sorted output keys
 	outKeysByTool := map[string][]string{}
 	parsed := make([]tools.Tool, 0, len(raw))
@@ -305,8 +378,7 @@ func parseNestfulTools(raw []any) ([]tools.Tool, map[string]string, map[string][
 			continue
 		}
 		orig := def.Name
-		sanitized := invalidNameChars.ReplaceAllString(orig, "_")
-		nameMap[sanitized] = orig
+		sanitized := nameMap.Sanitize(orig)
 
 		outKeys := make([]string, 0, len(def.OutputParameters))
 		for k := range def.OutputParameters {
@@ -322,25 +394,45 @@ func parseNestfulTools(raw []any) ([]tools.Tool, map[string]string, map[string][
 		outKeysByTool[sanitized] = outKeys
 
 		s := &schema.JSON{Type: schema.Object, Properties: map[string]*schema.JSON{}}
+		// Some NESTFUL variants declare the required parameters in an array next to the parameters
+		params := def.Parameters
 		var required []string
-		for k, v := range def.Parameters {
+		var known bool
+		if m, ok := rt.(map[string]any); ok {
+			required, known = requiredArray(m)
+		}
+		// Standard JSON Schema wraps the parameters in an object with properties and a required array
+		if props, ok := params["properties"].(map[string]any); ok && params["type"] == "object" {
+			params = props
+			if r, ok := requiredArray(def.Parameters); ok {
+				required, known = r, true
+			}
+		}
+		for k, v := range params {
 			ps := schemaFromAny(v)
 			if ps == nil {
 				ps = &schema.JSON{}
 			}
 			s.Properties[k] = ps
-			if isRequired(v) {
-				required = append(required, k)
+			if r, ok := isRequired(v); ok {
+				known = true
+				if r && !slices.Contains(required, k) {
+					required = append(required, k)
+				}
 			}
 		}
-		// NESTFUL tool specs often omit explicit per-parameter required flags.
-		// Default to requiring *all* parameters when none are marked required.
-		if len(required) == 0 {
+		// NESTFUL tool specs often omit requiredness altogether, neither a required array nor per-parameter flags.
+		// Default to requiring *all* parameters only then, so that genuinely optional parameters stay optional.
+		if !known {
 			required = make([]string, 0, len(s.Properties))
 			for k := range s.Properties {
 				required = append(required, k)
 			}
 		}
+		required = slices.DeleteFunc(slices.Clone(required), func(k string) bool {
+			_, ok := s.Properties[k]
+			return !ok
+		})
 		if len(required) > 0 {
 			sort.Strings(required)
 			s.Required = required
@@ -372,7 +464,7 @@ func parseNestfulTools(raw []any) ([]tools.Tool, map[string]string, map[string][
 	return parsed, nameMap, outKeysByTool, nil
 }
 
-func nestfulGeneratedText(ctx context.Context, tracer trace.Tracer, res *gen.Response, availableTools []tools.Tool, nameMap map[string]string, outKeysByTool map[string][]string, timeoutMs int) (generated string, content string) {
+func nestfulGeneratedText(ctx context.Context, tracer trace.Tracer, res *gen.Response, availableTools []tools.Tool, nameMap tools.NameMap, outKeysByTool map[string][]string, timeoutMs int, runtime *js.JavaScript) (generated string, content string) {
 	if !res.IsTools() {
 		text, _ := res.AsText()
 		return "[]", text
@@ -380,16 +472,16 @@ func nestfulGeneratedText(ctx context.Context, tracer trace.Tracer, res *gen.Res
 	out := make([]map[string]any, 0)
 	errMsgs := make([]string, 0, 1)
 	for i, tc := range res.Tools {
-		if tc.Name == "code_execution" {
-			var codeArgs struct {
-				Code string `json:"code"`
-			}
-			if err := json.Unmarshal(tc.Argument, &codeArgs); err != nil {
+		if tc.Name == ptc.ToolName {
+			code, err := ptc.ParseCode(tc.Argument)
+			if err != nil {
+				utils.ExtractionFailure("nestful")
 				errMsgs = append(errMsgs, fmt.Sprintf("code_execution args unmarshal error: %v", err))
 				continue
 			}
-			seq, errMsg := executeAndExtractNestful(ctx, tc, tracer, codeArgs.Code, availableTools, outKeysByTool, timeoutMs)
+			seq, errMsg := executeAndExtractNestful(ctx, tc, tracer, code, availableTools, outKeysByTool, timeoutMs, runtime)
 			if errMsg != "" {
+				utils.ExtractionFailure("nestful")
 				errMsgs = append(errMsgs, errMsg)
 			}
 			for i := range seq {
@@ -433,6 +525,7 @@ func executeAndExtractNestful(
 	availableTools []tools.Tool,
 	outKeysByTool map[string][]string,
 	timeoutMs int,
+	runtime *js.JavaScript, // nil creates a fresh runtime
 ) ([]map[string]any, string) {
 	const (
 		maxCapturedCalls = 15
@@ -456,9 +549,12 @@ func executeAndExtractNestful(
 		execSpan.End()
 	}()
 
-	runtime, err := js.NewRuntime(ptc.ToolName)
-	if err != nil {
-		log.Fatalf("NewRuntime error: %v", err)
+	if runtime == nil {
+		var err error
+		runtime, err = js.NewRuntime(ptc.ToolName)
+		if err != nil {
+			return nil, fmt.Sprintf("could not create runtime: %v", err)
+		}
 	}
 	vm := runtime.Runtime()
 	functionsObj := vm.NewObject()
@@ -581,17 +677,29 @@ func normalizeVarRefs(v any) any {
 	}
 }
 
-func isRequired(pdef any) bool {
+// isRequired returns the per-parameter "required": true|false flag, and whether the parameter has one
+func isRequired(pdef any) (required bool, ok bool) {
 	m, ok := pdef.(map[string]any)
 	if !ok {
-		return false
+		return false, false
 	}
-	v, ok := m["required"]
+	b, ok := m["required"].(bool)
+	return b, ok
+}
+
+// requiredArray returns the JSON Schema "required": [...] array of an object schema, and whether it has one
+func requiredArray(m map[string]any) ([]string, bool) {
+	arr, ok := m["required"].([]any)
 	if !ok {
-		return false
+		return nil, false
 	}
-	b, ok := v.(bool)
-	return ok && b
+	required := make([]string, 0, len(arr))
+	for _, v := range arr {
+		if k, ok := v.(string); ok {
+			required = append(required, k)
+		}
+	}
+	return required, true
 }
 
 func schemaFromAny(v any) *schema.JSON {
@@ -635,6 +743,13 @@ func schemaFromAny(v any) *schema.JSON {
 				}
 				js.Properties[k] = ps
 			}
+			if required, ok := requiredArray(m); ok {
+				for _, k := range required {
+					if _, ok := js.Properties[k]; ok {
+						js.Required = append(js.Required, k)
+					}
+				}
+			}
 		}
 		if ap, ok := m["additionalProperties"]; ok {
 			js.AdditionalProperties = schemaFromAny(ap)
@@ -680,12 +795,12 @@ func mustJSON(v any) []byte {
 }
 
 // setupHttpLangfuse reads the .env and wires a direct HTTP connection to localhost:3000
-func setupHttpLangfuse(ctx context.Context) (*sdktrace.TracerProvider, error) {
+func setupHttpLangfuse(ctx context.Context, logger *slog.Logger) (*sdktrace.TracerProvider, error) {
 	_ = godotenv.Load(".env")
 	pubKey := os.Getenv("LANGFUSE_PUBLIC_KEY")
 	secKey := os.Getenv("LANGFUSE_SECRET_KEY")
 	host := os.Getenv("LANGFUSE_BASE_URL")
-	fmt.Println("host:", host)
+	logger.Debug("langfuse host", "host", host)
 	if pubKey == "" || secKey == "" || host == "" {
 		fmt.Errorf("Missing LANGFUSE_PUBLIC_KEY or LANGFUSE_SECRET_KEY in .env")
 	}
@@ -0,0 +1,129 @@
+package nestful
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/modfin/bellman/models/gen"
+	"github.com/modfin/bellman/schema"
+	"github.com/modfin/bellman/tools"
+	"github.com/modfin/bellman/tools/ptc/bench/session"
+	"github.com/modfin/bellman/tools/ptc/bench/utils"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestSessionRuntime(t *testing.T) {
+	store := session.NewStore(session.DefaultTTL)
+	tracer := noop.NewTracerProvider().Tracer("test")
+	available := []tools.Tool{{Name: "get_user"}}
+	outKeys := map[string][]string{"get_user": {"name"}}
+
+	run := func(code string) []map[string]any {
+		sess, err := store.Acquire("trace-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sess.Lock()
+		defer sess.Unlock()
+		seq, errMsg := executeAndExtractNestful(context.Background(), tools.Call{Name: "code_execution"}, tracer, code, available, outKeys, 5000, sess.Runtime)
+		if errMsg != "" {
+			t.Fatal(errMsg)
+		}
+		return seq
+	}
+
+	run(`var user = get_user({id: 1}); __setResult(user)`)
+	seq := run(`__setResult(get_user({id: user.name}))`)
+	if len(seq) != 1 || seq[0]["arguments"].(map[string]any)["id"] != "$var_1.name$" {
+		t.Fatalf("expected variables of the previous request to be visible, got %v", seq)
+	}
+}
+
+func TestParseNestfulToolsRequired(t *testing.T) {
+	raw := []any{
+		map[string]any{
+			"name": "json_schema",
+			"parameters": map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"query": map[string]any{"type": "string"},
+					"limit": map[string]any{"type": "integer"},
+					"filter": map[string]any{
+						"type":       "object",
+						"properties": map[string]any{"from": map[string]any{"type": "string"}, "to": map[string]any{"type": "string"}},
+						"required":   []any{"from"},
+					},
+				},
+				"required": []any{"query"},
+			},
+		},
+		map[string]any{
+			"name":       "required_array",
+			"parameters": map[string]any{"query": map[string]any{"type": "string"}, "limit": map[string]any{"type": "int"}},
+			"required":   []any{"limit"},
+		},
+		map[string]any{
+			"name": "flags",
+			"parameters": map[string]any{
+				"query": map[string]any{"type": "string", "required": true},
+				"limit": map[string]any{"type": "int", "required": false},
+			},
+		},
+		map[string]any{
+			"name":       "all_optional",
+			"parameters": map[string]any{"query": map[string]any{"type": "string", "required": false}},
+		},
+		map[string]any{
+			"name":       "no_info",
+			"parameters": map[string]any{"query": map[string]any{"type": "string"}, "limit": map[string]any{"type": "int"}},
+		},
+	}
+	expected := map[string][]string{
+		"json_schema":    {"query"},
+		"required_array": {"limit"},
+		"flags":          {"query"},
+		"all_optional":   nil,
+		"no_info":        {"limit", "query"},
+	}
+
+	parsed, _, _, err := parseNestfulTools(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed) != len(expected) {
+		t.Fatalf("expected %d tools, got %d", len(expected), len(parsed))
+	}
+	for _, tool := range parsed {
+		if !reflect.DeepEqual(tool.ArgumentSchema.Required, expected[tool.Name]) {
+			t.Fatalf("expected %s to require %v, got %v", tool.Name, expected[tool.Name], tool.ArgumentSchema.Required)
+		}
+	}
+
+	s := parsed[0].ArgumentSchema
+	if len(s.Properties) != 3 || s.Properties["limit"].Type != schema.Integer {
+		t.Fatalf("expected the properties of the json schema, got %v", s.Properties)
+	}
+	if filter := s.Properties["filter"]; !reflect.DeepEqual(filter.Required, []string{"from"}) {
+		t.Fatalf("expected nested required array, got %v", filter.Required)
+	}
+}
+
+func TestNestfulHandlerBody(t *testing.T) {
+	defer func(limit int64) { utils.BodyLimit = limit }(utils.BodyLimit)
+	utils.BodyLimit = 64
+
+	for body, status := range map[string]int{
+		`{"query":"` + strings.Repeat("a", 64) + `"}`: http.StatusRequestEntityTooLarge,
+		`{"query":"q","temprature":0}`:                http.StatusBadRequest,
+	} {
+		rec := httptest.NewRecorder()
+		NestfulHandler(rec, httptest.NewRequest(http.MethodPost, "/nestful", strings.NewReader(body)), nil, gen.Model{}, nil)
+		if rec.Code != status || !strings.Contains(rec.Body.String(), `"error":`) {
+			t.Fatalf("expected a json error with status %d for %s, got %d %s", status, body, rec.Code, rec.Body.String())
+		}
+	}
+}
@@ -11,6 +11,8 @@ import (
 	"github.com/dop251/goja"
 	"github.com/modfin/bellman/tools"
 	"github.com/modfin/bellman/tools/ptc"
+	"github.com/modfin/bellman/tools/ptc/bench/session"
+	"github.com/modfin/bellman/tools/ptc/bench/utils"
 	"github.com/modfin/bellman/tools/ptc/js"
 )
 
@@ -19,6 +21,7 @@ type Replay struct {
 	record  []CallRecord
 	Cursor  int
 	Scripts []Script
+	session *session.Session
 }
 
 // CallRecord stores the history of executed tools and their benchmark responses
@@ -36,6 +39,7 @@ type Script struct {
 	ToolID string
 }
 
+// Result of a replay, ToolID is the script tool ID for outputs, and a per call ID (see utils.CallID) for records
 type Result struct {
 	Record *CallRecord
 	Output string
@@ -67,6 +71,13 @@ func (r *Replay) AddScript(script Script) {
 	r.Scripts = append(r.Scripts, script)
 }
 
+// SetSession sets the session to hold the VM of the last replay, e.g. for the debug endpoints of its store
+func (r *Replay) SetSession(sess *session.Session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.session = sess
+}
+
 // Clear wipes the cache on demand
 func (r *Replay) Clear() {
 	r.mu.Lock()
@@ -102,12 +113,21 @@ func (r *Replay) ExecutionReplay(tools []tools.Tool) Result {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	// Destroy state! Create a new VM for every single replay (prevent unexpected errors)
+	// Destroy state! Create a new VM for every single replay (prevent unexpected errors). Variables still persist
+	// across requests of a test case, since all its scripts are replayed in order. Running them in the VM of the
+	// session would run the replayed scripts twice, so the session only gets the VM once replayed.
 	runtime, err := js.NewRuntime(ptc.ToolName)
 	if err != nil {
 		return Result{Error: err}
 	}
 	r.Cursor = 0
+	if sess := r.session; sess != nil {
+		defer func() {
+			sess.Lock()
+			sess.Runtime = runtime
+			sess.Unlock()
+		}()
+	}
 
 	// Inject our cached tools into the VM, and add interrupt on new tool calls
 	for _, t := range tools {
@@ -119,6 +139,7 @@ func (r *Replay) ExecutionReplay(tools []tools.Tool) Result {
 
 	// Run the next code script
 	for i, s := range r.Scripts {
+		start := r.Cursor // calls made by this script are numbered from here
 		res, resErr, err := runtime.Execute(context.Background(), s.Code)
 		if err != nil {
 			return Result{Error: err}
@@ -131,7 +152,7 @@ func (r *Replay) ExecutionReplay(tools []tools.Tool) Result {
 			if errors.As(resErr, &jsErr) {
 				if record, isYield := jsErr.Value().(*CallRecord); isYield {
 					// new tool call!
-					return Result{Record: record, ToolID: s.ToolID}
+					return Result{Record: record, ToolID: utils.CallID(s.ToolID, r.Cursor-start)}
 				}
 			}
 			// script crash (set output+err)
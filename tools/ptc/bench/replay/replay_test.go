@@ -0,0 +1,50 @@
+package replay
+
+import (
+	"testing"
+	"time"
+
+	"github.com/modfin/bellman/tools"
+	"github.com/modfin/bellman/tools/ptc/bench/session"
+)
+
+// TestVariablesAcrossRequests checks that a variable set by a script of an earlier request is visible to a script
+// of a later request of the same test case, since all scripts are replayed in order in one runtime, and that the
+// session of the test case holds that runtime
+func TestVariablesAcrossRequests(t *testing.T) {
+	r := NewReplay()
+	sess, err := session.NewStore(time.Minute).Acquire("test-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetSession(sess)
+	toolset := []tools.Tool{{Name: "get_user"}}
+
+	// request 1: the script yields the tool call to the benchmark
+	r.AddScript(Script{Code: `var user = get_user({id: 1}); __setResult(user)`, ToolID: "call_1"})
+	res := r.ExecutionReplay(toolset)
+	if res.Record == nil || res.Record.ToolName != "get_user" {
+		t.Fatalf("expected get_user call, got %+v", res)
+	}
+
+	// request 2: the benchmark responds, the script completes
+	r.AddResponse(CallRecord{ToolName: "get_user", Result: `{"name":"ada"}`})
+	res = r.ExecutionReplay(toolset)
+	if res.Output != `{"name":"ada"}` || res.ToolID != "call_1" {
+		t.Fatalf("expected first script to complete, got %+v", res)
+	}
+
+	// request 3: a new script uses the variable of the first one
+	r.AddScript(Script{Code: `__setResult(user.name + "!")`, ToolID: "call_2"})
+	res = r.ExecutionReplay(toolset)
+	if res.Error != nil || res.Output != `"ada!"` || res.ToolID != "call_2" {
+		t.Fatalf("expected variable of the previous request to be visible, got %+v", res)
+	}
+
+	sess.Lock()
+	globals := sess.Runtime.Globals()
+	sess.Unlock()
+	if user, ok := globals["user"].(map[string]any); !ok || user["name"] != "ada" {
+		t.Fatalf("expected the session to hold the variables of the replay, got %v", globals)
+	}
+}
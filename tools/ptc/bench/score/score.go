@@ -0,0 +1,280 @@
+package score
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// ToolCall is a benchmark tool call, as generated by an adapter or given as gold answer
+type ToolCall struct {
+	Name      string         `json:"name"`
+	Arguments map[string]any `json:"arguments"`
+	Label     string         `json:"label,omitempty"` // NESTFUL output label, e.g. $var_1
+}
+
+// ScoreResult is the outcome of comparing predicted tool calls to the gold tool calls
+type ScoreResult struct {
+	Match   bool     `json:"match"`            // the predicted calls are fully correct
+	Matched int      `json:"matched"`          // number of gold calls matched by a predicted call
+	Total   int      `json:"total"`            // number of gold calls
+	Score   float64  `json:"score"`            // Matched / Total, or 1 if there are no gold calls and no predictions
+	Errors  []string `json:"errors,omitempty"` // reasons for mismatches
+}
+
+// Scorer scores predicted tool calls against gold tool calls
+type Scorer interface {
+	Score(predicted, gold []ToolCall) (ScoreResult, error)
+}
+
+func newResult(matched, total int, predicted int, errs []string) ScoreResult {
+	res := ScoreResult{Matched: matched, Total: total, Errors: errs}
+	switch {
+	case total > 0:
+		res.Score = float64(matched) / float64(total)
+	case predicted == 0:
+		res.Score = 1
+	}
+	res.Match = matched == total && predicted == total
+	return res
+}
+
+// normalize round trips v through JSON, so that numbers compare as float64 regardless of their Go type
+func normalize(v any) (any, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal value; %w", err)
+	}
+	var res any
+	if err := json.Unmarshal(b, &res); err != nil {
+		return nil, fmt.Errorf("could not unmarshal value; %w", err)
+	}
+	return res, nil
+}
+
+// Nestful scores NESTFUL sequences, i.e. the calls must match the gold calls in order by name and arguments.
+// Variable references, e.g. "$var_2.result$", are compared by the position of the call they refer to, so the
+// labels used by the prediction do not need to match the gold labels.
+type Nestful struct{}
+
+var varRef = regexp.MustCompile(`^\$(var_?\d+)\.(.+)\$$`)
+
+func (Nestful) Score(predicted, gold []ToolCall) (ScoreResult, error) {
+	predictedArgs, err := positionalArgs(predicted)
+	if err != nil {
+		return ScoreResult{}, err
+	}
+	goldArgs, err := positionalArgs(gold)
+	if err != nil {
+		return ScoreResult{}, err
+	}
+
+	var matched int
+	var errs []string
+	for i, g := range gold {
+		if i >= len(predicted) {
+			errs = append(errs, fmt.Sprintf("call %d: missing %s", i+1, g.Name))
+			continue
+		}
+		p := predicted[i]
+		if p.Name != g.Name {
+			errs = append(errs, fmt.Sprintf("call %d: expected %s, got %s", i+1, g.Name, p.Name))
+			continue
+		}
+		if !reflect.DeepEqual(predictedArgs[i], goldArgs[i]) {
+			errs = append(errs, fmt.Sprintf("call %d: arguments of %s differ", i+1, g.Name))
+			continue
+		}
+		matched++
+	}
+	if len(predicted) > len(gold) {
+		errs = append(errs, fmt.Sprintf("%d unexpected calls", len(predicted)-len(gold)))
+	}
+	return newResult(matched, len(gold), len(predicted), errs), nil
+}
+
+// positionalArgs normalizes the arguments of each call and rewrites variable references to the position of the
+// referenced call, e.g. "$var_7.result$" referring to the second call becomes "$#2.result$"
+func positionalArgs(calls []ToolCall) ([]any, error) {
+	positions := map[string]int{}
+	for i, c := range calls {
+		if c.Label != "" {
+			positions[strings.TrimPrefix(c.Label, "$")] = i + 1
+		}
+	}
+	res := make([]any, len(calls))
+	for i, c := range calls {
+		args, err := normalize(c.Arguments)
+		if err != nil {
+			return nil, err
+		}
+		if args == nil {
+			args = map[string]any{}
+		}
+		res[i] = rewriteRefs(args, positions)
+	}
+	return res, nil
+}
+
+func rewriteRefs(v any, positions map[string]int) any {
+	switch t := v.(type) {
+	case map[string]any:
+		for k, val := range t {
+			t[k] = rewriteRefs(val, positions)
+		}
+		return t
+	case []any:
+		for i, val := range t {
+			t[i] = rewriteRefs(val, positions)
+		}
+		return t
+	case string:
+		m := varRef.FindStringSubmatch(t)
+		if m == nil {
+			return t
+		}
+		if pos, ok := positions[m[1]]; ok {
+			return fmt.Sprintf("$#%d.%s$", pos, m[2])
+		}
+		return t
+	default:
+		return v
+	}
+}
+
+// BFCL scores like the BFCL AST checker. Each gold argument holds a list of accepted values, where an empty string
+// marks the argument as optional. The predicted calls must match the gold calls one to one, in any order, and
+// strings are compared case-insensitively, ignoring spaces and punctuation.
+type BFCL struct{}
+
+func (BFCL) Score(predicted, gold []ToolCall) (ScoreResult, error) {
+	used := make([]bool, len(predicted))
+	var matched int
+	var errs []string
+	for _, g := range gold {
+		found := false
+		var reason string
+		for i, p := range predicted {
+			if used[i] || p.Name != g.Name {
+				continue
+			}
+			ok, why, err := bfclMatch(p, g)
+			if err != nil {
+				return ScoreResult{}, err
+			}
+			if ok {
+				used[i] = true
+				found = true
+				break
+			}
+			reason = why
+		}
+		if found {
+			matched++
+			continue
+		}
+		if reason == "" {
+			reason = "no call"
+		}
+		errs = append(errs, fmt.Sprintf("%s: %s", g.Name, reason))
+	}
+	if len(predicted) > len(gold) {
+		errs = append(errs, fmt.Sprintf("%d unexpected calls", len(predicted)-len(gold)))
+	}
+	return newResult(matched, len(gold), len(predicted), errs), nil
+}
+
+func bfclMatch(predicted, gold ToolCall) (bool, string, error) {
+	args, err := normalize(predicted.Arguments)
+	if err != nil {
+		return false, "", err
+	}
+	pargs, _ := args.(map[string]any)
+
+	for name := range pargs {
+		if _, ok := gold.Arguments[name]; !ok {
+			return false, fmt.Sprintf("unexpected argument %s", name), nil
+		}
+	}
+	for name, accepted := range gold.Arguments {
+		acc, err := normalize(accepted)
+		if err != nil {
+			return false, "", err
+		}
+		options, isList := acc.([]any)
+		if !isList {
+			options = []any{acc}
+		}
+
+		value, ok := pargs[name]
+		if !ok {
+			if containsEmpty(options) {
+				continue
+			}
+			return false, fmt.Sprintf("missing argument %s", name), nil
+		}
+		if !acceptedValue(value, options) {
+			return false, fmt.Sprintf("invalid value for argument %s", name), nil
+		}
+	}
+	return true, "", nil
+}
+
+func containsEmpty(options []any) bool {
+	for _, o := range options {
+		if o == "" {
+			return true
+		}
+	}
+	return false
+}
+
+func acceptedValue(value any, options []any) bool {
+	for _, o := range options {
+		if equalValue(value, o) {
+			return true
+		}
+	}
+	return false
+}
+
+var punctuation = regexp.MustCompile(`[\s,./\-_*^]`)
+
+func equalValue(a, b any) bool {
+	switch at := a.(type) {
+	case string:
+		bt, ok := b.(string)
+		return ok && punctuation.ReplaceAllString(strings.ToLower(at), "") == punctuation.ReplaceAllString(strings.ToLower(bt), "")
+	case []any:
+		bt, ok := b.([]any)
+		if !ok || len(at) != len(bt) {
+			return false
+		}
+		for i := range at {
+			if !equalValue(at[i], bt[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]any:
+		bt, ok := b.(map[string]any)
+		if !ok || len(at) != len(bt) {
+			return false
+		}
+		for k, v := range at {
+			// nested values are lists of accepted values in BFCL gold answers
+			options, isList := bt[k].([]any)
+			if !isList {
+				options = []any{bt[k]}
+			}
+			if !acceptedValue(v, options) {
+				return false
+			}
+		}
+		return true
+	default:
+		return reflect.DeepEqual(a, b)
+	}
+}
@@ -0,0 +1,135 @@
+package score_test
+
+import (
+	"testing"
+
+	"github.com/modfin/bellman/tools/ptc/bench/score"
+)
+
+func TestNestful(t *testing.T) {
+	gold := []score.ToolCall{
+		{Name: "get_user", Arguments: map[string]any{"id": 7}, Label: "$var_1"},
+		{Name: "get_orders", Arguments: map[string]any{"user": "$var_1.name$", "limit": 5}, Label: "$var_2"},
+	}
+
+	tests := []struct {
+		name      string
+		predicted []score.ToolCall
+		match     bool
+		matched   int
+	}{
+		{
+			name: "identical",
+			predicted: []score.ToolCall{
+				{Name: "get_user", Arguments: map[string]any{"id": 7.0}, Label: "$var_1"},
+				{Name: "get_orders", Arguments: map[string]any{"user": "$var_1.name$", "limit": 5.0}, Label: "$var_2"},
+			},
+			match:   true,
+			matched: 2,
+		},
+		{
+			name: "other labels referring to the same call",
+			predicted: []score.ToolCall{
+				{Name: "get_user", Arguments: map[string]any{"id": 7}, Label: "$var_5"},
+				{Name: "get_orders", Arguments: map[string]any{"user": "$var_5.name$", "limit": 5}, Label: "$var_6"},
+			},
+			match:   true,
+			matched: 2,
+		},
+		{
+			name: "wrong reference",
+			predicted: []score.ToolCall{
+				{Name: "get_user", Arguments: map[string]any{"id": 7}, Label: "$var_1"},
+				{Name: "get_orders", Arguments: map[string]any{"user": "$var_1.id$", "limit": 5}, Label: "$var_2"},
+			},
+			matched: 1,
+		},
+		{
+			name: "extra call",
+			predicted: []score.ToolCall{
+				{Name: "get_user", Arguments: map[string]any{"id": 7}, Label: "$var_1"},
+				{Name: "get_orders", Arguments: map[string]any{"user": "$var_1.name$", "limit": 5}, Label: "$var_2"},
+				{Name: "get_user", Arguments: map[string]any{"id": 8}, Label: "$var_3"},
+			},
+			matched: 2,
+		},
+		{
+			name:      "missing calls",
+			predicted: []score.ToolCall{{Name: "get_user", Arguments: map[string]any{"id": 7}, Label: "$var_1"}},
+			matched:   1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := score.Nestful{}.Score(tt.predicted, gold)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Match != tt.match || res.Matched != tt.matched || res.Total != 2 {
+				t.Fatalf("unexpected result %+v", res)
+			}
+		})
+	}
+}
+
+func TestBFCL(t *testing.T) {
+	gold := []score.ToolCall{
+		{Name: "weather", Arguments: map[string]any{"city": []any{"New York", "NYC"}, "unit": []any{"celsius", ""}}},
+		{Name: "weather", Arguments: map[string]any{"city": []any{"Boston"}, "unit": []any{"celsius", ""}}},
+	}
+
+	tests := []struct {
+		name      string
+		predicted []score.ToolCall
+		match     bool
+		matched   int
+	}{
+		{
+			name: "parallel calls in any order",
+			predicted: []score.ToolCall{
+				{Name: "weather", Arguments: map[string]any{"city": "boston"}},
+				{Name: "weather", Arguments: map[string]any{"city": "new york", "unit": "Celsius"}},
+			},
+			match:   true,
+			matched: 2,
+		},
+		{
+			name: "invalid value",
+			predicted: []score.ToolCall{
+				{Name: "weather", Arguments: map[string]any{"city": "NYC", "unit": "kelvin"}},
+				{Name: "weather", Arguments: map[string]any{"city": "Boston"}},
+			},
+			matched: 1,
+		},
+		{
+			name: "unexpected argument",
+			predicted: []score.ToolCall{
+				{Name: "weather", Arguments: map[string]any{"city": "NYC", "days": 3}},
+				{Name: "weather", Arguments: map[string]any{"city": "Boston"}},
+			},
+			matched: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := score.BFCL{}.Score(tt.predicted, gold)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Match != tt.match || res.Matched != tt.matched {
+				t.Fatalf("unexpected result %+v", res)
+			}
+		})
+	}
+
+	res, _ := score.BFCL{}.Score(nil, []score.ToolCall{{Name: "sum", Arguments: map[string]any{"values": []any{[]any{1, 2}}}}})
+	if res.Match || len(res.Errors) != 1 {
+		t.Fatalf("expected missing call to fail, got %+v", res)
+	}
+	res, _ = score.BFCL{}.Score([]score.ToolCall{{Name: "sum", Arguments: map[string]any{"values": []any{1, 2.0}}}}, []score.ToolCall{{Name: "sum", Arguments: map[string]any{"values": []any{[]any{1, 2}}}}})
+	if !res.Match {
+		t.Fatalf("expected list argument to match, got %+v", res)
+	}
+}
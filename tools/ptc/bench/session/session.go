@@ -0,0 +1,184 @@
+package session
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/modfin/bellman/tools/ptc"
+	"github.com/modfin/bellman/tools/ptc/js"
+)
+
+// DefaultTTL is how long an unused session runtime is kept
+const DefaultTTL = 30 * time.Minute
+
+// Store keeps PTC runtimes keyed by session, see Key, so that JS variables persist across the requests of a
+// multi-turn evaluation. A session is evicted once it has not been used for the ttl.
+type Store struct {
+	ttl      time.Duration
+	mu       sync.Mutex
+	sessions map[string]*Session
+
+	now func() time.Time
+}
+
+// Session is a runtime kept by a Store. Hold the lock while binding tools and executing code, or replacing the
+// runtime, since requests of the same session may arrive concurrently.
+type Session struct {
+	Runtime *js.JavaScript
+	mu      sync.Mutex
+	used    time.Time
+}
+
+func (s *Session) Lock() {
+	s.mu.Lock()
+}
+
+func (s *Session) Unlock() {
+	s.mu.Unlock()
+}
+
+func NewStore(ttl time.Duration) *Store {
+	return &Store{
+		ttl:      ttl,
+		sessions: make(map[string]*Session),
+		now:      time.Now,
+	}
+}
+
+// Key returns the session key of a benchmark request, i.e. the first non-empty id, e.g. a test or trace id, or else a
+// hash of the first user message of the conversation, which all requests of a multi-turn test case share. The key is
+// empty if there is neither
+func Key(firstMessage string, ids ...string) string {
+	for _, id := range ids {
+		if id != "" {
+			return id
+		}
+	}
+	if firstMessage == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(firstMessage))
+	return "message-" + hex.EncodeToString(sum[:8])
+}
+
+// Acquire returns the session of the key, creating it with a fresh runtime if missing, and extends its ttl
+func (s *Store) Acquire(key string) (*Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.evictExpired()
+
+	if sess, ok := s.sessions[key]; ok {
+		sess.used = s.now()
+		return sess, nil
+	}
+
+	runtime, err := js.NewRuntime(ptc.ToolName)
+	if err != nil {
+		return nil, fmt.Errorf("could not create runtime; %w", err)
+	}
+	sess := &Session{Runtime: runtime, used: s.now()}
+	s.sessions[key] = sess
+	return sess, nil
+}
+
+// Get returns the session of the key, if any, without extending its ttl
+func (s *Store) Get(key string) (*Session, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.evictExpired()
+	sess, ok := s.sessions[key]
+	return sess, ok
+}
+
+// evictExpired removes the sessions not used for the ttl, the store lock must be held
+func (s *Store) evictExpired() {
+	for key, sess := range s.sessions {
+		if s.now().Sub(sess.used) >= s.ttl {
+			delete(s.sessions, key)
+		}
+	}
+}
+
+// Reset drops the session of the key, or all sessions if the key is empty, and returns the number dropped
+func (s *Store) Reset(key string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var dropped int
+	for k := range s.sessions {
+		if key != "" && k != key {
+			continue
+		}
+		delete(s.sessions, k)
+		dropped++
+	}
+	return dropped
+}
+
+// Len returns the number of live sessions
+func (s *Store) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.evictExpired()
+	return len(s.sessions)
+}
+
+// HandleGlobals returns the top-level JS variables of the runtime of a session, e.g. a trace or BFCL and CFB test id,
+// GET /ptc/debug/globals?trace_id=...
+func (s *Store) HandleGlobals(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	traceID := r.URL.Query().Get("trace_id")
+	if traceID == "" {
+		writeError(w, fmt.Errorf("trace_id is required"), http.StatusBadRequest)
+		return
+	}
+	sess, ok := s.Get(traceID)
+	if !ok {
+		writeError(w, fmt.Errorf("no session for trace_id %s", traceID), http.StatusNotFound)
+		return
+	}
+
+	sess.Lock()
+	globals := sess.Runtime.Globals()
+	sess.Unlock()
+
+	// the functions object only holds the bound tool interceptors
+	delete(globals, "functions")
+	res := make(map[string]json.RawMessage, len(globals))
+	for k, v := range globals {
+		b, err := json.Marshal(v)
+		if err != nil {
+			b, _ = json.Marshal(fmt.Sprintf("unserializable value: %v", err))
+		}
+		res[k] = b
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"trace_id": traceID, "globals": res})
+}
+
+// HandleReset drops the runtime of a trace, or all runtimes if no trace id is given, POST /ptc/debug/reset?trace_id=...
+func (s *Store) HandleReset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	traceID := r.URL.Query().Get("trace_id")
+	writeJSON(w, http.StatusOK, map[string]any{"trace_id": traceID, "reset": s.Reset(traceID)})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, err error, status int) {
+	writeJSON(w, status, map[string]any{"error": err.Error()})
+}
@@ -0,0 +1,71 @@
+package session_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/modfin/bellman/tools/ptc/bench/session"
+)
+
+func TestStore(t *testing.T) {
+	store := session.NewStore(time.Minute)
+
+	for i, code := range []string{`var count = 1; __setResult(count)`, `count = count + 1; __setResult(count)`} {
+		sess, err := store.Acquire("trace-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sess.Lock()
+		res, resErr, err := sess.Runtime.Execute(context.Background(), code)
+		sess.Unlock()
+		if err != nil || resErr != nil {
+			t.Fatalf("request %d failed: %v, %v", i+1, err, resErr)
+		}
+		if res != []string{"1", "2"}[i] {
+			t.Fatalf("expected variable of the previous request to be visible in request %d, got %s", i+1, res)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	store.HandleGlobals(rec, httptest.NewRequest(http.MethodGet, "/ptc/debug/globals?trace_id=trace-1", nil))
+	var res struct {
+		Globals map[string]json.RawMessage `json:"globals"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Globals) != 1 || string(res.Globals["count"]) != "2" {
+		t.Fatalf("unexpected globals %v", res.Globals)
+	}
+
+	rec = httptest.NewRecorder()
+	store.HandleReset(rec, httptest.NewRequest(http.MethodPost, "/ptc/debug/reset?trace_id=trace-1", nil))
+	if store.Len() != 0 {
+		t.Fatalf("expected session to be dropped, got %d sessions", store.Len())
+	}
+	rec = httptest.NewRecorder()
+	store.HandleGlobals(rec, httptest.NewRequest(http.MethodGet, "/ptc/debug/globals?trace_id=trace-1", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected not found, got %d", rec.Code)
+	}
+}
+
+func TestKey(t *testing.T) {
+	if key := session.Key("What is the weather?", "", "trace-1"); key != "trace-1" {
+		t.Fatalf("expected the first non-empty id, got %s", key)
+	}
+	key := session.Key("What is the weather?")
+	if key == "" || key != session.Key("What is the weather?") {
+		t.Fatalf("expected a stable key of the first message, got %s", key)
+	}
+	if key == session.Key("What is the time?") {
+		t.Fatal("expected different first messages to have different keys")
+	}
+	if key := session.Key(""); key != "" {
+		t.Fatalf("expected no key, got %s", key)
+	}
+}
@@ -0,0 +1,31 @@
+package session
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStoreTTL(t *testing.T) {
+	store := NewStore(20 * time.Millisecond)
+	now := time.Unix(0, 0)
+	store.now = func() time.Time { return now }
+
+	if _, err := store.Acquire("trace-1"); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(15 * time.Millisecond)
+	if _, err := store.Acquire("trace-1"); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(15 * time.Millisecond)
+	if _, ok := store.Get("trace-1"); !ok {
+		t.Fatal("expected used session to be kept")
+	}
+	now = now.Add(20 * time.Millisecond)
+	if _, ok := store.Get("trace-1"); ok {
+		t.Fatal("expected unused session to be evicted")
+	}
+	if store.Len() != 0 {
+		t.Fatalf("expected no sessions, got %d", store.Len())
+	}
+}
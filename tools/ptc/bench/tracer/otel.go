@@ -15,6 +15,7 @@ import (
 	"github.com/joho/godotenv"
 	"github.com/modfin/bellman/models/gen"
 	"github.com/modfin/bellman/prompt"
+	"github.com/modfin/bellman/tools/ptc/bench/utils"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
@@ -175,7 +176,7 @@ func (t *Tracer) TraceExec(p prompt.Prompt) {
 	switch p.Role {
 	case prompt.ToolCallRole:
 		// Immediately open a Tool Span!
-		execSpan.Context, execSpan.Span = t.Tracer.Start(t.ToolSpans[p.ToolCall.ToolCallID].Context, fmt.Sprintf("execute_tool %s", p.ToolCall.Name))
+		execSpan.Context, execSpan.Span = t.Tracer.Start(t.ToolSpans[utils.ParentCallID(p.ToolCall.ToolCallID)].Context, fmt.Sprintf("execute_tool %s", p.ToolCall.Name))
 		execSpan.SetAttributes(
 			attribute.String("gen_ai.operation.name", "execute_tool"),
 			attribute.String("gen_ai.tool.name", p.ToolCall.Name),
@@ -229,7 +230,7 @@ func (t *Tracer) NewTrace(req TracerRequest) {
 	t.ToolString = string(toolsBytes)
 
 	// add model
-	model, err := gen.ToModel(req.Model)
+	model, err := gen.ParseFQN(req.Model, gen.Lenient()...)
 	if err == nil {
 		t.Model = model
 	}
@@ -0,0 +1,143 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/modfin/bellman"
+	"github.com/modfin/bellman/metrics"
+)
+
+var (
+	suitesMu sync.Mutex
+	suites   = map[string]*metrics.Counters{}
+)
+
+// Suite returns the totals of a benchmark suite, e.g. "bfcl", logged per request and exported by MetricsHandler.
+// They implement metrics.Metrics, i.e. pass them to the bellman client of the suite with bellman.WithMetrics
+func Suite(name string) *metrics.Counters {
+	suitesMu.Lock()
+	defer suitesMu.Unlock()
+	c, ok := suites[name]
+	if !ok {
+		c = &metrics.Counters{}
+		suites[name] = c
+	}
+	return c
+}
+
+var (
+	requests = newFamily("bench_requests_total", "counter", "Requests by endpoint and response status")
+	latency  = newFamily("bench_request_duration_seconds", "summary", "Duration of requests by endpoint")
+	inFlight = newFamily("bench_in_flight_requests", "gauge", "Requests being handled by endpoint")
+
+	upstreamErrors     = newFamily("bench_upstream_errors_total", "counter", "Errors of bellman requests by endpoint and class, i.e. the upstream status class or other")
+	extractionFailures = newFamily("bench_ptc_extraction_failures_total", "counter", "Code executions whose tool calls could not be extracted, by endpoint")
+)
+
+// MetricsHandler serves the metrics of the bench server in the Prometheus text exposition format
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		for _, f := range []*family{requests, latency, inFlight, upstreamErrors, extractionFailures, suiteTokens()} {
+			f.write(w)
+		}
+	})
+}
+
+// Instrument counts the requests of an endpoint by status, and observes their latency and the requests in flight
+func Instrument(endpoint string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		inFlight.add("", 1, "endpoint", endpoint)
+		defer inFlight.add("", -1, "endpoint", endpoint)
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h(rec, r)
+		requests.add("", 1, "endpoint", endpoint, "status", strconv.Itoa(rec.status))
+		latency.add("_sum", time.Since(start).Seconds(), "endpoint", endpoint)
+		latency.add("_count", 1, "endpoint", endpoint)
+	}
+}
+
+// UpstreamError counts a failed bellman request of an endpoint by its status class, see bellman.ErrorClass
+func UpstreamError(endpoint string, err error) {
+	upstreamErrors.add("", 1, "class", bellman.ErrorClass(err), "endpoint", endpoint)
+}
+
+// ExtractionFailure counts a code execution of an endpoint whose tool calls could not be extracted
+func ExtractionFailure(endpoint string) {
+	extractionFailures.add("", 1, "endpoint", endpoint)
+}
+
+// suiteTokens returns the token totals of the suites by kind
+func suiteTokens() *family {
+	f := newFamily("bench_tokens_total", "counter", "Tokens of all requests by suite and kind, i.e. input, output or thinking")
+	suitesMu.Lock()
+	defer suitesMu.Unlock()
+	for name, c := range suites {
+		for _, kind := range []string{metrics.TokensInput, metrics.TokensOutput, metrics.TokensThinking} {
+			f.add("", float64(c.Tokens(kind)), "kind", kind, "suite", name)
+		}
+	}
+	return f
+}
+
+// family is a metric of the exposition format with its samples, keyed by the sample name suffix and labels
+type family struct {
+	name string
+	typ  string
+	help string
+
+	mu      sync.Mutex
+	samples map[string]float64
+}
+
+func newFamily(name string, typ string, help string) *family {
+	return &family{name: name, typ: typ, help: help, samples: map[string]float64{}}
+}
+
+// add adds v to the sample of the suffix, e.g. "_count" of a summary, and the labels, given as name value pairs
+// sorted by name
+func (f *family) add(suffix string, v float64, labels ...string) {
+	var pairs []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+"="+strconv.Quote(labels[i+1]))
+	}
+	key := f.name + suffix + "{" + strings.Join(pairs, ",") + "}"
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.samples[key] += v
+}
+
+func (f *family) write(w io.Writer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.typ)
+	keys := make([]string, 0, len(f.samples))
+	for k := range f.samples {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		_, _ = fmt.Fprintf(w, "%s %s\n", k, strconv.FormatFloat(f.samples[k], 'g', -1, 64))
+	}
+}
+
+// statusRecorder records the status written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
@@ -0,0 +1,107 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/modfin/bellman"
+	"github.com/modfin/bellman/models/gen"
+)
+
+// TraceHeader carries the trace id of a benchmark request, the same header the bellman client sends
+const TraceHeader = bellman.TraceHeader
+
+// DefaultBodyLimit is the default maximum size of a benchmark request body
+const DefaultBodyLimit int64 = 20 << 20
+
+// BodyLimit is the maximum size of a benchmark request body used by DecodeRequest. Raise it if large tool lists
+// are rejected.
+var BodyLimit = DefaultBodyLimit
+
+// DecodeRequest decodes the JSON request body into v, rejecting unknown fields and bodies larger than BodyLimit.
+// On failure the error response is written, 413 for a too large body and 400 otherwise, and the error returned.
+func DecodeRequest(w http.ResponseWriter, r *http.Request, v any) error {
+	return decodeRequest(w, r, v, true)
+}
+
+// DecodeRequestLenient works like DecodeRequest, but ignores unknown fields, for harnesses that send extra keys, e.g.
+// BFCL
+func DecodeRequestLenient(w http.ResponseWriter, r *http.Request, v any) error {
+	return decodeRequest(w, r, v, false)
+}
+
+func decodeRequest(w http.ResponseWriter, r *http.Request, v any, disallowUnknown bool) error {
+	limit := BodyLimit
+	if limit <= 0 {
+		limit = DefaultBodyLimit
+	}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, limit))
+	if disallowUnknown {
+		dec.DisallowUnknownFields()
+	}
+
+	err := dec.Decode(v)
+	if err == nil {
+		if _, err = dec.Token(); err == io.EOF {
+			return nil
+		}
+		if err == nil {
+			err = errors.New("unexpected data after the json body")
+		}
+	}
+
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		err = fmt.Errorf("request body exceeds %d bytes", maxBytesErr.Limit)
+		writeError(w, err, http.StatusRequestEntityTooLarge)
+		return err
+	}
+	err = fmt.Errorf("invalid json: %w", err)
+	writeError(w, err, http.StatusBadRequest)
+	return err
+}
+
+// TraceID returns the trace id of the request header, or a new one if absent, and echoes it in the response header
+func TraceID(w http.ResponseWriter, r *http.Request) string {
+	traceID := r.Header.Get(TraceHeader)
+	if traceID == "" {
+		traceID = uuid.New().String()
+	}
+	w.Header().Set(TraceHeader, traceID)
+	return traceID
+}
+
+// ResolveModel validates the requested model against the models served by the proxy, see bellman.ValidateModel. On
+// an unknown model a 400 with the closest served models is written and false returned. If the models cannot be
+// listed, the fqn is used as is and a warning logged to logger.
+func ResolveModel(w http.ResponseWriter, client *bellman.Bellman, fqn string, logger *slog.Logger) (gen.Model, bool) {
+	model, suggestions, err := bellman.ValidateModel(client, fqn)
+	if err == nil {
+		return model, true
+	}
+	if errors.Is(err, bellman.ErrUnknownModel) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]any{"error": err.Error(), "suggestions": suggestions})
+		return gen.Model{}, false
+	}
+
+	model, parseErr := gen.ParseFQN(fqn, gen.Lenient()...)
+	if parseErr != nil {
+		writeError(w, parseErr, http.StatusBadRequest)
+		return gen.Model{}, false
+	}
+	logger.Warn("could not validate model", "model", fqn, "error", err)
+	return model, true
+}
+
+func writeError(w http.ResponseWriter, err error, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]any{"error": err.Error()})
+}
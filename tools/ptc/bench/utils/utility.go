@@ -3,17 +3,22 @@ package utils
 import (
 	"context"
 	"encoding/json"
-	"regexp"
+	"fmt"
+	"strconv"
+	"strings"
 
+	"github.com/modfin/bellman/models/gen"
+	"github.com/modfin/bellman/prompt"
 	"github.com/modfin/bellman/schema"
 	"github.com/modfin/bellman/tools"
+	"github.com/modfin/bellman/tools/ptc"
 )
 
-// Regex to find invalid characters (only letters, numbers, underscores, dashes allowed)
-var invalidNameChars = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
-
-func ParseJsonSchemaTools(rawTools []interface{}, enablePTC bool) []tools.Tool {
+// ParseJsonSchemaTools parses the benchmark tool definitions into tools with sanitized names, see
+// tools.SanitizeToolName, and returns the map of the sanitized to the original names
+func ParseJsonSchemaTools(rawTools []interface{}, enablePTC bool) ([]tools.Tool, tools.NameMap) {
 	var parsedTools []tools.Tool
+	names := tools.NameMap{}
 
 	for _, rt := range rawTools {
 		jsonBytes, _ := json.Marshal(rt)
@@ -39,8 +44,8 @@ func ParseJsonSchemaTools(rawTools []interface{}, enablePTC bool) []tools.Tool {
 			continue
 		}
 
-		// Some Toolman models rejects dots. "math.factorial" -> "math_factorial"
-		sanitizedName := invalidNameChars.ReplaceAllString(tDef.Name, "_") // TODO: check bench compatability
+		// Some Toolman models rejects dots. "math.factorial" -> "math_factorial", mapped back in the bench responses
+		sanitizedName := names.Sanitize(tDef.Name)
 
 		// convert raw JSON parameters to Toolman-compatible JSON schema
 		paramSchema := parseSchemaRawToJSON(tDef.Parameters)
@@ -62,7 +67,7 @@ func ParseJsonSchemaTools(rawTools []interface{}, enablePTC bool) []tools.Tool {
 		parsedTools = append(parsedTools, tool)
 	}
 
-	return parsedTools
+	return parsedTools, names
 }
 
 // parseSchemaRawToJSON converts raw JSON parameters to Toolman-compatible JSON schema
@@ -147,3 +152,127 @@ func normalizeBFCLSchema(s *schema.JSON, require bool) { // Replace *schema.JSON
 		normalizeBFCLSchema(s.Items, require)
 	}
 }
+
+// CallID derives the ID of the n:th tool call extracted from a code_execution call, e.g. "call_1#0"
+func CallID(parentID string, n int) string {
+	return fmt.Sprintf("%s#%d", parentID, n)
+}
+
+// ParentCallID returns the code_execution call ID of an extracted tool call ID, or the ID itself if not extracted
+func ParentCallID(id string) string {
+	i := strings.LastIndex(id, "#")
+	if i < 0 {
+		return id
+	}
+	if _, err := strconv.Atoi(id[i+1:]); err != nil {
+		return id
+	}
+	return id[:i]
+}
+
+// NewUsers returns a func to call for each user message of a benchmark request, in order, reporting whether the
+// message is new, i.e. not yet in the toolman history. The benchmarks resend the whole conversation, so the first user
+// messages of a request are those already in the history, however many new ones follow
+func NewUsers(history []prompt.Prompt) func() bool {
+	known := 0
+	for _, p := range history {
+		if p.Role == prompt.UserRole {
+			known++
+		}
+	}
+	return func() bool {
+		if known > 0 {
+			known--
+			return false
+		}
+		return true
+	}
+}
+
+// NewToolResponses returns a func to call for each tool call of a rebuilt conversation, in order, returning the next
+// response to the call ID not yet paired with an earlier call. The benchmarks reuse call IDs in long conversations, so
+// pairing each call with the first, or last, matching response would pair earlier calls with later responses. Responses
+// of extracted calls, see CallID, are matched by the ID of their code_execution call
+func NewToolResponses(responses []prompt.Prompt) func(callID string) (prompt.Prompt, bool) {
+	used := make([]bool, len(responses))
+	return func(callID string) (prompt.Prompt, bool) {
+		for j, r := range responses {
+			if used[j] || r.Role != prompt.ToolResponseRole || r.ToolResponse == nil {
+				continue
+			}
+			if r.ToolResponse.ToolCallID == callID || ParentCallID(r.ToolResponse.ToolCallID) == callID {
+				used[j] = true
+				return r, true
+			}
+		}
+		return prompt.Prompt{}, false
+	}
+}
+
+// AppendResponseConversation rebuilds the history with the response of every tool call right after the call. Responses
+// are taken, in order of priority, from the history, the new response, which is added once, and the tool responses of
+// the request messages. They are consumed in order, see NewToolResponses, and the messages, holding the whole
+// conversation, are consumed for every call whichever source its response is taken from. trace is called with every
+// response not taken from the history.
+func AppendResponseConversation(history []prompt.Prompt, messages []prompt.Prompt, response *prompt.Prompt, trace func(prompt.Prompt)) []prompt.Prompt {
+	nextMessage := NewToolResponses(messages)
+	nextHistory := NewToolResponses(history)
+	responded := false
+
+	var rebuilt []prompt.Prompt
+	for _, p := range history {
+		switch p.Role {
+		case prompt.ToolCallRole:
+			rebuilt = append(rebuilt, p)
+
+			message, inMessages := nextMessage(p.ToolCall.ToolCallID)
+			if h, ok := nextHistory(p.ToolCall.ToolCallID); ok {
+				rebuilt = append(rebuilt, h)
+				break
+			}
+			if !responded && response != nil && response.ToolResponse.ToolCallID == p.ToolCall.ToolCallID {
+				responded = true
+				trace(*response)
+				rebuilt = append(rebuilt, *response)
+				break
+			}
+			if inMessages {
+				trace(message)
+				rebuilt = append(rebuilt, message)
+			}
+		case prompt.UserRole, prompt.AssistantRole:
+			rebuilt = append(rebuilt, p)
+		}
+	}
+	return rebuilt
+}
+
+// ApplyToolChoice sets the tool config of the generator from a benchmark tool_choice value, i.e. "auto",
+// "required", "none" or the name of a tool. A named tool that has been moved into code_execution by PTC forces
+// code_execution instead. An empty choice leaves the generator unchanged.
+func ApplyToolChoice(g *gen.Generator, choice string) (*gen.Generator, error) {
+	choice = strings.TrimSpace(choice)
+	switch strings.ToLower(choice) {
+	case "":
+		return g, nil
+	case tools.AutoTool.Name:
+		return g.SetToolConfig(tools.AutoTool), nil
+	case tools.RequiredTool.Name, "any":
+		return g.SetToolConfig(tools.RequiredTool), nil
+	case tools.NoTool.Name:
+		return g.SetToolConfig(tools.NoTool), nil
+	}
+
+	name := tools.SanitizeToolName(choice)
+	for _, t := range g.Request.Tools {
+		if t.Name == name {
+			return g.SetToolConfig(tools.ToolChoice{Name: name}), nil
+		}
+	}
+	for _, t := range g.Request.PTCTools {
+		if t.Name == name {
+			return g.SetToolConfig(tools.ToolChoice{Name: ptc.ToolName}), nil
+		}
+	}
+	return g, fmt.Errorf("tool_choice %q is not a known tool", choice)
+}
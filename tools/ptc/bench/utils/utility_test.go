@@ -0,0 +1,272 @@
+package utils_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/modfin/bellman"
+	"github.com/modfin/bellman/metrics"
+	"github.com/modfin/bellman/models/gen"
+	"github.com/modfin/bellman/prompt"
+	"github.com/modfin/bellman/tools"
+	"github.com/modfin/bellman/tools/ptc"
+	"github.com/modfin/bellman/tools/ptc/bench/utils"
+)
+
+func TestParseJsonSchemaToolsEmpty(t *testing.T) {
+	parsed, _ := utils.ParseJsonSchemaTools([]interface{}{}, true)
+	if len(parsed) != 0 {
+		t.Fatalf("expected no tools, got %d", len(parsed))
+	}
+
+	// tools without names are skipped, leaving nothing to parse
+	parsed, _ = utils.ParseJsonSchemaTools([]interface{}{map[string]any{"description": "nameless"}}, false)
+	if len(parsed) != 0 {
+		t.Fatalf("expected nameless tools to be skipped, got %d", len(parsed))
+	}
+}
+
+func TestDecodeRequest(t *testing.T) {
+	type request struct {
+		Query string `json:"query"`
+	}
+	defer func(limit int64) { utils.BodyLimit = limit }(utils.BodyLimit)
+	utils.BodyLimit = 32
+
+	tests := []struct {
+		name    string
+		body    string
+		lenient bool
+		status  int
+	}{
+		{name: "valid", body: `{"query":"hi"}`, status: http.StatusOK},
+		{name: "unknown field", body: `{"query":"hi","extra":1}`, status: http.StatusBadRequest},
+		{name: "lenient unknown field", body: `{"query":"hi","extra":1}`, lenient: true, status: http.StatusOK},
+		{name: "malformed", body: `{"query":`, status: http.StatusBadRequest},
+		{name: "trailing data", body: `{"query":"hi"}{}`, status: http.StatusBadRequest},
+		{name: "too large", body: `{"query":"` + strings.Repeat("a", 64) + `"}`, status: http.StatusRequestEntityTooLarge},
+		{name: "lenient too large", body: `{"query":"` + strings.Repeat("a", 64) + `"}`, lenient: true, status: http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decode := utils.DecodeRequest
+			if tt.lenient {
+				decode = utils.DecodeRequestLenient
+			}
+			rec := httptest.NewRecorder()
+			var req request
+			err := decode(rec, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body)), &req)
+			if (err == nil) != (tt.status == http.StatusOK) || rec.Code != tt.status {
+				t.Fatalf("expected status %d, got %d, err %v", tt.status, rec.Code, err)
+			}
+			if err != nil && !strings.Contains(rec.Body.String(), `"error":`) {
+				t.Fatalf("expected a json error, got %s", rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestTraceID(t *testing.T) {
+	rec := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.Header.Set(utils.TraceHeader, "cfb/q1/2")
+	if traceID := utils.TraceID(rec, r); traceID != "cfb/q1/2" || rec.Header().Get(utils.TraceHeader) != traceID {
+		t.Fatalf("expected the sent trace id to be used and echoed, got %q, %q", traceID, rec.Header().Get(utils.TraceHeader))
+	}
+
+	rec = httptest.NewRecorder()
+	traceID := utils.TraceID(rec, httptest.NewRequest(http.MethodPost, "/", nil))
+	if traceID == "" || rec.Header().Get(utils.TraceHeader) != traceID {
+		t.Fatalf("expected a generated trace id to be echoed, got %q, %q", traceID, rec.Header().Get(utils.TraceHeader))
+	}
+}
+
+func TestResolveModel(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`[{"provider":"OpenAI","name":"gpt-4o"}]`))
+	}))
+	defer srv.Close()
+	client := bellman.New(srv.URL, bellman.Key{Name: "test", Token: "test"})
+
+	rec := httptest.NewRecorder()
+	if model, ok := utils.ResolveModel(rec, client, "OpenAI/gpt-4o", slog.Default()); !ok || model.Name != "gpt-4o" {
+		t.Fatalf("expected the model to resolve, got %+v", model)
+	}
+	rec = httptest.NewRecorder()
+	if _, ok := utils.ResolveModel(rec, client, "OpenAI/gpt-4", slog.Default()); ok || rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), `"suggestions":["OpenAI/gpt-4o"]`) {
+		t.Fatalf("expected a bad request with suggestions, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	// models are used as is when the proxy cannot list them
+	rec = httptest.NewRecorder()
+	unlisted := bellman.New("http://127.0.0.1:0", bellman.Key{})
+	var logs bytes.Buffer
+	if model, ok := utils.ResolveModel(rec, unlisted, "OpenAI/gpt-4o", slog.New(slog.NewTextHandler(&logs, nil))); !ok || model.Provider != "OpenAI" {
+		t.Fatalf("expected a fallback to the fqn, got %+v", model)
+	}
+	if !strings.Contains(logs.String(), "level=WARN") || !strings.Contains(logs.String(), "model=OpenAI/gpt-4o") {
+		t.Fatalf("expected the fallback to be logged, got %q", logs.String())
+	}
+}
+
+func TestApplyToolChoice(t *testing.T) {
+	raw := []interface{}{
+		map[string]any{"name": "math.factorial", "parameters": map[string]any{"type": "dict", "properties": map[string]any{}}},
+	}
+	regularTools, _ := utils.ParseJsonSchemaTools(raw, false)
+	ptcTools, _ := utils.ParseJsonSchemaTools(raw, true)
+	regular := (&gen.Generator{}).SetTools(regularTools...)
+	withPTC, err := (&gen.Generator{}).SetTools(ptcTools...).ActivatePTC(ptc.JavaScript)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		g        *gen.Generator
+		choice   string
+		expected *tools.ToolChoice
+	}{
+		{name: "empty", g: regular, choice: "", expected: nil},
+		{name: "auto", g: regular, choice: "auto", expected: &tools.AutoTool},
+		{name: "required", g: regular, choice: "Required", expected: &tools.RequiredTool},
+		{name: "none", g: regular, choice: "none", expected: &tools.NoTool},
+		{name: "named", g: regular, choice: "math.factorial", expected: &tools.ToolChoice{Name: "math_factorial"}},
+		{name: "named with ptc", g: withPTC, choice: "math.factorial", expected: &tools.ToolChoice{Name: ptc.ToolName}},
+		{name: "required with ptc", g: withPTC, choice: "required", expected: &tools.RequiredTool},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g, err := utils.ApplyToolChoice(tt.g, tt.choice)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(g.Request.ToolConfig, tt.expected) {
+				t.Fatalf("expected tool config %v, got %v", tt.expected, g.Request.ToolConfig)
+			}
+		})
+	}
+
+	if _, err := utils.ApplyToolChoice(regular, "unknown"); err == nil {
+		t.Fatal("expected error for unknown tool")
+	}
+}
+
+func TestNewUsers(t *testing.T) {
+	newUsers := func(history []prompt.Prompt, roles ...string) []bool {
+		isNewUser := utils.NewUsers(history)
+		var res []bool
+		for _, role := range roles {
+			if role == "user" {
+				res = append(res, isNewUser())
+			}
+		}
+		return res
+	}
+	history := []prompt.Prompt{prompt.AsUser("hi"), prompt.AsAssistant("hello"), prompt.AsUser("book a flight"), prompt.AsToolCall("1", "book", []byte(`{}`))}
+
+	// two new user messages after a miss turn
+	got := newUsers(history, "user", "assistant", "user", "tool", "user", "user")
+	if !reflect.DeepEqual(got, []bool{false, false, true, true}) {
+		t.Fatalf("expected the last two users to be new, got %v", got)
+	}
+
+	// all users already in the history
+	got = newUsers(history, "user", "assistant", "user")
+	if !reflect.DeepEqual(got, []bool{false, false}) {
+		t.Fatalf("expected no new users, got %v", got)
+	}
+
+	if got = newUsers(nil, "user"); !reflect.DeepEqual(got, []bool{true}) {
+		t.Fatalf("expected the first user of a new conversation to be new, got %v", got)
+	}
+}
+
+func TestNewToolResponses(t *testing.T) {
+	next := utils.NewToolResponses([]prompt.Prompt{
+		prompt.AsToolResponse("1", "ls", "first"),
+		prompt.AsUser("again"),
+		prompt.AsToolResponse("ptc_1#1", "ls", "extracted"),
+		prompt.AsToolResponse("1", "ls", "second"),
+	})
+	for _, e := range []struct{ id, response string }{{"1", "first"}, {"ptc_1", "extracted"}, {"1", "second"}} {
+		r, ok := next(e.id)
+		if !ok || r.ToolResponse.Response != e.response {
+			t.Fatalf("expected %s for call %s, got %+v", e.response, e.id, r.ToolResponse)
+		}
+	}
+	if r, ok := next("1"); ok {
+		t.Fatalf("expected the responses of call 1 to be consumed, got %+v", r.ToolResponse)
+	}
+}
+
+func TestAppendResponseConversation(t *testing.T) {
+	history := []prompt.Prompt{
+		prompt.AsUser("hi"),
+		prompt.AsToolCall("a", "ls", []byte(`{}`)),
+		prompt.AsToolResponse("a", "ls", "history"),
+		prompt.AsToolCall("b", "ls", []byte(`{}`)),
+		prompt.AsToolCall("c", "ls", []byte(`{}`)),
+		prompt.AsAssistant("done"),
+	}
+	messages := []prompt.Prompt{
+		prompt.AsToolResponse("a", "ls", "message a"),
+		prompt.AsToolResponse("b", "ls", "message b"),
+		prompt.AsToolResponse("c", "ls", "message c"),
+	}
+	response := prompt.AsToolResponse("b", "ls", "new")
+	var traced []string
+	rebuilt := utils.AppendResponseConversation(history, messages, &response, func(p prompt.Prompt) {
+		traced = append(traced, p.ToolResponse.Response)
+	})
+
+	var responses []string
+	for _, p := range rebuilt {
+		if p.Role == prompt.ToolResponseRole {
+			responses = append(responses, p.ToolResponse.Response)
+		}
+	}
+	// the history takes precedence over the response, which takes precedence over the messages
+	if len(rebuilt) != 8 || !reflect.DeepEqual(responses, []string{"history", "new", "message c"}) {
+		t.Fatalf("unexpected conversation %+v", rebuilt)
+	}
+	if !reflect.DeepEqual(traced, []string{"new", "message c"}) {
+		t.Fatalf("expected the responses not from the history to be traced, got %v", traced)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	h := utils.Instrument("test", func(w http.ResponseWriter, r *http.Request) {
+		utils.UpstreamError("test", fmt.Errorf("could not prompt; %w", &bellman.APIError{Status: http.StatusServiceUnavailable}))
+		utils.UpstreamError("test", errors.New("connection refused"))
+		utils.ExtractionFailure("test")
+		utils.Suite("test").AddTokens("model", metrics.TokensInput, 7)
+		w.WriteHeader(http.StatusTeapot)
+	})
+	h(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/test", nil))
+
+	rec := httptest.NewRecorder()
+	utils.MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+	for _, line := range []string{
+		`bench_requests_total{endpoint="test",status="418"} 1`,
+		`bench_request_duration_seconds_count{endpoint="test"} 1`,
+		`bench_in_flight_requests{endpoint="test"} 0`,
+		`bench_upstream_errors_total{class="5xx",endpoint="test"} 1`,
+		`bench_upstream_errors_total{class="other",endpoint="test"} 1`,
+		`bench_ptc_extraction_failures_total{endpoint="test"} 1`,
+		`bench_tokens_total{kind="input",suite="test"} 7`,
+		`bench_tokens_total{kind="output",suite="test"} 0`,
+	} {
+		if !strings.Contains(body, line) {
+			t.Fatalf("expected %s in the metrics, got\n%s", line, body)
+		}
+	}
+}
@@ -8,7 +8,7 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
-	"regexp"
+	"math"
 	"sort"
 	"strings"
 	"sync"
@@ -27,6 +27,19 @@ type JavaScript struct {
 	toolName string
 	output   *resultOutput
 	Log      *slog.Logger `json:"-"`
+
+	session *tools.CodeSession // of executions without a code session in the context, see tools.CodeSessionFromContext
+}
+
+// activeToolsKey is the context key of the names of the tools code may call, set by the tool of AdaptTools
+type activeToolsKey struct{}
+
+func activeTools(ctx context.Context) (map[string]bool, bool) {
+	if ctx == nil {
+		return nil, false
+	}
+	active, ok := ctx.Value(activeToolsKey{}).(map[string]bool)
+	return active, ok
 }
 
 type resultOutput struct {
@@ -38,6 +51,7 @@ type TemplateData struct {
 	PTCToolName    string
 	Signatures     []FunctionSignatureData
 	ReturnFunction string
+	ToolErrorKey   string
 }
 
 type FunctionSignatureData struct {
@@ -57,6 +71,7 @@ type TSNode struct {
 	Format      string
 	Min         string
 	Max         string
+	Default     string
 	Properties  []*TSNode // populated if Type == "object"
 	Items       *TSNode   // populated if Type == "array"
 	Indent      string
@@ -66,8 +81,9 @@ type TSNode struct {
 var templateFS embed.FS
 var parsedTemplates *template.Template
 
-const nilValue string = "null"          // nil in JS
-const returnFunc string = "__setResult" // define JS return value func
+const nilValue string = "null"               // nil in JS
+const returnFunc string = "__setResult"      // define JS return value func
+const toolErrorKey string = "__tool_error__" // reserved key of failed tool calls, results are returned untouched
 
 func init() {
 	var err error
@@ -82,6 +98,7 @@ func NewRuntime(toolName string) (*JavaScript, error) {
 		runtime:  goja.New(),
 		mu:       sync.Mutex{},
 		toolName: toolName,
+		session:  tools.NewCodeSession(0, false),
 	}
 	return javaScript.registerReturn()
 }
@@ -98,41 +115,77 @@ func (j *JavaScript) Runtime() *goja.Runtime {
 	return j.runtime
 }
 
-func (j *JavaScript) log(msg string, args ...any) {
-	if j.Log == nil {
+// log writes a debug log to the logger of the context, see tools.ContextWithLogger, or else to Log
+func (j *JavaScript) log(ctx context.Context, msg string, args ...any) {
+	logger := tools.LoggerFromContext(ctx)
+	if logger == nil {
+		logger = j.Log
+	}
+	if logger == nil {
 		return
 	}
-	j.Log.Debug("[bellman/javascript] "+msg, args...)
+	logger.Debug("[bellman/javascript] "+msg, args...)
 }
 
-// AdaptTools converts a list of Bellman tools into a single PTC tool with runtime execution environment
+// AdaptTools converts a list of Bellman tools into a single PTC tool with runtime execution environment. The tools
+// are bound in addition to the ones of previous calls, since the runtime may be shared, but code executed by the
+// returned tool can only call the given tools, calls of other bound tools return an error. Tools whose names escape to
+// the same function name, e.g. "a-b" and "a.b", return an error
 func (j *JavaScript) AdaptTools(tool ...tools.Tool) (tools.Tool, error) {
+	bound := map[string]string{}
+	for _, t := range tool {
+		escapedName := escapeFunctionName(t.Name)
+		if other, ok := bound[escapedName]; ok && other != t.Name {
+			return tools.Tool{}, fmt.Errorf("error adapting tools to ptc: tools %s and %s are both bound as %s", other, t.Name, escapedName)
+		}
+		bound[escapedName] = t.Name
+	}
+
+	active := map[string]bool{}
 	for _, t := range tool {
 		err := j.bindToolFunction(t)
 		if err != nil {
 			return tools.Tool{}, fmt.Errorf("error adapting tools to ptc: %w", err)
 		}
+		active[t.Name] = true
 	}
 
 	type CodeArgs struct {
 		Code string `json:"code" json-description:"The executable top-level JavaScript code string."`
 	}
 	executor := func(ctx context.Context, call tools.Call) (string, error) {
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		ctx = context.WithValue(ctx, activeToolsKey{}, active)
+
 		var arg CodeArgs
 		if err := json.Unmarshal(call.Argument, &arg); err != nil {
+			j.log(ctx, "error: invalid code_execution arguments", "error", err)
 			return "", err
 		}
+		j.log(ctx, "code received", "call_id", call.ID, "code", arg.Code)
+
+		// enforce execution budget, tell the LLM to answer instead
+		if session := j.sessionOf(ctx); !session.ReserveExecution() {
+			j.log(ctx, "execution budget exhausted", "limit", session.ExecutionLimit())
+			return fmt.Sprintf(`{"error": %q}`, fmt.Sprintf("%s budget exhausted (%d calls). Do not call %s again, answer the user in plain text using the data you already have.",
+				j.toolName, session.ExecutionLimit(), j.toolName)), nil
+		}
 
 		res, resErr, err := j.Execute(ctx, arg.Code)
 		if err != nil {
+			j.log(ctx, "error: code execution failed", "call_id", call.ID, "error", err)
 			return res, err
 		}
 
 		// return error string to LLM
 		if resErr != nil {
+			j.log(ctx, "code execution returned error", "call_id", call.ID, "error", resErr)
 			return fmt.Sprintf(`{"error": %q}`, resErr.Error()), err
 		}
 
+		j.log(ctx, "code execution result", "call_id", call.ID, "result", res)
 		return res, err
 	}
 
@@ -160,22 +213,33 @@ func (j *JavaScript) bindToolFunction(tool tools.Tool) error {
 		// go panic to goja exception recovery
 		defer func() {
 			if r := recover(); r != nil {
+				j.log(j.ctx, "error: tool panic", "tool", tool.Name, "panic", r)
 				panic(j.runtime.NewGoError(fmt.Errorf("critical native function panic: %v", r))) // native refers to Go!
 			}
 		}()
 
+		// tools bound by another AdaptTools call are not available to the executing code_execution tool
+		if active, ok := activeTools(j.ctx); ok && !active[tool.Name] {
+			j.log(j.ctx, "tool not available", "tool", tool.Name)
+			return j.runtime.ToValue(map[string]string{toolErrorKey: fmt.Sprintf("tool %s is not available", escapedName)})
+		}
+
 		// check if LLM passed multiple arguments (common mistake)
 		if len(call.Arguments) > 1 {
 			errMsg := fmt.Sprintf("Error: %s expects a single configuration object argument, but received %d arguments. Usage: %s({ key: val })",
 				escapedName, len(call.Arguments), escapedName)
-			return j.runtime.ToValue(map[string]string{"error": errMsg})
+			return j.runtime.ToValue(map[string]string{toolErrorKey: errMsg})
 		}
 
 		// extract runtime argument (expecting a single object)
 		if len(call.Arguments) == 0 {
 			return j.runtime.NewGoError(fmt.Errorf("tool %s requires arguments", escapedName))
 		}
-		jsArgs := call.Argument(0).Export()
+		jsArgs, err := normalizeArgument(call.Argument(0).Export(), tool.ArgumentSchema, tool.ArgumentSchema, "")
+		if err != nil {
+			errMsg := fmt.Sprintf("Error: invalid arguments for %s; %v", escapedName, err)
+			return j.runtime.ToValue(map[string]string{toolErrorKey: errMsg})
+		}
 
 		// marshal args to JSON for the Bellman tool
 		jsonArgs, err := json.Marshal(jsArgs)
@@ -183,19 +247,38 @@ func (j *JavaScript) bindToolFunction(tool tools.Tool) error {
 			return j.runtime.NewGoError(err)
 		}
 
-		// execute the actual go tool
-		ctx := j.ctx
-		if ctx == nil {
-			ctx = context.Background()
-		}
-		res, err := tool.Function(ctx, tools.Call{
-			Name:     tool.Name,
-			Argument: jsonArgs,
-		})
-		if err != nil {
-			// return error string directly so the LLM can self-correct, e.g., "json: cannot unmarshal number..."
-			return j.runtime.ToValue(map[string]any{"ok": false, "error": err.Error()})
+		// identical calls are answered from cache, if enabled. map keys are sorted by json.Marshal, i.e., canonical
+		dedupKey := tool.Name + "\x00" + string(jsonArgs)
+		session := j.sessionOf(j.ctx)
+		start := time.Now()
+		var duration time.Duration
+		res, cached := session.LookupCall(dedupKey)
+		if cached {
+			j.log(j.ctx, "deduplicated tool call", "tool", tool.Name)
+		} else {
+			j.log(j.ctx, "tool call", "tool", tool.Name, "args", string(jsonArgs))
+			// execute the actual go tool
+			ctx := j.ctx
+			if ctx == nil {
+				ctx = context.Background()
+			}
+			res, err = tool.Function(ctx, tools.Call{
+				Name:     tool.Name,
+				Argument: jsonArgs,
+			})
+			if err != nil {
+				j.log(j.ctx, "tool call failed", "tool", tool.Name, "error", err)
+				session.RecordCall(tools.Invocation{Name: tool.Name, Argument: string(jsonArgs), Duration: time.Since(start), Error: err.Error()})
+				// return error string directly so the LLM can self-correct, e.g., "json: cannot unmarshal number..."
+				return j.runtime.ToValue(map[string]string{toolErrorKey: err.Error()})
+			}
+			duration = time.Since(start)
+			j.log(j.ctx, "tool call result", "tool", tool.Name, "result", res)
+			session.StoreCall(dedupKey, res)
 		}
+		res = tools.ResultTransformFromContext(j.ctx).Transform(tool.Name, string(jsonArgs), res)
+		res = tools.TruncateResponse(res, tools.ResponseLimit(&tool, tools.MaxResponseBytesFromContext(j.ctx)))
+		session.RecordCall(tools.Invocation{Name: tool.Name, Argument: string(jsonArgs), Response: res, Duration: duration, Cached: cached})
 
 		// unmarshal result back to runtime object if possible
 		var parsed interface{}
@@ -220,7 +303,12 @@ func (j *JavaScript) bindToolFunction(tool tools.Tool) error {
 
 // Execute runs a code script in the runtime, uses same error handling as LLM (runtime errors return string!)
 func (j *JavaScript) Execute(ctx context.Context, code string) (resString string, resErr error, err error) {
-	code, resErr = j.Guardrail(code)
+	// get or sanitize context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	code, resErr = j.guardrail(ctx, code)
 	if resErr != nil {
 		return "", resErr, nil
 	}
@@ -229,17 +317,13 @@ func (j *JavaScript) Execute(ctx context.Context, code string) (resString string
 
 	j.output.set = false // reset output
 
-	// get or sanitize context
-	if ctx == nil {
-		ctx = context.Background()
-	}
-	j.ctx = ctx
-	defer func() { j.ctx = nil }()
+	// Math.random draws from the random source of the context, i.e. seeded if the run is, see tools.ContextWithRand
+	j.runtime.SetRandSource(tools.RandFromContext(ctx).Float64)
 
 	// panic recovery
 	defer func() {
 		if r := recover(); r != nil {
-			j.log("error: fatal runtime panic! recovering.", "panic", r)
+			j.log(ctx, "error: fatal runtime panic! recovering.", "panic", r)
 			resErr = fmt.Errorf("fatal runtime panic: %v", r)
 			err = nil
 		}
@@ -248,8 +332,10 @@ func (j *JavaScript) Execute(ctx context.Context, code string) (resString string
 	// timeout and context interrupt
 	ctx, cancel := context.WithTimeout(ctx, 3*time.Minute)
 	defer cancel()
+	j.ctx = ctx // tool wrappers get the timeout bound context, so in-flight tool calls are cancelled too
+	defer func() { j.ctx = nil }()
 	stop := context.AfterFunc(ctx, func() {
-		j.log("error: runtime interrupted", "error", ctx.Err())
+		j.log(ctx, "error: runtime interrupted", "error", ctx.Err())
 		j.runtime.Interrupt(fmt.Sprintf("execution interrupted: %v", ctx.Err()))
 	})
 	defer stop()
@@ -259,11 +345,11 @@ func (j *JavaScript) Execute(ctx context.Context, code string) (resString string
 		// catch goja exception
 		var jsErr *goja.Exception
 		if errors.As(resErr, &jsErr) {
-			j.log("error: script execution failed", "details", jsErr.String())
+			j.log(ctx, "error: script execution failed", "details", jsErr.String())
 			return "", fmt.Errorf("JavaScript error:\n%s", jsErr.String()), nil
 		}
 
-		j.log("error: runtime error!")
+		j.log(ctx, "error: runtime error!")
 		return "", resErr, nil
 	}
 
@@ -275,18 +361,152 @@ func (j *JavaScript) Execute(ctx context.Context, code string) (resString string
 	return nilValue, nil, nil
 }
 
-// Matches anything that IS NOT a letter, number, underscore, or dollar sign
-var invalidJSFuncSymbols = regexp.MustCompile(`[^a-zA-Z0-9_$]`)
+// Globals returns the top-level variables that persist between executions, i.e. 'var' declarations and assignments
+// to undeclared names. Functions, including the bound tools, are left out, and 'let'/'const' declarations are not
+// visible since they are not properties of the global object.
+func (j *JavaScript) Globals() map[string]any {
+	j.Lock()
+	defer j.Unlock()
 
-func escapeFunctionName(name string) string {
-	safeName := invalidJSFuncSymbols.ReplaceAllString(name, "_")
+	global := j.runtime.GlobalObject()
+	res := map[string]any{}
+	for _, key := range global.Keys() {
+		v := global.Get(key)
+		if _, ok := goja.AssertFunction(v); ok {
+			continue
+		}
+		res[key] = v.Export()
+	}
+	return res
+}
 
-	// JS identifiers cannot start with a number
-	if len(safeName) > 0 && safeName[0] >= '0' && safeName[0] <= '9' {
-		safeName = "_" + safeName
+// sessionOf returns the code session of the context, or the session of the runtime if none is set
+func (j *JavaScript) sessionOf(ctx context.Context) *tools.CodeSession {
+	if s := tools.CodeSessionFromContext(ctx); s != nil {
+		return s
 	}
+	return j.session
+}
+
+// SetExecutionLimit caps the number of code executions without a code session in the context, 0 means unlimited
+func (j *JavaScript) SetExecutionLimit(n int) {
+	j.session.SetExecutionLimit(n)
+}
+
+// Executions returns the number of code executions without a code session in the context since the last reset
+func (j *JavaScript) Executions() int {
+	return j.session.Executions()
+}
+
+// ResetExecutions resets the code execution counter and the recorded tool calls of executions without a code session
+// in the context
+func (j *JavaScript) ResetExecutions() {
+	j.session.ResetExecutions()
+}
+
+// ToolCalls returns the tool calls made from code without a code session in the context since the last reset, in
+// order. Deduplicated calls are included
+func (j *JavaScript) ToolCalls() []tools.Invocation {
+	return j.session.ToolCalls()
+}
 
-	return safeName
+// SetDeduplication toggles caching of identical tool calls (same tool and arguments) of executions without a code
+// session in the context. Disable for intentionally non-deterministic tools.
+func (j *JavaScript) SetDeduplication(enabled bool) {
+	j.session.SetDeduplication(enabled)
+}
+
+// Deduplications returns the number of tool calls answered from cache since the last reset
+func (j *JavaScript) Deduplications() int {
+	return j.session.Deduplications()
+}
+
+// ResetDeduplication clears the tool call cache and the deduplication counter
+func (j *JavaScript) ResetDeduplication() {
+	j.session.ResetDeduplication()
+}
+
+// maxSafeInteger is the largest integer a JS number represents exactly, i.e. Number.MAX_SAFE_INTEGER
+const maxSafeInteger = 1<<53 - 1
+
+// normalizeArgument coerces a value exported from the runtime to the types of the argument schema, i.e. whole numbers
+// become int64 for integer arguments. Non finite numbers, fractions for integer arguments and integers beyond the safe
+// integer range are rejected, since they would be corrupted or fail when unmarshalled by the tool.
+func normalizeArgument(v any, s *schema.JSON, root *schema.JSON, path string) (any, error) {
+	if s != nil && s.Ref != "" && root != nil {
+		s = root.Defs[strings.TrimPrefix(s.Ref, "#/$defs/")]
+	}
+	name := path
+	if name == "" {
+		name = "argument"
+	}
+
+	switch t := v.(type) {
+	case float64:
+		if math.IsNaN(t) || math.IsInf(t, 0) {
+			return nil, fmt.Errorf("%s must be a finite number, got %v", name, t)
+		}
+		if s == nil || s.Type != schema.Integer {
+			return t, nil
+		}
+		if t != math.Trunc(t) {
+			return nil, fmt.Errorf("%s must be an integer, got %v", name, t)
+		}
+		if math.Abs(t) > maxSafeInteger {
+			return nil, fmt.Errorf("%s is outside the safe integer range, got %v", name, t)
+		}
+		return int64(t), nil
+	case int64:
+		if t > maxSafeInteger || t < -maxSafeInteger {
+			return nil, fmt.Errorf("%s is outside the safe integer range, got %d", name, t)
+		}
+		return t, nil
+	case map[string]any:
+		res := make(map[string]any, len(t))
+		for k, val := range t {
+			var prop *schema.JSON
+			if s != nil {
+				prop = s.Properties[k]
+				if prop == nil {
+					prop = s.AdditionalProperties
+				}
+			}
+			normalized, err := normalizeArgument(val, prop, root, joinPath(path, k))
+			if err != nil {
+				return nil, err
+			}
+			res[k] = normalized
+		}
+		return res, nil
+	case []any:
+		var items *schema.JSON
+		if s != nil {
+			items = s.Items
+		}
+		res := make([]any, len(t))
+		for i, val := range t {
+			normalized, err := normalizeArgument(val, items, root, fmt.Sprintf("%s[%d]", name, i))
+			if err != nil {
+				return nil, err
+			}
+			res[i] = normalized
+		}
+		return res, nil
+	default:
+		return v, nil
+	}
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// escapeFunctionName returns the tool name as a valid JS identifier, see tools.SanitizeToolName
+func escapeFunctionName(name string) string {
+	return tools.SanitizeToolName(name)
 }
 
 // registerReturn registers the custom return function in Goja, that returns the value from the PTC tools code
@@ -317,26 +537,32 @@ func (j *JavaScript) registerReturn() (*JavaScript, error) {
 
 // Guardrail guardrails code before exec; important since LLMs trained for diff. coding objectives
 func (j *JavaScript) Guardrail(code string) (string, error) {
+	return j.guardrail(context.Background(), code)
+}
+
+func (j *JavaScript) guardrail(ctx context.Context, code string) (string, error) {
 	if code == "" {
-		j.log("guardrail empty code")
+		j.log(ctx, "guardrail blocked: empty code")
 		return code, errors.New("no javascript code provided. validate tool input arguments, required format: '{\"code\": string}'")
 	}
 
 	if strings.Contains(code, "async ") || strings.Contains(code, "await") || strings.Contains(code, "async(") {
-		j.log("guardrail async code")
+		j.log(ctx, "guardrail blocked: async code")
 		return code, errors.New("runtime error: async functions are unavailable in this runtime. must use synchronous, blocking calls (e.g., 'var x = tool()')")
 	}
 
 	if strings.Contains(code, "console.log(") || strings.Contains(code, "print(") {
-		j.log("guardrail console/print usage")
+		j.log(ctx, "guardrail blocked: console/print usage")
 		return code, errors.New("runtime error: console.log() and print() are not for returning data")
 	}
 
 	if !strings.Contains(code, fmt.Sprintf("%s(", returnFunc)) {
-		j.log("guardrail missing result()")
+		j.log(ctx, "guardrail blocked: missing result()")
 		return code, errors.New("runtime error: script must call result(value) exactly once to return data. example: result({ a, b })")
 	}
 
+	j.log(ctx, "guardrail passed")
+
 	return code, nil
 }
 
@@ -348,10 +574,11 @@ func (j *JavaScript) SystemFragment(tool ...tools.Tool) (string, error) {
 		PTCToolName:    j.toolName,
 		Signatures:     sigs,
 		ReturnFunction: returnFunc,
+		ToolErrorKey:   toolErrorKey,
 	}
 	var buf bytes.Buffer
 	if err := parsedTemplates.ExecuteTemplate(&buf, "ptc_system_prompt", data); err != nil {
-		j.log("failed to execute system prompt template", "error", err)
+		j.log(context.Background(), "failed to execute system prompt template", "error", err)
 		return "", err
 	}
 
@@ -412,6 +639,16 @@ func SchemaToNode(name string, s *schema.JSON, isRequired bool, currentIndent st
 		maxVal = fmt.Sprintf("%v", *s.Maximum)
 	}
 
+	// as JSON, i.e. a valid literal also for strings with quotes, arrays and objects
+	defaultVal := ""
+	if s.Default != nil {
+		if b, err := json.Marshal(s.Default); err == nil {
+			defaultVal = string(b)
+		} else {
+			defaultVal = fmt.Sprintf("%v", s.Default)
+		}
+	}
+
 	node := &TSNode{
 		Name:        name,
 		Required:    isRequired,
@@ -419,6 +656,7 @@ func SchemaToNode(name string, s *schema.JSON, isRequired bool, currentIndent st
 		Format:      format,
 		Min:         minVal,
 		Max:         maxVal,
+		Default:     defaultVal,
 		Indent:      currentIndent,
 	}
 
@@ -476,6 +714,9 @@ func SchemaToNode(name string, s *schema.JSON, isRequired bool, currentIndent st
 	return node
 }
 
+// SetLogger sets the logger for debug logs of each code execution, i.e. the submitted code, the guardrail
+// decision, the tool calls and the result. Nil disables logging. A logger of the execution context takes precedence,
+// see tools.ContextWithLogger
 func (j *JavaScript) SetLogger(logger *slog.Logger) *JavaScript {
 	j.Log = logger
 	return j
@@ -0,0 +1,513 @@
+package js_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/modfin/bellman/tools"
+	"github.com/modfin/bellman/tools/ptc/js"
+)
+
+func codeCall(code string) tools.Call {
+	arg, _ := json.Marshal(map[string]string{"code": code})
+	return tools.Call{Name: "code_execution", Argument: arg}
+}
+
+func TestExecutionLimit(t *testing.T) {
+	runtime, err := js.NewRuntime("code_execution")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo := tools.NewTool("echo", tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
+		return string(call.Argument), nil
+	}))
+	ptcTool, err := runtime.AdaptTools(echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runtime.SetExecutionLimit(1)
+
+	res, err := ptcTool.Function(context.Background(), codeCall(`__setResult(echo({a: 1}))`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != `{"a":1}` {
+		t.Fatalf("expected echo result, got %s", res)
+	}
+
+	res, err = ptcTool.Function(context.Background(), codeCall(`__setResult(echo({a: 2}))`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(res, "budget exhausted") {
+		t.Fatalf("expected budget exhausted response, got %s", res)
+	}
+	if runtime.Executions() != 1 {
+		t.Fatalf("expected 1 execution, got %d", runtime.Executions())
+	}
+
+	runtime.ResetExecutions()
+	res, _ = ptcTool.Function(context.Background(), codeCall(`__setResult(echo({a: 3}))`))
+	if res != `{"a":3}` {
+		t.Fatalf("expected execution after reset, got %s", res)
+	}
+}
+
+func TestDeduplication(t *testing.T) {
+	runtime, err := js.NewRuntime("code_execution")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var calls int
+	counter := tools.NewTool("counter", tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
+		calls++
+		return fmt.Sprintf(`{"n":%d}`, calls), nil
+	}))
+	ptcTool, err := runtime.AdaptTools(counter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := codeCall(`var a = counter({x: 1, y: 2}); var b = counter({y: 2, x: 1}); var c = counter({x: 2}); __setResult([a.n, b.n, c.n])`)
+
+	res, _ := ptcTool.Function(context.Background(), code)
+	if res != `[1,2,3]` {
+		t.Fatalf("expected no deduplication by default, got %s", res)
+	}
+
+	runtime.SetDeduplication(true)
+	calls = 0
+	res, _ = ptcTool.Function(context.Background(), code)
+	if res != `[1,1,2]` {
+		t.Fatalf("expected identical call to be deduplicated, got %s", res)
+	}
+	if runtime.Deduplications() != 1 {
+		t.Fatalf("expected 1 deduplication, got %d", runtime.Deduplications())
+	}
+	if calls := runtime.ToolCalls(); len(calls) != 6 || calls[3].Cached || !calls[4].Cached || calls[4].Duration != 0 || calls[4].Response != `{"n":1}` {
+		t.Fatalf("expected the deduplicated call to be marked as cached, got %+v", calls)
+	}
+
+	runtime.ResetDeduplication()
+	calls = 0
+	res, _ = ptcTool.Function(context.Background(), codeCall(`__setResult(counter({x: 2}).n)`))
+	if res != `1` {
+		t.Fatalf("expected cache to be cleared after reset, got %s", res)
+	}
+	if runtime.Deduplications() != 0 {
+		t.Fatalf("expected counter to be cleared after reset, got %d", runtime.Deduplications())
+	}
+}
+
+func TestExecuteContextCancel(t *testing.T) {
+	runtime, err := js.NewRuntime("code_execution")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sleep := tools.NewTool("sleep", tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(10 * time.Second):
+			return `{"slept":true}`, nil
+		}
+	}))
+	_, err = runtime.AdaptTools(sleep)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	res, resErr, err := runtime.Execute(ctx, `var r = sleep({}); while (true) {} __setResult(r)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("expected cancelled context to stop the sleeping tool")
+	}
+	if resErr == nil || !strings.Contains(resErr.Error(), "interrupted") {
+		t.Fatalf("expected interrupted execution, got res %s, err %v", res, resErr)
+	}
+}
+
+func TestToolErrorEnvelope(t *testing.T) {
+	runtime, err := js.NewRuntime("code_execution")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookup := tools.NewTool("lookup", tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
+		return `{"ok": false, "error": "no such user"}`, nil
+	}))
+	broken := tools.NewTool("broken", tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
+		return "", fmt.Errorf("connection refused")
+	}))
+	ptcTool, err := runtime.AdaptTools(lookup, broken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, _ := ptcTool.Function(context.Background(), codeCall(`var r = lookup({}); __setResult({failed: "__tool_error__" in r, r})`))
+	if res != `{"failed":false,"r":{"error":"no such user","ok":false}}` {
+		t.Fatalf("expected tool result with error field to be returned untouched, got %s", res)
+	}
+
+	res, _ = ptcTool.Function(context.Background(), codeCall(`var r = broken({}); __setResult({failed: "__tool_error__" in r, r})`))
+	if res != `{"failed":true,"r":{"__tool_error__":"connection refused"}}` {
+		t.Fatalf("expected failed tool call to use the error envelope, got %s", res)
+	}
+}
+
+type forecastArgs struct {
+	City  string `json:"city" json-description:"City name"`
+	Unit  string `json:"unit,omitempty" json-enum:"celsius,fahrenheit" json-default:"celsius"`
+	Days  int    `json:"days,omitempty" json-minimum:"1" json-maximum:"14" json-default:"3"`
+	Hours bool   `json:"hours,omitempty" json-default:"false"`
+}
+
+func TestSystemFragmentSchemaTags(t *testing.T) {
+	runtime, err := js.NewRuntime("code_execution")
+	if err != nil {
+		t.Fatal(err)
+	}
+	forecast := tools.NewTool("forecast", tools.WithArgSchema(forecastArgs{}))
+
+	s := forecast.ArgumentSchema
+	if s.Properties["unit"].Default != "celsius" || s.Properties["days"].Default != int64(3) || s.Properties["hours"].Default != false {
+		t.Fatalf("unexpected defaults: %v, %v, %v", s.Properties["unit"].Default, s.Properties["days"].Default, s.Properties["hours"].Default)
+	}
+
+	fragment, err := runtime.SystemFragment(forecast)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		`city: string; // City name`,
+		`unit?: "celsius" | "fahrenheit"; // Default: "celsius"`,
+		`days?: number; // Min: 1, Max: 14, Default: 3`,
+	} {
+		if !strings.Contains(fragment, expected) {
+			t.Fatalf("expected fragment to contain %q, got:\n%s", expected, fragment)
+		}
+	}
+
+	s.Properties["unit"].Default = `say "hi"`
+	s.Properties["days"].Default = []any{1, 2}
+	fragment, err = runtime.SystemFragment(forecast)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{`Default: "say \"hi\""`, `Default: [1,2]`} {
+		if !strings.Contains(fragment, expected) {
+			t.Fatalf("expected fragment to contain %q, got:\n%s", expected, fragment)
+		}
+	}
+}
+
+func TestExecutionLogging(t *testing.T) {
+	runtime, err := js.NewRuntime("code_execution")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo := tools.NewTool("echo", tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
+		return string(call.Argument), nil
+	}))
+	ptcTool, err := runtime.AdaptTools(echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// no logger, must not panic
+	if _, err := ptcTool.Function(context.Background(), codeCall(`__setResult(echo({a: 1}))`)); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	runtime.SetLogger(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	if _, err := ptcTool.Function(context.Background(), codeCall(`__setResult(echo({a: 2}))`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ptcTool.Function(context.Background(), codeCall(`console.log(1)`)); err != nil {
+		t.Fatal(err)
+	}
+
+	logs := buf.String()
+	for _, expected := range []string{"code received", "guardrail passed", "tool call", `args="{\"a\":2}"`, "code execution result", "guardrail blocked"} {
+		if !strings.Contains(logs, expected) {
+			t.Fatalf("expected %q in logs, got\n%s", expected, logs)
+		}
+	}
+
+	// a logger of the execution context takes precedence, the runtime logger is left untouched
+	var scoped bytes.Buffer
+	ctx := tools.ContextWithLogger(context.Background(), slog.New(slog.NewTextHandler(&scoped, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	before := buf.Len()
+	if _, err := ptcTool.Function(ctx, codeCall(`__setResult(echo({a: 3}))`)); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(scoped.String(), `args="{\"a\":3}"`) || !strings.Contains(scoped.String(), "guardrail passed") {
+		t.Fatalf("expected the execution in the context logger, got\n%s", scoped.String())
+	}
+	if buf.Len() != before {
+		t.Fatalf("expected no logs on the runtime logger, got\n%s", buf.String()[before:])
+	}
+	if runtime.SetLogger(nil) != runtime {
+		t.Fatal("expected SetLogger to return the runtime")
+	}
+}
+
+func TestDashedToolName(t *testing.T) {
+	runtime, err := js.NewRuntime("code_execution")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var called string
+	factorial := tools.NewTool("math-factorial", tools.WithArgSchema(struct {
+		N int `json:"n"`
+	}{}), tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
+		called = call.Name
+		return `120`, nil
+	}))
+	ptcTool, err := runtime.AdaptTools(factorial)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fragment, err := runtime.SystemFragment(factorial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(fragment, "math_factorial") || strings.Contains(fragment, "math-factorial") {
+		t.Fatalf("expected the documented function name to be a valid identifier, got:\n%s", fragment)
+	}
+
+	res, err := ptcTool.Function(context.Background(), codeCall(`__setResult(math_factorial({n: 5}))`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != `120` || called != "math-factorial" {
+		t.Fatalf("expected dashed tool to be callable, got %s, called %q", res, called)
+	}
+}
+
+func TestToolNameCollision(t *testing.T) {
+	runtime, err := js.NewRuntime("code_execution")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tool := func(name string) tools.Tool {
+		return tools.NewTool(name, tools.WithArgSchema(struct{}{}), tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
+			return `{"ok":true}`, nil
+		}))
+	}
+
+	_, err = runtime.AdaptTools(tool("a-b"), tool("a.b"))
+	if err == nil || !strings.Contains(err.Error(), "a-b") || !strings.Contains(err.Error(), "a.b") {
+		t.Fatalf("expected an error naming both tools, got %v", err)
+	}
+
+	// the same tool given twice is bound once
+	if _, err := runtime.AdaptTools(tool("a-b"), tool("a-b")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type countArgs struct {
+	Count  int        `json:"count"`
+	Ratio  float64    `json:"ratio"`
+	Counts []int      `json:"counts"`
+	Nested countArgs2 `json:"nested"`
+}
+
+type countArgs2 struct {
+	Count int `json:"count"`
+}
+
+func TestArgumentNormalization(t *testing.T) {
+	runtime, err := js.NewRuntime("code_execution")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo := tools.NewTool("echo", tools.WithArgSchema(countArgs{}), tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
+		var args countArgs
+		if err := json.Unmarshal(call.Argument, &args); err != nil {
+			return "", err
+		}
+		return string(call.Argument), nil
+	}))
+	ptcTool, err := runtime.AdaptTools(echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := ptcTool.Function(context.Background(), codeCall(`__setResult(echo({count: 6 / 2, ratio: 0.5, counts: [1, 2.0], nested: {count: 4}}))`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != `{"count":3,"counts":[1,2],"nested":{"count":4},"ratio":0.5}` {
+		t.Fatalf("expected normalized arguments, got %s", res)
+	}
+
+	for code, expected := range map[string]string{
+		`__setResult(echo({count: 3.5}))`:               "count must be an integer",
+		`__setResult(echo({count: NaN}))`:               "count must be a finite number",
+		`__setResult(echo({ratio: Infinity}))`:          "ratio must be a finite number",
+		`__setResult(echo({counts: [1, 2.5]}))`:         "counts[1] must be an integer",
+		`__setResult(echo({nested: {count: 2 ** 60}}))`: "nested.count is outside the safe integer range",
+	} {
+		res, err := ptcTool.Function(context.Background(), codeCall(code))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(res, expected) {
+			t.Fatalf("expected %q for %s, got %s", expected, code, res)
+		}
+	}
+}
+
+func TestMaxResponseBytes(t *testing.T) {
+	runtime, err := js.NewRuntime("code_execution")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logs bytes.Buffer
+	runtime.SetLogger(slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	big := tools.NewTool("big", tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
+		return `{"items":[1,2,3,4,5]}`, nil
+	}))
+	ptcTool, err := runtime.AdaptTools(big)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the limit is scoped to the execution, other executions on the runtime are unlimited
+	res, err := ptcTool.Function(context.Background(), codeCall(`__setResult(big({}))`))
+	if err != nil || res != `{"items":[1,2,3,4,5]}` {
+		t.Fatalf("expected the full response without a limit, got %s, %v", res, err)
+	}
+	res, err = ptcTool.Function(tools.ContextWithMaxResponseBytes(context.Background(), 8), codeCall(`__setResult(big({}))`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != `"{\"items\"...[truncated 13 of 21 bytes]"` {
+		t.Fatalf("expected truncated response, got %s", res)
+	}
+	if !strings.Contains(logs.String(), `[1,2,3,4,5]`) {
+		t.Fatalf("expected full response in the logs, got %s", logs.String())
+	}
+	if calls := runtime.ToolCalls(); len(calls) != 2 || calls[1].Response != `{"items"...[truncated 13 of 21 bytes]` {
+		t.Fatalf("expected the truncated response to be recorded, got %+v", calls)
+	}
+}
+
+func TestAdaptToolsActive(t *testing.T) {
+	runtime, err := js.NewRuntime("code_execution")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tool := func(name string) tools.Tool {
+		return tools.NewTool(name, tools.WithArgSchema(struct{}{}), tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
+			return `{"ok":true}`, nil
+		}))
+	}
+
+	all, err := runtime.AdaptTools(tool("draft"), tool("send_email"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := all.Function(context.Background(), codeCall(`counter = 1; __setResult(send_email({}))`))
+	if err != nil || res != `{"ok":true}` {
+		t.Fatalf("expected send_email to be callable, got %s, %v", res, err)
+	}
+
+	drafts, err := runtime.AdaptTools(tool("draft"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = drafts.Function(context.Background(), codeCall(`__setResult([draft({}), send_email({}), counter])`))
+	if err != nil || res != `[{"ok":true},{"__tool_error__":"tool send_email is not available"},1]` {
+		t.Fatalf("expected send_email to be unavailable and other globals kept, got %s, %v", res, err)
+	}
+
+	// the tools of the first call are untouched on the shared runtime
+	res, err = all.Function(context.Background(), codeCall(`__setResult(send_email({}))`))
+	if err != nil || res != `{"ok":true}` {
+		t.Fatalf("expected send_email to stay callable by the first tool, got %s, %v", res, err)
+	}
+}
+
+func TestResultTransform(t *testing.T) {
+	runtime, err := js.NewRuntime("code_execution")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := tools.NewTool("secret", tools.WithArgSchema(struct {
+		User string `json:"user"`
+	}{}), tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
+		return `{"password":"hunter2"}`, nil
+	}))
+	ptcTool, err := runtime.AdaptTools(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := tools.ContextWithResultTransform(context.Background(), func(name string, argument string, response string) string {
+		return strings.ReplaceAll(response, "hunter2", "***") + `|` + name + argument
+	})
+	res, err := ptcTool.Function(ctx, codeCall(`__setResult(secret({user: "bob"}))`))
+	if err != nil || res != `"{\"password\":\"***\"}|secret{\"user\":\"bob\"}"` {
+		t.Fatalf("expected the transformed response, got %s, %v", res, err)
+	}
+
+	// the transform is scoped to the execution, other executions on the runtime are untouched
+	res, err = ptcTool.Function(context.Background(), codeCall(`__setResult(secret({user: "bob"}).password)`))
+	if err != nil || res != `"hunter2"` {
+		t.Fatalf("expected the response as is without a transform, got %s, %v", res, err)
+	}
+}
+
+func TestSeed(t *testing.T) {
+	roll := tools.NewTool("roll", tools.WithFunction(func(ctx context.Context, call tools.Call) (string, error) {
+		return fmt.Sprintf(`{"n":%d}`, tools.RandFromContext(ctx).Int63()), nil
+	}))
+	code := codeCall(`__setResult([Math.random(), Math.random(), roll({}).n, roll({}).n])`)
+	run := func(seed *int64) string {
+		runtime, err := js.NewRuntime("code_execution")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ptcTool, err := runtime.AdaptTools(roll)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := context.Background()
+		if seed != nil {
+			ctx = tools.ContextWithRand(ctx, tools.NewRand(*seed))
+		}
+		res, err := ptcTool.Function(ctx, code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	seed := int64(42)
+	first, second := run(&seed), run(&seed)
+	if first != second {
+		t.Fatalf("expected seeded runs to be identical, got %s and %s", first, second)
+	}
+	if unseeded := run(nil); unseeded == first {
+		t.Fatalf("expected unseeded run to differ, got %s", unseeded)
+	}
+	other := int64(7)
+	if res := run(&other); res == first {
+		t.Fatalf("expected another seed to differ, got %s", res)
+	}
+}
@@ -2,6 +2,7 @@ package ptc
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 
 	"github.com/modfin/bellman/tools"
@@ -9,12 +10,33 @@ import (
 )
 
 type Runtime interface {
+	// AdaptTools binds the tools in the runtime, in addition to the tools of previous calls, and returns the code
+	// execution tool, which only allows calls of the given tools
 	AdaptTools(tools ...tools.Tool) (tools.Tool, error)
 	Guardrail(code string) (string, error)
 	SystemFragment(tool ...tools.Tool) (string, error)
 	Lock()
 	Unlock()
 	Execute(ctx context.Context, code string) (string, error, error)
+
+	// The execution budget, counters and cache below are of executions without a code session in the context, runs
+	// sharing the runtime keep their own, see tools.CodeSession and gen.Generator.ToolContext
+
+	// SetExecutionLimit caps the number of code executions, 0 means unlimited
+	SetExecutionLimit(n int)
+	// Executions returns the number of code executions since the last reset
+	Executions() int
+	// ResetExecutions resets the code execution counter and the recorded tool calls
+	ResetExecutions()
+	// ToolCalls returns the tool calls made from code since the last reset, in order
+	ToolCalls() []tools.Invocation
+
+	// SetDeduplication toggles caching of identical tool calls within a session
+	SetDeduplication(enabled bool)
+	// Deduplications returns the number of tool calls answered from cache since the last reset
+	Deduplications() int
+	// ResetDeduplication clears the tool call cache and the deduplication counter
+	ResetDeduplication()
 }
 
 type ProgramLanguage string
@@ -51,3 +73,29 @@ func SplitTools(inputTools []tools.Tool) ([]tools.Tool, []tools.Tool) {
 	}
 	return regularTools, ptcTools
 }
+
+// ParseCode returns the code of a code execution call argument, i.e. {"code": "..."}
+func ParseCode(argument []byte) (string, error) {
+	var arg struct {
+		Code string `json:"code"`
+	}
+	if err := json.Unmarshal(argument, &arg); err != nil {
+		return "", fmt.Errorf("could not unmarshal code execution argument; %w", err)
+	}
+	return arg.Code, nil
+}
+
+// ExtractCallCodeExecutions returns the code of all code execution calls, in order, e.g. of gen.Response.Tools. Calls
+// with an argument that cannot be parsed are skipped
+func ExtractCallCodeExecutions(calls []tools.Call) []string {
+	var codes []string
+	for _, c := range calls {
+		if c.Name != ToolName {
+			continue
+		}
+		if code, err := ParseCode(c.Argument); err == nil {
+			codes = append(codes, code)
+		}
+	}
+	return codes
+}
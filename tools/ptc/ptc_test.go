@@ -0,0 +1,23 @@
+package ptc_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/modfin/bellman/tools"
+	"github.com/modfin/bellman/tools/ptc"
+)
+
+func TestExtractCallCodeExecutions(t *testing.T) {
+	calls := []tools.Call{
+		{ID: "1", Name: ptc.ToolName, Argument: []byte(`{"code":"const a = price('ABC');"}`)},
+		{ID: "2", Name: "price", Argument: []byte(`{"code":"not code execution"}`)},
+		{ID: "3", Name: ptc.ToolName, Argument: []byte(`not json`)},
+		{ID: "4", Name: ptc.ToolName, Argument: []byte(`{"code":"a + price('DEF')"}`)},
+	}
+	expected := []string{"const a = price('ABC');", "a + price('DEF')"}
+
+	if codes := ptc.ExtractCallCodeExecutions(calls); !reflect.DeepEqual(codes, expected) {
+		t.Fatalf("expected %q, got %q", expected, codes)
+	}
+}
@@ -4,9 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"math/rand"
 	"strings"
-	"time"
 
 	"github.com/modfin/bellman/tools"
 )
@@ -324,8 +322,7 @@ func GetMockBellmanTools(enablePTC bool) []tools.Tool {
 				"It is certain.", "Reply hazy, try again.", "Don't count on it.",
 				"The stars say yes.", "My sources say no.",
 			}
-			rand.Seed(time.Now().UnixNano())
-			ans := answers[rand.Intn(len(answers))]
+			ans := answers[tools.RandFromContext(ctx).Intn(len(answers))]
 			return ans, nil
 		}),
 	)
@@ -16,6 +16,7 @@ import (
 	"github.com/modfin/bellman/agent"
 	"github.com/modfin/bellman/models/embed"
 	"github.com/modfin/bellman/models/gen"
+	"github.com/modfin/bellman/models/pricing"
 	"github.com/modfin/bellman/prompt"
 	"github.com/modfin/bellman/services/anthropic"
 	"github.com/modfin/bellman/services/openai"
@@ -79,8 +80,6 @@ func TestToolmanPTC(t *testing.T) {
 
 		var res *agent.Result[Result]
 		switch llm.Request.Model.Provider {
-		case vertexai.Provider:
-			res, err = agent.RunWithToolsOnly[Result](10, 0, llm, prompt.AsUser(userPrompt))
 		case anthropic.Provider:
 			// haiku does not support temperature=0
 			llm.Temperature(1)
@@ -352,12 +351,7 @@ func TestOpenTelemetry(t *testing.T) {
 	start := time.Now()
 
 	var res *agent.Result[Result]
-	switch llm.Request.Model.Provider {
-	case vertexai.Provider:
-		res, err = agent.RunWithToolsOnly[Result](10, 0, llm, prompt.AsUser(userPrompt))
-	default:
-		res, err = agent.Run[Result](10, 0, llm, prompt.AsUser(userPrompt))
-	}
+	res, err = agent.Run[Result](10, 0, llm, prompt.AsUser(userPrompt))
 
 	// start tracing in res loop
 	if err != nil {
@@ -525,8 +519,6 @@ func TestToolman(t *testing.T) {
 
 		var res *agent.Result[Result]
 		switch llm.Request.Model.Provider {
-		case vertexai.Provider:
-			res, err = agent.RunWithToolsOnly[Result](10, 0, llm, prompt.AsUser(userPrompt))
 		case anthropic.Provider:
 			// haiku does not support temperature=0
 			llm.Temperature(1)
@@ -659,12 +651,7 @@ You solve complex logic by writing JavaScript code for the code_execution tool.`
 	userPrompt := "Predict the future, convert 69 usd to sek, and then generate a secret password."
 
 	var res *agent.Result[Result]
-	switch llm.Request.Model.Provider {
-	case vertexai.Provider:
-		res, err = agent.RunWithToolsOnly[Result](10, 0, llm, prompt.AsUser(userPrompt))
-	default:
-		res, err = agent.Run[Result](10, 0, llm, prompt.AsUser(userPrompt))
-	}
+	res, err = agent.Run[Result](10, 0, llm, prompt.AsUser(userPrompt))
 
 	if err != nil {
 		log.Fatalf("Prompt() error = %v", err)
@@ -687,10 +674,10 @@ func prettyPrint(res *agent.Result[Result]) {
 	fmt.Printf("==== Result after %d calls ====\n", res.Depth)
 	fmt.Printf("%+v\n", res.Result.Text)
 	fmt.Printf("==== Used %d tokens ====\n", res.Metadata.TotalTokens)
-	costLow := (float64(res.Metadata.InputTokens)*0.15 + float64(res.Metadata.OutputTokens)*0.60) / 1_000_000.0
-	costHigh := (float64(res.Metadata.InputTokens)*0.30 + float64(res.Metadata.OutputTokens)*2.50) / 1_000_000.0
 	fmt.Printf("Input/output tokens: %d / %d\n", res.Metadata.InputTokens, res.Metadata.OutputTokens)
-	fmt.Printf("approx. $%.4f - $%.4f\n", costLow, costHigh)
+	if res.Metadata.EstimateCost(pricing.Default) {
+		fmt.Printf("approx. $%.4f\n", res.Metadata.CostUSD)
+	}
 	fmt.Printf("Thinking tokens: %d\n", res.Metadata.ThinkingTokens)
 	fmt.Printf("==== Conversation ====\n")
 
@@ -823,12 +810,7 @@ You solve complex logic by writing JavaScript code for the code_execution tool.
 		Text string `json:"text" json-description:"The final natural text answer to the user's request."`
 	}
 	var res *agent.Result[Result]
-	switch llm.Request.Model.Provider {
-	case vertexai.Provider:
-		res, err = agent.RunWithToolsOnly[Result](10, 0, llm, prompt.AsUser(userPrompt))
-	default:
-		res, err = agent.Run[Result](10, 0, llm, prompt.AsUser(userPrompt))
-	}
+	res, err = agent.Run[Result](10, 0, llm, prompt.AsUser(userPrompt))
 
 	if err != nil {
 		log.Fatalf("Prompt() error = %v", err)
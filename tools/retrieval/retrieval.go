@@ -0,0 +1,153 @@
+package retrieval
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/modfin/bellman/models/embed"
+	"github.com/modfin/bellman/tools"
+)
+
+// Selector selects the tools most relevant to a query, by cosine similarity of the embedded query and the embedded
+// tool name and description. Tool embeddings are cached, so each tool is only embedded once.
+type Selector struct {
+	embeder embed.Embeder
+	model   embed.Model
+
+	mu    sync.Mutex
+	cache map[string][]float64 // tool embeddings by name and description
+}
+
+func NewSelector(embeder embed.Embeder, model embed.Model) *Selector {
+	return &Selector{
+		embeder: embeder,
+		model:   model,
+		cache:   map[string][]float64{},
+	}
+}
+
+// ScoredTool is a selected tool and its similarity to the query
+type ScoredTool struct {
+	Name  string  `json:"name"`
+	Score float64 `json:"score"`
+}
+
+// Selection is the result of a tool selection, meant to be recorded with benchmark outputs so that retrieval misses
+// can be told apart from model failures
+type Selection struct {
+	Tools    []tools.Tool `json:"-"`
+	Selected []ScoredTool `json:"selected"`
+	Fallback bool         `json:"fallback,omitempty"` // all tools are used, since embedding failed
+	Error    string       `json:"error,omitempty"`
+}
+
+// Select returns the k tools most similar to the query, in order of similarity. All tools are returned if there are
+// no more than k, and, marked as a fallback, if embedding fails.
+func (s *Selector) Select(ctx context.Context, query string, toolList []tools.Tool, k int) Selection {
+	if k <= 0 || len(toolList) <= k {
+		return Selection{Tools: toolList, Selected: unscored(toolList)}
+	}
+
+	toolVectors, err := s.toolEmbeddings(ctx, toolList)
+	if err != nil {
+		return fallback(toolList, err)
+	}
+	res, err := s.embeder.Embed(embed.NewSingleRequest(ctx, s.model.WithType(embed.TypeQuery), query))
+	if err != nil {
+		return fallback(toolList, fmt.Errorf("could not embed query; %w", err))
+	}
+	queryVector, err := res.Single()
+	if err != nil {
+		return fallback(toolList, fmt.Errorf("could not embed query; %w", err))
+	}
+
+	scored := make([]ScoredTool, len(toolList))
+	for i, t := range toolList {
+		scored[i] = ScoredTool{Name: t.Name, Score: cosine(queryVector, toolVectors[i])}
+	}
+	order := make([]int, len(toolList))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return scored[order[a]].Score > scored[order[b]].Score
+	})
+
+	selection := Selection{}
+	for _, i := range order[:k] {
+		selection.Tools = append(selection.Tools, toolList[i])
+		selection.Selected = append(selection.Selected, scored[i])
+	}
+	return selection
+}
+
+// toolEmbeddings returns the embeddings of the tools, embedding the ones not cached in a single request
+func (s *Selector) toolEmbeddings(ctx context.Context, toolList []tools.Tool) ([][]float64, error) {
+	s.mu.Lock()
+	vectors := make([][]float64, len(toolList))
+	var missing []int
+	var texts []string
+	for i, t := range toolList {
+		if v, ok := s.cache[toolText(t)]; ok {
+			vectors[i] = v
+			continue
+		}
+		missing = append(missing, i)
+		texts = append(texts, toolText(t))
+	}
+	s.mu.Unlock()
+	if len(missing) == 0 {
+		return vectors, nil
+	}
+
+	res, err := s.embeder.Embed(embed.NewManyRequest(ctx, s.model.WithType(embed.TypeDocument), texts))
+	if err != nil {
+		return nil, fmt.Errorf("could not embed tools; %w", err)
+	}
+	if len(res.Embeddings) != len(texts) {
+		return nil, fmt.Errorf("could not embed tools; expected %d embeddings, got %d", len(texts), len(res.Embeddings))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for j, i := range missing {
+		vectors[i] = res.Embeddings[j]
+		s.cache[texts[j]] = res.Embeddings[j]
+	}
+	return vectors, nil
+}
+
+func toolText(t tools.Tool) string {
+	if t.Description == "" {
+		return t.Name
+	}
+	return t.Name + ": " + t.Description
+}
+
+func fallback(toolList []tools.Tool, err error) Selection {
+	return Selection{Tools: toolList, Selected: unscored(toolList), Fallback: true, Error: err.Error()}
+}
+
+func unscored(toolList []tools.Tool) []ScoredTool {
+	res := make([]ScoredTool, len(toolList))
+	for i, t := range toolList {
+		res[i] = ScoredTool{Name: t.Name}
+	}
+	return res
+}
+
+func cosine(a, b []float64) float64 {
+	var dot, na, nb float64
+	for i := 0; i < len(a) && i < len(b); i++ {
+		dot += a[i] * b[i]
+		na += a[i] * a[i]
+		nb += b[i] * b[i]
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(na) * math.Sqrt(nb))
+}
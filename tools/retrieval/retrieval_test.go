@@ -0,0 +1,74 @@
+package retrieval_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/modfin/bellman/models/embed"
+	"github.com/modfin/bellman/tools"
+	"github.com/modfin/bellman/tools/retrieval"
+)
+
+// keywordEmbeder embeds texts as keyword counts of weather, stock and news
+type keywordEmbeder struct {
+	texts []string
+	fail  bool
+}
+
+func (e *keywordEmbeder) Provider() string { return "test" }
+
+func (e *keywordEmbeder) Embed(req *embed.Request) (*embed.Response, error) {
+	if e.fail {
+		return nil, errors.New("embedding unavailable")
+	}
+	res := &embed.Response{}
+	for _, text := range req.Texts {
+		e.texts = append(e.texts, text)
+		var v []float64
+		for _, keyword := range []string{"weather", "stock", "news"} {
+			v = append(v, float64(strings.Count(strings.ToLower(text), keyword)))
+		}
+		res.Embeddings = append(res.Embeddings, v)
+	}
+	return res, nil
+}
+
+func (e *keywordEmbeder) EmbedDocument(req *embed.DocumentRequest) (*embed.DocumentResponse, error) {
+	return nil, errors.New("not implemented")
+}
+
+func TestSelect(t *testing.T) {
+	toolList := []tools.Tool{
+		tools.NewTool("get_news", tools.WithDescription("Latest news headlines")),
+		tools.NewTool("get_weather", tools.WithDescription("Current weather for a city")),
+		tools.NewTool("get_stock", tools.WithDescription("Stock price for a ticker")),
+	}
+	embeder := &keywordEmbeder{}
+	selector := retrieval.NewSelector(embeder, embed.Model{Provider: "test", Name: "test"})
+
+	selection := selector.Select(context.Background(), "what is the weather and the stock price?", toolList, 2)
+	if selection.Fallback || len(selection.Tools) != 2 || len(selection.Selected) != 2 {
+		t.Fatalf("unexpected selection %+v", selection)
+	}
+	names := []string{selection.Tools[0].Name, selection.Tools[1].Name}
+	if !(names[0] == "get_weather" && names[1] == "get_stock" || names[0] == "get_stock" && names[1] == "get_weather") {
+		t.Fatalf("expected weather and stock tools, got %v", names)
+	}
+	if selection.Selected[0].Score < selection.Selected[1].Score {
+		t.Fatalf("expected tools in order of similarity, got %+v", selection.Selected)
+	}
+
+	embedded := len(embeder.texts)
+	selector.Select(context.Background(), "news please", toolList, 1)
+	if len(embeder.texts) != embedded+1 {
+		t.Fatalf("expected only the query to be embedded with cached tools, got %v", embeder.texts[embedded:])
+	}
+
+	embeder.fail = true
+	selection = retrieval.NewSelector(embeder, embed.Model{}).Select(context.Background(), "weather", toolList, 1)
+	if !selection.Fallback || len(selection.Tools) != 3 || !strings.Contains(selection.Error, "embedding unavailable") {
+		t.Fatalf("expected fallback to all tools, got %+v", selection)
+	}
+}
@@ -2,6 +2,9 @@ package tools
 
 import (
 	"context"
+	"fmt"
+	"time"
+	"unicode/utf8"
 
 	"github.com/modfin/bellman/schema"
 )
@@ -10,6 +13,7 @@ type EmptyArgs struct{}
 
 // ToolChoice represents a tool selection configuration for the model.
 // It is distinct from Tool — it only carries a name used to control tool behavior.
+// Besides the ControlTools, the name of a tool in the tool set forces the model to call that tool.
 type ToolChoice struct {
 	Name string `json:"name"`
 }
@@ -73,6 +77,15 @@ func WithPTC(usePTC bool) ToolOption {
 	}
 }
 
+// WithMaxResponseBytes truncates responses of the tool longer than n bytes before they are added to the conversation
+// or returned into the PTC runtime, see TruncateResponse. 0 falls back to the default of the generator
+func WithMaxResponseBytes(n int) ToolOption {
+	return func(tool Tool) Tool {
+		tool.MaxResponseBytes = max(n, 0)
+		return tool
+	}
+}
+
 func NewTool(name string, options ...ToolOption) Tool {
 	t := Tool{
 		Name: name,
@@ -90,6 +103,8 @@ type Tool struct {
 	Function       func(ctx context.Context, call Call) (string, error) `json:"-"`
 	ResponseSchema *schema.JSON                                         `json:"response_schema,omitempty"`
 	UsePTC         bool                                                 `json:"use_ptc"` // false is default
+
+	MaxResponseBytes int `json:"-"` // responses are truncated beyond this size, 0 means the generator default
 }
 
 type Call struct {
@@ -99,3 +114,69 @@ type Call struct {
 
 	Ref *Tool `json:"-"`
 }
+
+// ToOpenAISpec exports the tool as an OpenAI function tool definition, see schema.ToOpenAI for the parameters
+func ToOpenAISpec(t Tool) map[string]any {
+	return map[string]any{
+		"type": "function",
+		"function": map[string]any{
+			"name":        t.Name,
+			"description": t.Description,
+			"parameters":  schema.ToOpenAI(t.ArgumentSchema),
+		},
+	}
+}
+
+// ToJSONSchema exports the tool arguments as a standalone JSON Schema (draft-07) document, titled by the tool name and
+// described by the tool description unless the argument schema has a description of its own
+func ToJSONSchema(t Tool) map[string]any {
+	m := schema.ToJSONSchema(t.ArgumentSchema)
+	m["title"] = t.Name
+	if _, ok := m["description"]; !ok && t.Description != "" {
+		m["description"] = t.Description
+	}
+	return m
+}
+
+// TruncateResponse cuts a response longer than maxBytes to maxBytes, at a UTF-8 boundary, and appends a notice of how
+// much was truncated, e.g. "...[truncated 183402 of 201402 bytes]". maxBytes <= 0 means no limit
+func TruncateResponse(response string, maxBytes int) string {
+	if maxBytes <= 0 || len(response) <= maxBytes {
+		return response
+	}
+	cut := maxBytes
+	for cut > 0 && !utf8.RuneStart(response[cut]) {
+		cut--
+	}
+	return fmt.Sprintf("%s...[truncated %d of %d bytes]", response[:cut], len(response)-cut, len(response))
+}
+
+// Invocation records an executed tool call, e.g. of a tool called from code, see ptc.Runtime.ToolCalls
+type Invocation struct {
+	Name     string        `json:"name"`
+	Argument string        `json:"argument"`
+	Response string        `json:"response"` // the response as passed on, i.e. after any transform and truncation
+	Duration time.Duration `json:"duration"` // 0 if cached
+	Error    string        `json:"error,omitempty"`
+	Cached   bool          `json:"cached,omitempty"` // answered from the deduplication cache, the tool was not called
+}
+
+// ResultTransform post-processes the response of a tool before the model sees it, e.g. to cap or redact it. The
+// argument is the JSON argument of the call
+type ResultTransform func(name string, argument string, response string) string
+
+// Transform returns the response transformed by fn, or as is if fn is nil
+func (fn ResultTransform) Transform(name string, argument string, response string) string {
+	if fn == nil {
+		return response
+	}
+	return fn(name, argument, response)
+}
+
+// ResponseLimit returns the response size limit of the tool, or defaultLimit if the tool has none
+func ResponseLimit(t *Tool, defaultLimit int) int {
+	if t != nil && t.MaxResponseBytes > 0 {
+		return t.MaxResponseBytes
+	}
+	return defaultLimit
+}
@@ -0,0 +1,117 @@
+package bellman
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/modfin/bellman/models/gen"
+)
+
+// ErrUnknownModel is matched, using errors.Is, by an UnknownModelError
+var ErrUnknownModel = errors.New("unknown model")
+
+// UnknownModelError is returned by ValidateModel when the proxy does not serve the model
+type UnknownModelError struct {
+	FQN         string
+	Suggestions []string // closest served models, by edit distance
+}
+
+func (e *UnknownModelError) Error() string {
+	if len(e.Suggestions) == 0 {
+		return fmt.Sprintf("unknown model %s", e.FQN)
+	}
+	return fmt.Sprintf("unknown model %s, did you mean %s", e.FQN, strings.Join(e.Suggestions, ", "))
+}
+
+func (e *UnknownModelError) Is(target error) bool {
+	return target == ErrUnknownModel
+}
+
+// genModelsCache holds the models served by each proxy url, listed once per process
+var genModelsCache = struct {
+	sync.Mutex
+	models map[string][]gen.Model
+}{models: map[string][]gen.Model{}}
+
+// CachedGenModels returns the models served by the proxy, calling GenModels only on the first call for its url
+func (v *Bellman) CachedGenModels() ([]gen.Model, error) {
+	genModelsCache.Lock()
+	defer genModelsCache.Unlock()
+	if models, ok := genModelsCache.models[v.url]; ok {
+		return models, nil
+	}
+	models, err := v.GenModels()
+	if err != nil {
+		return nil, err
+	}
+	genModelsCache.models[v.url] = models
+	return models, nil
+}
+
+// ValidateModel checks that the proxy serves the model, e.g. before starting a benchmark run, and returns it with the
+// metadata listed by the proxy. If it is not served, an UnknownModelError is returned along with up to 3 of the
+// closest served models. The fqn is parsed leniently, see gen.Lenient, and the model list is cached, see
+// CachedGenModels
+func ValidateModel(client *Bellman, fqn string) (gen.Model, []string, error) {
+	model, err := gen.ParseFQN(fqn, gen.Lenient()...)
+	if err != nil {
+		return gen.Model{}, nil, fmt.Errorf("could not parse model; %w", err)
+	}
+	fqn = model.FQN()
+	models, err := client.CachedGenModels()
+	if err != nil {
+		return gen.Model{}, nil, fmt.Errorf("could not list models; %w", err)
+	}
+	for _, m := range models {
+		if m.FQN() == fqn {
+			return m, nil, nil
+		}
+	}
+
+	suggestions := closestModels(fqn, models, 3)
+	return gen.Model{}, suggestions, &UnknownModelError{FQN: fqn, Suggestions: suggestions}
+}
+
+func closestModels(fqn string, models []gen.Model, n int) []string {
+	type candidate struct {
+		fqn      string
+		distance int
+	}
+	candidates := make([]candidate, len(models))
+	for i, m := range models {
+		candidates[i] = candidate{fqn: m.FQN(), distance: levenshtein(strings.ToLower(fqn), strings.ToLower(m.FQN()))}
+	}
+	sort.SliceStable(candidates, func(a, b int) bool {
+		return candidates[a].distance < candidates[b].distance
+	})
+
+	var res []string
+	for _, c := range candidates[:min(n, len(candidates))] {
+		res = append(res, c.fqn)
+	}
+	return res
+}
+
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = min(min(prev[j]+1, curr[j-1]+1), prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}